@@ -5,7 +5,9 @@ server. This file makes use of the url_shortener package.
 
 This file consists of only a single function: main( ) which is the entry
 point for the program and performs the above operations. Clients can
-now connect to the server and shorten/expand URLs.
+now connect to the server and shorten/expand URLs. If arguments are
+given, main( ) instead runs one of the command line tools (see
+commands.go in the url_shortener package).
 
 Note: You are meant to put a file that is meant to be built into an
 executable (or a client program/entry point/etc.) into the main package.
@@ -23,15 +25,44 @@ via a go mod init url_shortener command).
 Finally, observe in the directory structure in src/: the files within
 the url_shortener package are placed into a url_shortener folder.
 */
-import "url_shortener/url_shortener"
+import (
+	"flag"
+	"log"
+	"url_shortener/url_shortener"
+)
 
 func main() {
+	/*
+		The flag package parses options like -config path/to/file.json
+		that come before any other arguments. flag.String( ) returns a
+		pointer which is filled in once flag.Parse( ) runs.
+	*/
+	config_path := flag.String("config", url_shortener.CONFIG_FILE, "path to the JSON configuration file")
+	flag.Parse()
+	config, err := url_shortener.LoadConfig(*config_path)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	/*
+		Any remaining arguments mean we are running one of the command
+		line tools (e.g. go run . migrate status) rather than booting
+		the server.
+	*/
+	if flag.NArg() > 0 {
+		err = url_shortener.RunCommand(config, flag.Args())
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	/*
 		Note about this call: here we are invoking the NewServer() function
 		on the package. It is important to note that you cannot have two
 		identically named functions within the files of a package.
 	*/
-	server := url_shortener.NewServer()
+	server := url_shortener.NewServer(config)
 	if server != nil {
 		server.Run()
 	}
@@ -0,0 +1,595 @@
+/*
+Package url_shortener serves as a library of utilities for the URL-Shortener
+application. This includes the definition of our API, database configuration,
+and HTTP server implementation. This is used by the main package to instantiate
+and run a server easily. This library could be used in other applications
+that do more than just initializing and booting a server.
+
+This file provides the admin dashboard: HTML pages for creating, searching,
+editing, disabling and deleting links, and charting a link's expansions.
+The pages are rendered on the server with html/template, and the templates
+and static assets (stylesheet, script) are embedded into the executable
+like the migrations are. The dashboard goes through the same functions as
+the JSON API (e.g. CreateLink( ), GetLinksPage( )) so links behave the same
+no matter where they were managed from.
+*/
+
+package url_shortener
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"mime"
+	"net/http"
+	neturl "net/url"
+	"strconv"
+	"strings"
+)
+
+//go:embed admin/templates/*.html admin/static/*
+var adminFiles embed.FS
+
+// Name shown by browsers when asking for the admin credentials
+const ADMIN_REALM = "URL-Shortener admin"
+
+// Name of the hidden form field holding the server's admin token
+const ADMIN_TOKEN_FIELD = "token"
+
+// Number of days shown in the expansions chart of a link
+const ADMIN_CHART_DAYS = 30
+
+// Size of the expansions chart in pixels
+const ADMIN_CHART_WIDTH = 600
+const ADMIN_CHART_HEIGHT = 160
+
+// Returns the path of a link's page (or of an action on it) in the dashboard
+func AdminLinkPath(alias string, action string) string {
+	path := ADMIN_ENDPOINT + "links/" + neturl.PathEscape(alias)
+	if action != "" {
+		path += "/" + action
+	}
+	return path
+}
+
+/*
+Templates of the dashboard pages. layout.html defines the parts shared by
+every page, and each other file is a page named after the file.
+*/
+var ADMIN_TEMPLATES = template.Must(template.New("admin").Funcs(template.FuncMap{
+	"linkPath": AdminLinkPath,
+	"join":     strings.Join,
+}).ParseFS(adminFiles, "admin/templates/*.html"))
+
+// Data shared by every dashboard page
+type AdminPage struct {
+	Title    string
+	Endpoint string
+	Token    string
+
+	// Messages from the action that led to this page (e.g. a failed create)
+	Notice string
+	Error  string
+}
+
+// Data for the dashboard's main page (index.html)
+type AdminIndexPage struct {
+	AdminPage
+	Summary *SummaryAnalyticsResponse
+	Query   *LinksQuery
+	Page    *LinksPage
+
+	// Value of the automatic search field: true, false or empty for any
+	Automatic string
+
+	// Link to the next page of links with the same search, empty if none
+	NextPage string
+}
+
+// Data for the page of a single link (link.html)
+type AdminLinkPage struct {
+	AdminPage
+	Link     *LinkSummary
+	ShortURL string
+	Chart    template.HTML
+	Clicks   int
+
+	// The link's routing rules as indented JSON, empty if it has none
+	RoutingRules string
+}
+
+// Makes a random token for the admin forms (see the adminToken field of Server)
+func NewAdminToken() (string, error) {
+	token := make([]byte, 32)
+	_, err := rand.Read(token)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token), nil
+}
+
+// Returns whether the admin dashboard is configured and so should be served
+func AdminEnabled(config Config) bool {
+	return config.AdminUsername != "" && config.AdminPasswordHash != ""
+}
+
+/*
+Checks that a request carries the admin credentials (using HTTP basic
+authentication). Incorrect credentials are rate limited per client the
+same way link passwords are.
+
+Parameters:
+
+	s: Pointer to Server holding the credentials and attempt limiter
+	w: Where we write response for user if the check fails
+	r: The request to check
+
+Returns:
+
+	Whether the request may use the dashboard. If not, a response has
+	already been written.
+*/
+func CheckAdminCredentials(s *Server, w http.ResponseWriter, r *http.Request) bool {
+	key := "admin " + ClientIP(r)
+	allowed, wait := s.passwordLimiter.Allow(key)
+	if !allowed {
+		ReportClientError(w, r, http.StatusTooManyRequests, "Admin login locked out", fmt.Sprintf("Too many incorrect logins, try again in %d seconds", int(wait.Seconds())+1))
+		return false
+	}
+
+	username, password, ok := r.BasicAuth()
+	if ok {
+		username_matches := subtle.ConstantTimeCompare([]byte(username), []byte(s.config.AdminUsername)) == 1
+		password_matches := VerifyPassword(password, s.config.AdminPasswordHash)
+		if username_matches && password_matches {
+			s.passwordLimiter.Reset(key)
+			return true
+		}
+		// Incorrect credentials stay counted as a failure by Allow( )
+	} else {
+		s.passwordLimiter.Release(key)
+	}
+
+	// This header makes browsers ask the user for the credentials
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", ADMIN_REALM))
+	ReportClientError(w, r, http.StatusUnauthorized, "Admin credentials missing or incorrect", "Admin credentials required")
+	return false
+}
+
+/*
+Checks that a form was submitted from the dashboard itself, i.e. that it
+carries the server's admin token. Basic authentication alone isn't
+enough as browsers send the credentials along with requests that other
+sites trigger.
+*/
+func CheckAdminToken(s *Server, r *http.Request) bool {
+	token := r.PostFormValue(ADMIN_TOKEN_FIELD)
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) == 1
+}
+
+/*
+Checks that a request to an admin JSON endpoint says its body is JSON.
+Like the admin token for dashboard forms, this keeps other sites from
+using the credentials a browser sends along: a page can only send JSON
+to another site after the browser has asked that site (through CORS)
+whether it may, which this server never allows.
+*/
+func CheckAdminJSONRequest(w http.ResponseWriter, r *http.Request) bool {
+	media_type, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || media_type != "application/json" {
+		ReportClientError(w, r, http.StatusUnsupportedMediaType, "Content type "+r.Header.Get("Content-Type"), "Content-Type must be application/json")
+		return false
+	}
+	return true
+}
+
+// Fills in the data shared by every dashboard page
+func NewAdminPage(s *Server, r *http.Request, title string) AdminPage {
+	return AdminPage{
+		Title:    title,
+		Endpoint: ADMIN_ENDPOINT,
+		Token:    s.adminToken,
+		Notice:   r.URL.Query().Get("notice"),
+		Error:    r.URL.Query().Get("error"),
+	}
+}
+
+/*
+Renders a dashboard page.
+
+Parameters:
+
+	w: Where we write response for user
+	r: The request being answered
+	name: File name of the page's template
+	data: Data for the template
+*/
+func RenderAdminPage(w http.ResponseWriter, r *http.Request, name string, data any) {
+	/*
+		Render into a buffer first so a template error can still be
+		reported as an internal error rather than as half a page.
+	*/
+	var page strings.Builder
+	err := ADMIN_TEMPLATES.ExecuteTemplate(&page, name, data)
+	if err != nil {
+		ReportUnexpectedInternalServerError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(page.String()))
+}
+
+/*
+Sends the browser to another dashboard page after a form was submitted,
+with a message to show there.
+
+Parameters:
+
+	w: Where we write response for user
+	r: The request that submitted the form
+	path: The page to go to
+	kind: notice or error
+	message: The message to show
+*/
+func AdminRedirect(w http.ResponseWriter, r *http.Request, path string, kind string, message string) {
+	if kind == "error" {
+		RequestLogger(r).Warn("Admin action failed", "message", message)
+	}
+	http.Redirect(w, r, path+"?"+neturl.Values{kind: {message}}.Encode(), http.StatusSeeOther)
+}
+
+/*
+Renders the expansions of a link per day as a bar chart. The SVG is put
+inline in the page, so no charting library or extra request is needed.
+
+Parameters:
+
+	daily: The expansions per day, see GetDailyClicks( )
+
+Returns:
+
+	The SVG markup. It only holds numbers and dates we formatted
+	ourselves, so it is safe to mark as HTML.
+*/
+func RenderBarChartSVG(daily []DailyCount) template.HTML {
+	highest := 1
+	for _, day := range daily {
+		highest = max(highest, day.Count)
+	}
+
+	// Leave room at the bottom for the first and last dates
+	const label_height = 20
+	plot_height := float64(ADMIN_CHART_HEIGHT - label_height)
+	bar_width := float64(ADMIN_CHART_WIDTH) / float64(len(daily))
+
+	var svg strings.Builder
+	fmt.Fprintf(&svg, `<svg xmlns="http://www.w3.org/2000/svg" class="chart" viewBox="0 0 %d %d" width="%d" height="%d">`, ADMIN_CHART_WIDTH, ADMIN_CHART_HEIGHT, ADMIN_CHART_WIDTH, ADMIN_CHART_HEIGHT)
+	for i, day := range daily {
+		height := plot_height * float64(day.Count) / float64(highest)
+		fmt.Fprintf(&svg, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f"><title>%s: %d</title></rect>`,
+			float64(i)*bar_width+1, plot_height-height, bar_width-2, height, day.Day, day.Count)
+	}
+	fmt.Fprintf(&svg, `<line x1="0" y1="%.1f" x2="%d" y2="%.1f"/>`, plot_height, ADMIN_CHART_WIDTH, plot_height)
+	if len(daily) > 0 {
+		fmt.Fprintf(&svg, `<text x="0" y="%d">%s</text>`, ADMIN_CHART_HEIGHT-4, daily[0].Day)
+		fmt.Fprintf(&svg, `<text x="%d" y="%d" text-anchor="end">%s</text>`, ADMIN_CHART_WIDTH, ADMIN_CHART_HEIGHT-4, daily[len(daily)-1].Day)
+	}
+	fmt.Fprintf(&svg, `<text x="0" y="12">%d</text>`, highest)
+	svg.WriteString(`</svg>`)
+	return template.HTML(svg.String())
+}
+
+/*
+Handles every request under the /admin/ endpoint, after checking the
+admin credentials, by dispatching on the rest of the path:
+
+	(empty)                  GET the main page (search, create, totals)
+	static/...               GET the stylesheet and script
+	create                   POST the create form
+	links/<alias>            GET the page of a link
+	links/<alias>/<action>   POST an edit, disable, enable or delete form
+
+Parameters:
+
+	s: Pointer to HTTP server whose links are managed
+	request: Pointer to struct that represents contents of HTTP
+		request
+	w: Where we write response for user
+*/
+func AdminDashboard(s *Server, w http.ResponseWriter, r *http.Request) {
+	if !CheckAdminCredentials(s, w, r) {
+		return
+	}
+
+	rest := strings.TrimPrefix(r.URL.Path, ADMIN_ENDPOINT)
+	if strings.HasPrefix(rest, "static/") {
+		static, _ := fs.Sub(adminFiles, "admin/static")
+		http.StripPrefix(ADMIN_ENDPOINT+"static/", http.FileServer(http.FS(static))).ServeHTTP(w, r)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		if rest == "" {
+			AdminIndex(s, w, r)
+		} else if alias, ok := strings.CutPrefix(rest, "links/"); ok {
+			AdminLink(s, w, r, alias)
+		} else {
+			ReportClientError(w, r, http.StatusNotFound, "Unknown admin page "+rest, "Page not found")
+		}
+		return
+	}
+	if r.Method != http.MethodPost {
+		ReportInvalidMethodError(w, r, r.Method)
+		return
+	}
+	if !CheckAdminToken(s, r) {
+		ReportClientError(w, r, http.StatusForbidden, "Admin form without a valid token", "Form has expired, reload the page and try again")
+		return
+	}
+
+	if rest == "create" {
+		AdminCreate(s, w, r)
+		return
+	}
+
+	/*
+		The action is whatever follows the last slash. An alias could
+		itself contain a slash if the alias policy allows it, which is
+		why we split from the end.
+	*/
+	link, ok := strings.CutPrefix(rest, "links/")
+	slash := strings.LastIndex(link, "/")
+	if !ok || slash < 0 {
+		ReportClientError(w, r, http.StatusNotFound, "Unknown admin action "+rest, "Page not found")
+		return
+	}
+	AdminLinkAction(s, w, r, link[:slash], link[slash+1:])
+}
+
+// Renders the dashboard's main page
+func AdminIndex(s *Server, w http.ResponseWriter, r *http.Request) {
+	data := AdminIndexPage{AdminPage: NewAdminPage(s, r, "Links")}
+
+	/*
+		The search form uses the same parameters as the links endpoint,
+		except that fields left blank are sent empty, so those are
+		dropped before parsing.
+	*/
+	params := r.URL.Query()
+	params.Del("notice")
+	params.Del("error")
+	for key, values := range params {
+		if len(values) == 0 || values[0] == "" {
+			params.Del(key)
+		}
+	}
+	search := r.Clone(r.Context())
+	search.URL.RawQuery = params.Encode()
+
+	query, err_msg := ParseLinksQuery(search)
+	if err_msg != "" {
+		data.Error = err_msg
+		query = &LinksQuery{Sort: "created", Order: "asc", Limit: LINKS_DEFAULT_LIMIT}
+	}
+	data.Query = query
+	if query.Automatic != nil {
+		data.Automatic = strconv.FormatBool(*query.Automatic)
+	}
+
+	var err error
+	data.Summary, err = GetSummaryAnalytics(s, r.Context(), &SummaryQuery{Top: ANALYTICS_DEFAULT_TOP})
+	if err != nil {
+		ReportUnexpectedInternalServerError(w, r, err)
+		return
+	}
+	data.Page, err = GetLinksPage(s, r.Context(), query)
+	if err != nil {
+		ReportUnexpectedInternalServerError(w, r, err)
+		return
+	}
+	if data.Page.NextCursor != "" {
+		params.Set("cursor", data.Page.NextCursor)
+		data.NextPage = ADMIN_ENDPOINT + "?" + params.Encode()
+	}
+	RenderAdminPage(w, r, "index.html", data)
+}
+
+// Renders the page of a single link
+func AdminLink(s *Server, w http.ResponseWriter, r *http.Request, alias string) {
+	link, err := GetLinkSummary(s, r.Context(), alias)
+	if err == sql.ErrNoRows {
+		ReportClientError(w, r, http.StatusNotFound, "No mapping exists for alias", fmt.Sprintf("%s is not mapped", alias))
+		return
+	} else if err != nil {
+		ReportUnexpectedInternalServerError(w, r, err)
+		return
+	}
+
+	daily, err := GetDailyClicks(s, r.Context(), alias, ADMIN_CHART_DAYS)
+	if err != nil {
+		ReportUnexpectedInternalServerError(w, r, err)
+		return
+	}
+	clicks := 0
+	for _, day := range daily {
+		clicks += day.Count
+	}
+
+	routed, err := GetLinkByAlias(s, r.Context(), alias)
+	if err != nil {
+		ReportUnexpectedInternalServerError(w, r, err)
+		return
+	}
+	routing_rules := ""
+	if len(routed.RoutingRules) > 0 {
+		contents, _ := json.MarshalIndent(routed.RoutingRules, "", "  ")
+		routing_rules = string(contents)
+	}
+
+	RenderAdminPage(w, r, "link.html", AdminLinkPage{
+		AdminPage:    NewAdminPage(s, r, alias),
+		Link:         link,
+		ShortURL:     ShortURL(s, alias),
+		Chart:        RenderBarChartSVG(daily),
+		Clicks:       clicks,
+		RoutingRules: routing_rules,
+	})
+}
+
+/*
+Parses the tags field of a dashboard form, where tags are separated by
+commas.
+
+Returns:
+
+	The tags as given, checked when the link is saved.
+*/
+func ParseAdminTags(r *http.Request) []string {
+	tags := []string{}
+	for _, tag := range strings.Split(r.PostFormValue("tags"), ",") {
+		tag = strings.TrimSpace(tag)
+		if tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+/*
+Parses the max_expansions field of a dashboard form, where blank means no
+cap.
+
+Returns:
+
+	The cap and, if the field is not a number, a message for the user.
+*/
+func ParseAdminMaxExpansions(r *http.Request) (int, string) {
+	value := r.PostFormValue("max_expansions")
+	if value == "" {
+		return 0, ""
+	}
+	max_expansions, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, "max_expansions must be a number"
+	}
+	return max_expansions, ""
+}
+
+// Handles the create form, which makes a link like a shorten/ request would
+func AdminCreate(s *Server, w http.ResponseWriter, r *http.Request) {
+	max_expansions, err_msg := ParseAdminMaxExpansions(r)
+	if err_msg != "" {
+		AdminRedirect(w, r, ADMIN_ENDPOINT, "error", err_msg)
+		return
+	}
+	request := ShortenRequest{
+		Url:               r.PostFormValue("url"),
+		Alias:             r.PostFormValue("alias"),
+		AllowDuplicateUrl: r.PostFormValue("allow_duplicate_url") != "",
+		Password:          r.PostFormValue("password"),
+		MaxExpansions:     max_expansions,
+	}
+	if request.Url == "" {
+		AdminRedirect(w, r, ADMIN_ENDPOINT, "error", "URL must not be empty")
+		return
+	}
+
+	alias, err_msg, err := CreateLink(s, r.Context(), &request, NewActor(r, s.config.AdminUsername))
+	if err != nil {
+		if err_msg == INTERNAL_ERROR_MESSAGE {
+			ReportUnexpectedInternalServerError(w, r, err)
+		} else {
+			AdminRedirect(w, r, ADMIN_ENDPOINT, "error", err_msg)
+		}
+		return
+	}
+	AdminRedirect(w, r, AdminLinkPath(alias, ""), "notice", fmt.Sprintf("Created %s", alias))
+}
+
+/*
+Handles the forms on a link's page.
+
+Parameters:
+
+	s: Pointer to HTTP server whose links are managed
+	w: Where we write response for user
+	r: The request that submitted the form
+	alias: The link's alias
+	action: One of edit, disable, enable, delete
+*/
+func AdminLinkAction(s *Server, w http.ResponseWriter, r *http.Request, alias string, action string) {
+	page := AdminLinkPath(alias, "")
+	actor := NewActor(r, s.config.AdminUsername)
+
+	var err error
+	var err_msg string
+	var notice string
+	switch action {
+	case "edit":
+		max_expansions, parse_msg := ParseAdminMaxExpansions(r)
+		if parse_msg != "" {
+			AdminRedirect(w, r, page, "error", parse_msg)
+			return
+		}
+		// password_action is keep (the default), set or remove
+		password_action := r.PostFormValue("password_action")
+		password := r.PostFormValue("password")
+		if password_action == "set" && password == "" {
+			AdminRedirect(w, r, page, "error", "Enter the new password")
+			return
+		} else if password_action != "set" {
+			password = ""
+		}
+		err_msg, err = UpdateLink(s, r.Context(), alias, &LinkUpdate{
+			Url:               r.PostFormValue("url"),
+			MaxExpansions:     max_expansions,
+			ChangePassword:    password_action == "set" || password_action == "remove",
+			Password:          password,
+			AllowDuplicateUrl: r.PostFormValue("allow_duplicate_url") != "",
+			Tags:              ParseAdminTags(r),
+			Campaign:          r.PostFormValue("campaign"),
+		}, actor)
+		notice = "Saved"
+	case "rules":
+		// A blank field removes the rules
+		var rules []RoutingRule
+		contents := strings.TrimSpace(r.PostFormValue("routing_rules"))
+		if contents != "" {
+			err = json.Unmarshal([]byte(contents), &rules)
+			if err != nil {
+				AdminRedirect(w, r, page, "error", "Routing rules must be a JSON list of rules")
+				return
+			}
+		}
+		err_msg, err = SetRoutingRules(s, r.Context(), alias, rules, actor)
+		notice = "Saved routing rules"
+	case "disable", "enable":
+		err = SetLinkDisabled(s, r.Context(), alias, action == "disable", actor)
+		notice = fmt.Sprintf("%s is %sd", alias, action)
+	case "delete":
+		err = DeleteLink(s, r.Context(), alias, actor)
+		notice = fmt.Sprintf("Deleted %s", alias)
+		page = ADMIN_ENDPOINT
+	default:
+		ReportClientError(w, r, http.StatusNotFound, "Unknown admin action "+action, "Page not found")
+		return
+	}
+
+	if err == sql.ErrNoRows {
+		ReportClientError(w, r, http.StatusNotFound, "No mapping exists for alias", fmt.Sprintf("%s is not mapped", alias))
+		return
+	} else if err != nil && (err_msg == "" || err_msg == INTERNAL_ERROR_MESSAGE) {
+		ReportUnexpectedInternalServerError(w, r, err)
+		return
+	} else if err != nil {
+		AdminRedirect(w, r, page, "error", err_msg)
+		return
+	}
+	AdminRedirect(w, r, page, "notice", notice)
+}
@@ -0,0 +1,9 @@
+// Asks for confirmation before submitting forms marked with data-confirm
+// (e.g. deleting a link). Without JavaScript the forms still work.
+document.querySelectorAll("form[data-confirm]").forEach(function (form) {
+	form.addEventListener("submit", function (event) {
+		if (!window.confirm(form.dataset.confirm)) {
+			event.preventDefault();
+		}
+	});
+});
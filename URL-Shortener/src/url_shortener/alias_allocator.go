@@ -0,0 +1,512 @@
+/*
+Package url_shortener serves as a library of utilities for the URL-Shortener
+application. This includes the definition of our API, database configuration,
+and HTTP server implementation. This is used by the main package to instantiate
+and run a server easily. This library could be used in other applications
+that do more than just initializing and booting a server.
+
+This file provides how automatic aliases are picked. The counter lives in
+the alias_sequence table, from which servers lease ranges of
+ALIAS_BLOCK_SIZE aliases (recorded in the alias_ranges table). Aliases
+are then handed out from memory, so picking one is a quick locked
+increment rather than a database round trip, and automatic shortens only
+wait for each other when a new range has to be leased. Several servers
+can share the database, as each hands out only the range it leases.
+
+A lease lasts alias_lease_seconds and is renewed while the server runs,
+recording how far into the range the server got. If a server dies, its
+lease expires and another server takes over the rest of its range.
+
+Custom aliases that are numbers (and so could clash with an automatic
+alias) are kept in a skip set so they are passed over instead of being
+found by failed inserts.
+*/
+
+package url_shortener
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Number of automatic aliases leased from the alias sequence at a time
+const ALIAS_BLOCK_SIZE = 100
+
+/*
+Query to get the lowest alias that may still be handed out: the progress
+of the earliest unfinished range, or where the sequence is up to if every
+range is finished.
+*/
+const QUERY_GET_FIRST_UNUSED_ALIAS = `
+SELECT COALESCE(
+    (SELECT MIN(Next) FROM alias_ranges WHERE Next < End),
+    (SELECT Next FROM alias_sequence)
+)
+`
+
+/*
+Query template to take over the earliest range whose lease has expired and
+that still has aliases left, returning the range. A range whose lease
+was released (see ReleaseAliasRange( )) has already expired.
+*/
+const QUERY_TAKE_OVER_ALIAS_RANGE_TEMPLATE = `
+UPDATE alias_ranges
+SET Owner = ?, LeaseExpires = ?
+WHERE Start = (
+    SELECT Start
+    FROM alias_ranges
+    WHERE LeaseExpires < ? AND Next < End
+    ORDER BY Start
+    LIMIT 1
+)
+RETURNING Start, Next, End
+`
+
+/*
+Query template to take a new range from the end of the alias sequence,
+returning the end of the range. As this is a single statement, two
+servers sharing the database can't take the same range.
+*/
+const QUERY_RESERVE_ALIAS_BLOCK_TEMPLATE = `
+UPDATE alias_sequence
+SET Next = Next + ?
+RETURNING Next
+`
+
+// Query template to record a new range and its lease
+const QUERY_INSERT_ALIAS_RANGE_TEMPLATE = `
+INSERT INTO alias_ranges (Start, End, Next, Owner, LeaseExpires)
+VALUES (?, ?, ?, ?, ?)
+`
+
+// Query template to forget a range every alias of which was handed out
+const QUERY_DELETE_ALIAS_RANGE_TEMPLATE = `
+DELETE FROM alias_ranges
+WHERE Start = ? AND Owner = ?
+`
+
+/*
+Query template to renew the lease of a range and record how far into it
+the server got. Nothing is updated if the lease was lost.
+*/
+const QUERY_RENEW_ALIAS_LEASE_TEMPLATE = `
+UPDATE alias_ranges
+SET Next = ?, LeaseExpires = ?
+WHERE Start = ? AND Owner = ?
+`
+
+/*
+Query template to give up the lease of a range, recording how far into
+it the server got, so another server (or the next boot) carries on from
+there right away.
+*/
+const QUERY_RELEASE_ALIAS_RANGE_TEMPLATE = `
+UPDATE alias_ranges
+SET Next = ?, Owner = NULL, LeaseExpires = 0
+WHERE Start = ? AND Owner = ?
+`
+
+/*
+Query template to get the custom aliases that are made of digits only
+and are not below a given number. The digits are checked to be a number
+as written by strconv.Itoa( ) (e.g. no leading 0) by the caller.
+*/
+const QUERY_GET_CUSTOM_NUMERIC_ALIASES_TEMPLATE = `
+SELECT Alias
+FROM aliases
+WHERE NOT Automatic
+    AND Alias != ''
+    AND Alias NOT GLOB '*[^0-9]*'
+    AND CAST(Alias AS INTEGER) >= ?
+`
+
+/*
+Hands out automatic aliases from the range the server leases. The lock is
+only held to pick an alias or lease a range, never while a mapping is
+inserted.
+*/
+type AliasAllocator struct {
+	// Names this server in the leases it holds
+	owner string
+
+	lock sync.Mutex
+
+	/*
+		The range being handed out is [next, end), leased until expires.
+		start identifies the range in the alias_ranges table. Without a
+		lease, expires is the zero time.
+	*/
+	start   int
+	next    int
+	end     int
+	expires time.Time
+
+	/*
+		Aliases of the range that were handed out but not used (e.g. the
+		URL already had an alias), smallest first. These are handed out
+		again before next, so failed shortens don't leave gaps.
+	*/
+	returned []int
+
+	// Custom numeric aliases that are yet to be passed, see SkipCustomAlias( )
+	skip map[int]bool
+}
+
+/*
+Gets the number an alias stands for if it could be an automatic alias,
+i.e. if it is written exactly like strconv.Itoa( ) writes a number.
+
+Parameters:
+
+	alias: The alias to check
+
+Returns:
+
+	The number and whether the alias is one.
+*/
+func ParseNumericAlias(alias string) (int, bool) {
+	n, err := strconv.Atoi(alias)
+	if err != nil || n < 0 || strconv.Itoa(n) != alias {
+		return 0, false
+	}
+	return n, true
+}
+
+/*
+Makes the name a server holds its leases under. It names the host and
+process for whoever looks at the alias_ranges table, and ends with random
+characters so it is unique even if a process ID is reused.
+
+Returns:
+
+	The name and, if no random characters could be made, an error.
+*/
+func NewLeaseOwner() (string, error) {
+	random := make([]byte, 4)
+	_, err := rand.Read(random)
+	if err != nil {
+		return "", err
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(random)), nil
+}
+
+/*
+Sets up automatic alias assignment when the server boots. No range is
+leased yet (the first automatic shorten does that), but the custom
+numeric aliases that could still be handed out are loaded into the skip
+set.
+
+Parameters:
+
+	s: Pointer to Server whose allocator is set up
+
+Returns:
+
+	If the lease duration is not valid or the ranges or the aliases
+	could not be read, an error, otherwise nil.
+*/
+func LoadAliasAllocator(s *Server) error {
+	if s.config.AliasLeaseSeconds <= 0 {
+		return errors.New("alias_lease_seconds must be positive")
+	}
+	owner, err := NewLeaseOwner()
+	if err != nil {
+		return err
+	}
+	var first int
+	err = s.db.QueryRow(QUERY_GET_FIRST_UNUSED_ALIAS).Scan(&first)
+	if err != nil {
+		return err
+	}
+
+	rows, err := s.db.Query(QUERY_GET_CUSTOM_NUMERIC_ALIASES_TEMPLATE, first)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	skip := make(map[int]bool)
+	for rows.Next() {
+		var alias string
+		err = rows.Scan(&alias)
+		if err != nil {
+			return err
+		}
+		n, ok := ParseNumericAlias(alias)
+		if ok {
+			skip[n] = true
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+
+	s.aliases.lock.Lock()
+	s.aliases.owner = owner
+	s.aliases.skip = skip
+	s.aliases.lock.Unlock()
+	s.aliasesLoaded.Store(true)
+	return nil
+}
+
+// Returns how long a lease on a range of aliases lasts
+func AliasLeaseDuration(s *Server) time.Duration {
+	return time.Duration(s.config.AliasLeaseSeconds) * time.Second
+}
+
+/*
+Leases a range of aliases, taking over an expired lease if there is one
+and otherwise taking a new range from the alias sequence. The range the
+server had, which is used up, is forgotten in the same transaction. The
+caller must hold the allocator's lock.
+
+Parameters:
+
+	s: Pointer to Server leasing the range
+	ctx: Context of the request that needs an alias
+
+Returns:
+
+	If no range could be leased, an error, otherwise nil.
+*/
+func LeaseAliasRange(s *Server, ctx context.Context) error {
+	var start, next, end int
+	now := time.Now()
+	expires := now.Add(AliasLeaseDuration(s))
+	had_range := !s.aliases.expires.IsZero()
+	err := RunQuery(s, ctx, func(ctx context.Context) error {
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		if had_range {
+			_, err = tx.ExecContext(ctx, QUERY_DELETE_ALIAS_RANGE_TEMPLATE, s.aliases.start, s.aliases.owner)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = tx.QueryRowContext(ctx, QUERY_TAKE_OVER_ALIAS_RANGE_TEMPLATE, s.aliases.owner, expires.Unix(), now.Unix()).Scan(&start, &next, &end)
+		if err == sql.ErrNoRows {
+			err = tx.QueryRowContext(ctx, QUERY_RESERVE_ALIAS_BLOCK_TEMPLATE, ALIAS_BLOCK_SIZE).Scan(&end)
+			if err != nil {
+				return err
+			}
+			start = end - ALIAS_BLOCK_SIZE
+			next = start
+			_, err = tx.ExecContext(ctx, QUERY_INSERT_ALIAS_RANGE_TEMPLATE, start, end, next, s.aliases.owner, expires.Unix())
+		}
+		if err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		return err
+	}
+	s.aliases.start = start
+	s.aliases.next = next
+	s.aliases.end = end
+	s.aliases.expires = expires
+	return nil
+}
+
+/*
+Picks the alias for an automatic shorten, leasing a new range first if the
+current one is used up or its lease has run out.
+
+Parameters:
+
+	s: Pointer to Server whose allocator is used
+	ctx: Context of the request that needs an alias
+
+Returns:
+
+	The alias and, if a range was needed but could not be leased, an
+	error. An alias that ends up unused should be given back with
+	ReturnAutomaticAlias( ).
+*/
+func NextAutomaticAlias(s *Server, ctx context.Context) (int, error) {
+	s.aliases.lock.Lock()
+	defer s.aliases.lock.Unlock()
+
+	/*
+		Past its expiry, another server may have taken over the range,
+		so none of it (not even returned aliases) can be handed out. If
+		no one did, the range is taken over again by LeaseAliasRange( ),
+		carrying on from the progress last recorded.
+	*/
+	if !s.aliases.expires.IsZero() && time.Now().After(s.aliases.expires) {
+		s.aliases.next = s.aliases.end
+		s.aliases.returned = nil
+		s.aliases.expires = time.Time{}
+	}
+	if len(s.aliases.returned) > 0 {
+		n := s.aliases.returned[0]
+		s.aliases.returned = s.aliases.returned[1:]
+		return n, nil
+	}
+	for {
+		if s.aliases.next >= s.aliases.end {
+			err := LeaseAliasRange(s, ctx)
+			if err != nil {
+				return 0, err
+			}
+		}
+		n := s.aliases.next
+		s.aliases.next += 1
+		if s.aliases.skip[n] {
+			delete(s.aliases.skip, n)
+			continue
+		}
+		return n, nil
+	}
+}
+
+/*
+Gives back an automatic alias that was not used, so it is handed out
+again. This must not be called for an alias that turned out to be in
+use.
+
+Parameters:
+
+	s: Pointer to Server whose allocator is used
+	n: The alias given by NextAutomaticAlias( )
+*/
+func ReturnAutomaticAlias(s *Server, n int) {
+	s.aliases.lock.Lock()
+	defer s.aliases.lock.Unlock()
+
+	// The range may have been replaced meanwhile, then n is not ours
+	if n < s.aliases.start || n >= s.aliases.next {
+		return
+	}
+	i, _ := slices.BinarySearch(s.aliases.returned, n)
+	s.aliases.returned = slices.Insert(s.aliases.returned, i, n)
+}
+
+/*
+Records that a custom alias was created. If it is a number that could
+still be handed out, it is added to the skip set. Which ranges other
+servers lease is not known here, so numbers outside of the server's
+range are added too.
+
+Parameters:
+
+	s: Pointer to Server whose allocator is used
+	alias: The custom alias that was created
+*/
+func SkipCustomAlias(s *Server, alias string) {
+	n, ok := ParseNumericAlias(alias)
+	if !ok {
+		return
+	}
+	s.aliases.lock.Lock()
+	defer s.aliases.lock.Unlock()
+	if n >= s.aliases.next || n < s.aliases.start {
+		s.aliases.skip[n] = true
+	}
+}
+
+/*
+Renews the lease of the server's range, recording how far into it the
+server got. Aliases given back with ReturnAutomaticAlias( ) are only
+handed out again by this server, as aliases after them are in use. If
+the lease was lost (it ran out before being renewed and another server
+took over), the range is dropped so the next automatic shorten leases a
+new one.
+
+Parameters:
+
+	s: Pointer to Server whose lease is renewed
+
+Returns:
+
+	If the lease could not be renewed, an error, otherwise nil.
+*/
+func RenewAliasLease(s *Server) error {
+	s.aliases.lock.Lock()
+	defer s.aliases.lock.Unlock()
+	if s.aliases.expires.IsZero() {
+		return nil
+	}
+
+	expires := time.Now().Add(AliasLeaseDuration(s))
+	result, err := s.db.Exec(QUERY_RENEW_ALIAS_LEASE_TEMPLATE, s.aliases.next, expires.Unix(), s.aliases.start, s.aliases.owner)
+	if err != nil {
+		return err
+	}
+	renewed, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if renewed == 0 {
+		s.aliases.next = s.aliases.end
+		s.aliases.returned = nil
+		s.aliases.expires = time.Time{}
+		return fmt.Errorf("lost the lease of aliases %d to %d", s.aliases.start, s.aliases.end-1)
+	}
+	s.aliases.expires = expires
+	return nil
+}
+
+/*
+Renews the server's lease three times per alias_lease_seconds until the
+server stops, so one failed renewal doesn't lose the lease.
+
+Parameters:
+
+	s: Pointer to Server whose lease is renewed
+*/
+func RunAliasLeaseRenewals(s *Server) {
+	ticker := time.NewTicker(AliasLeaseDuration(s) / 3)
+	defer ticker.Stop()
+	for range ticker.C {
+		err := RenewAliasLease(s)
+		if err != nil {
+			log.Println("Alias lease renewal failed:", err)
+		}
+	}
+}
+
+/*
+Gives up the server's lease when it stops, recording how far into the
+range it got, so another server or the next boot carries on from there
+right away rather than once the lease runs out. Like when renewing,
+aliases given back with ReturnAutomaticAlias( ) are left as gaps.
+
+Parameters:
+
+	s: Pointer to Server that is stopping
+*/
+func ReleaseAliasRange(s *Server) {
+	s.aliases.lock.Lock()
+	defer s.aliases.lock.Unlock()
+	if s.aliases.expires.IsZero() {
+		return
+	}
+	_, err := s.db.Exec(QUERY_RELEASE_ALIAS_RANGE_TEMPLATE, s.aliases.next, s.aliases.start, s.aliases.owner)
+	if err != nil {
+		log.Println("Could not release alias range:", err)
+		return
+	}
+	s.aliases.next = s.aliases.end
+	s.aliases.returned = nil
+	s.aliases.expires = time.Time{}
+}
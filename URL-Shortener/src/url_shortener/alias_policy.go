@@ -0,0 +1,227 @@
+/*
+Package url_shortener serves as a library of utilities for the URL-Shortener
+application. This includes the definition of our API, database configuration,
+and HTTP server implementation. This is used by the main package to instantiate
+and run a server easily. This library could be used in other applications
+that do more than just initializing and booting a server.
+
+This file provides the policy that custom aliases must follow. Custom aliases
+end up in URL paths, so the policy keeps out characters like slashes and
+spaces, keeps lengths reasonable, and reserves words that may be used for
+routes. The policy itself is part of the configuration (see config.go).
+*/
+
+package url_shortener
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+/*
+Represents the rules custom aliases must follow. Automatically assigned
+aliases are not checked as they are always non-negative integers.
+*/
+type AliasPolicy struct {
+	/*
+		The characters allowed in an alias, written as the inside of a
+		regular expression character class (e.g. A-Za-z0-9_- allows
+		letters, digits, underscores and dashes).
+	*/
+	AllowedCharacters string `json:"allowed_characters"`
+
+	// Minimum and maximum alias length (in characters, not bytes)
+	MinLength int `json:"min_length"`
+	MaxLength int `json:"max_length"`
+
+	// Aliases that can't be used, compared ignoring case
+	ReservedWords []string `json:"reserved_words"`
+
+	/*
+		If true, aliases that only differ by case (e.g. Google and google)
+		are treated as the same alias when checking an alias is unused.
+		Expanding an alias still requires the exact case it was created
+		with.
+	*/
+	CaseInsensitive bool `json:"case_insensitive"`
+}
+
+// Returns the alias policy used when the configuration does not provide one
+func DefaultAliasPolicy() AliasPolicy {
+	return AliasPolicy{
+		AllowedCharacters: "A-Za-z0-9_-",
+		MinLength:         1,
+		MaxLength:         64,
+		ReservedWords: []string{
+			"admin", "analytics", "api", "expand", "shorten", "static",
+		},
+		CaseInsensitive: false,
+	}
+}
+
+/*
+Checks aliases against an AliasPolicy. The policy's character class is
+compiled into a regular expression once, when the checker is made,
+rather than on every check.
+*/
+type AliasChecker struct {
+	policy   AliasPolicy
+	pattern  *regexp.Regexp
+	reserved map[string]bool
+}
+
+/*
+Makes a checker for an alias policy.
+
+Parameters:
+
+	policy: The alias policy to check against
+
+Returns:
+
+	The checker and, if the policy is invalid (e.g. its character class
+	does not compile or the lengths are inconsistent), an error.
+*/
+func NewAliasChecker(policy AliasPolicy) (*AliasChecker, error) {
+	if policy.MinLength < 1 {
+		return nil, fmt.Errorf("alias policy min_length must be at least 1, got %d", policy.MinLength)
+	}
+	if policy.MaxLength < policy.MinLength {
+		return nil, fmt.Errorf("alias policy max_length %d is less than min_length %d", policy.MaxLength, policy.MinLength)
+	}
+
+	/*
+		\A and \z anchor the expression to the start and end of the whole
+		string so every character has to be in the class.
+	*/
+	pattern, err := regexp.Compile(`\A[` + policy.AllowedCharacters + `]*\z`)
+	if err != nil {
+		return nil, fmt.Errorf("alias policy allowed_characters is not a valid character class: %w", err)
+	}
+
+	reserved := make(map[string]bool, len(policy.ReservedWords))
+	for _, word := range policy.ReservedWords {
+		reserved[strings.ToLower(word)] = true
+	}
+	return &AliasChecker{policy: policy, pattern: pattern, reserved: reserved}, nil
+}
+
+/*
+Checks a custom alias against the policy.
+
+Parameters:
+
+	alias: The alias to check
+
+Returns:
+
+	A message describing the first rule the alias breaks, which is meant
+	to be sent to the user. If the alias follows the policy, the empty
+	string is returned.
+*/
+func (checker *AliasChecker) Check(alias string) string {
+	length := utf8.RuneCountInString(alias)
+	if length < checker.policy.MinLength || length > checker.policy.MaxLength {
+		return fmt.Sprintf("Alias must be between %d and %d characters long", checker.policy.MinLength, checker.policy.MaxLength)
+	}
+	if !checker.pattern.MatchString(alias) {
+		return fmt.Sprintf("Alias may only contain the characters [%s]", checker.policy.AllowedCharacters)
+	}
+	if checker.reserved[strings.ToLower(alias)] {
+		return fmt.Sprintf("Alias %s is reserved", alias)
+	}
+	return ""
+}
+
+// Represents an existing alias that does not follow the alias policy
+type AliasPolicyViolation struct {
+	Alias     string
+	Url       string
+	Violation string
+}
+
+/*
+Query to get the custom aliases (and their URLs) so they can be checked
+against the alias policy
+*/
+const QUERY_GET_CUSTOM_ALIASES = `
+SELECT Alias, URL
+FROM aliases
+WHERE NOT Automatic
+ORDER BY Alias
+`
+
+/*
+Query to get aliases that only differ by case from another alias. These
+break the policy if it is case insensitive.
+*/
+const QUERY_GET_CASE_COLLIDING_ALIASES = `
+SELECT Alias, URL
+FROM aliases
+WHERE LOWER(Alias) IN (
+	SELECT LOWER(Alias)
+	FROM aliases
+	GROUP BY LOWER(Alias)
+	HAVING COUNT(*) > 1
+)
+ORDER BY LOWER(Alias), Alias
+`
+
+/*
+Finds the existing custom aliases that do not follow an alias policy.
+These could have been created before the policy existed or before it
+was changed.
+
+Parameters:
+
+	db: Connection to the database to check
+	checker: Checker for the alias policy
+
+Returns:
+
+	The violations found (sorted by alias) and, if a query failed, an
+	error.
+*/
+func FindAliasPolicyViolations(db *sql.DB, checker *AliasChecker) ([]AliasPolicyViolation, error) {
+	var violations []AliasPolicyViolation
+
+	rows, err := db.Query(QUERY_GET_CUSTOM_ALIASES)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var violation AliasPolicyViolation
+		err = rows.Scan(&violation.Alias, &violation.Url)
+		if err != nil {
+			return nil, err
+		}
+		violation.Violation = checker.Check(violation.Alias)
+		if violation.Violation != "" {
+			violations = append(violations, violation)
+		}
+	}
+	err = rows.Err()
+	if err != nil || !checker.policy.CaseInsensitive {
+		return violations, err
+	}
+
+	colliding, err := db.Query(QUERY_GET_CASE_COLLIDING_ALIASES)
+	if err != nil {
+		return nil, err
+	}
+	defer colliding.Close()
+	for colliding.Next() {
+		var violation AliasPolicyViolation
+		err = colliding.Scan(&violation.Alias, &violation.Url)
+		if err != nil {
+			return nil, err
+		}
+		violation.Violation = "Alias only differs by case from another alias"
+		violations = append(violations, violation)
+	}
+	return violations, colliding.Err()
+}
@@ -0,0 +1,475 @@
+/*
+Package url_shortener serves as a library of utilities for the URL-Shortener
+application. This includes the definition of our API, database configuration,
+and HTTP server implementation. This is used by the main package to instantiate
+and run a server easily. This library could be used in other applications
+that do more than just initializing and booting a server.
+
+This file provides analytics across all links (as opposed to analytics/ on
+a single alias, see Analytics( ) in server.go). All time totals come from
+the Expansions counter, while anything over a time window comes from the
+click history that RecordExpansion( ) keeps.
+*/
+
+package url_shortener
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Number of top links reported when the request does not give top
+const ANALYTICS_DEFAULT_TOP = 10
+
+// Largest number of top links a request may ask for
+const ANALYTICS_MAX_TOP = 100
+
+/*
+Query to get the number of links (and automatic links) and all time
+expansions, by people and by bots
+*/
+const QUERY_GET_LINK_TOTALS = `
+SELECT COUNT(*), COALESCE(SUM(Automatic), 0), COALESCE(SUM(Expansions), 0), COALESCE(SUM(BotExpansions), 0)
+FROM aliases
+`
+
+/*
+Query to count the links created per day (UTC) between two Unix times.
+Links made before creation times were recorded are not counted.
+*/
+const QUERY_GET_LINKS_CREATED_PER_DAY_TEMPLATE = `
+SELECT date(Created, 'unixepoch') AS Day, COUNT(*)
+FROM aliases
+WHERE Created >= ? AND Created < ?
+GROUP BY Day
+ORDER BY Day
+`
+
+/*
+Query to get the links with the most expansions of all time. Anyone can
+read the analytics summary, so the URLs of password protected links are
+left blank.
+*/
+const QUERY_GET_TOP_LINKS_TEMPLATE = `
+SELECT Alias, CASE WHEN PasswordHash IS NULL THEN URL ELSE '' END, Expansions
+FROM aliases
+ORDER BY Expansions DESC, Alias
+LIMIT ?
+`
+
+/*
+Query to get the links with the most expansions between two Unix times,
+counted from the click history. URLs of protected links are left blank
+as above.
+*/
+const QUERY_GET_TOP_LINKS_IN_WINDOW_TEMPLATE = `
+SELECT clicks.Alias, CASE WHEN aliases.PasswordHash IS NULL THEN aliases.URL ELSE '' END, COUNT(*) AS Clicks
+FROM clicks
+JOIN aliases ON aliases.Alias = clicks.Alias
+WHERE clicks.Time >= ? AND clicks.Time < ?
+GROUP BY clicks.Alias
+ORDER BY Clicks DESC, clicks.Alias
+LIMIT ?
+`
+
+// Query to count the expansions of an alias per day (UTC) since a Unix time
+const QUERY_GET_DAILY_CLICKS_BY_ALIAS_TEMPLATE = `
+SELECT date(Time, 'unixepoch') AS Day, COUNT(*)
+FROM clicks
+WHERE Alias = ? AND Time >= ?
+GROUP BY Day
+`
+
+/*
+Query template to count the expansions of an alias within a window by one
+of the columns User-Agents are sorted into. Only the fixed column names of
+BREAKDOWN_COLUMNS are put in place of %s. Clicks recorded before the
+columns existed are counted as Unknown.
+*/
+const QUERY_GET_CLICK_BREAKDOWN_TEMPLATE = `
+SELECT COALESCE(%s, 'Unknown') AS Name, COUNT(*) AS Clicks
+FROM clicks
+WHERE Alias = ? AND Time >= ? AND Time < ?
+GROUP BY Name
+ORDER BY Clicks DESC, Name
+`
+
+// Columns of the click history that the breakdown counts by
+var BREAKDOWN_COLUMNS = []string{"Device", "Browser", "OS"}
+
+/*
+Represents the options of an analytics request without an alias, parsed
+from its query parameters. Since and Until are Unix times, nil when the
+window is open on that side.
+*/
+type SummaryQuery struct {
+	Top   int
+	Since *int64
+	Until *int64
+}
+
+/*
+Parses the query parameters of an analytics request without an alias,
+see ANALYTICS_SUMMARY_ENDPOINT for the parameters.
+
+Parameters:
+
+	r: The analytics request
+
+Returns:
+
+	The parsed query and a message for the user if a parameter is invalid
+	(empty if they are all valid).
+*/
+func ParseSummaryQuery(r *http.Request) (*SummaryQuery, string) {
+	params := r.URL.Query()
+	query := &SummaryQuery{Top: ANALYTICS_DEFAULT_TOP}
+
+	if params.Has("top") {
+		top, err := strconv.Atoi(params.Get("top"))
+		if err != nil || top < 1 || top > ANALYTICS_MAX_TOP {
+			return nil, fmt.Sprintf("top must be an integer between 1 and %d", ANALYTICS_MAX_TOP)
+		}
+		query.Top = top
+	}
+	var err_msg string
+	query.Since, query.Until, err_msg = ParseTimeWindow(r)
+	if err_msg != "" {
+		return nil, err_msg
+	}
+	return query, ""
+}
+
+/*
+Parses the since and until query parameters that limit analytics to a
+time window.
+
+Parameters:
+
+	r: The analytics request
+
+Returns:
+
+	The Unix times the window starts at and ends before (nil when the
+	window is open on that side), and a message for the user if a
+	parameter is invalid (empty if they are valid).
+*/
+func ParseTimeWindow(r *http.Request) (*int64, *int64, string) {
+	params := r.URL.Query()
+	var since_time, until_time *int64
+	if params.Has("since") {
+		since, err := ParseTimeParameter(params.Get("since"))
+		if err != nil {
+			return nil, nil, "since must be a date (YYYY-MM-DD) or RFC 3339 time"
+		}
+		since_time = &since
+	}
+	if params.Has("until") {
+		until, err := ParseTimeParameter(params.Get("until"))
+		if err != nil {
+			return nil, nil, "until must be a date (YYYY-MM-DD) or RFC 3339 time"
+		}
+		until_time = &until
+	}
+	return since_time, until_time, ""
+}
+
+/*
+Replaces the open sides of a time window by bounds that every time falls
+within, so the same queries work with or without a window.
+
+Parameters:
+
+	since: Start of the window, nil if open
+	until: End of the window, nil if open
+
+Returns:
+
+	The start and end of the window.
+*/
+func WindowBounds(since *int64, until *int64) (int64, int64) {
+	var start int64 = 0
+	var end int64 = 1<<63 - 1
+	if since != nil {
+		start = *since
+	}
+	if until != nil {
+		end = *until
+	}
+	return start, end
+}
+
+/*
+Gets the analytics across all links from the server's database.
+
+Parameters:
+
+	s: Pointer to Server whose database we query
+	ctx: Context of the request the analytics are for
+	query: The parsed analytics request
+
+Returns:
+
+	The analytics and, if a query failed, an error.
+*/
+func GetSummaryAnalytics(s *Server, ctx context.Context, query *SummaryQuery) (*SummaryAnalyticsResponse, error) {
+	var response *SummaryAnalyticsResponse
+	err := RunQuery(s, ctx, func(ctx context.Context) error {
+		var err error
+		response, err = readSummaryAnalytics(ctx, s.db, query)
+		return err
+	})
+	return response, err
+}
+
+/*
+Runs the queries behind GetSummaryAnalytics( ), which retries them
+together if the database is busy.
+
+Parameters:
+
+	ctx: Context the queries run in
+	db: Connection to the database holding the links
+	query: The parsed analytics request
+
+Returns:
+
+	The analytics and, if a query failed, an error.
+*/
+func readSummaryAnalytics(ctx context.Context, db *sql.DB, query *SummaryQuery) (*SummaryAnalyticsResponse, error) {
+	response := &SummaryAnalyticsResponse{
+		CreatedPerDay: []DailyCount{},
+		TopLinks:      []TopLink{},
+	}
+	var automatic int
+	err := db.QueryRowContext(ctx, QUERY_GET_LINK_TOTALS).Scan(&response.Links, &automatic, &response.Expansions, &response.BotExpansions)
+	if err != nil {
+		return nil, err
+	}
+	response.AutomaticLinks = automatic
+	response.CustomLinks = response.Links - automatic
+
+	since, until := WindowBounds(query.Since, query.Until)
+
+	days, err := db.QueryContext(ctx, QUERY_GET_LINKS_CREATED_PER_DAY_TEMPLATE, since, until)
+	if err != nil {
+		return nil, err
+	}
+	defer days.Close()
+	for days.Next() {
+		var day DailyCount
+		err = days.Scan(&day.Day, &day.Count)
+		if err != nil {
+			return nil, err
+		}
+		response.CreatedPerDay = append(response.CreatedPerDay, day)
+	}
+	err = days.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	/*
+		Without a window, the top links come from the Expansions counter
+		so that expansions made before the click history existed count.
+	*/
+	var top *sql.Rows
+	if query.Since == nil && query.Until == nil {
+		top, err = db.QueryContext(ctx, QUERY_GET_TOP_LINKS_TEMPLATE, query.Top)
+	} else {
+		top, err = db.QueryContext(ctx, QUERY_GET_TOP_LINKS_IN_WINDOW_TEMPLATE, since, until, query.Top)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer top.Close()
+	for top.Next() {
+		var link TopLink
+		err = top.Scan(&link.Alias, &link.Url, &link.Expansions)
+		if err != nil {
+			return nil, err
+		}
+		response.TopLinks = append(response.TopLinks, link)
+	}
+	return response, top.Err()
+}
+
+/*
+Gets the number of expansions of an alias on each of the last few days
+(in UTC, ending today), counted from the click history. Days without
+expansions are included with a count of 0, so the result is ready to be
+charted.
+
+Parameters:
+
+	s: Pointer to Server whose database we query
+	ctx: Context of the request the counts are for
+	alias: The alias whose expansions are counted
+	days: Number of days to count
+
+Returns:
+
+	The counts, oldest day first, and if the query failed, an error.
+*/
+func GetDailyClicks(s *Server, ctx context.Context, alias string, days int) ([]DailyCount, error) {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	first := today.AddDate(0, 0, 1-days)
+
+	counts := make(map[string]int)
+	err := RunQuery(s, ctx, func(ctx context.Context) error {
+		rows, err := s.db.QueryContext(ctx, QUERY_GET_DAILY_CLICKS_BY_ALIAS_TEMPLATE, alias, first.Unix())
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var day string
+			var count int
+			err = rows.Scan(&day, &count)
+			if err != nil {
+				return err
+			}
+			counts[day] = count
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	daily := make([]DailyCount, days)
+	for i := range daily {
+		day := first.AddDate(0, 0, i).Format(time.DateOnly)
+		daily[i] = DailyCount{Day: day, Count: counts[day]}
+	}
+	return daily, nil
+}
+
+/*
+Handles analytics requests that don't name an alias, i.e. on
+/urlshortener/analytics.
+
+Parameters:
+
+	s: Pointer to HTTP server whose links are analyzed
+	request: Pointer to struct that represents contents of HTTP
+		request
+	w: Where we write response for user
+*/
+func SummaryAnalytics(s *Server, w http.ResponseWriter, r *http.Request) {
+	// Only GET requests are allowed on the analytics endpoint
+	if r.Method != http.MethodGet {
+		ReportInvalidMethodError(w, r, r.Method)
+		return
+	}
+
+	query, err_msg := ParseSummaryQuery(r)
+	if err_msg != "" {
+		ReportBadRequestError(w, r, r.URL.RawQuery, err_msg)
+		return
+	}
+
+	response, err := GetSummaryAnalytics(s, r.Context(), query)
+	if err != nil {
+		ReportUnexpectedInternalServerError(w, r, err)
+		return
+	}
+	RespondAsJSON(w, response)
+}
+
+/*
+Gets the breakdown of an alias's expansions by device, browser and
+operating system, counted from the click history.
+
+Parameters:
+
+	s: Pointer to Server whose database we query
+	ctx: Context of the request the breakdown is for
+	alias: The alias whose expansions are counted
+	since: Start of the window, nil if open
+	until: End of the window, nil if open
+
+Returns:
+
+	The breakdown and, if a query failed, an error. If the alias is not
+	mapped, the error is sql.ErrNoRows.
+*/
+func GetAnalyticsBreakdown(s *Server, ctx context.Context, alias string, since *int64, until *int64) (*AnalyticsBreakdownResponse, error) {
+	start, end := WindowBounds(since, until)
+	var response *AnalyticsBreakdownResponse
+	err := RunQuery(s, ctx, func(ctx context.Context) error {
+		response = &AnalyticsBreakdownResponse{Alias: alias}
+		err := s.db.QueryRowContext(ctx, QUERY_GET_URL_BY_ALIAS_TEMPLATE, alias).Scan(&response.Url)
+		if err != nil {
+			return err
+		}
+
+		lists := []*[]BreakdownCount{&response.Devices, &response.Browsers, &response.OperatingSystems}
+		for i, column := range BREAKDOWN_COLUMNS {
+			*lists[i] = []BreakdownCount{}
+			rows, err := s.db.QueryContext(ctx, fmt.Sprintf(QUERY_GET_CLICK_BREAKDOWN_TEMPLATE, column), alias, start, end)
+			if err != nil {
+				return err
+			}
+			for rows.Next() {
+				var count BreakdownCount
+				err = rows.Scan(&count.Name, &count.Expansions)
+				if err != nil {
+					rows.Close()
+					return err
+				}
+				*lists[i] = append(*lists[i], count)
+			}
+			rows.Close()
+			err = rows.Err()
+			if err != nil {
+				return err
+			}
+		}
+
+		// Every click is counted once in each list
+		for _, count := range response.Devices {
+			response.Expansions += count.Expansions
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+/*
+Handles requests for an alias's analytics breakdown, i.e. on
+/urlshortener/analytics/<alias>/breakdown (see Analytics( ) in server.go).
+
+Parameters:
+
+	s: Pointer to HTTP server whose click history is read
+	request: Pointer to struct that represents contents of HTTP
+		request
+	w: Where we write response for user
+	alias: The alias whose expansions are broken down
+*/
+func AnalyticsBreakdown(s *Server, w http.ResponseWriter, r *http.Request, alias string) {
+	since, until, err_msg := ParseTimeWindow(r)
+	if err_msg != "" {
+		ReportBadRequestError(w, r, r.URL.RawQuery, err_msg)
+		return
+	}
+
+	response, err := GetAnalyticsBreakdown(s, r.Context(), alias, since, until)
+	if err == sql.ErrNoRows {
+		ReportBadRequestError(w, r, "No mapping exists for alias", fmt.Sprintf("Cannot get analytics for %s, not mapped", alias))
+		return
+	} else if err != nil {
+		ReportUnexpectedInternalServerError(w, r, err)
+		return
+	}
+	RequestLogger(r).Info("Reported analytics breakdown", "alias", alias, "expansions", response.Expansions)
+	RespondAsJSON(w, response)
+}
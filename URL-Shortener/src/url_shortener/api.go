@@ -14,15 +14,167 @@ and forth to clients.
 
 package url_shortener
 
+import "encoding/json"
+
 // Endpoint for shorten operation (map URL <-> alias)
 const SHORTEN_ENDPOINT = "/urlshortener/shorten"
 
 // Endpoint for expand operation (get URL from alias)
 const EXPAND_ENDPOINT = "/urlshortener/expand/"
 
+/*
+Endpoint for redirecting a browser to the URL of an alias. This is what
+short URLs point to. Password protected links show a form here, which
+is posted back to the same endpoint.
+*/
+const REDIRECT_ENDPOINT = "/urlshortener/r/"
+
+/*
+Endpoint for trying out the routing rules of an alias (see routing.go),
+e.g. /urlshortener/route/google. It shows which rule the request's own
+headers would match without counting an expansion. The optional query
+parameter at gives the time to route at (RFC 3339 or a date, default now).
+*/
+const ROUTE_ENDPOINT = "/urlshortener/route/"
+
 // Endpoint for analytics operation (get # expansions for alias)
 const ANALYTICS_ENDPOINT = "/urlshortener/analytics/"
 
+/*
+Suffix of the analytics/ path that breaks an alias's expansions down by
+device, browser and operating system (see analytics.go), e.g.
+/urlshortener/analytics/google/breakdown. These query parameters are
+supported, both optional:
+
+	since: Only expansions at or after this date or time
+	until: Only expansions before this date or time
+*/
+const ANALYTICS_BREAKDOWN_SUFFIX = "/breakdown"
+
+/*
+Suffix of the analytics/ path that estimates an alias's unique visitors
+per day and over a window (see visitors.go), e.g.
+/urlshortener/analytics/google/visitors. These query parameters are
+supported, both optional:
+
+	since: Only days on or after the day of this date or time
+	until: Only days before this date or time (the day it falls in is
+		included unless it is midnight)
+*/
+const ANALYTICS_VISITORS_SUFFIX = "/visitors"
+
+/*
+Endpoint for analytics across all links (see analytics.go). These query
+parameters are supported, all of them optional:
+
+	top: Number of top links by expansions to report (default 10, at most 100)
+	since: Only count from this date or time
+	until: Only count until (before) this date or time
+
+since and until limit the links created per day and the top links, which
+are then ranked by their expansions within the window.
+*/
+const ANALYTICS_SUMMARY_ENDPOINT = "/urlshortener/analytics"
+
+/*
+Endpoint for QR code images of an alias's short URL. The alias is followed
+by the image format, e.g. /urlshortener/qr/google.png or .svg. These
+query parameters are supported:
+
+	size: Width (and height) of the image in pixels (default 256)
+	ec: Error correction level, one of L, M, Q, H (default M)
+	margin: Width of the light border in modules (default 4)
+*/
+const QR_ENDPOINT = "/urlshortener/qr/"
+
+/*
+Endpoint for listing links a page at a time (see links.go). These query
+parameters are supported, all of them optional:
+
+	alias_prefix: Only links whose alias starts with this
+	url_contains: Only links whose URL contains this
+	automatic: true for only automatic aliases, false for only custom ones
+	created_after: Only links created at or after this date or time
+	created_before: Only links created before this date or time
+	tag: Only links with this tag (repeat for links with every one of them)
+	campaign: Only links in this campaign
+	sort: One of alias, created, expansions (default created)
+	order: asc or desc (default asc)
+	limit: Number of links in a page (default 50, at most 500)
+	cursor: The next_cursor of the previous page
+*/
+const LINKS_ENDPOINT = "/urlshortener/links"
+
+/*
+Endpoint for analytics across the links of a campaign (see campaigns.go),
+e.g. /urlshortener/campaigns/spring-sale. It takes the same query
+parameters as ANALYTICS_SUMMARY_ENDPOINT: since and until limit the
+expansions per day and the top links.
+*/
+const CAMPAIGNS_ENDPOINT = "/urlshortener/campaigns/"
+
+/*
+Endpoint for changing the tags and campaign of a link (see campaigns.go),
+e.g. /urlshortener/labels/123. Like the admin dashboard, it requires the
+admin credentials. A PUT (with a LabelsRequest body) replaces the link's
+tags and campaign.
+*/
+const LABELS_ENDPOINT = "/urlshortener/labels/"
+
+/*
+Root of the admin dashboard (see admin.go). Unlike the other endpoints,
+it serves HTML pages for a browser and requires the admin credentials.
+*/
+const ADMIN_ENDPOINT = "/urlshortener/admin/"
+
+/*
+Endpoint for reading the audit log (see audit.go). Like the admin
+dashboard, it requires the admin credentials. These query parameters are
+supported, all of them optional:
+
+	alias: Only entries about this alias
+	actor: Only entries made by this actor (api or an admin username)
+	action: Only entries of this action (create, update, disable, enable, delete)
+	since: Only entries made at or after this date or time
+	until: Only entries made before this date or time
+	limit: Number of entries in a page (default 100, at most 1000)
+	cursor: The next_cursor of the previous page
+	format: jsonl to export every matching entry as JSON lines instead
+*/
+const AUDIT_ENDPOINT = "/urlshortener/audit"
+
+/*
+Endpoint for database backups (see backup.go). Like the admin dashboard,
+it requires the admin credentials. A GET lists the backups, a POST takes
+a new one.
+*/
+const BACKUPS_ENDPOINT = "/urlshortener/backups"
+
+/*
+Endpoint for webhooks (see webhooks.go). Like the admin dashboard, it
+requires the admin credentials. A GET lists the webhooks, a POST (with a
+WebhookRequest body) subscribes a new one. Below it:
+
+	/urlshortener/webhooks/{id}: a DELETE removes the webhook
+	/urlshortener/webhooks/{id}/deliveries: a GET pages through the
+		webhook's delivery history, oldest first
+
+These query parameters of the delivery history are supported, all of
+them optional:
+
+	status: Only deliveries with this status (pending, delivered, failed)
+	limit: Number of deliveries in a page (default 100, at most 1000)
+	cursor: The next_cursor of the previous page
+*/
+const WEBHOOKS_ENDPOINT = "/urlshortener/webhooks"
+
+/*
+Endpoints for liveness and readiness checks (see health.go). They sit
+outside /urlshortener as orchestrators expect these paths.
+*/
+const HEALTHZ_ENDPOINT = "/healthz"
+const READYZ_ENDPOINT = "/readyz"
+
 /*
 Specifies the JSON structure for body of an HTTP request to
 shorten/ endpoint. A user must provide a URL to shorten and
@@ -46,10 +198,97 @@ the JSON is missing the particular key, the zero value
 is substituted into the struct's field. In our application,
 if the alias is not provided, it is set to the empty string
 signally an alias must be automatically assigned.
+
+The AllowDuplicateUrl field lets a single request create another alias
+for a URL that has already been shortened (e.g. so each channel of a
+campaign gets its own alias). It defaults to false, in which case the
+server-wide allow_duplicate_urls setting decides (see config.go).
+
+The Password field protects the link. Once set, expanding the alias
+requires the password, see passwords.go. Only a salted hash of it is
+stored.
+
+The MaxExpansions field caps how many times the alias can be expanded,
+e.g. 1 makes a one-time link. Once reached, the alias still exists (and
+its analytics can be viewed) but it no longer expands. It defaults to 0,
+meaning no cap.
+
+The Destinations field makes a split link for A/B experiments: visitors
+are shared between the destinations by weight, each visitor keeping its
+destination (see split.go). Url may then be left out, in which case it is
+the first destination's URL.
+
+The QueryPassthrough field says what happens to the query parameters the
+link is visited with: off (the default) drops them, merge adds them to the
+URL unless it already has the key, override adds them replacing the URL's
+values. The UTMDefaults field holds UTM parameters (e.g. utm_source) added
+to the URL unless it or the visit already has them. See query_params.go.
+
+The Tags and Campaign fields label the link, so links can be listed by tag
+and analyzed by campaign (see campaigns.go). A link has any number of tags
+but is in at most one campaign.
+
+The RoutingRules field sends visitors matching a rule (by device, language
+or time of day) to the rule's URL instead, the first matching rule winning
+(see routing.go).
 */
 type ShortenRequest struct {
-	Url   string `json:"url"`
-	Alias string `json:"alias,omitempty"`
+	Url               string            `json:"url"`
+	Alias             string            `json:"alias,omitempty"`
+	AllowDuplicateUrl bool              `json:"allow_duplicate_url,omitempty"`
+	Password          string            `json:"password,omitempty"`
+	MaxExpansions     int               `json:"max_expansions,omitempty"`
+	QueryPassthrough  string            `json:"query_passthrough,omitempty"`
+	UTMDefaults       map[string]string `json:"utm_defaults,omitempty"`
+	Destinations      []Destination     `json:"destinations,omitempty"`
+	RoutingRules      []RoutingRule     `json:"routing_rules,omitempty"`
+	Tags              []string          `json:"tags,omitempty"`
+	Campaign          string            `json:"campaign,omitempty"`
+}
+
+/*
+Specifies the JSON structure of a routing rule. A rule matches a visit
+when every condition it has holds, a rule without conditions matching
+every visit. Within a condition, any of the listed values may match:
+
+  - Devices, Browsers and OS hold names of the User-Agent rules (see
+    user_agents.go), e.g. Mobile, Safari or iOS.
+  - Languages hold language tags matched against the visitor's preferred
+    language (Accept-Language). A tag also matches its subtags, e.g. de
+    matches de-AT.
+  - Days (mon to sun) and Hours hold when the rule applies, in Timezone
+    (an IANA time zone, UTC if left out).
+*/
+type RoutingRule struct {
+	Name      string        `json:"name,omitempty"`
+	Url       string        `json:"url"`
+	Devices   []string      `json:"devices,omitempty"`
+	Browsers  []string      `json:"browsers,omitempty"`
+	OS        []string      `json:"os,omitempty"`
+	Languages []string      `json:"languages,omitempty"`
+	Days      []string      `json:"days,omitempty"`
+	Hours     *RoutingHours `json:"hours,omitempty"`
+	Timezone  string        `json:"timezone,omitempty"`
+}
+
+/*
+Specifies the JSON structure of the hours of a routing rule, as HH:MM. From
+is included and Until is not. If Until is earlier than From, the hours run
+past midnight (e.g. 18:00 until 09:00).
+*/
+type RoutingHours struct {
+	From  string `json:"from"`
+	Until string `json:"until"`
+}
+
+/*
+Specifies the JSON structure of a destination of a split link. The name
+identifies the variant in analytics and in the visitor's cookie.
+*/
+type Destination struct {
+	Name   string `json:"name"`
+	Url    string `json:"url"`
+	Weight int    `json:"weight"`
 }
 
 /*
@@ -70,15 +309,330 @@ that corresponds to the expansion.
 type ExpandResponse struct {
 	Url   string `json:"url"`
 	Alias string `json:"alias"`
+
+	// Name of the destination a split link sent the user to
+	Variant string `json:"variant,omitempty"`
 }
 
 /*
 Specifies the JSON structure for body of an HTTP response from
 analytics/ endpoint. A user will receive the URL <-> alias
-mapping and the number of times it was expanded.
+mapping and the number of times it was expanded by people and by
+bots (along with the maximum number of expansions if the link has
+one).
 */
 type AnalyticsResponse struct {
-	Url        string `json:"url"`
+	Url           string `json:"url"`
+	Alias         string `json:"alias"`
+	Expansions    int    `json:"expansions"`
+	BotExpansions int    `json:"bot_expansions"`
+
+	/*
+		Cap on the number of expansions. This is a pointer so that links
+		without a cap (nil) leave the key out of the JSON entirely.
+	*/
+	MaxExpansions *int `json:"max_expansions,omitempty"`
+
+	// Estimate of the different visitors of all time (see visitors.go)
+	UniqueVisitors int `json:"unique_visitors"`
+
+	// Expansions of each destination of a split link (see split.go)
+	Variants []VariantAnalytics `json:"variants,omitempty"`
+}
+
+// Specifies the JSON structure of the expansions of a split link's destination
+type VariantAnalytics struct {
+	Destination
+	Expansions int `json:"expansions"`
+}
+
+/*
+Specifies the JSON structure for body of an HTTP response from the
+visitors suffix of the analytics/ endpoint. A user will receive the
+unique visitors of each day in the window that had any, and of the whole
+window (a visitor returning on several days is counted once).
+*/
+type AnalyticsVisitorsResponse struct {
+	Url            string       `json:"url"`
+	Alias          string       `json:"alias"`
+	UniqueVisitors int          `json:"unique_visitors"`
+	Days           []DailyCount `json:"days"`
+}
+
+// Specifies the JSON structure of the expansions counted under one name
+type BreakdownCount struct {
+	Name       string `json:"name"`
+	Expansions int    `json:"expansions"`
+}
+
+/*
+Specifies the JSON structure for body of an HTTP response from an
+alias's analytics breakdown. Expansions is the number of expansions in
+the click history (within the window, if one was given), and each list
+splits them up, most expansions first.
+*/
+type AnalyticsBreakdownResponse struct {
+	Url              string           `json:"url"`
+	Alias            string           `json:"alias"`
+	Expansions       int              `json:"expansions"`
+	Devices          []BreakdownCount `json:"devices"`
+	Browsers         []BreakdownCount `json:"browsers"`
+	OperatingSystems []BreakdownCount `json:"operating_systems"`
+}
+
+/*
+Specifies the JSON structure of a link in a response from the links
+endpoint. Created is an RFC 3339 time, left out for links made before
+creation times were recorded.
+*/
+type LinkSummary struct {
+	Url           string   `json:"url"`
+	Alias         string   `json:"alias"`
+	Expansions    int      `json:"expansions"`
+	Automatic     bool     `json:"automatic"`
+	Created       string   `json:"created,omitempty"`
+	MaxExpansions *int     `json:"max_expansions,omitempty"`
+	Protected     bool     `json:"protected"`
+	Disabled      bool     `json:"disabled"`
+	Tags          []string `json:"tags,omitempty"`
+	Campaign      string   `json:"campaign,omitempty"`
+}
+
+/*
+Specifies the JSON structure for body of an HTTP response from the links
+endpoint. A user will receive a page of links and, if there are more
+links, a cursor to pass back to get the next page.
+*/
+type LinksPage struct {
+	Links      []LinkSummary `json:"links"`
+	NextCursor string        `json:"next_cursor,omitempty"`
+}
+
+// Specifies the JSON structure of a day and a count for that day
+type DailyCount struct {
+	Day   string `json:"day"`
+	Count int    `json:"count"`
+}
+
+/*
+Specifies the JSON structure of a link among the most expanded links.
+Expansions are the link's expansions within the requested window (all
+time if there is none).
+*/
+type TopLink struct {
 	Alias      string `json:"alias"`
+	Url        string `json:"url"`
 	Expansions int    `json:"expansions"`
 }
+
+/*
+Specifies the JSON structure for body of an HTTP request on the labels
+endpoint. The link's tags and campaign are replaced by these, so leaving
+one out removes it.
+*/
+type LabelsRequest struct {
+	Tags     []string `json:"tags"`
+	Campaign string   `json:"campaign"`
+}
+
+/*
+Specifies the JSON structure for body of an HTTP response from the
+campaigns endpoint. A user will receive the number of links in the
+campaign with their expansions and unique visitors of all time (a visitor
+of several links counted once), along with the expansions per day and the
+most expanded links.
+*/
+type CampaignAnalyticsResponse struct {
+	Campaign         string       `json:"campaign"`
+	Links            int          `json:"links"`
+	Expansions       int          `json:"expansions"`
+	BotExpansions    int          `json:"bot_expansions"`
+	UniqueVisitors   int          `json:"unique_visitors"`
+	ExpansionsPerDay []DailyCount `json:"expansions_per_day"`
+	TopLinks         []TopLink    `json:"top_links"`
+}
+
+/*
+Specifies the JSON structure for body of an HTTP response from the
+analytics endpoint when no alias is given. A user will receive the
+number of links and expansions of all time, along with the links created
+per day and the most expanded links.
+*/
+type SummaryAnalyticsResponse struct {
+	Links          int          `json:"links"`
+	AutomaticLinks int          `json:"automatic_links"`
+	CustomLinks    int          `json:"custom_links"`
+	Expansions     int          `json:"expansions"`
+	BotExpansions  int          `json:"bot_expansions"`
+	CreatedPerDay  []DailyCount `json:"created_per_day"`
+	TopLinks       []TopLink    `json:"top_links"`
+}
+
+/*
+Specifies the JSON structure for body of an HTTP response from route/
+endpoint. It shows what the request was sorted into and where it would be
+sent. Rule is the position of the matching rule (counting from 1) and is
+left out if no rule matches, in which case the URL is the link's own (or,
+for a split link, the destination the request would get).
+*/
+type RouteResponse struct {
+	Url      string `json:"url"`
+	Alias    string `json:"alias"`
+	Rule     int    `json:"rule,omitempty"`
+	RuleName string `json:"rule_name,omitempty"`
+	Variant  string `json:"variant,omitempty"`
+	Device   string `json:"device"`
+	Browser  string `json:"browser"`
+	OS       string `json:"os"`
+	Language string `json:"language"`
+	Time     string `json:"time"`
+}
+
+/*
+Specifies the JSON structure of a link's state in the audit log. Only
+whether the link has a password is recorded, not its hash. The query
+parameter settings are left out while they are off.
+*/
+type LinkState struct {
+	Url              string          `json:"url"`
+	Alias            string          `json:"alias"`
+	Automatic        bool            `json:"automatic"`
+	MaxExpansions    *int            `json:"max_expansions,omitempty"`
+	Protected        bool            `json:"protected"`
+	Disabled         bool            `json:"disabled"`
+	QueryPassthrough string          `json:"query_passthrough,omitempty"`
+	UTMDefaults      json.RawMessage `json:"utm_defaults,omitempty"`
+	RoutingRules     json.RawMessage `json:"routing_rules,omitempty"`
+	Destinations     []Destination   `json:"destinations,omitempty"`
+	Tags             []string        `json:"tags,omitempty"`
+	Campaign         string          `json:"campaign,omitempty"`
+}
+
+/*
+Specifies the JSON structure of an entry in the audit log. Before and
+After hold a LinkState as stored, and are null when there is no state
+(before a create, after a delete).
+*/
+type AuditEntry struct {
+	ID     int64           `json:"id"`
+	Time   string          `json:"time"`
+	Action string          `json:"action"`
+	Alias  string          `json:"alias"`
+	Actor  string          `json:"actor"`
+	IP     string          `json:"ip"`
+	Before json.RawMessage `json:"before"`
+	After  json.RawMessage `json:"after"`
+}
+
+/*
+Specifies the JSON structure for body of an HTTP response from the audit
+endpoint. A user will receive a page of entries (oldest first) and, if
+there are more entries, a cursor to pass back to get the next page.
+*/
+type AuditPage struct {
+	Entries    []AuditEntry `json:"entries"`
+	NextCursor string       `json:"next_cursor,omitempty"`
+}
+
+/*
+Specifies the JSON structure of a database backup, both in the list of
+backups and in the response to taking one. File is the name of the
+backup within the backup folder.
+*/
+type BackupInfo struct {
+	File    string `json:"file"`
+	Size    int64  `json:"size"`
+	Created string `json:"created"`
+}
+
+// Specifies the JSON structure for body of an HTTP response from /healthz
+type HealthResponse struct {
+	Status string `json:"status"`
+}
+
+/*
+Specifies the JSON structure of one readiness check. Status is ok,
+failed or unknown, and Detail says why when it isn't ok. FreeBytes is
+only included in the disk check.
+*/
+type HealthCheck struct {
+	Name      string  `json:"name"`
+	Status    string  `json:"status"`
+	Detail    string  `json:"detail,omitempty"`
+	FreeBytes *uint64 `json:"free_bytes,omitempty"`
+}
+
+/*
+Specifies the JSON structure for body of an HTTP response from /readyz.
+Status is ok if the server is ready, failed otherwise.
+*/
+type ReadinessResponse struct {
+	Status string        `json:"status"`
+	Checks []HealthCheck `json:"checks"`
+}
+
+/*
+Specifies the JSON structure for body of an HTTP request subscribing a
+webhook. Events lists the events to send (link.created, link.expanded,
+link.milestone, link.expired). If no secret is given, one is made.
+*/
+type WebhookRequest struct {
+	Url    string   `json:"url"`
+	Events []string `json:"events"`
+	Secret string   `json:"secret"`
+}
+
+/*
+Specifies the JSON structure of a webhook. The secret is only included
+in the response to subscribing it.
+*/
+type WebhookInfo struct {
+	ID      int64    `json:"id"`
+	Url     string   `json:"url"`
+	Events  []string `json:"events"`
+	Secret  string   `json:"secret,omitempty"`
+	Created string   `json:"created"`
+}
+
+/*
+Specifies the JSON structure of the payload sent to a webhook. Expansions
+is the link's number of expansions once the event happened (for
+link.milestone, the milestone reached).
+*/
+type WebhookEvent struct {
+	Event         string `json:"event"`
+	Time          string `json:"time"`
+	Alias         string `json:"alias"`
+	Url           string `json:"url"`
+	Expansions    int    `json:"expansions"`
+	MaxExpansions *int   `json:"max_expansions,omitempty"`
+}
+
+/*
+Specifies the JSON structure of a delivery in a webhook's delivery
+history. Payload holds the WebhookEvent sent. NextAttempt is only
+included while the delivery is pending, and ResponseStatus and Error
+describe the last attempt.
+*/
+type WebhookDelivery struct {
+	ID             int64           `json:"id"`
+	WebhookID      int64           `json:"webhook_id"`
+	Event          string          `json:"event"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	NextAttempt    string          `json:"next_attempt,omitempty"`
+	LastAttempt    string          `json:"last_attempt,omitempty"`
+	ResponseStatus *int            `json:"response_status,omitempty"`
+	Error          string          `json:"error,omitempty"`
+	Created        string          `json:"created"`
+	Payload        json.RawMessage `json:"payload"`
+}
+
+/*
+Specifies the JSON structure for body of an HTTP response from a
+webhook's delivery history, paged like the audit log.
+*/
+type WebhookDeliveriesPage struct {
+	Deliveries []WebhookDelivery `json:"deliveries"`
+	NextCursor string            `json:"next_cursor,omitempty"`
+}
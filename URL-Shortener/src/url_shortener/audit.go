@@ -0,0 +1,434 @@
+/*
+Package url_shortener serves as a library of utilities for the URL-Shortener
+application. This includes the definition of our API, database configuration,
+and HTTP server implementation. This is used by the main package to instantiate
+and run a server easily. This library could be used in other applications
+that do more than just initializing and booting a server.
+
+This file provides the audit log: a record of who created or changed each
+link, when, from where, and what the link looked like before and after.
+Entries are written in the same transaction as the change they describe,
+so a change is never made without its entry (or the other way around).
+The audit_log table is append-only, triggers in its migration refuse any
+UPDATE or DELETE on it.
+*/
+
+package url_shortener
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Actions recorded in the audit log
+const AUDIT_ACTION_CREATE = "create"
+const AUDIT_ACTION_UPDATE = "update"
+const AUDIT_ACTION_DISABLE = "disable"
+const AUDIT_ACTION_ENABLE = "enable"
+const AUDIT_ACTION_DELETE = "delete"
+
+/*
+Name recorded as the actor of changes made through the JSON API. The API
+has no accounts, so only the IP address tells these clients apart.
+*/
+const API_ACTOR = "api"
+
+// Number of audit entries in a page when the request does not give a limit
+const AUDIT_DEFAULT_LIMIT = 100
+
+// Largest number of audit entries a request may ask for in one page
+const AUDIT_MAX_LIMIT = 1000
+
+// Value of the format query parameter that exports entries as JSON lines
+const AUDIT_FORMAT_JSONL = "jsonl"
+
+// Query template to get the state of a link that the audit log records
+const QUERY_GET_LINK_STATE_TEMPLATE = `
+SELECT URL, Automatic, MaxExpansions, PasswordHash IS NOT NULL, Disabled, NULLIF(QueryPassthrough, 'off'), UTMDefaults, RoutingRules, Campaign
+FROM aliases
+WHERE Alias = ?
+`
+
+// Query template to append an entry to the audit log
+const QUERY_INSERT_AUDIT_ENTRY_TEMPLATE = `
+INSERT INTO audit_log (Time, Action, Alias, Actor, IP, Before, After)
+VALUES (?, ?, ?, ?, ?, ?, ?)
+`
+
+// Represents who made a change: a name and the IP address they came from
+type Actor struct {
+	Name string
+	IP   string
+}
+
+/*
+Makes the actor of a change from the request that asked for it.
+
+Parameters:
+
+	r: The request making the change
+	name: Who made the request (e.g. API_ACTOR or the admin's username)
+*/
+func NewActor(r *http.Request, name string) *Actor {
+	return &Actor{Name: name, IP: ClientIP(r)}
+}
+
+/*
+Gets the state of a link, as recorded in the audit log, from within a
+transaction so that it is consistent with the change being made.
+
+Parameters:
+
+	ctx: Context of the transaction
+	tx: The transaction making the change
+	alias: The alias of the link
+
+Returns:
+
+	The state and, if the query failed, an error. If the alias is not
+	mapped, the error is sql.ErrNoRows.
+*/
+func GetLinkState(ctx context.Context, tx *sql.Tx, alias string) (*LinkState, error) {
+	state := &LinkState{Alias: alias}
+	var max_expansions sql.NullInt64
+	var passthrough, utm_defaults, routing_rules, campaign sql.NullString
+	err := tx.QueryRowContext(ctx, QUERY_GET_LINK_STATE_TEMPLATE, alias).Scan(&state.Url, &state.Automatic, &max_expansions, &state.Protected, &state.Disabled, &passthrough, &utm_defaults, &routing_rules, &campaign)
+	if err != nil {
+		return nil, err
+	}
+	state.QueryPassthrough = passthrough.String
+	state.Campaign = campaign.String
+	if utm_defaults.Valid {
+		state.UTMDefaults = json.RawMessage(utm_defaults.String)
+	}
+	if routing_rules.Valid {
+		state.RoutingRules = json.RawMessage(routing_rules.String)
+	}
+	if max_expansions.Valid {
+		limit := int(max_expansions.Int64)
+		state.MaxExpansions = &limit
+	}
+	destinations, err := GetDestinations(ctx, tx.QueryContext, alias)
+	if err != nil {
+		return nil, err
+	}
+	for _, destination := range destinations {
+		state.Destinations = append(state.Destinations, destination.Destination)
+	}
+	state.Tags, err = GetLinkTags(ctx, tx, alias)
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+/*
+Appends an entry to the audit log. This must be called within the
+transaction making the change, before it is committed.
+
+Parameters:
+
+	ctx: Context of the transaction
+	tx: The transaction making the change
+	action: One of the AUDIT_ACTION constants
+	alias: The alias of the changed link
+	actor: Who made the change
+	before: The link's state before the change (nil if it was created)
+	after: The link's state after the change (nil if it was deleted)
+
+Returns:
+
+	If the entry could not be written, an error, otherwise nil.
+*/
+func RecordAudit(ctx context.Context, tx *sql.Tx, action string, alias string, actor *Actor, before *LinkState, after *LinkState) error {
+	// A nil state is stored as NULL rather than the JSON null
+	encode := func(state *LinkState) (sql.NullString, error) {
+		if state == nil {
+			return sql.NullString{}, nil
+		}
+		contents, err := json.Marshal(state)
+		return sql.NullString{String: string(contents), Valid: true}, err
+	}
+	before_json, err := encode(before)
+	if err != nil {
+		return err
+	}
+	after_json, err := encode(after)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, QUERY_INSERT_AUDIT_ENTRY_TEMPLATE, time.Now().Unix(), action, alias, actor.Name, actor.IP, before_json, after_json)
+	return err
+}
+
+/*
+Represents the filters and page of an audit request, parsed from its
+query parameters.
+*/
+type AuditQuery struct {
+	Alias  string
+	Actor  string
+	Action string
+	Since  *int64
+	Until  *int64
+	Limit  int
+
+	// ID of the last entry of the previous page, 0 to start from the first
+	After int64
+
+	// Whether to export every matching entry as JSON lines instead of a page
+	Export bool
+}
+
+/*
+Parses the query parameters of an audit request, see AUDIT_ENDPOINT for
+the parameters.
+
+Parameters:
+
+	r: The audit request
+
+Returns:
+
+	The parsed query and a message for the user if a parameter is invalid
+	(empty if they are all valid).
+*/
+func ParseAuditQuery(r *http.Request) (*AuditQuery, string) {
+	params := r.URL.Query()
+	query := &AuditQuery{
+		Alias:  params.Get("alias"),
+		Actor:  params.Get("actor"),
+		Action: params.Get("action"),
+		Limit:  AUDIT_DEFAULT_LIMIT,
+	}
+
+	if params.Has("since") {
+		since, err := ParseTimeParameter(params.Get("since"))
+		if err != nil {
+			return nil, "since must be a date (YYYY-MM-DD) or RFC 3339 time"
+		}
+		query.Since = &since
+	}
+	if params.Has("until") {
+		until, err := ParseTimeParameter(params.Get("until"))
+		if err != nil {
+			return nil, "until must be a date (YYYY-MM-DD) or RFC 3339 time"
+		}
+		query.Until = &until
+	}
+	if params.Has("limit") {
+		limit, err := strconv.Atoi(params.Get("limit"))
+		if err != nil || limit < 1 || limit > AUDIT_MAX_LIMIT {
+			return nil, fmt.Sprintf("limit must be an integer between 1 and %d", AUDIT_MAX_LIMIT)
+		}
+		query.Limit = limit
+	}
+	if params.Has("cursor") {
+		after, err := strconv.ParseInt(params.Get("cursor"), 10, 64)
+		if err != nil || after < 0 {
+			return nil, "cursor is not valid"
+		}
+		query.After = after
+	}
+	if params.Has("format") {
+		if params.Get("format") != AUDIT_FORMAT_JSONL {
+			return nil, "format must be jsonl"
+		}
+		query.Export = true
+	}
+	return query, ""
+}
+
+/*
+Builds the SQL for an audit request. Like BuildLinksQuery( ), only fixed
+pieces of SQL are put into the query text. Entries are always in the
+order they were written (oldest first).
+
+Parameters:
+
+	query: The parsed audit request
+	limit: Whether to limit the entries to a page (plus one to tell
+		whether there is another page)
+
+Returns:
+
+	The query and its arguments.
+*/
+func BuildAuditQuery(query *AuditQuery, limit bool) (string, []any) {
+	conditions := []string{"ID > ?"}
+	args := []any{query.After}
+
+	if query.Alias != "" {
+		conditions = append(conditions, "Alias = ?")
+		args = append(args, query.Alias)
+	}
+	if query.Actor != "" {
+		conditions = append(conditions, "Actor = ?")
+		args = append(args, query.Actor)
+	}
+	if query.Action != "" {
+		conditions = append(conditions, "Action = ?")
+		args = append(args, query.Action)
+	}
+	if query.Since != nil {
+		conditions = append(conditions, "Time >= ?")
+		args = append(args, *query.Since)
+	}
+	if query.Until != nil {
+		conditions = append(conditions, "Time < ?")
+		args = append(args, *query.Until)
+	}
+
+	sql_query := "SELECT ID, Time, Action, Alias, Actor, IP, Before, After FROM audit_log WHERE " + strings.Join(conditions, " AND ") + " ORDER BY ID"
+	if limit {
+		sql_query += " LIMIT ?"
+		args = append(args, query.Limit+1)
+	}
+	return sql_query, args
+}
+
+/*
+Runs an audit query and calls a function with each entry it finds, so
+entries can be streamed (e.g. to an export) rather than held in memory.
+
+Parameters:
+
+	ctx: Context the query runs in, cancelling it stops the query
+	db: Connection to the database holding the audit log
+	query: The parsed audit request
+	limit: See BuildAuditQuery( )
+	visit: Called with each entry in order, an error stops the query
+
+Returns:
+
+	If the query failed or visit returned an error, that error, otherwise
+	nil.
+*/
+func VisitAuditEntries(ctx context.Context, db *sql.DB, query *AuditQuery, limit bool, visit func(AuditEntry) error) error {
+	sql_query, args := BuildAuditQuery(query, limit)
+	rows, err := db.QueryContext(ctx, sql_query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var entry AuditEntry
+		var unix_time int64
+		var before, after sql.NullString
+		err = rows.Scan(&entry.ID, &unix_time, &entry.Action, &entry.Alias, &entry.Actor, &entry.IP, &before, &after)
+		if err != nil {
+			return err
+		}
+		entry.Time = time.Unix(unix_time, 0).UTC().Format(time.RFC3339)
+		if before.Valid {
+			entry.Before = json.RawMessage(before.String)
+		}
+		if after.Valid {
+			entry.After = json.RawMessage(after.String)
+		}
+		err = visit(entry)
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+/*
+Writes every entry matching an audit query as JSON lines (one JSON object
+per line), which is how the audit log is exported.
+
+Parameters:
+
+	ctx: Context the export runs in, cancelling it stops the export
+	db: Connection to the database holding the audit log
+	query: The parsed audit request (its limit is ignored)
+	w: Where the entries are written
+
+Returns:
+
+	If the query or a write failed, an error, otherwise nil.
+*/
+func ExportAuditLog(ctx context.Context, db *sql.DB, query *AuditQuery, w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	return VisitAuditEntries(ctx, db, query, false, func(entry AuditEntry) error {
+		// Encode( ) ends each entry with a newline, as JSON lines expects
+		return encoder.Encode(entry)
+	})
+}
+
+/*
+Handles requests on the /audit endpoint. The audit log holds IP addresses,
+so it requires the admin credentials like the admin dashboard does.
+
+Parameters:
+
+	s: Pointer to HTTP server whose audit log is read
+	request: Pointer to struct that represents contents of HTTP
+		request
+	w: Where we write response for user
+*/
+func Audit(s *Server, w http.ResponseWriter, r *http.Request) {
+	if !CheckAdminCredentials(s, w, r) {
+		return
+	}
+
+	// Only GET requests are allowed on the audit endpoint
+	if r.Method != http.MethodGet {
+		ReportInvalidMethodError(w, r, r.Method)
+		return
+	}
+
+	query, err_msg := ParseAuditQuery(r)
+	if err_msg != "" {
+		ReportBadRequestError(w, r, r.URL.RawQuery, err_msg)
+		return
+	}
+
+	if query.Export {
+		/*
+			Once the first entry is written the status can't be changed, so
+			an error part way through can only be logged. The export is
+			then cut short, which a reader notices by the missing newline
+			or entries.
+		*/
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="audit_log.jsonl"`)
+
+		/*
+			An export can take longer than query_timeout_seconds on a big
+			log, so it only stops if the client goes away.
+		*/
+		err := ExportAuditLog(r.Context(), s.db, query, w)
+		if err != nil {
+			RequestLogger(r).Warn("Audit log export cut short", "error", err)
+		}
+		return
+	}
+
+	var page AuditPage
+	err := RunQuery(s, r.Context(), func(ctx context.Context) error {
+		page = AuditPage{Entries: []AuditEntry{}}
+		return VisitAuditEntries(ctx, s.db, query, true, func(entry AuditEntry) error {
+			page.Entries = append(page.Entries, entry)
+			return nil
+		})
+	})
+	if err != nil {
+		ReportUnexpectedInternalServerError(w, r, err)
+		return
+	}
+	if len(page.Entries) > query.Limit {
+		page.Entries = page.Entries[:query.Limit]
+		page.NextCursor = strconv.FormatInt(page.Entries[query.Limit-1].ID, 10)
+	}
+	RespondAsJSON(w, page)
+}
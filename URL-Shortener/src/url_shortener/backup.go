@@ -0,0 +1,410 @@
+/*
+Package url_shortener serves as a library of utilities for the URL-Shortener
+application. This includes the definition of our API, database configuration,
+and HTTP server implementation. This is used by the main package to instantiate
+and run a server easily. This library could be used in other applications
+that do more than just initializing and booting a server.
+
+This file provides backups of the database and restoring from them.
+Copying DATABASE_FILE while the server is writing to it can produce a
+corrupt copy, so backups are instead taken with SQLite's VACUUM INTO,
+which writes a consistent snapshot from within a read transaction while
+the server keeps running. Backups can be taken from the backups endpoint,
+the backup command or on a schedule (see Config).
+*/
+
+package url_shortener
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Backup file names start with this, followed by when they were taken
+const BACKUP_FILE_PREFIX = "database-"
+
+// Extension of backup files
+const BACKUP_FILE_SUFFIX = ".db"
+
+/*
+Format of the time in backup file names. It has a fixed width, so
+sorting backups by name also sorts them by age.
+*/
+const BACKUP_TIME_FORMAT = "20060102T150405.000000Z"
+
+/*
+Where restore moves the database that is replaced, so a restore can be
+undone by hand. It is overwritten by the next restore.
+*/
+const PRE_RESTORE_FILE = DATABASE_FILE + ".pre-restore"
+
+// Where restore copies a backup to before checking it and swapping it in
+const RESTORE_TEMP_FILE = DATABASE_FILE + ".restore"
+
+// Query template to write a snapshot of the database to a new file
+const QUERY_BACKUP_INTO_TEMPLATE = `VACUUM INTO ?`
+
+// Query to check a database file for corruption, it returns ok if there is none
+const QUERY_INTEGRITY_CHECK = `PRAGMA integrity_check`
+
+// Query template to check whether a database has a table
+const QUERY_HAS_TABLE_TEMPLATE = `
+SELECT EXISTS(SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = ?)
+`
+
+/*
+Takes a backup of a database into a folder, then deletes the oldest
+backups in the folder beyond the retention.
+
+Parameters:
+
+	ctx: Context the backup is taken in, cancelling it stops the backup
+	db: Connection to the database to back up
+	folder: Folder the backup is written to (created if needed)
+	retention: Number of backups to keep, 0 to keep every backup
+
+Returns:
+
+	The new backup and, if it could not be taken, an error. Failing to
+	delete old backups is only logged as the backup itself was taken.
+*/
+func CreateBackup(ctx context.Context, db *sql.DB, folder string, retention int) (*BackupInfo, error) {
+	err := os.MkdirAll(folder, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	// VACUUM INTO refuses to overwrite a file, so names must be unique
+	file_name := BACKUP_FILE_PREFIX + time.Now().UTC().Format(BACKUP_TIME_FORMAT) + BACKUP_FILE_SUFFIX
+	_, err = db.ExecContext(ctx, QUERY_BACKUP_INTO_TEMPLATE, filepath.Join(folder, file_name))
+	if err != nil {
+		return nil, err
+	}
+
+	err = PruneBackups(folder, retention)
+	if err != nil {
+		log.Println(err)
+	}
+	return GetBackupInfo(folder, file_name)
+}
+
+/*
+Describes a backup file, using the time in its name as when it was
+taken.
+
+Parameters:
+
+	folder: Folder holding the backup
+	file_name: Name of the backup within the folder
+
+Returns:
+
+	The backup's description and, if the file is missing or is not named
+	like a backup, an error.
+*/
+func GetBackupInfo(folder string, file_name string) (*BackupInfo, error) {
+	stamp, found := strings.CutPrefix(file_name, BACKUP_FILE_PREFIX)
+	stamp, trimmed := strings.CutSuffix(stamp, BACKUP_FILE_SUFFIX)
+	if !found || !trimmed {
+		return nil, fmt.Errorf("%s is not named like a backup", file_name)
+	}
+	created, err := time.Parse(BACKUP_TIME_FORMAT, stamp)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not named like a backup", file_name)
+	}
+	stat, err := os.Stat(filepath.Join(folder, file_name))
+	if err != nil {
+		return nil, err
+	}
+	return &BackupInfo{
+		File:    file_name,
+		Size:    stat.Size(),
+		Created: created.Format(time.RFC3339),
+	}, nil
+}
+
+/*
+Lists the backups in a folder. Other files in the folder are ignored.
+
+Parameters:
+
+	folder: Folder holding the backups
+
+Returns:
+
+	The backups, oldest first, and if the folder could not be read, an
+	error. A folder that doesn't exist yet has no backups.
+*/
+func ListBackups(folder string) ([]BackupInfo, error) {
+	entries, err := os.ReadDir(folder)
+	if errors.Is(err, os.ErrNotExist) {
+		return []BackupInfo{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	backups := []BackupInfo{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		backup, err := GetBackupInfo(folder, entry.Name())
+		if err != nil {
+			continue
+		}
+		backups = append(backups, *backup)
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].File < backups[j].File
+	})
+	return backups, nil
+}
+
+/*
+Deletes the oldest backups in a folder so that only the newest few are
+left.
+
+Parameters:
+
+	folder: Folder holding the backups
+	retention: Number of backups to keep, 0 to keep every backup
+
+Returns:
+
+	If a backup could not be listed or deleted, an error, otherwise nil.
+*/
+func PruneBackups(folder string, retention int) error {
+	if retention <= 0 {
+		return nil
+	}
+	backups, err := ListBackups(folder)
+	if err != nil {
+		return err
+	}
+	for len(backups) > retention {
+		err = os.Remove(filepath.Join(folder, backups[0].File))
+		if err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+/*
+Checks that a file is a database this server can run on: it must be an
+uncorrupted SQLite database whose migrations are all known to this
+server. A backup from an older server is fine, its pending migrations
+are applied when the server boots.
+
+Parameters:
+
+	db_path: Path to the database file
+
+Returns:
+
+	An error describing the first problem found, otherwise nil.
+*/
+func ValidateDatabase(db_path string) error {
+	db, err := sql.Open(SQL_DRIVER, "file:"+db_path+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var integrity string
+	err = db.QueryRow(QUERY_INTEGRITY_CHECK).Scan(&integrity)
+	if err != nil {
+		return fmt.Errorf("not a readable database: %w", err)
+	}
+	if integrity != "ok" {
+		return fmt.Errorf("database is corrupt: %s", integrity)
+	}
+
+	// GetAppliedMigrations( ) would create the table, so check for it first
+	var migrated bool
+	err = db.QueryRow(QUERY_HAS_TABLE_TEMPLATE, "schema_migrations").Scan(&migrated)
+	if err != nil {
+		return err
+	}
+	if !migrated {
+		return errors.New("database has no schema_migrations table, is it a URL-Shortener database?")
+	}
+	migrations, err := LoadMigrations()
+	if err != nil {
+		return err
+	}
+	applied, err := GetAppliedMigrations(db)
+	if err != nil {
+		return err
+	}
+	err = CheckNoUnknownMigrations(migrations, applied)
+	if err != nil {
+		return err
+	}
+	for _, migration := range migrations {
+		status, ok := applied[migration.Version]
+		if ok && status.Name != migration.Name {
+			return fmt.Errorf("database has migration %d applied as %s, expected %s", migration.Version, status.Name, migration.Name)
+		}
+	}
+	return nil
+}
+
+/*
+Copies a file, syncing the copy to disk before returning.
+
+Parameters:
+
+	source: Path of the file to copy
+	destination: Path of the copy (overwritten if it exists)
+
+Returns:
+
+	If the copy failed, an error, otherwise nil.
+*/
+func CopyFile(source string, destination string) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(destination)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	close_err := out.Close()
+	if err != nil {
+		return err
+	}
+	return close_err
+}
+
+/*
+Replaces the database with a backup. The backup is copied next to the
+database and checked with ValidateDatabase( ) before anything is
+replaced. The current database is then moved to PRE_RESTORE_FILE and the
+copy renamed into its place, so the swap itself can't leave a partly
+written database behind.
+
+Note: the server must not be running, as it would keep using the
+replaced file.
+
+Parameters:
+
+	backup_path: Path to the backup to restore
+
+Returns:
+
+	If the backup is not valid or the swap failed, an error, otherwise nil.
+*/
+func RestoreBackup(backup_path string) error {
+	err := os.MkdirAll(DATABASE_FOLDER, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	err = CopyFile(backup_path, RESTORE_TEMP_FILE)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(RESTORE_TEMP_FILE)
+
+	err = ValidateDatabase(RESTORE_TEMP_FILE)
+	if err != nil {
+		return fmt.Errorf("cannot restore %s: %w", backup_path, err)
+	}
+
+	err = os.Rename(DATABASE_FILE, PRE_RESTORE_FILE)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	// A journal left by the replaced database must not be applied to the backup
+	err = os.Remove(DATABASE_FILE + "-journal")
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return os.Rename(RESTORE_TEMP_FILE, DATABASE_FILE)
+}
+
+/*
+Backs up the server's database every backup_interval_seconds until the
+server stops. Failed backups are logged and retried at the next interval.
+
+Parameters:
+
+	s: Pointer to Server whose database is backed up
+*/
+func RunScheduledBackups(s *Server) {
+	ticker := time.NewTicker(time.Duration(s.config.BackupIntervalSeconds) * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		backup, err := CreateBackup(context.Background(), s.db, s.config.BackupFolder, s.config.BackupRetention)
+		if err != nil {
+			log.Println("Scheduled backup failed:", err)
+			continue
+		}
+		log.Printf("Backed up database to %s", backup.File)
+	}
+}
+
+/*
+Handles requests on the backups endpoint, which lists (GET) or takes
+(POST) backups. Backups hold every link, so it requires the admin
+credentials like the admin dashboard does.
+
+Parameters:
+
+	s: Pointer to HTTP server whose database is backed up
+	request: Pointer to struct that represents contents of HTTP
+		request
+	w: Where we write response for user
+*/
+func Backups(s *Server, w http.ResponseWriter, r *http.Request) {
+	if !CheckAdminCredentials(s, w, r) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		backups, err := ListBackups(s.config.BackupFolder)
+		if err != nil {
+			ReportUnexpectedInternalServerError(w, r, err)
+			return
+		}
+		RespondAsJSON(w, backups)
+	case http.MethodPost:
+		/*
+			A backup has no body, but the JSON content type still keeps
+			other sites from taking backups until the good ones are
+			pruned (see CheckAdminJSONRequest( ))
+		*/
+		if !CheckAdminJSONRequest(w, r) {
+			return
+		}
+		// Like an audit export, a backup may outlast query_timeout_seconds
+		backup, err := CreateBackup(r.Context(), s.db, s.config.BackupFolder, s.config.BackupRetention)
+		if err != nil {
+			ReportUnexpectedInternalServerError(w, r, err)
+			return
+		}
+		RequestLogger(r).Info("Backed up database", "file", backup.File)
+		RespondAsJSON(w, backup)
+	default:
+		ReportInvalidMethodError(w, r, r.Method)
+	}
+}
@@ -0,0 +1,336 @@
+/*
+Package url_shortener serves as a library of utilities for the URL-Shortener
+application. This includes the definition of our API, database configuration,
+and HTTP server implementation. This is used by the main package to instantiate
+and run a server easily. This library could be used in other applications
+that do more than just initializing and booting a server.
+
+This file provides how expansions by bots (link previews of chat apps,
+search crawlers and the like) are told apart from those by people. An
+expansion is flagged as a bot's, checking in this order, when:
+
+ 1. Its User-Agent matches a known signature.
+ 2. It is missing a header every browser sends (e.g. Accept).
+ 3. Its visitor (IP address and User-Agent, see visitors.go) has expanded
+    more than bot_burst_limit times within bot_burst_seconds.
+
+The signatures and required headers are in a JSON file. A default file
+(rules/bot_signatures.json) is built into the executable, and
+bot_signatures_file points to a replacement, which is reloaded when it
+changes on disk like the User-Agent rules (see user_agents.go).
+
+Flagged expansions still resolve, but only count towards BotExpansions:
+they don't add to Expansions, add a click or a visitor, or send webhook
+events. Links with an expansion cap are the exception. Whether a request
+is a bot's is up to the client (it picks its User-Agent and headers), so
+on a capped link every expansion is counted like a person's and uses up
+the cap, otherwise anyone could get past e.g. a one-time link by posing
+as a bot.
+*/
+
+package url_shortener
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+//go:embed rules/bot_signatures.json
+var defaultBotSignatures []byte
+
+// How often the signature file is checked for changes
+const BOT_SIGNATURES_CHECK_INTERVAL = time.Second
+
+/*
+Query template to count an expansion by a bot. It matches no row if the
+link has an expansion cap, as those are counted like a person's (see the
+top of this file).
+*/
+const QUERY_UPDATE_BOT_EXPANSIONS_BY_ALIAS_TEMPLATE = `
+UPDATE aliases
+SET BotExpansions = BotExpansions + 1
+WHERE Alias = ? AND MaxExpansions IS NULL
+`
+
+/*
+Specifies the JSON structure of a signature file. A signature has the same
+form as a User-Agent rule (see UserAgentRule), its name being what the
+bot is logged as. The first matching signature is used.
+*/
+type BotSignatures struct {
+	// Headers an expansion must have (with a value) not to be a bot's
+	RequiredHeaders []string `json:"required_headers"`
+
+	Signatures []UserAgentRule `json:"signatures"`
+}
+
+// Represents a signature file whose signatures have been compiled
+type compiledBotSignatures struct {
+	requiredHeaders []string
+	signatures      []compiledUserAgentRule
+}
+
+/*
+Tells expansions by bots apart from those by people, loading the signature
+file again when it changes. If a changed file can't be loaded, the
+previous signatures are kept and loading is retried at the next check.
+*/
+type BotDetector struct {
+	// Path to the signature file, empty to use the built in signatures
+	file string
+
+	// Flags visitors expanding in bursts, nil if bursts aren't flagged
+	bursts *BurstTracker
+
+	// Guards every field below, as expansions run concurrently
+	lock      sync.Mutex
+	rules     *compiledBotSignatures
+	version   fileVersion
+	lastCheck time.Time
+}
+
+/*
+Parses and compiles a signature file.
+
+Parameters:
+
+	contents: The contents of the signature file
+
+Returns:
+
+	The compiled signatures and, if the file is not valid, an error.
+*/
+func ParseBotSignatures(contents []byte) (*compiledBotSignatures, error) {
+	var signatures BotSignatures
+	err := json.Unmarshal(contents, &signatures)
+	if err != nil {
+		return nil, err
+	}
+	compiled := &compiledBotSignatures{requiredHeaders: signatures.RequiredHeaders}
+	compiled.signatures, err = compileUserAgentRuleList("signatures", signatures.Signatures)
+	if err != nil {
+		return nil, err
+	}
+	return compiled, nil
+}
+
+/*
+Makes a bot detector and loads its signatures right away, so a server with
+a bad signature file fails to boot rather than counting every bot as a
+person.
+
+Parameters:
+
+	config: Server configuration, for the signature file and bursts
+
+Returns:
+
+	The detector and, if the signatures could not be loaded, an error.
+*/
+func NewBotDetector(config Config) (*BotDetector, error) {
+	detector := &BotDetector{file: config.BotSignaturesFile}
+	if config.BotBurstLimit > 0 {
+		if config.BotBurstSeconds <= 0 {
+			return nil, errors.New("bot_burst_seconds must be positive")
+		}
+		detector.bursts = NewBurstTracker(config.BotBurstLimit, time.Duration(config.BotBurstSeconds)*time.Second)
+	}
+	if detector.file == "" {
+		rules, err := ParseBotSignatures(defaultBotSignatures)
+		if err != nil {
+			return nil, err
+		}
+		detector.rules = rules
+		return detector, nil
+	}
+
+	detector.lock.Lock()
+	defer detector.lock.Unlock()
+	err := detector.reload()
+	if err != nil {
+		return nil, err
+	}
+	return detector, nil
+}
+
+/*
+Loads the signature file if it changed since it was last loaded. The
+caller must hold the lock.
+
+Returns:
+
+	If the file changed but could not be loaded, an error, otherwise nil.
+*/
+func (d *BotDetector) reload() error {
+	d.lastCheck = time.Now()
+	version, err := getFileVersion(d.file)
+	if err != nil {
+		return err
+	}
+	if d.rules != nil && version == d.version {
+		return nil
+	}
+
+	contents, err := os.ReadFile(d.file)
+	if err != nil {
+		return err
+	}
+	rules, err := ParseBotSignatures(contents)
+	if err != nil {
+		return fmt.Errorf("loading bot signatures %s: %w", d.file, err)
+	}
+	if d.rules != nil {
+		log.Printf("Reloaded bot signatures %s", d.file)
+	}
+	d.rules = rules
+	d.version = version
+	return nil
+}
+
+/*
+Checks whether an expansion is a bot's, checking the signature file for
+changes at most once per BOT_SIGNATURES_CHECK_INTERVAL. Every expansion
+that isn't flagged by its headers counts towards its visitor's burst.
+
+Parameters:
+
+	r: The expansion request
+	visitor: The visitor's hash (see VisitorHash( ))
+
+Returns:
+
+	Whether the expansion is a bot's and, if so, why (for the logs).
+*/
+func (d *BotDetector) Detect(r *http.Request, visitor uint64) (bool, string) {
+	d.lock.Lock()
+	if d.file != "" && time.Since(d.lastCheck) >= BOT_SIGNATURES_CHECK_INTERVAL {
+		err := d.reload()
+		if err != nil {
+			log.Printf("Keeping the current bot signatures: %s", err)
+		}
+	}
+	rules := d.rules
+	d.lock.Unlock()
+
+	name, found := findUserAgentRule(rules.signatures, r.UserAgent())
+	if found {
+		return true, "signature " + name
+	}
+	for _, header := range rules.requiredHeaders {
+		if r.Header.Get(header) == "" {
+			return true, "missing " + header
+		}
+	}
+	if d.bursts != nil && d.bursts.Add(visitor) {
+		return true, "burst"
+	}
+	return false, ""
+}
+
+/*
+Counts the expansions of each visitor within a sliding window, to flag
+visitors expanding faster than a person would. Like AttemptLimiter,
+visitors that went quiet are swept away once per window.
+*/
+type BurstTracker struct {
+	// Number of expansions allowed within the window
+	limit int
+
+	// How long an expansion is remembered for
+	window time.Duration
+
+	// Guards every field below, as expansions run concurrently
+	lock sync.Mutex
+
+	// Times of recent expansions per visitor, oldest first
+	expansions map[uint64][]time.Time
+
+	// When visitors that went quiet were last swept away
+	lastSweep time.Time
+}
+
+// Makes a BurstTracker, see the BurstTracker fields for the parameters
+func NewBurstTracker(limit int, window time.Duration) *BurstTracker {
+	return &BurstTracker{
+		limit:      limit,
+		window:     window,
+		expansions: make(map[uint64][]time.Time),
+		lastSweep:  time.Now(),
+	}
+}
+
+/*
+Records an expansion by a visitor.
+
+Parameters:
+
+	visitor: The visitor's hash
+
+Returns:
+
+	Whether the visitor has gone over the limit within the window.
+*/
+func (tracker *BurstTracker) Add(visitor uint64) bool {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	now := time.Now()
+	if now.Sub(tracker.lastSweep) >= tracker.window {
+		for key, times := range tracker.expansions {
+			if now.Sub(times[len(times)-1]) >= tracker.window {
+				delete(tracker.expansions, key)
+			}
+		}
+		tracker.lastSweep = now
+	}
+
+	recent := tracker.expansions[visitor]
+	for len(recent) > 0 && now.Sub(recent[0]) >= tracker.window {
+		recent = recent[1:]
+	}
+	// Only the last limit + 1 times are needed to tell if there are too many
+	if len(recent) > tracker.limit {
+		recent = recent[1:]
+	}
+	recent = append(recent, now)
+	tracker.expansions[visitor] = recent
+	return len(recent) > tracker.limit
+}
+
+/*
+Counts an expansion by a bot. The link still resolves, but nothing else a
+person's expansion does happens (see the top of this file).
+
+Parameters:
+
+	s: Pointer to Server whose database we update
+	ctx: Context of the expansion
+	link: The link being expanded
+
+Returns:
+
+	Whether the expansion was counted as a bot's and, if the update
+	failed, an error. It is not counted if the link has an expansion cap
+	(or is no longer mapped), in which case the caller records it like a
+	person's.
+*/
+func RecordBotExpansion(s *Server, ctx context.Context, link *Link) (bool, error) {
+	var updated int64
+	err := RunQuery(s, ctx, func(ctx context.Context) error {
+		result, err := s.db.ExecContext(ctx, QUERY_UPDATE_BOT_EXPANSIONS_BY_ALIAS_TEMPLATE, link.Alias)
+		if err != nil {
+			return err
+		}
+		updated, err = result.RowsAffected()
+		return err
+	})
+	return updated > 0, err
+}
@@ -0,0 +1,535 @@
+/*
+Package url_shortener serves as a library of utilities for the URL-Shortener
+application. This includes the definition of our API, database configuration,
+and HTTP server implementation. This is used by the main package to instantiate
+and run a server easily. This library could be used in other applications
+that do more than just initializing and booting a server.
+
+This file provides tags and campaigns, the labels that group links. A link
+has any number of tags, kept in the link_tags table, and links can be
+listed by tag. A link is in at most one campaign (aliases.Campaign), and
+the analytics of a campaign add up the analytics of its links. Both are
+set when shortening and can be changed from the admin dashboard or the
+labels/ endpoint.
+
+Tags and campaign names are made of letters, digits, - and _, and are kept
+in lower case so that e.g. Spring-Sale and spring-sale are the same.
+*/
+
+package url_shortener
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Most tags a link can have
+const MAX_TAGS = 10
+
+// Tags, which are at most 32 characters
+var TAG_PATTERN = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+// Campaign names, which are at most 64 characters
+var CAMPAIGN_PATTERN = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// Query template to tag a link
+const QUERY_ADD_TAG_TEMPLATE = `
+INSERT INTO link_tags (Alias, Tag)
+VALUES (?, ?)
+`
+
+// Query template for removing the tags of a link, before retagging or deleting it
+const QUERY_DELETE_TAGS_TEMPLATE = `
+DELETE FROM link_tags
+WHERE Alias = ?
+`
+
+// Query template to get the tags of a link, in order
+const QUERY_GET_TAGS_TEMPLATE = `
+SELECT Tag
+FROM link_tags
+WHERE Alias = ?
+ORDER BY Tag
+`
+
+// Query template to move a link to another campaign
+const QUERY_UPDATE_CAMPAIGN_TEMPLATE = `
+UPDATE aliases
+SET Campaign = ?
+WHERE Alias = ?
+`
+
+// Query template to get the number of links in a campaign and their expansions
+const QUERY_GET_CAMPAIGN_TOTALS_TEMPLATE = `
+SELECT COUNT(*), COALESCE(SUM(Expansions), 0), COALESCE(SUM(BotExpansions), 0)
+FROM aliases
+WHERE Campaign = ?
+`
+
+// Query template to get the visitor sketches of the links in a campaign
+const QUERY_GET_CAMPAIGN_SKETCHES_TEMPLATE = `
+SELECT VisitorSketch
+FROM aliases
+WHERE Campaign = ? AND VisitorSketch IS NOT NULL
+`
+
+// Query template to count the expansions of a campaign per day (UTC) between two Unix times
+const QUERY_GET_CAMPAIGN_EXPANSIONS_PER_DAY_TEMPLATE = `
+SELECT date(clicks.Time, 'unixepoch') AS Day, COUNT(*)
+FROM clicks
+JOIN aliases ON aliases.Alias = clicks.Alias
+WHERE aliases.Campaign = ? AND clicks.Time >= ? AND clicks.Time < ?
+GROUP BY Day
+ORDER BY Day
+`
+
+/*
+Query template to get the links of a campaign with the most expansions of
+all time. URLs of password protected links are left blank, like in the
+analytics summary.
+*/
+const QUERY_GET_CAMPAIGN_TOP_LINKS_TEMPLATE = `
+SELECT Alias, CASE WHEN PasswordHash IS NULL THEN URL ELSE '' END, Expansions
+FROM aliases
+WHERE Campaign = ?
+ORDER BY Expansions DESC, Alias
+LIMIT ?
+`
+
+/*
+Query template to get the links of a campaign with the most expansions
+between two Unix times, counted from the click history. URLs of protected
+links are left blank as above.
+*/
+const QUERY_GET_CAMPAIGN_TOP_LINKS_IN_WINDOW_TEMPLATE = `
+SELECT clicks.Alias, CASE WHEN aliases.PasswordHash IS NULL THEN aliases.URL ELSE '' END, COUNT(*) AS Clicks
+FROM clicks
+JOIN aliases ON aliases.Alias = clicks.Alias
+WHERE aliases.Campaign = ? AND clicks.Time >= ? AND clicks.Time < ?
+GROUP BY clicks.Alias
+ORDER BY Clicks DESC, clicks.Alias
+LIMIT ?
+`
+
+/*
+Checks the tags of a link and puts them in the form they are stored in.
+
+Parameters:
+
+	tags: The tags as given
+
+Returns:
+
+	The tags in lower case, sorted and without repeats, and a message for
+	the user if a tag is invalid (empty if they are all valid).
+*/
+func NormalizeTags(tags []string) ([]string, string) {
+	normalized := []string{}
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if !TAG_PATTERN.MatchString(tag) {
+			return nil, fmt.Sprintf("tag %q must be 1 to 32 letters, digits, - or _", tag)
+		}
+		if !slices.Contains(normalized, tag) {
+			normalized = append(normalized, tag)
+		}
+	}
+	if len(normalized) > MAX_TAGS {
+		return nil, fmt.Sprintf("a link can have at most %d tags", MAX_TAGS)
+	}
+	slices.Sort(normalized)
+	return normalized, ""
+}
+
+/*
+Checks the campaign of a link and puts it in the form it is stored in.
+
+Parameters:
+
+	campaign: The campaign as given, empty for none
+
+Returns:
+
+	The value to store (NULL for no campaign) and a message for the user
+	if the campaign is invalid (empty if it is valid).
+*/
+func NormalizeCampaign(campaign string) (sql.NullString, string) {
+	campaign = strings.ToLower(strings.TrimSpace(campaign))
+	if campaign == "" {
+		return sql.NullString{}, ""
+	}
+	if !CAMPAIGN_PATTERN.MatchString(campaign) {
+		return sql.NullString{}, "campaign must be 1 to 64 letters, digits, - or _"
+	}
+	return sql.NullString{String: campaign, Valid: true}, ""
+}
+
+/*
+Checks the tags and campaign of a shorten request and puts them in the
+settings of the new mapping.
+
+Parameters:
+
+	request: Pointer to struct that represents contents of shorten request
+	settings: The settings being built for the new mapping
+
+Returns:
+
+	A message for the user if a tag or the campaign is invalid, otherwise
+	the empty string.
+*/
+func SetLabelSettings(request *ShortenRequest, settings *LinkSettings) string {
+	var err_msg string
+	settings.Tags, err_msg = NormalizeTags(request.Tags)
+	if err_msg != "" {
+		return err_msg
+	}
+	settings.Campaign, err_msg = NormalizeCampaign(request.Campaign)
+	return err_msg
+}
+
+/*
+Replaces the tags of a link. This must be called within the transaction
+creating or editing the link.
+
+Parameters:
+
+	ctx: Context of the transaction
+	tx: The transaction changing the link
+	alias: The alias of the link
+	tags: The link's tags, which must have been normalized
+
+Returns:
+
+	If the tags could not be written, an error, otherwise nil.
+*/
+func SetLinkTags(ctx context.Context, tx *sql.Tx, alias string, tags []string) error {
+	_, err := tx.ExecContext(ctx, QUERY_DELETE_TAGS_TEMPLATE, alias)
+	if err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		_, err = tx.ExecContext(ctx, QUERY_ADD_TAG_TEMPLATE, alias, tag)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Reads the tags of a link within a transaction, for the audit log.
+
+Parameters:
+
+	ctx: Context of the transaction
+	tx: The transaction reading the link
+	alias: The alias of the link
+
+Returns:
+
+	The tags in order (nil if there are none) and, if the query failed, an
+	error.
+*/
+func GetLinkTags(ctx context.Context, tx *sql.Tx, alias string) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, QUERY_GET_TAGS_TEMPLATE, alias)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tags []string
+	for rows.Next() {
+		var tag string
+		err = rows.Scan(&tag)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+/*
+Replaces the tags and campaign of an existing link.
+
+Parameters:
+
+	s: Pointer to Server whose database we update
+	ctx: Context of the request making the change
+	alias: The alias of the link
+	request: The new tags and campaign
+	actor: Who is making the change, recorded in the audit log
+
+Returns:
+
+	An error message that is meant to be sent to the user (like in
+	UpdateLink( )) and the error that occurred. If the alias is not
+	mapped, the error is sql.ErrNoRows.
+*/
+func SetLinkLabels(s *Server, ctx context.Context, alias string, request *LabelsRequest, actor *Actor) (string, error) {
+	tags, err_msg := NormalizeTags(request.Tags)
+	if err_msg != "" {
+		return err_msg, errors.New("invalid tags")
+	}
+	campaign, err_msg := NormalizeCampaign(request.Campaign)
+	if err_msg != "" {
+		return err_msg, errors.New("invalid campaign")
+	}
+
+	err := RunQuery(s, ctx, func(ctx context.Context) error {
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		before, err := GetLinkState(ctx, tx, alias)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, QUERY_UPDATE_CAMPAIGN_TEMPLATE, campaign, alias)
+		if err != nil {
+			return err
+		}
+		err = SetLinkTags(ctx, tx, alias, tags)
+		if err != nil {
+			return err
+		}
+		after, err := GetLinkState(ctx, tx, alias)
+		if err != nil {
+			return err
+		}
+		err = RecordAudit(ctx, tx, AUDIT_ACTION_UPDATE, alias, actor, before, after)
+		if err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err == sql.ErrNoRows {
+		return fmt.Sprintf("Cannot edit %s, not mapped", alias), err
+	} else if err != nil {
+		return INTERNAL_ERROR_MESSAGE, err
+	}
+	return "", nil
+}
+
+/*
+Gets the analytics of a campaign from the server's database.
+
+Parameters:
+
+	s: Pointer to Server whose database we query
+	ctx: Context of the request the analytics are for
+	campaign: The campaign, normalized
+	query: The parsed analytics request (see ParseSummaryQuery( ))
+
+Returns:
+
+	The analytics and, if a query failed, an error. If the campaign has no
+	links, the error is sql.ErrNoRows.
+*/
+func GetCampaignAnalytics(s *Server, ctx context.Context, campaign string, query *SummaryQuery) (*CampaignAnalyticsResponse, error) {
+	var response *CampaignAnalyticsResponse
+	err := RunQuery(s, ctx, func(ctx context.Context) error {
+		var err error
+		response, err = readCampaignAnalytics(ctx, s.db, campaign, query)
+		return err
+	})
+	return response, err
+}
+
+/*
+Runs the queries behind GetCampaignAnalytics( ), which retries them
+together if the database is busy.
+
+Parameters:
+
+	ctx: Context the queries run in
+	db: Connection to the database holding the links
+	campaign: The campaign, normalized
+	query: The parsed analytics request
+
+Returns:
+
+	The analytics and, if a query failed, an error.
+*/
+func readCampaignAnalytics(ctx context.Context, db *sql.DB, campaign string, query *SummaryQuery) (*CampaignAnalyticsResponse, error) {
+	response := &CampaignAnalyticsResponse{
+		Campaign:         campaign,
+		ExpansionsPerDay: []DailyCount{},
+		TopLinks:         []TopLink{},
+	}
+	err := db.QueryRowContext(ctx, QUERY_GET_CAMPAIGN_TOTALS_TEMPLATE, campaign).Scan(&response.Links, &response.Expansions, &response.BotExpansions)
+	if err != nil {
+		return nil, err
+	}
+	if response.Links == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	// Merging the links' sketches counts a visitor of several links once
+	visitors := NewVisitorSketch()
+	sketches, err := db.QueryContext(ctx, QUERY_GET_CAMPAIGN_SKETCHES_TEMPLATE, campaign)
+	if err != nil {
+		return nil, err
+	}
+	defer sketches.Close()
+	for sketches.Next() {
+		var stored []byte
+		err = sketches.Scan(&stored)
+		if err != nil {
+			return nil, err
+		}
+		sketch, err := DecodeVisitorSketch(stored)
+		if err != nil {
+			return nil, err
+		}
+		visitors.Merge(sketch)
+	}
+	err = sketches.Err()
+	if err != nil {
+		return nil, err
+	}
+	response.UniqueVisitors = visitors.Estimate()
+
+	since, until := WindowBounds(query.Since, query.Until)
+
+	days, err := db.QueryContext(ctx, QUERY_GET_CAMPAIGN_EXPANSIONS_PER_DAY_TEMPLATE, campaign, since, until)
+	if err != nil {
+		return nil, err
+	}
+	defer days.Close()
+	for days.Next() {
+		var day DailyCount
+		err = days.Scan(&day.Day, &day.Count)
+		if err != nil {
+			return nil, err
+		}
+		response.ExpansionsPerDay = append(response.ExpansionsPerDay, day)
+	}
+	err = days.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	// Like the summary, all time top links count expansions from before the click history
+	var top *sql.Rows
+	if query.Since == nil && query.Until == nil {
+		top, err = db.QueryContext(ctx, QUERY_GET_CAMPAIGN_TOP_LINKS_TEMPLATE, campaign, query.Top)
+	} else {
+		top, err = db.QueryContext(ctx, QUERY_GET_CAMPAIGN_TOP_LINKS_IN_WINDOW_TEMPLATE, campaign, since, until, query.Top)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer top.Close()
+	for top.Next() {
+		var link TopLink
+		err = top.Scan(&link.Alias, &link.Url, &link.Expansions)
+		if err != nil {
+			return nil, err
+		}
+		response.TopLinks = append(response.TopLinks, link)
+	}
+	return response, top.Err()
+}
+
+/*
+Handles requests on the campaigns/ endpoint.
+
+Parameters:
+
+	s: Pointer to HTTP server whose links are analyzed
+	w: Where we write response for user
+	r: Pointer to struct that represents contents of HTTP request
+*/
+func CampaignAnalytics(s *Server, w http.ResponseWriter, r *http.Request) {
+	// Only GET requests are allowed on the campaigns endpoint
+	if r.Method != http.MethodGet {
+		ReportInvalidMethodError(w, r, r.Method)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, CAMPAIGNS_ENDPOINT)
+	campaign, err_msg := NormalizeCampaign(name)
+	if err_msg == "" && !campaign.Valid {
+		err_msg = "campaign must be given"
+	}
+	if err_msg != "" {
+		ReportBadRequestError(w, r, name, err_msg)
+		return
+	}
+	query, err_msg := ParseSummaryQuery(r)
+	if err_msg != "" {
+		ReportBadRequestError(w, r, r.URL.RawQuery, err_msg)
+		return
+	}
+
+	response, err := GetCampaignAnalytics(s, r.Context(), campaign.String, query)
+	if err == sql.ErrNoRows {
+		ReportBadRequestError(w, r, "No links in campaign", fmt.Sprintf("Campaign %s has no links", campaign.String))
+		return
+	} else if err != nil {
+		ReportUnexpectedInternalServerError(w, r, err)
+		return
+	}
+	RespondAsJSON(w, response)
+}
+
+/*
+Handles requests on the labels/ endpoint, which replace the tags and
+campaign of a link. The response is the link as it appears in a page of
+links.
+
+Parameters:
+
+	s: Pointer to HTTP server whose links are labelled
+	w: Where we write response for user
+	r: Pointer to struct that represents contents of HTTP request
+*/
+func Labels(s *Server, w http.ResponseWriter, r *http.Request) {
+	if !CheckAdminCredentials(s, w, r) {
+		return
+	}
+
+	// Only PUT requests are allowed on the labels endpoint
+	if r.Method != http.MethodPut {
+		ReportInvalidMethodError(w, r, r.Method)
+		return
+	}
+
+	alias := strings.TrimPrefix(r.URL.Path, LABELS_ENDPOINT)
+	var request LabelsRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		ReportBadRequestError(w, r, err.Error(), "Invalid JSON format")
+		return
+	}
+
+	err_msg, err := SetLinkLabels(s, r.Context(), alias, &request, NewActor(r, s.config.AdminUsername))
+	if err == sql.ErrNoRows {
+		ReportClientError(w, r, http.StatusNotFound, "No mapping exists for alias", err_msg)
+		return
+	} else if err_msg == INTERNAL_ERROR_MESSAGE {
+		ReportUnexpectedInternalServerError(w, r, err)
+		return
+	} else if err != nil {
+		ReportBadRequestError(w, r, err.Error(), err_msg)
+		return
+	}
+
+	link, err := GetLinkSummary(s, r.Context(), alias)
+	if err != nil {
+		ReportUnexpectedInternalServerError(w, r, err)
+		return
+	}
+	RequestLogger(r).Info("Relabelled link", "alias", alias, "tags", link.Tags, "campaign", link.Campaign)
+	RespondAsJSON(w, link)
+}
@@ -0,0 +1,275 @@
+/*
+Package url_shortener serves as a library of utilities for the URL-Shortener
+application. This includes the definition of our API, database configuration,
+and HTTP server implementation. This is used by the main package to instantiate
+and run a server easily. This library could be used in other applications
+that do more than just initializing and booting a server.
+
+This file provides the command line tools that can be run instead of
+booting the server (e.g. go run . migrate status). Each command works
+directly on the database file, so they are meant for operators doing
+maintenance on a deployment.
+*/
+
+package url_shortener
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Usage message printed when a command is missing or not recognized
+const COMMAND_USAGE = `Usage: [-config path/to/config.json] [command]
+	(no command)        boot the server
+	migrate status      list schema migrations and whether they are applied
+	migrate up          apply pending schema migrations
+	aliases report      list custom aliases that break the alias policy
+	admin hash-password read a password from standard input and print
+	                    its hash for admin_password_hash
+	backup              take a backup of the database (safe while the
+	                    server is running)
+	backup list         list the backups in backup_folder
+	restore <file>      replace the database with a backup (stop the
+	                    server first)`
+
+/*
+Runs a command line tool. The main package calls this whenever it is
+given arguments, instead of booting a server.
+
+Parameters:
+
+	config: Server configuration loaded by the main package
+	args: The command line arguments (excluding the program name and
+		any flags)
+
+Returns:
+
+	If the command failed or was not recognized, an error is returned,
+	otherwise nil.
+*/
+func RunCommand(config Config, args []string) error {
+	if len(args) == 0 {
+		return errors.New(COMMAND_USAGE)
+	}
+	switch args[0] {
+	case "migrate":
+		return RunMigrateCommand(args[1:])
+	case "aliases":
+		return RunAliasesCommand(config, args[1:])
+	case "admin":
+		return RunAdminCommand(args[1:])
+	case "backup":
+		return RunBackupCommand(config, args[1:])
+	case "restore":
+		return RunRestoreCommand(args[1:])
+	default:
+		return fmt.Errorf("unknown command %s\n%s", args[0], COMMAND_USAGE)
+	}
+}
+
+/*
+Runs the migrate command which either reports (status) or applies (up)
+schema migrations.
+
+Parameters:
+
+	args: The arguments that followed migrate on the command line
+
+Returns:
+
+	If the subcommand failed or was not recognized, an error is returned,
+	otherwise nil.
+*/
+func RunMigrateCommand(args []string) error {
+	if len(args) != 1 {
+		return errors.New(COMMAND_USAGE)
+	}
+
+	db, err := OpenDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	switch args[0] {
+	case "status":
+		statuses, err := GetMigrationStatus(db)
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			applied := status.Applied
+			if applied == "" {
+				applied = "pending"
+			}
+			fmt.Fprintf(os.Stdout, "%04d %-40s %s\n", status.Version, status.Name, applied)
+		}
+		return nil
+	case "up":
+		applied, err := MigrateUp(db)
+		for _, migration := range applied {
+			fmt.Fprintf(os.Stdout, "Applied migration %d (%s)\n", migration.Version, migration.Name)
+		}
+		if err == nil && len(applied) == 0 {
+			fmt.Fprintln(os.Stdout, "Database is up to date")
+		}
+		return err
+	default:
+		return fmt.Errorf("unknown migrate subcommand %s\n%s", args[0], COMMAND_USAGE)
+	}
+}
+
+/*
+Runs the aliases command. Its only subcommand (report) lists the existing
+custom aliases that break the configured alias policy, so an operator can
+decide what to do with them after tightening the policy.
+
+Parameters:
+
+	config: Server configuration holding the alias policy
+	args: The arguments that followed aliases on the command line
+
+Returns:
+
+	If the subcommand failed or was not recognized, an error is returned,
+	otherwise nil. Finding violations is not an error.
+*/
+func RunAliasesCommand(config Config, args []string) error {
+	if len(args) != 1 || args[0] != "report" {
+		return errors.New(COMMAND_USAGE)
+	}
+
+	checker, err := NewAliasChecker(config.AliasPolicy)
+	if err != nil {
+		return err
+	}
+	db, err := OpenDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	violations, err := FindAliasPolicyViolations(db, checker)
+	if err != nil {
+		return err
+	}
+	for _, violation := range violations {
+		fmt.Fprintf(os.Stdout, "%s\t%s\t%s\n", violation.Alias, violation.Url, violation.Violation)
+	}
+	fmt.Fprintf(os.Stdout, "%d alias(es) break the alias policy\n", len(violations))
+	return nil
+}
+
+/*
+Runs the admin command. Its only subcommand (hash-password) hashes a
+password for the admin_password_hash setting. The password is read from
+standard input rather than the command line so it doesn't end up in the
+shell history.
+
+Parameters:
+
+	args: The arguments that followed admin on the command line
+
+Returns:
+
+	If the subcommand failed or was not recognized, an error is returned,
+	otherwise nil.
+*/
+func RunAdminCommand(args []string) error {
+	if len(args) != 1 || args[0] != "hash-password" {
+		return errors.New(COMMAND_USAGE)
+	}
+
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && password == "" {
+		return err
+	}
+	password = strings.TrimRight(password, "\r\n")
+	if password == "" {
+		return errors.New("password must not be empty")
+	}
+
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stdout, hash)
+	return nil
+}
+
+/*
+Runs the backup command which either takes a backup (no subcommand) or
+lists the backups (list). Backups are taken the same way as on the
+backups endpoint, so this is safe while the server is running.
+
+Parameters:
+
+	config: Server configuration holding the backup folder and retention
+	args: The arguments that followed backup on the command line
+
+Returns:
+
+	If the subcommand failed or was not recognized, an error is returned,
+	otherwise nil.
+*/
+func RunBackupCommand(config Config, args []string) error {
+	if len(args) == 1 && args[0] == "list" {
+		backups, err := ListBackups(config.BackupFolder)
+		if err != nil {
+			return err
+		}
+		for _, backup := range backups {
+			fmt.Fprintf(os.Stdout, "%s\t%d\t%s\n", backup.File, backup.Size, backup.Created)
+		}
+		return nil
+	} else if len(args) != 0 {
+		return errors.New(COMMAND_USAGE)
+	}
+
+	db, err := OpenDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	backup, err := CreateBackup(context.Background(), db, config.BackupFolder, config.BackupRetention)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stdout, "Backed up database to %s\n", filepath.Join(config.BackupFolder, backup.File))
+	return nil
+}
+
+/*
+Runs the restore command which replaces the database with a backup after
+checking that the backup is a database this server can run on (see
+RestoreBackup( )).
+
+Parameters:
+
+	args: The arguments that followed restore on the command line (the
+		path to the backup)
+
+Returns:
+
+	If the backup is not valid or could not be restored, an error is
+	returned, otherwise nil.
+*/
+func RunRestoreCommand(args []string) error {
+	if len(args) != 1 {
+		return errors.New(COMMAND_USAGE)
+	}
+
+	err := RestoreBackup(args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stdout, "Restored database from %s, the replaced database was moved to %s\n", args[0], PRE_RESTORE_FILE)
+	return nil
+}
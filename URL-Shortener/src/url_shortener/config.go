@@ -0,0 +1,244 @@
+/*
+Package url_shortener serves as a library of utilities for the URL-Shortener
+application. This includes the definition of our API, database configuration,
+and HTTP server implementation. This is used by the main package to instantiate
+and run a server easily. This library could be used in other applications
+that do more than just initializing and booting a server.
+
+This file provides the server configuration. Settings that an operator may
+want to change without rebuilding (as opposed to the constants found
+throughout the package) are read from an optional JSON file. Any setting
+missing from the file keeps its default value.
+*/
+
+package url_shortener
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+)
+
+// Default path to the configuration file (relative to src/ like DATABASE_FOLDER)
+const CONFIG_FILE = "../config.json"
+
+/*
+Represents the server configuration. The struct tags give the key used
+for each setting in the JSON configuration file.
+*/
+type Config struct {
+	/*
+		If true, a URL may be shortened to any number of aliases (e.g. one
+		per marketing channel). If false (the default), shortening a URL
+		that already has an alias fails and reports the existing alias,
+		unless the shorten request itself asks to allow duplicates.
+	*/
+	AllowDuplicateURLs bool `json:"allow_duplicate_urls"`
+
+	// Rules custom aliases must follow (see alias_policy.go)
+	AliasPolicy AliasPolicy `json:"alias_policy"`
+
+	/*
+		Scheme, host and port clients use to reach the server. Short URLs
+		(e.g. the ones encoded in QR codes) start with this. Set it when
+		the server sits behind a proxy or a public domain name.
+	*/
+	PublicBaseURL string `json:"public_base_url"`
+
+	/*
+		Number of incorrect passwords a client may try for a protected
+		link within password_lockout_seconds before it is locked out of
+		that link.
+	*/
+	PasswordMaxFailures    int `json:"password_max_failures"`
+	PasswordLockoutSeconds int `json:"password_lockout_seconds"`
+
+	/*
+		Credentials for the admin dashboard (see admin.go). Only a hash
+		of the password is kept here, made with the admin hash-password
+		command. The dashboard is off unless both are set.
+	*/
+	AdminUsername     string `json:"admin_username"`
+	AdminPasswordHash string `json:"admin_password_hash"`
+
+	// Folder database backups are written to (see backup.go)
+	BackupFolder string `json:"backup_folder"`
+
+	/*
+		How often the server backs up its database on its own, 0 (the
+		default) for no scheduled backups.
+	*/
+	BackupIntervalSeconds int `json:"backup_interval_seconds"`
+
+	/*
+		Number of backups kept in backup_folder. Taking a backup deletes
+		the oldest ones beyond this, 0 keeps every backup.
+	*/
+	BackupRetention int `json:"backup_retention"`
+
+	/*
+		Readiness fails when the disk holding the database has less than
+		this many bytes free, so traffic moves elsewhere before writes
+		start failing.
+	*/
+	MinFreeDiskBytes uint64 `json:"min_free_disk_bytes"`
+
+	/*
+		How long the server keeps answering requests after it is asked to
+		stop, with readiness failing, so an orchestrator has time to stop
+		sending it traffic. 0 (the default) stops right away.
+	*/
+	ShutdownDrainSeconds int `json:"shutdown_drain_seconds"`
+
+	/*
+		Paths to the PEM encoded certificate and private key to serve
+		HTTPS with (see tls.go). The server serves plain HTTP unless both
+		are set. The files are reloaded when they change on disk.
+	*/
+	TLSCertFile string `json:"tls_cert_file"`
+	TLSKeyFile  string `json:"tls_key_file"`
+
+	/*
+		Port for a plain HTTP listener that redirects every request to
+		HTTPS, 0 (the default) for none. Only used when serving HTTPS.
+	*/
+	HTTPRedirectPort int `json:"http_redirect_port"`
+
+	// Format of the server's logs, text or json (see logging.go)
+	LogFormat string `json:"log_format"`
+	/*
+		How long a request's database work may take before it is given
+		up and answered with 504 (Gateway Timeout), see query_context.go.
+		0 turns the deadline off, leaving only the client's own.
+	*/
+	QueryTimeoutSeconds float64 `json:"query_timeout_seconds"`
+
+	/*
+		How many times database work that finds the database busy (locked
+		by another connection) is retried before it is answered with 503
+		(Service Unavailable).
+	*/
+	BusyRetries int `json:"busy_retries"`
+
+	/*
+		How long a server's lease on a range of automatic aliases lasts
+		(see alias_allocator.go). The lease is renewed while the server
+		runs, so this is how long the rest of a range is held up after
+		its server dies.
+	*/
+	AliasLeaseSeconds int `json:"alias_lease_seconds"`
+
+	/*
+		Webhooks are sent a link.milestone event each time a link's
+		expansions reach a multiple of this (see webhooks.go), 0 for no
+		milestones.
+	*/
+	WebhookMilestoneInterval int `json:"webhook_milestone_interval"`
+
+	/*
+		How long a webhook receiver has to answer a delivery before the
+		attempt counts as failed.
+	*/
+	WebhookTimeoutSeconds int `json:"webhook_timeout_seconds"`
+
+	/*
+		How long to wait before retrying a failed webhook delivery. The
+		wait doubles with each failed attempt, and the delivery is given
+		up once webhook_max_attempts attempts have failed.
+	*/
+	WebhookRetrySeconds int `json:"webhook_retry_seconds"`
+	WebhookMaxAttempts  int `json:"webhook_max_attempts"`
+
+	/*
+		How long a webhook delivery is kept in the delivery history once
+		it was delivered or given up, 0 to keep them until the webhook
+		is deleted.
+	*/
+	WebhookRetentionSeconds int `json:"webhook_retention_seconds"`
+
+	/*
+		Path to a JSON file of rules sorting User-Agents into devices,
+		browsers and operating systems (see user_agents.go), empty (the
+		default) for the built in rules. The file is reloaded when it
+		changes.
+	*/
+	UserAgentRulesFile string `json:"user_agent_rules_file"`
+
+	/*
+		Path to a JSON file of bot signatures and the headers every
+		browser sends (see bots.go), empty (the default) for the built
+		in signatures. The file is reloaded when it changes.
+	*/
+	BotSignaturesFile string `json:"bot_signatures_file"`
+
+	/*
+		A visitor expanding more than bot_burst_limit times within
+		bot_burst_seconds is counted as a bot until it slows down. 0
+		turns burst detection off.
+	*/
+	BotBurstLimit   int `json:"bot_burst_limit"`
+	BotBurstSeconds int `json:"bot_burst_seconds"`
+}
+
+// Returns the configuration used when no configuration file is provided
+func DefaultConfig() Config {
+	return Config{
+		AllowDuplicateURLs: false,
+		AliasPolicy:        DefaultAliasPolicy(),
+		PublicBaseURL:      fmt.Sprintf("http://%s:%d", HOSTNAME, PORT),
+
+		PasswordMaxFailures:    5,
+		PasswordLockoutSeconds: 15 * 60,
+
+		BackupFolder:    DATABASE_FOLDER + "backups/",
+		BackupRetention: 7,
+
+		MinFreeDiskBytes: 100 * 1024 * 1024,
+
+		LogFormat: LOG_FORMAT_TEXT,
+
+		QueryTimeoutSeconds: 5,
+		BusyRetries:         5,
+
+		AliasLeaseSeconds: 60,
+
+		WebhookMilestoneInterval: 1000,
+		WebhookTimeoutSeconds:    10,
+		WebhookRetrySeconds:      10,
+		WebhookMaxAttempts:       8,
+		WebhookRetentionSeconds:  7 * 24 * 60 * 60,
+
+		BotBurstLimit:   20,
+		BotBurstSeconds: 10,
+	}
+}
+
+/*
+Loads the server configuration from a JSON file. The file is optional,
+if it does not exist the default configuration is returned.
+
+Note: decoding into a struct that already holds the defaults means only
+the keys present in the file overwrite settings.
+
+Parameters:
+
+	path: Path to the JSON configuration file
+
+Returns:
+
+	The loaded configuration and, if the file could not be read or
+	is not valid JSON, an error.
+*/
+func LoadConfig(path string) (Config, error) {
+	config := DefaultConfig()
+	contents, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return config, nil
+	} else if err != nil {
+		return config, err
+	}
+	err = json.Unmarshal(contents, &config)
+	return config, err
+}
@@ -28,29 +28,26 @@ const DATABASE_FOLDER = "../data/"
 // The path to the database file
 const DATABASE_FILE = DATABASE_FOLDER + "database.db"
 
-// Table creation query
-const QUERY_CREATE_TABLE = `
-CREATE TABLE IF NOT EXISTS aliases (
-	URL TEXT UNIQUE NOT NULL,
-	Alias TEXT PRIMARY KEY,
-	Expansions INT,
-	Automatic BOOL
-);
-`
-
 /*
-Query for getting the next alias upon server boot. In particular, gets
-the maximum automatically assigned alias currently in the database.
+The data source name used to open the database file. _txlock=immediate
+makes every transaction take the write lock when it begins. Transactions
+that read a row before changing it (e.g. for the audit log) would
+otherwise start as readers, and two of them trying to become writers at
+once would fail with SQLITE_BUSY instead of waiting for each other.
+
+_busy_timeout is how long SQLite itself waits for a lock before giving
+up with SQLITE_BUSY. It is kept short (the driver's default is 5s) as a
+waiting call can't be interrupted, which would hold requests past their
+deadline. Longer waits are retried by RunQuery( ) instead, which gives
+up once the request's deadline passes.
+*/
+const DATABASE_DSN = "file:" + DATABASE_FILE + "?_txlock=immediate&_busy_timeout=250"
 
-Note: to avoid doing a string max (which would put "2" over "11"),
-we cast to integer first. Casting is done slightly differently based
-on SQL engine, so this query is not necessarily portable.
+/*
+Note: the tables themselves are no longer created here. Each change to
+the schema lives in a numbered file in the migrations/ folder, see
+migrations.go for how these are applied.
 */
-const QUERY_GET_NEXT_ALIAS = `
-SELECT MAX(CAST(Alias AS INTEGER))
-FROM aliases 
-WHERE Automatic
-`
 
 /*
 This is a query template for inserting a new row (representing an
@@ -67,39 +64,159 @@ triple quote string in Python which allows one to forgo having to
 put in newlines manually while still preserving code readability.
 */
 const QUERY_MAKE_MAPPING_TEMPLATE = `
-INSERT INTO aliases (URL, Alias, Expansions, Automatic) 
-VALUES (?, ?, 0, ?)
+INSERT INTO aliases (URL, Alias, Expansions, Automatic, PasswordHash, MaxExpansions, Created, QueryPassthrough, UTMDefaults, RoutingRules, Campaign) 
+VALUES (?, ?, 0, ?, ?, ?, ?, ?, ?, ?, ?)
 `
 
-// Query to get the alias associated with a URL
-const QUERY_GET_ALIAS_BY_URL_TEMPLATE = `
+/*
+This is a query template for inserting a new mapping only if it passes
+two optional checks. It is used when a URL may only be shortened once
+(the default) or when aliases must be unique ignoring case (see
+alias_policy.go). The first placeholders are the same as in
+QUERY_MAKE_MAPPING_TEMPLATE. Then, each check is a pair of placeholders:
+whether the check is on, followed by the value checked.
+
+1. If on, the URL must not already have an alias.
+2. If on, no alias may match the new one ignoring case. COLLATE NOCASE
+makes the = comparison ignore (ASCII) case.
+
+Note: SQLite runs a single statement atomically, so there is no window
+between the NOT EXISTS checks and the insert for a concurrent request
+to sneak in a conflicting mapping. If a check fails, no row is inserted,
+which we detect by checking the rows affected.
+*/
+const QUERY_MAKE_CHECKED_MAPPING_TEMPLATE = `
+INSERT INTO aliases (URL, Alias, Expansions, Automatic, PasswordHash, MaxExpansions, Created, QueryPassthrough, UTMDefaults, RoutingRules, Campaign)
+SELECT ?, ?, 0, ?, ?, ?, ?, ?, ?, ?, ?
+WHERE NOT (? AND EXISTS (
+	SELECT 1
+	FROM aliases
+	WHERE URL = ?
+))
+AND NOT (? AND EXISTS (
+	SELECT 1
+	FROM aliases
+	WHERE Alias = ? COLLATE NOCASE
+))
+`
+
+/*
+Query to get the aliases associated with a URL. rowid is the insertion
+order of rows, so the oldest alias is returned first.
+*/
+const QUERY_GET_ALIASES_BY_URL_TEMPLATE = `
 SELECT Alias
 FROM aliases 
 WHERE URL = ?
+ORDER BY rowid
 `
 
-// Query to get the URL associated with an alias
-const QUERY_GET_URL_BY_ALIAS_TEMPLATE = `
-SELECT URL
+/*
+Query to get the URL associated with an alias along with the settings
+needed to expand it (see the Link type)
+*/
+const QUERY_GET_LINK_BY_ALIAS_TEMPLATE = `
+SELECT URL, PasswordHash, Disabled, QueryPassthrough, UTMDefaults, RoutingRules
 FROM aliases
 WHERE Alias = ?
 `
 
-// Query to increment number of expansions for an alias
+/*
+Query to increment number of expansions for an alias, unless the alias
+has reached its maximum number of expansions.
+
+Note: the check and the increment are a single statement, which SQLite
+runs atomically. If they were separate (read Expansions, compare, then
+update), two concurrent expansions of a one-time link could both read 0
+and both succeed. Here, the second UPDATE sees the first one's increment
+and matches no rows, so it returns no row.
+
+The new count and the cap are returned for the webhook events they may
+trigger (see webhooks.go).
+*/
 const QUERY_UPDATE_ANALYTICS_BY_ALIAS_TEMPLATE = `
 UPDATE aliases 
 SET Expansions = Expansions + 1
 WHERE Alias = ?
+AND (MaxExpansions IS NULL OR Expansions < MaxExpansions)
+RETURNING Expansions, MaxExpansions
+`
+
+/*
+Query to record a single expansion of an alias in the click history, along
+with the query parameters it came with and what its User-Agent was sorted
+into
+*/
+const QUERY_RECORD_CLICK_TEMPLATE = `
+INSERT INTO clicks (Alias, Time, Params, Device, Browser, OS, Variant)
+VALUES (?, ?, ?, ?, ?, ?, ?)
 `
 
-// Query to get the number of expansions for an alias
+/*
+Query to get the number of expansions (and the cap on them) for an alias,
+along with its expansions by bots (see bots.go) and its all time visitor
+sketch (see visitors.go)
+*/
 const QUERY_GET_ANALYTICS_BY_ALIAS_TEMPLATE = `
-SELECT URL, Expansions
+SELECT URL, Expansions, MaxExpansions, BotExpansions, VisitorSketch
+FROM aliases
+WHERE Alias = ?
+`
+
+// Query to get the URL of an alias, for analytics read from other tables
+const QUERY_GET_URL_BY_ALIAS_TEMPLATE = `
+SELECT URL
 FROM aliases
 WHERE Alias = ?
 `
 
-// Violation reported when an insert fails due to duplicate URLs
+/*
+Query template for changing the URL and settings of an existing mapping.
+The password is only changed if the first placeholder is true, so an
+edit can keep the current password without knowing it. Like
+QUERY_MAKE_CHECKED_MAPPING_TEMPLATE, the update is skipped if duplicate
+URLs are not allowed (the second to last check placeholder is true) and
+another alias has the new URL.
+*/
+const QUERY_UPDATE_MAPPING_TEMPLATE = `
+UPDATE aliases
+SET URL = ?,
+	MaxExpansions = ?,
+	PasswordHash = CASE WHEN ? THEN ? ELSE PasswordHash END
+WHERE Alias = ?
+AND NOT (? AND EXISTS (
+	SELECT 1
+	FROM aliases AS others
+	WHERE others.URL = ? AND others.Alias <> ?
+))
+`
+
+// Query template for switching a mapping off (or back on)
+const QUERY_SET_DISABLED_TEMPLATE = `
+UPDATE aliases
+SET Disabled = ?
+WHERE Alias = ?
+`
+
+/*
+Query templates for deleting a mapping along with its click history.
+These are run in one transaction.
+*/
+const QUERY_DELETE_MAPPING_TEMPLATE = `
+DELETE FROM aliases
+WHERE Alias = ?
+`
+const QUERY_DELETE_CLICKS_TEMPLATE = `
+DELETE FROM clicks
+WHERE Alias = ?
+`
+
+/*
+Violation reported when an insert fails due to duplicate URLs. The
+table no longer has a UNIQUE constraint on URL (so that duplicates can
+be allowed), so this is reported by InsertMapping( ) instead of SQLite.
+The message is kept identical to what SQLite used to report.
+*/
 const DUPLICATE_URL_VIOLATION = "UNIQUE constraint failed: aliases.URL"
 
 // Violation reported when an insert fails due to duplicate aliases
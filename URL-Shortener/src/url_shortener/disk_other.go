@@ -0,0 +1,30 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+/*
+Package url_shortener serves as a library of utilities for the URL-Shortener
+application. This includes the definition of our API, database configuration,
+and HTTP server implementation. This is used by the main package to instantiate
+and run a server easily. This library could be used in other applications
+that do more than just initializing and booting a server.
+
+This file provides the free disk space check used by readiness (see
+health.go) on systems where we don't know how to read it. Readiness then
+reports the check as unknown rather than failing it.
+*/
+
+package url_shortener
+
+/*
+Stands in for reading the disk space on systems it isn't implemented for.
+
+Parameters:
+
+	folder: Path to the folder (unused)
+
+Returns:
+
+	0 and ErrFreeDiskSpaceUnsupported.
+*/
+func FreeDiskSpace(folder string) (uint64, error) {
+	return 0, ErrFreeDiskSpaceUnsupported
+}
@@ -0,0 +1,40 @@
+//go:build linux || darwin || freebsd
+
+/*
+Package url_shortener serves as a library of utilities for the URL-Shortener
+application. This includes the definition of our API, database configuration,
+and HTTP server implementation. This is used by the main package to instantiate
+and run a server easily. This library could be used in other applications
+that do more than just initializing and booting a server.
+
+This file provides the free disk space check used by readiness (see
+health.go) on Unix systems, where it is read with statfs.
+*/
+
+package url_shortener
+
+import "syscall"
+
+/*
+Gets the disk space available to the server in the file system holding
+a folder.
+
+Parameters:
+
+	folder: Path to the folder
+
+Returns:
+
+	The number of free bytes (that an unprivileged user may use) and, if
+	they could not be found, an error.
+*/
+func FreeDiskSpace(folder string) (uint64, error) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(folder, &stat)
+	if err != nil {
+		return 0, err
+	}
+
+	// Field types differ between systems, hence the conversions
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,50 @@
+//go:build windows
+
+/*
+Package url_shortener serves as a library of utilities for the URL-Shortener
+application. This includes the definition of our API, database configuration,
+and HTTP server implementation. This is used by the main package to instantiate
+and run a server easily. This library could be used in other applications
+that do more than just initializing and booting a server.
+
+This file provides the free disk space check used by readiness (see
+health.go) on Windows, where it is read with GetDiskFreeSpaceExW.
+*/
+
+package url_shortener
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// GetDiskFreeSpaceExW from kernel32.dll, loaded the first time it is called
+var getDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+/*
+Gets the disk space available to the server on the volume holding a
+folder.
+
+Parameters:
+
+	folder: Path to the folder
+
+Returns:
+
+	The number of free bytes (available to the user running the server,
+	which quotas may limit) and, if they could not be found, an error.
+*/
+func FreeDiskSpace(folder string) (uint64, error) {
+	path, err := syscall.UTF16PtrFromString(folder)
+	if err != nil {
+		return 0, err
+	}
+	var free uint64
+
+	// A return of 0 means the call failed, err is then set from GetLastError
+	result, _, err := getDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(path)), uintptr(unsafe.Pointer(&free)), 0, 0)
+	if result == 0 {
+		return 0, err
+	}
+	return free, nil
+}
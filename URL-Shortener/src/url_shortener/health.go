@@ -0,0 +1,159 @@
+/*
+Package url_shortener serves as a library of utilities for the URL-Shortener
+application. This includes the definition of our API, database configuration,
+and HTTP server implementation. This is used by the main package to instantiate
+and run a server easily. This library could be used in other applications
+that do more than just initializing and booting a server.
+
+This file provides the liveness (/healthz) and readiness (/readyz) checks
+an orchestrator uses to decide whether to restart the server or send it
+traffic. Liveness only says the server is answering. Readiness also
+checks that setup finished, the database answers, there is disk space
+left for the database, and the server isn't shutting down.
+*/
+
+package url_shortener
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// How long the readiness check waits for the database to answer
+const READINESS_PING_TIMEOUT = 2 * time.Second
+
+// Names of the readiness checks
+const CHECK_MIGRATIONS = "migrations"
+const CHECK_NEXT_ALIAS = "next_alias"
+const CHECK_DATABASE = "database"
+const CHECK_DISK = "disk"
+const CHECK_SHUTDOWN = "shutdown"
+
+// Statuses of a readiness check
+const CHECK_OK = "ok"
+const CHECK_FAILED = "failed"
+
+// Disk space that couldn't be read doesn't fail readiness
+const CHECK_UNKNOWN = "unknown"
+
+// Returned by FreeDiskSpace( ) on systems it isn't implemented for
+var ErrFreeDiskSpaceUnsupported = errors.New("free disk space is not supported on this system")
+
+/*
+Runs the readiness checks on a server. Checks are independent of each
+other so every failing check is reported, not just the first.
+
+Parameters:
+
+	s: Pointer to Server to check
+	ctx: Context of the readiness request, the database ping stops if it
+		is cancelled
+
+Returns:
+
+	The result of each check and whether the server is ready (every check
+	is ok or unknown).
+*/
+func CheckReadiness(s *Server, ctx context.Context) ([]HealthCheck, bool) {
+	checks := []HealthCheck{}
+	add := func(check HealthCheck) {
+		checks = append(checks, check)
+	}
+
+	if s.migrated.Load() {
+		add(HealthCheck{Name: CHECK_MIGRATIONS, Status: CHECK_OK})
+	} else {
+		add(HealthCheck{Name: CHECK_MIGRATIONS, Status: CHECK_FAILED, Detail: "migrations have not been applied yet"})
+	}
+	if s.aliasesLoaded.Load() {
+		add(HealthCheck{Name: CHECK_NEXT_ALIAS, Status: CHECK_OK})
+	} else {
+		add(HealthCheck{Name: CHECK_NEXT_ALIAS, Status: CHECK_FAILED, Detail: "alias allocator has not been loaded yet"})
+	}
+
+	ping_ctx, cancel := context.WithTimeout(ctx, READINESS_PING_TIMEOUT)
+	defer cancel()
+	err := s.db.PingContext(ping_ctx)
+	if err != nil {
+		add(HealthCheck{Name: CHECK_DATABASE, Status: CHECK_FAILED, Detail: err.Error()})
+	} else {
+		add(HealthCheck{Name: CHECK_DATABASE, Status: CHECK_OK})
+	}
+
+	free, err := FreeDiskSpace(DATABASE_FOLDER)
+	if errors.Is(err, ErrFreeDiskSpaceUnsupported) {
+		add(HealthCheck{Name: CHECK_DISK, Status: CHECK_UNKNOWN, Detail: err.Error()})
+	} else if err != nil {
+		add(HealthCheck{Name: CHECK_DISK, Status: CHECK_FAILED, Detail: err.Error()})
+	} else if free < s.config.MinFreeDiskBytes {
+		add(HealthCheck{Name: CHECK_DISK, Status: CHECK_FAILED, Detail: fmt.Sprintf("less than %d bytes free", s.config.MinFreeDiskBytes), FreeBytes: &free})
+	} else {
+		add(HealthCheck{Name: CHECK_DISK, Status: CHECK_OK, FreeBytes: &free})
+	}
+
+	if s.draining.Load() {
+		add(HealthCheck{Name: CHECK_SHUTDOWN, Status: CHECK_FAILED, Detail: "server is shutting down"})
+	} else {
+		add(HealthCheck{Name: CHECK_SHUTDOWN, Status: CHECK_OK})
+	}
+
+	ready := true
+	for _, check := range checks {
+		if check.Status == CHECK_FAILED {
+			ready = false
+		}
+	}
+	return checks, ready
+}
+
+/*
+Handles requests on /healthz. If the server can answer at all, it is
+alive, so this always succeeds (even while shutting down).
+
+Parameters:
+
+	w: Where we write response for user
+	request: Pointer to struct that represents contents of HTTP
+		request
+*/
+func Healthz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		ReportInvalidMethodError(w, r, r.Method)
+		return
+	}
+	RespondAsJSON(w, HealthResponse{Status: CHECK_OK})
+}
+
+/*
+Handles requests on /readyz. The response describes each check, with a
+service unavailable (503) status if any failed so an orchestrator stops
+sending traffic.
+
+Parameters:
+
+	s: Pointer to HTTP server to check
+	w: Where we write response for user
+	request: Pointer to struct that represents contents of HTTP
+		request
+*/
+func Readyz(s *Server, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		ReportInvalidMethodError(w, r, r.Method)
+		return
+	}
+
+	checks, ready := CheckReadiness(s, r.Context())
+	response := ReadinessResponse{Status: CHECK_OK, Checks: checks}
+
+	// RespondAsJSON( ) always answers OK, so the status is written here
+	w.Header().Set("Content-Type", "application/json")
+	if !ready {
+		response.Status = CHECK_FAILED
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,673 @@
+/*
+Package url_shortener serves as a library of utilities for the URL-Shortener
+application. This includes the definition of our API, database configuration,
+and HTTP server implementation. This is used by the main package to instantiate
+and run a server easily. This library could be used in other applications
+that do more than just initializing and booting a server.
+
+This file provides the links/ endpoint which lists the existing mappings a
+page at a time. Pages are found with a cursor (the sort key of the last
+link on the previous page) rather than an offset, so a page is as fast to
+get at the end of the table as at the start, and links created between
+requests don't shift later pages.
+
+It also provides the changes that can be made to existing links (editing,
+disabling and deleting them), which the admin dashboard uses.
+*/
+
+package url_shortener
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Number of links in a page when the request does not give a limit
+const LINKS_DEFAULT_LIMIT = 50
+
+// Largest number of links a request may ask for in one page
+const LINKS_MAX_LIMIT = 500
+
+/*
+The columns links can be sorted by. Created is NULL for links made before
+creation times were recorded, these sort as if created at time 0 (i.e.
+first). Every sort ends with the alias so the order is total, which is
+what lets a cursor say exactly where a page stopped.
+*/
+var LINKS_SORT_COLUMNS = map[string]string{
+	"alias":      "Alias",
+	"created":    "COALESCE(Created, 0)",
+	"expansions": "Expansions",
+}
+
+/*
+Holds where a page stopped: the sort key and alias of its last link. The
+sort and order are kept too so a cursor can't be used with a different
+sort, which would skip or repeat links. It is sent to the user as base64
+encoded JSON, which they should treat as opaque.
+*/
+type LinksCursor struct {
+	Sort  string `json:"s"`
+	Order string `json:"o"`
+	Key   int64  `json:"k,omitempty"`
+	Alias string `json:"a"`
+}
+
+// Encodes a cursor for the next_cursor field of a LinksPage
+func EncodeLinksCursor(cursor LinksCursor) string {
+	contents, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(contents)
+}
+
+// Decodes a cursor made by EncodeLinksCursor( )
+func DecodeLinksCursor(encoded string) (LinksCursor, error) {
+	var cursor LinksCursor
+	contents, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return cursor, err
+	}
+	err = json.Unmarshal(contents, &cursor)
+	return cursor, err
+}
+
+/*
+Parses a time given in a query parameter (e.g. created_after on links/).
+Either a full RFC 3339 timestamp or just a date (taken as midnight UTC)
+is accepted.
+
+Returns:
+
+	The time as Unix seconds and, if it could not be parsed, an error.
+*/
+func ParseTimeParameter(value string) (int64, error) {
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		parsed, err = time.Parse(time.DateOnly, value)
+	}
+	return parsed.Unix(), err
+}
+
+/*
+Represents the filters, sort and page of a links/ request, parsed from
+its query parameters.
+*/
+type LinksQuery struct {
+	// Exact alias to get, only used internally (see GetLinkSummary( ))
+	Alias string
+
+	AliasPrefix   string
+	UrlContains   string
+	Automatic     *bool
+	CreatedAfter  *int64
+	CreatedBefore *int64
+	Tags          []string
+	Campaign      string
+	Sort          string
+	Order         string
+	Limit         int
+	Cursor        *LinksCursor
+
+	/*
+		Whether the URLs of password protected links are blanked out and
+		left out of UrlContains matches, so the listing can't be used to
+		find them. Set on the public links/ endpoint, the admin dashboard
+		sees every URL.
+	*/
+	HideProtectedUrls bool
+}
+
+/*
+Parses the query parameters of a links/ request, see LINKS_ENDPOINT for
+the parameters.
+
+Parameters:
+
+	r: The links/ request
+
+Returns:
+
+	The parsed query and a message for the user if a parameter is invalid
+	(empty if they are all valid).
+*/
+func ParseLinksQuery(r *http.Request) (*LinksQuery, string) {
+	params := r.URL.Query()
+	query := &LinksQuery{
+		AliasPrefix: params.Get("alias_prefix"),
+		UrlContains: params.Get("url_contains"),
+		Sort:        "created",
+		Order:       "asc",
+		Limit:       LINKS_DEFAULT_LIMIT,
+	}
+
+	if params.Has("automatic") {
+		automatic, err := strconv.ParseBool(params.Get("automatic"))
+		if err != nil {
+			return nil, "automatic must be true or false"
+		}
+		query.Automatic = &automatic
+	}
+	if params.Has("created_after") {
+		after, err := ParseTimeParameter(params.Get("created_after"))
+		if err != nil {
+			return nil, "created_after must be a date (YYYY-MM-DD) or RFC 3339 time"
+		}
+		query.CreatedAfter = &after
+	}
+	if params.Has("created_before") {
+		before, err := ParseTimeParameter(params.Get("created_before"))
+		if err != nil {
+			return nil, "created_before must be a date (YYYY-MM-DD) or RFC 3339 time"
+		}
+		query.CreatedBefore = &before
+	}
+	if params.Has("tag") {
+		tags, err_msg := NormalizeTags(params["tag"])
+		if err_msg != "" {
+			return nil, err_msg
+		}
+		query.Tags = tags
+	}
+	if params.Has("campaign") {
+		campaign, err_msg := NormalizeCampaign(params.Get("campaign"))
+		if err_msg != "" || !campaign.Valid {
+			return nil, "campaign must be 1 to 64 letters, digits, - or _"
+		}
+		query.Campaign = campaign.String
+	}
+	if params.Has("sort") {
+		query.Sort = params.Get("sort")
+		if _, ok := LINKS_SORT_COLUMNS[query.Sort]; !ok {
+			return nil, "sort must be one of alias, created, expansions"
+		}
+	}
+	if params.Has("order") {
+		query.Order = params.Get("order")
+		if query.Order != "asc" && query.Order != "desc" {
+			return nil, "order must be asc or desc"
+		}
+	}
+	if params.Has("limit") {
+		limit, err := strconv.Atoi(params.Get("limit"))
+		if err != nil || limit < 1 || limit > LINKS_MAX_LIMIT {
+			return nil, fmt.Sprintf("limit must be an integer between 1 and %d", LINKS_MAX_LIMIT)
+		}
+		query.Limit = limit
+	}
+	if params.Has("cursor") {
+		cursor, err := DecodeLinksCursor(params.Get("cursor"))
+		if err != nil {
+			return nil, "cursor is not valid"
+		}
+		if cursor.Sort != query.Sort || cursor.Order != query.Order {
+			return nil, "cursor was made for a different sort or order"
+		}
+		query.Cursor = &cursor
+	}
+	return query, ""
+}
+
+/*
+Builds the SQL for a links/ request. Only fixed pieces of SQL (e.g. the
+sort column from LINKS_SORT_COLUMNS) are put into the query text, every
+value from the user is passed as an argument.
+
+Note: the alias prefix and URL substring are matched with substr( ) and
+instr( ) rather than LIKE, so % and _ in them are matched literally.
+
+Returns:
+
+	The query and its arguments.
+*/
+func BuildLinksQuery(query *LinksQuery) (string, []any) {
+	var conditions []string
+	var args []any
+
+	if query.Alias != "" {
+		conditions = append(conditions, "Alias = ?")
+		args = append(args, query.Alias)
+	}
+	if query.AliasPrefix != "" {
+		conditions = append(conditions, "substr(Alias, 1, length(?)) = ?")
+		args = append(args, query.AliasPrefix, query.AliasPrefix)
+	}
+	if query.UrlContains != "" {
+		conditions = append(conditions, "instr(URL, ?) > 0")
+		args = append(args, query.UrlContains)
+		if query.HideProtectedUrls {
+			conditions = append(conditions, "PasswordHash IS NULL")
+		}
+	}
+	if query.Automatic != nil {
+		conditions = append(conditions, "Automatic = ?")
+		args = append(args, *query.Automatic)
+	}
+	if query.CreatedAfter != nil {
+		conditions = append(conditions, "Created >= ?")
+		args = append(args, *query.CreatedAfter)
+	}
+	if query.CreatedBefore != nil {
+		conditions = append(conditions, "Created < ?")
+		args = append(args, *query.CreatedBefore)
+	}
+	for _, tag := range query.Tags {
+		conditions = append(conditions, "EXISTS (SELECT 1 FROM link_tags WHERE link_tags.Alias = aliases.Alias AND Tag = ?)")
+		args = append(args, tag)
+	}
+	if query.Campaign != "" {
+		conditions = append(conditions, "Campaign = ?")
+		args = append(args, query.Campaign)
+	}
+
+	column := LINKS_SORT_COLUMNS[query.Sort]
+	comparison := ">"
+	direction := "ASC"
+	if query.Order == "desc" {
+		comparison = "<"
+		direction = "DESC"
+	}
+
+	/*
+		Continue after the cursor: links whose sort key is past the
+		cursor's, or equal to it with an alias past the cursor's alias.
+	*/
+	if query.Cursor != nil {
+		if query.Sort == "alias" {
+			conditions = append(conditions, "Alias "+comparison+" ?")
+			args = append(args, query.Cursor.Alias)
+		} else {
+			conditions = append(conditions, fmt.Sprintf("(%s %s ? OR (%s = ? AND Alias %s ?))", column, comparison, column, comparison))
+			args = append(args, query.Cursor.Key, query.Cursor.Key, query.Cursor.Alias)
+		}
+	}
+
+	/*
+		Tags are joined with commas, which they can't contain. The lookup
+		goes through the primary key of link_tags, so they come in order.
+	*/
+	sql_query := "SELECT URL, Alias, Expansions, Automatic, Created, MaxExpansions, PasswordHash IS NOT NULL, Disabled, Campaign, " +
+		"(SELECT group_concat(Tag, ',') FROM link_tags WHERE link_tags.Alias = aliases.Alias) FROM aliases"
+	if len(conditions) > 0 {
+		sql_query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	if query.Sort == "alias" {
+		sql_query += fmt.Sprintf(" ORDER BY Alias %s", direction)
+	} else {
+		sql_query += fmt.Sprintf(" ORDER BY %s %s, Alias %s", column, direction, direction)
+	}
+
+	// One extra row tells us whether there is another page
+	sql_query += " LIMIT ?"
+	args = append(args, query.Limit+1)
+	return sql_query, args
+}
+
+/*
+Gets a page of links from the server's database.
+
+Parameters:
+
+	s: Pointer to Server whose database we query
+	ctx: Context of the request the page is for
+	query: The parsed links/ request
+
+Returns:
+
+	The page and, if the query failed, an error.
+*/
+func GetLinksPage(s *Server, ctx context.Context, query *LinksQuery) (*LinksPage, error) {
+	sql_query, args := BuildLinksQuery(query)
+	var page *LinksPage
+	var keys []int64
+	err := RunQuery(s, ctx, func(ctx context.Context) error {
+		rows, err := s.db.QueryContext(ctx, sql_query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		page = &LinksPage{Links: []LinkSummary{}}
+		keys = nil
+		for rows.Next() {
+			var link LinkSummary
+			var created sql.NullInt64
+			var max_expansions sql.NullInt64
+			var campaign, tags sql.NullString
+			err = rows.Scan(&link.Url, &link.Alias, &link.Expansions, &link.Automatic, &created, &max_expansions, &link.Protected, &link.Disabled, &campaign, &tags)
+			if err != nil {
+				return err
+			}
+			if link.Protected && query.HideProtectedUrls {
+				link.Url = ""
+			}
+			link.Campaign = campaign.String
+			if tags.Valid {
+				link.Tags = strings.Split(tags.String, ",")
+			}
+			if created.Valid {
+				link.Created = time.Unix(created.Int64, 0).UTC().Format(time.RFC3339)
+			}
+			if max_expansions.Valid {
+				limit := int(max_expansions.Int64)
+				link.MaxExpansions = &limit
+			}
+			page.Links = append(page.Links, link)
+
+			// Remember the sort key in case this link ends the page
+			switch query.Sort {
+			case "created":
+				keys = append(keys, created.Int64)
+			case "expansions":
+				keys = append(keys, int64(link.Expansions))
+			default:
+				keys = append(keys, 0)
+			}
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(page.Links) > query.Limit {
+		page.Links = page.Links[:query.Limit]
+		last := page.Links[query.Limit-1]
+		page.NextCursor = EncodeLinksCursor(LinksCursor{
+			Sort:  query.Sort,
+			Order: query.Order,
+			Key:   keys[query.Limit-1],
+			Alias: last.Alias,
+		})
+	}
+	return page, nil
+}
+
+/*
+Gets the summary of a single link, the same as it would appear in a page
+of links.
+
+Parameters:
+
+	s: Pointer to Server whose database we query
+	ctx: Context of the request the link is for
+	alias: The alias of the link
+
+Returns:
+
+	The link and, if the query failed, an error. If the alias is not
+	mapped, the error is sql.ErrNoRows.
+*/
+func GetLinkSummary(s *Server, ctx context.Context, alias string) (*LinkSummary, error) {
+	page, err := GetLinksPage(s, ctx, &LinksQuery{Alias: alias, Sort: "alias", Order: "asc", Limit: 1})
+	if err != nil {
+		return nil, err
+	}
+	if len(page.Links) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &page.Links[0], nil
+}
+
+/*
+Handles requests on the /links endpoint.
+
+Parameters:
+
+	s: Pointer to HTTP server whose links are listed
+	request: Pointer to struct that represents contents of HTTP
+		request
+	w: Where we write response for user
+*/
+func Links(s *Server, w http.ResponseWriter, r *http.Request) {
+	// Only GET requests are allowed on the links endpoint
+	if r.Method != http.MethodGet {
+		ReportInvalidMethodError(w, r, r.Method)
+		return
+	}
+
+	query, err_msg := ParseLinksQuery(r)
+	if err_msg != "" {
+		ReportBadRequestError(w, r, r.URL.RawQuery, err_msg)
+		return
+	}
+
+	// Anyone can list links, but only the password opens a protected one
+	query.HideProtectedUrls = true
+	page, err := GetLinksPage(s, r.Context(), query)
+	if err != nil {
+		ReportUnexpectedInternalServerError(w, r, err)
+		return
+	}
+	RespondAsJSON(w, page)
+}
+
+/*
+Represents the changes made when editing a link. The alias itself can't
+be changed as it may already be printed or shared.
+*/
+type LinkUpdate struct {
+	Url string
+
+	// Cap on the number of expansions, 0 for no cap
+	MaxExpansions int
+
+	/*
+		If true, the password is replaced by Password (or removed if
+		Password is empty). If false, the current password is kept.
+	*/
+	ChangePassword bool
+	Password       string
+
+	// Same as in ShortenRequest
+	AllowDuplicateUrl bool
+
+	// Replace the link's tags and campaign (empty for none)
+	Tags     []string
+	Campaign string
+}
+
+/*
+Edits an existing link.
+
+Parameters:
+
+	s: Pointer to Server whose database we update
+	ctx: Context of the request making the change
+	alias: The alias of the link to edit
+	update: The changes to make
+	actor: Who is making the changes, recorded in the audit log
+
+Returns:
+
+	An error message that is meant to be sent to the user (like in
+	ShortenAutomatic( ), INTERNAL_ERROR_MESSAGE for internal errors) and
+	the error that occurred. If the alias is not mapped, the error is
+	sql.ErrNoRows. If successful, these are the empty string and nil.
+*/
+func UpdateLink(s *Server, ctx context.Context, alias string, update *LinkUpdate, actor *Actor) (string, error) {
+	if update.Url == "" {
+		return "URL must not be empty", errors.New("empty URL in link update")
+	}
+	settings, err_msg, err := NewLinkSettings(&ShortenRequest{
+		Url:           update.Url,
+		Password:      update.Password,
+		MaxExpansions: update.MaxExpansions,
+		Tags:          update.Tags,
+		Campaign:      update.Campaign,
+	})
+	if err != nil {
+		return err_msg, err
+	}
+
+	check_url := !(s.config.AllowDuplicateURLs || update.AllowDuplicateUrl)
+	var updated int64
+	err = RunQuery(s, ctx, func(ctx context.Context) error {
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		before, err := GetLinkState(ctx, tx, alias)
+		if err != nil {
+			return err
+		}
+		result, err := tx.ExecContext(ctx, QUERY_UPDATE_MAPPING_TEMPLATE, update.Url, settings.MaxExpansions, update.ChangePassword, settings.PasswordHash, alias, check_url, update.Url, alias)
+		if err != nil {
+			return err
+		}
+		updated, err = result.RowsAffected()
+		if err != nil || updated == 0 {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, QUERY_UPDATE_CAMPAIGN_TEMPLATE, settings.Campaign, alias)
+		if err != nil {
+			return err
+		}
+		err = SetLinkTags(ctx, tx, alias, settings.Tags)
+		if err != nil {
+			return err
+		}
+
+		after, err := GetLinkState(ctx, tx, alias)
+		if err != nil {
+			return err
+		}
+		err = RecordAudit(ctx, tx, AUDIT_ACTION_UPDATE, alias, actor, before, after)
+		if err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err == sql.ErrNoRows {
+		return fmt.Sprintf("Cannot edit %s, not mapped", alias), err
+	} else if err != nil {
+		return INTERNAL_ERROR_MESSAGE, err
+	}
+
+	// The alias exists, so nothing updated means the URL check failed
+	if updated == 0 {
+		err_msg, err = DuplicateURLMessage(s, ctx, update.Url)
+		if err != nil {
+			return INTERNAL_ERROR_MESSAGE, err
+		}
+		return err_msg, errors.New(DUPLICATE_URL_VIOLATION)
+	}
+	return "", nil
+}
+
+/*
+Switches a link off or back on. A disabled link keeps its analytics but
+can't be expanded.
+
+Parameters:
+
+	s: Pointer to Server whose database we update
+	ctx: Context of the request making the change
+	alias: The alias of the link
+	disabled: Whether the link should be disabled
+	actor: Who is switching the link, recorded in the audit log
+
+Returns:
+
+	If the alias is not mapped, sql.ErrNoRows. Otherwise, any error that
+	occurred or nil.
+*/
+func SetLinkDisabled(s *Server, ctx context.Context, alias string, disabled bool, actor *Actor) error {
+	action := AUDIT_ACTION_ENABLE
+	if disabled {
+		action = AUDIT_ACTION_DISABLE
+	}
+	return RunQuery(s, ctx, func(ctx context.Context) error {
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		before, err := GetLinkState(ctx, tx, alias)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, QUERY_SET_DISABLED_TEMPLATE, disabled, alias)
+		if err != nil {
+			return err
+		}
+		after, err := GetLinkState(ctx, tx, alias)
+		if err != nil {
+			return err
+		}
+		err = RecordAudit(ctx, tx, action, alias, actor, before, after)
+		if err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+}
+
+/*
+Deletes a link along with its click history. The audit log keeps its
+entries about the link, ending with the delete.
+
+Note: the alias can then be used again as a custom alias. Automatic
+aliases are never assigned again, as the alias sequence only moves
+forward (see alias_allocator.go).
+
+Parameters:
+
+	s: Pointer to Server whose database we update
+	ctx: Context of the request making the change
+	alias: The alias of the link
+	actor: Who is deleting the link, recorded in the audit log
+
+Returns:
+
+	If the alias is not mapped, sql.ErrNoRows. Otherwise, any error that
+	occurred or nil.
+*/
+func DeleteLink(s *Server, ctx context.Context, alias string, actor *Actor) error {
+	return RunQuery(s, ctx, func(ctx context.Context) error {
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		before, err := GetLinkState(ctx, tx, alias)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, QUERY_DELETE_MAPPING_TEMPLATE, alias)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, QUERY_DELETE_CLICKS_TEMPLATE, alias)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, QUERY_DELETE_VISITOR_SKETCHES_TEMPLATE, alias)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, QUERY_DELETE_DESTINATIONS_TEMPLATE, alias)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, QUERY_DELETE_TAGS_TEMPLATE, alias)
+		if err != nil {
+			return err
+		}
+		err = RecordAudit(ctx, tx, AUDIT_ACTION_DELETE, alias, actor, before, nil)
+		if err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+}
@@ -0,0 +1,193 @@
+/*
+Package url_shortener serves as a library of utilities for the URL-Shortener
+application. This includes the definition of our API, database configuration,
+and HTTP server implementation. This is used by the main package to instantiate
+and run a server easily. This library could be used in other applications
+that do more than just initializing and booting a server.
+
+This file provides structured logging with log/slog. Every request is
+given an ID (taken from its X-Request-ID header or generated), which is
+sent back in the response and attached to every log record made while
+handling the request, so the records of a request can be found together.
+Once a request is answered, one record sums it up (method, path, status,
+latency and bytes written).
+*/
+
+package url_shortener
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"time"
+)
+
+// Header a request ID is read from and written to
+const REQUEST_ID_HEADER = "X-Request-ID"
+
+/*
+Request IDs given by clients are only used if they match this, so they
+can't fill the logs or break log lines. Otherwise, one is generated.
+*/
+var REQUEST_ID_PATTERN = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// Values of the log_format setting
+const LOG_FORMAT_TEXT = "text"
+const LOG_FORMAT_JSON = "json"
+
+/*
+Key of the request's logger in its context. Using an unexported type as
+the key means no other package can collide with it.
+*/
+type loggerKey struct{}
+
+/*
+Makes the server log with log/slog in the configured format. This also
+sends the log package's output (e.g. log.Println) through slog, so
+records made outside of requests share the format.
+
+Parameters:
+
+	config: Server configuration holding the log format
+
+Returns:
+
+	If the format is not known, an error, otherwise nil.
+*/
+func SetUpLogging(config Config) error {
+	var handler slog.Handler
+	switch config.LogFormat {
+	case LOG_FORMAT_TEXT:
+		handler = slog.NewTextHandler(os.Stderr, nil)
+	case LOG_FORMAT_JSON:
+		handler = slog.NewJSONHandler(os.Stderr, nil)
+	default:
+		return fmt.Errorf("log_format must be %s or %s", LOG_FORMAT_TEXT, LOG_FORMAT_JSON)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+/*
+Gets the logger of a request, which adds the request's ID to its records.
+
+Parameters:
+
+	r: The request
+
+Returns:
+
+	The request's logger, or the default logger if the request did not
+	go through LogRequests( ).
+*/
+func RequestLogger(r *http.Request) *slog.Logger {
+	logger, ok := r.Context().Value(loggerKey{}).(*slog.Logger)
+	if !ok {
+		return slog.Default()
+	}
+	return logger
+}
+
+/*
+Gets the ID of a request from its header, or makes one if the header is
+missing or not a valid ID.
+
+Parameters:
+
+	r: The request
+
+Returns:
+
+	The request ID.
+*/
+func GetRequestID(r *http.Request) string {
+	id := r.Header.Get(REQUEST_ID_HEADER)
+	if REQUEST_ID_PATTERN.MatchString(id) {
+		return id
+	}
+	random := make([]byte, 16)
+
+	// crypto/rand only fails if the system has no randomness to give
+	_, err := rand.Read(random)
+	if err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(random)
+}
+
+/*
+Wraps a ResponseWriter to keep track of the status and number of bytes
+written, for the record that sums up a request.
+*/
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+// Records the status before writing it
+func (w *responseRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Counts the bytes written, a write without a status means OK (200)
+func (w *responseRecorder) Write(contents []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(contents)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Lets http.ResponseController reach the wrapped ResponseWriter
+func (w *responseRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+/*
+Wraps a handler so that every request gets an ID and a logger (see
+RequestLogger( )), and is logged once it has been answered.
+
+Parameters:
+
+	next: The handler that answers requests
+
+Returns:
+
+	The wrapped handler.
+*/
+func LogRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := GetRequestID(r)
+		logger := slog.Default().With("request_id", id)
+		w.Header().Set(REQUEST_ID_HEADER, id)
+
+		recorder := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), loggerKey{}, logger)))
+
+		// A handler that wrote nothing answered OK (200)
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		// The query is left out as it may hold personal data (e.g. searches)
+		logger.Info("Request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", status,
+			"latency", time.Since(start),
+			"bytes", recorder.bytes,
+		)
+	})
+}
@@ -0,0 +1,328 @@
+/*
+Package url_shortener serves as a library of utilities for the URL-Shortener
+application. This includes the definition of our API, database configuration,
+and HTTP server implementation. This is used by the main package to instantiate
+and run a server easily. This library could be used in other applications
+that do more than just initializing and booting a server.
+
+This file provides our schema migration runner. Every change to the database
+schema is written as a numbered SQL file in the migrations/ folder. These
+files are embedded into the binary and applied in order, with each applied
+version recorded in a schema_migrations table. This way, a database file
+created by an older version of the server picks up new tables and columns
+the next time it is opened.
+*/
+
+package url_shortener
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+The go:embed directive below asks the compiler to bundle every .sql file
+in the migrations/ folder into the variable that follows it. This means
+the migrations travel with the executable, and we don't have to worry
+about where the server is being run from when looking them up.
+*/
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Folder (within migrationFiles) that holds the migration files
+const MIGRATIONS_FOLDER = "migrations"
+
+// Table creation query for the table that records applied migrations
+const QUERY_CREATE_MIGRATIONS_TABLE = `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+	Version INTEGER PRIMARY KEY,
+	Name TEXT NOT NULL,
+	Applied TEXT NOT NULL
+);
+`
+
+// Query to get every migration that has been applied so far
+const QUERY_GET_APPLIED_MIGRATIONS = `
+SELECT Version, Name, Applied
+FROM schema_migrations
+ORDER BY Version
+`
+
+// Query template for recording that a migration has been applied
+const QUERY_RECORD_MIGRATION_TEMPLATE = `
+INSERT INTO schema_migrations (Version, Name, Applied)
+VALUES (?, ?, ?)
+`
+
+// Represents a single up-migration loaded from the migrations/ folder
+type Migration struct {
+	// Number taken from the file name prefix (e.g. 1 for 0001_x.sql)
+	Version int
+
+	// Rest of the file name without the extension (e.g. x for 0001_x.sql)
+	Name string
+
+	// Contents of the file, may hold multiple SQL statements
+	Query string
+}
+
+// Represents whether a particular migration has been applied to a database
+type MigrationStatus struct {
+	Version int
+	Name    string
+
+	// Time the migration was applied (RFC 3339), empty if it is pending
+	Applied string
+}
+
+/*
+Loads the migrations embedded in the binary. File names must look like
+0001_create_aliases.sql, where the number gives the order migrations
+are applied in.
+
+Returns:
+
+	The migrations sorted by version and, if a file is misnamed or
+	two files share a version, an error.
+*/
+func LoadMigrations() ([]Migration, error) {
+	entries, err := migrationFiles.ReadDir(MIGRATIONS_FOLDER)
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []Migration
+	seen := make(map[int]string)
+	for _, entry := range entries {
+		file_name := entry.Name()
+		base := strings.TrimSuffix(file_name, ".sql")
+		version_str, name, found := strings.Cut(base, "_")
+		if !found {
+			return nil, fmt.Errorf("migration %s is not named <version>_<name>.sql", file_name)
+		}
+		version, err := strconv.Atoi(version_str)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %s does not start with a positive version", file_name)
+		}
+		if other, ok := seen[version]; ok {
+			return nil, fmt.Errorf("migrations %s and %s share version %d", other, file_name, version)
+		}
+		seen[version] = file_name
+
+		/*
+			embed.FS paths always use forward slashes regardless of the
+			operating system, hence path (not path/filepath) is used.
+		*/
+		contents, err := migrationFiles.ReadFile(path.Join(MIGRATIONS_FOLDER, file_name))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, Migration{
+			Version: version,
+			Name:    name,
+			Query:   string(contents),
+		})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+/*
+Gets the migrations that have been applied to a database, creating the
+schema_migrations table first if the database has never been migrated.
+
+Parameters:
+
+	db: Connection to the database to inspect
+
+Returns:
+
+	A map from version to the status of the applied migration and, if
+	the lookup failed, an error.
+*/
+func GetAppliedMigrations(db *sql.DB) (map[int]MigrationStatus, error) {
+	_, err := db.Exec(QUERY_CREATE_MIGRATIONS_TABLE)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(QUERY_GET_APPLIED_MIGRATIONS)
+	if err != nil {
+		return nil, err
+	}
+
+	/*
+		Rows hold on to a database connection until they are closed,
+		defer makes sure that happens however we leave this function.
+	*/
+	defer rows.Close()
+
+	applied := make(map[int]MigrationStatus)
+	for rows.Next() {
+		var status MigrationStatus
+		err = rows.Scan(&status.Version, &status.Name, &status.Applied)
+		if err != nil {
+			return nil, err
+		}
+		applied[status.Version] = status
+	}
+	return applied, rows.Err()
+}
+
+/*
+Reports the status of every known migration against a database.
+
+Parameters:
+
+	db: Connection to the database to inspect
+
+Returns:
+
+	One status per embedded migration (in order) where pending migrations
+	have an empty Applied time and, if the lookup failed, an error. An error
+	is also returned if the database has been migrated by a newer binary.
+*/
+func GetMigrationStatus(db *sql.DB) ([]MigrationStatus, error) {
+	migrations, err := LoadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	applied, err := GetAppliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+	err = CheckNoUnknownMigrations(migrations, applied)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, 0, len(migrations))
+	for _, migration := range migrations {
+		status, ok := applied[migration.Version]
+		if !ok {
+			status = MigrationStatus{Version: migration.Version, Name: migration.Name}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+/*
+Checks that every migration applied to a database is one that this binary
+knows about. If not, the database was migrated by a newer version of the
+server and this (older) version should not touch it.
+
+Parameters:
+
+	migrations: Migrations embedded in this binary
+	applied: Migrations applied to the database
+
+Returns:
+
+	An error naming the first unknown version, otherwise nil.
+*/
+func CheckNoUnknownMigrations(migrations []Migration, applied map[int]MigrationStatus) error {
+	known := make(map[int]bool, len(migrations))
+	for _, migration := range migrations {
+		known[migration.Version] = true
+	}
+	for version, status := range applied {
+		if !known[version] {
+			return fmt.Errorf("database has migration %d (%s) which this server does not know, was it created by a newer version?", version, status.Name)
+		}
+	}
+	return nil
+}
+
+/*
+Applies every pending migration to a database in version order. Each
+migration runs in its own transaction alongside the insert that records
+it, so a failing migration leaves neither a half-applied schema change
+nor a record claiming it was applied.
+
+Parameters:
+
+	db: Connection to the database to migrate
+
+Returns:
+
+	The migrations that were applied by this call (empty if the database
+	was already up to date) and, if a migration failed, an error naming it.
+*/
+func MigrateUp(db *sql.DB) ([]Migration, error) {
+	migrations, err := LoadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	applied, err := GetAppliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+	err = CheckNoUnknownMigrations(migrations, applied)
+	if err != nil {
+		return nil, err
+	}
+
+	var newly_applied []Migration
+	for _, migration := range migrations {
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+		err = ApplyMigration(db, migration)
+		if err != nil {
+			return newly_applied, fmt.Errorf("migration %d (%s) failed: %w", migration.Version, migration.Name, err)
+		}
+		newly_applied = append(newly_applied, migration)
+	}
+	return newly_applied, nil
+}
+
+/*
+Applies a single migration inside a transaction and records it in the
+schema_migrations table.
+
+Note: the SQLite driver runs every statement in a multi-statement string
+passed to Exec( ), so a migration file may contain as many statements
+as it needs.
+
+Parameters:
+
+	db: Connection to the database to migrate
+	migration: Migration to apply
+
+Returns:
+
+	If the migration or recording it failed, an error is returned (and
+	the transaction is rolled back), otherwise nil.
+*/
+func ApplyMigration(db *sql.DB, migration Migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	/*
+		Rollback after a successful Commit is a no-op, so deferring it
+		is a simple way to undo the transaction on every error path.
+	*/
+	defer tx.Rollback()
+
+	_, err = tx.Exec(migration.Query)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(QUERY_RECORD_MIGRATION_TEMPLATE, migration.Version, migration.Name, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
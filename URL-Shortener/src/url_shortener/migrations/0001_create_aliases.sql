@@ -0,0 +1,9 @@
+-- Initial schema: the single table that holds URL <-> alias mappings along
+-- with the number of times each alias has been expanded. IF NOT EXISTS is
+-- kept so databases created before migrations existed adopt this version.
+CREATE TABLE IF NOT EXISTS aliases (
+	URL TEXT UNIQUE NOT NULL,
+	Alias TEXT PRIMARY KEY,
+	Expansions INT,
+	Automatic BOOL
+);
@@ -0,0 +1,21 @@
+-- Drops the UNIQUE constraint on URL so a URL can have several aliases.
+-- SQLite cannot drop a constraint in place, so the table is rebuilt and
+-- the rows copied over. Deduplication is now enforced by the insert query
+-- (see QUERY_MAKE_CHECKED_MAPPING_TEMPLATE) unless duplicates are allowed.
+CREATE TABLE aliases_new (
+	URL TEXT NOT NULL,
+	Alias TEXT PRIMARY KEY,
+	Expansions INT,
+	Automatic BOOL
+);
+
+INSERT INTO aliases_new (URL, Alias, Expansions, Automatic)
+SELECT URL, Alias, Expansions, Automatic
+FROM aliases;
+
+DROP TABLE aliases;
+
+ALTER TABLE aliases_new RENAME TO aliases;
+
+-- Keeps lookups by URL fast now that the UNIQUE index is gone
+CREATE INDEX aliases_url ON aliases (URL);
@@ -0,0 +1,3 @@
+-- Adds optional password protection to links. PasswordHash holds a salted
+-- hash (see passwords.go) and is NULL for links without a password.
+ALTER TABLE aliases ADD COLUMN PasswordHash TEXT;
@@ -0,0 +1,3 @@
+-- Adds an optional cap on the number of times a link can be expanded
+-- (e.g. 1 for one-time links). NULL means the link has no cap.
+ALTER TABLE aliases ADD COLUMN MaxExpansions INT;
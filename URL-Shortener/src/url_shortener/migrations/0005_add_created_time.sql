@@ -0,0 +1,5 @@
+-- Records when each mapping was created (Unix time in seconds). Mappings
+-- created before this migration are left NULL as their time is unknown.
+ALTER TABLE aliases ADD COLUMN Created INTEGER;
+
+CREATE INDEX aliases_created ON aliases (Created);
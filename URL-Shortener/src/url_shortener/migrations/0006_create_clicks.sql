@@ -0,0 +1,11 @@
+-- Keeps a row per expansion so analytics can be computed over a time
+-- window (the Expansions counter in aliases only holds the all time total).
+-- Expansions made before this migration have no rows here.
+CREATE TABLE clicks (
+	Alias TEXT NOT NULL,
+	Time INTEGER NOT NULL
+);
+
+CREATE INDEX clicks_time ON clicks (Time);
+
+CREATE INDEX clicks_alias_time ON clicks (Alias, Time);
@@ -0,0 +1,3 @@
+-- Lets a link be switched off (e.g. from the admin dashboard) without
+-- deleting it, so its analytics are kept and it can be switched back on.
+ALTER TABLE aliases ADD COLUMN Disabled BOOL NOT NULL DEFAULT 0;
@@ -0,0 +1,27 @@
+-- Records who created or changed each link, when, from which IP address,
+-- and the link's state before and after (as JSON). Entries are only ever
+-- appended, the triggers below refuse to change or remove them.
+CREATE TABLE audit_log (
+	ID INTEGER PRIMARY KEY AUTOINCREMENT,
+	Time INTEGER NOT NULL,
+	Action TEXT NOT NULL,
+	Alias TEXT NOT NULL,
+	Actor TEXT NOT NULL,
+	IP TEXT NOT NULL,
+	Before TEXT,
+	After TEXT
+);
+
+CREATE INDEX audit_log_alias ON audit_log (Alias);
+
+CREATE TRIGGER audit_log_no_update
+BEFORE UPDATE ON audit_log
+BEGIN
+	SELECT RAISE(ABORT, 'audit_log is append-only');
+END;
+
+CREATE TRIGGER audit_log_no_delete
+BEFORE DELETE ON audit_log
+BEGIN
+	SELECT RAISE(ABORT, 'audit_log is append-only');
+END;
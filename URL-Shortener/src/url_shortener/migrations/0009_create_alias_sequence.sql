@@ -0,0 +1,13 @@
+-- Persists the automatic alias counter, so automatic aliases are handed out
+-- in blocks without scanning the aliases table and are never reused, even
+-- once their link is deleted. It starts after the largest automatic alias,
+-- which is where the counter used to be recomputed from on every boot.
+CREATE TABLE alias_sequence (
+	Id INTEGER PRIMARY KEY CHECK (Id = 1),
+	Next INTEGER NOT NULL
+);
+
+INSERT INTO alias_sequence (Id, Next)
+SELECT 1, COALESCE(MAX(CAST(Alias AS INTEGER)) + 1, 0)
+FROM aliases
+WHERE Automatic;
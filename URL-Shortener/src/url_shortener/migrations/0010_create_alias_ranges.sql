@@ -0,0 +1,13 @@
+-- Ranges of automatic aliases leased by servers sharing the database. A
+-- server hands out the aliases of its range from memory, renewing the lease
+-- (and recording how far it got) while it runs. Once a lease expires (e.g.
+-- the server died), another server can take over the rest of the range.
+CREATE TABLE alias_ranges (
+	Start INTEGER PRIMARY KEY,
+	End INTEGER NOT NULL,
+	Next INTEGER NOT NULL,
+	Owner TEXT,
+	LeaseExpires INTEGER NOT NULL
+);
+
+CREATE INDEX alias_ranges_lease_expires ON alias_ranges (LeaseExpires);
@@ -0,0 +1,29 @@
+-- Webhook subscriptions and the outbox of deliveries to them. A delivery is
+-- written in the same transaction as the change it reports, so an event is
+-- never lost (or sent for a change that was rolled back). Deliveries are
+-- kept once done as the delivery history, until their webhook is deleted or
+-- they are older than the retention period.
+CREATE TABLE webhooks (
+	ID INTEGER PRIMARY KEY AUTOINCREMENT,
+	URL TEXT NOT NULL,
+	Secret TEXT NOT NULL,
+	Events TEXT NOT NULL,
+	Created INTEGER NOT NULL
+);
+
+CREATE TABLE webhook_deliveries (
+	ID INTEGER PRIMARY KEY AUTOINCREMENT,
+	WebhookID INTEGER NOT NULL,
+	Event TEXT NOT NULL,
+	Payload TEXT NOT NULL,
+	Status TEXT NOT NULL,
+	Attempts INTEGER NOT NULL DEFAULT 0,
+	NextAttempt INTEGER NOT NULL,
+	LastAttempt INTEGER,
+	ResponseStatus INTEGER,
+	Error TEXT,
+	Created INTEGER NOT NULL
+);
+
+CREATE INDEX webhook_deliveries_due ON webhook_deliveries (Status, NextAttempt);
+CREATE INDEX webhook_deliveries_webhook ON webhook_deliveries (WebhookID, ID);
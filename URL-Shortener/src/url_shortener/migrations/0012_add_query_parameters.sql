@@ -0,0 +1,6 @@
+-- Lets a link pass the query parameters it is visited with on to its URL
+-- and add default UTM parameters (see query_params.go). The parameters each
+-- expansion came with are kept in the click history.
+ALTER TABLE aliases ADD COLUMN QueryPassthrough TEXT NOT NULL DEFAULT 'off';
+ALTER TABLE aliases ADD COLUMN UTMDefaults TEXT;
+ALTER TABLE clicks ADD COLUMN Params TEXT;
@@ -0,0 +1,6 @@
+-- Records what the User-Agent of each expansion was sorted into (see
+-- user_agents.go) for the analytics breakdown. Clicks recorded before this
+-- migration are left NULL and reported as Unknown.
+ALTER TABLE clicks ADD COLUMN Device TEXT;
+ALTER TABLE clicks ADD COLUMN Browser TEXT;
+ALTER TABLE clicks ADD COLUMN OS TEXT;
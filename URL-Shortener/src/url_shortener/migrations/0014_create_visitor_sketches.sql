@@ -0,0 +1,21 @@
+-- HyperLogLog sketches of the visitors of each alias (see visitors.go), one
+-- of all time on the alias and one per day (UTC) that can be merged over
+-- any range of days. Links expanded before this migration have no sketch
+-- and count their visitors from their next expansion on.
+ALTER TABLE aliases ADD COLUMN VisitorSketch BLOB;
+
+CREATE TABLE visitor_sketches (
+	Alias TEXT NOT NULL,
+	Day TEXT NOT NULL,
+	Sketch BLOB NOT NULL,
+	PRIMARY KEY (Alias, Day)
+);
+
+-- Secret salt visitors are hashed with, so the sketches can't be matched
+-- to an IP address and User-Agent by hashing guesses. It is shared by the
+-- servers using the database, so they count a visitor once.
+CREATE TABLE visitor_salt (
+	Salt BLOB NOT NULL
+);
+
+INSERT INTO visitor_salt (Salt) VALUES (randomblob(32));
@@ -0,0 +1,3 @@
+-- Expansions flagged as a bot's (see bots.go) are counted apart from
+-- Expansions, which only counts people from this migration on.
+ALTER TABLE aliases ADD COLUMN BotExpansions INTEGER NOT NULL DEFAULT 0;
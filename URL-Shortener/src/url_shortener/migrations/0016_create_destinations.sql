@@ -0,0 +1,13 @@
+-- Destinations of split links (see split.go), which share their visitors
+-- between several URLs by weight. A link with a single URL has none.
+CREATE TABLE destinations (
+	Alias TEXT NOT NULL,
+	Variant TEXT NOT NULL,
+	URL TEXT NOT NULL,
+	Weight INTEGER NOT NULL,
+	Expansions INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (Alias, Variant)
+);
+
+-- Destination each click was sent to, NULL for links with a single URL
+ALTER TABLE clicks ADD COLUMN Variant TEXT;
@@ -0,0 +1,3 @@
+-- Routing rules of each link (see routing.go), as a JSON list checked in
+-- order. NULL if the link has none.
+ALTER TABLE aliases ADD COLUMN RoutingRules TEXT;
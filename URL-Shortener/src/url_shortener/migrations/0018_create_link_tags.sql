@@ -0,0 +1,13 @@
+-- Tags and campaigns group links (see campaigns.go). A link has any number
+-- of tags and is in at most one campaign, NULL if none.
+CREATE TABLE link_tags (
+	Alias TEXT NOT NULL,
+	Tag TEXT NOT NULL,
+	PRIMARY KEY (Alias, Tag)
+);
+
+CREATE INDEX link_tags_tag ON link_tags (Tag);
+
+ALTER TABLE aliases ADD COLUMN Campaign TEXT;
+
+CREATE INDEX aliases_campaign ON aliases (Campaign);
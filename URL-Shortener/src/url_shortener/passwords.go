@@ -0,0 +1,388 @@
+/*
+Package url_shortener serves as a library of utilities for the URL-Shortener
+application. This includes the definition of our API, database configuration,
+and HTTP server implementation. This is used by the main package to instantiate
+and run a server easily. This library could be used in other applications
+that do more than just initializing and booting a server.
+
+This file provides password protection for links. Passwords are never
+stored, only a salted hash of them. Checking a password is deliberately
+slow (see PASSWORD_HASH_ITERATIONS) and failed attempts are rate limited
+per client and alias, so passwords can't be guessed by brute force.
+*/
+
+package url_shortener
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Header a JSON API client puts a link's password in when expanding it
+const PASSWORD_HEADER = "X-Link-Password"
+
+// Name of the password field in the HTML form shown by the redirect route
+const PASSWORD_FORM_FIELD = "password"
+
+/*
+Identifies the hashing scheme in a stored hash. Storing it means the
+scheme (or its iterations) can be changed later while old hashes stay
+verifiable.
+*/
+const PASSWORD_HASH_SCHEME = "pbkdf2-sha256"
+
+// Number of PBKDF2 iterations, more iterations make guessing slower
+const PASSWORD_HASH_ITERATIONS = 100000
+
+// Length of the random salt and of the derived key in bytes
+const PASSWORD_SALT_LENGTH = 16
+const PASSWORD_KEY_LENGTH = 32
+
+/*
+Hashes a password for storage. The result holds everything needed to
+verify a password later: scheme$iterations$salt$key with the salt and
+key base64 encoded.
+
+Parameters:
+
+	password: The password to hash
+
+Returns:
+
+	The encoded hash and, if a random salt could not be generated, an
+	error.
+*/
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, PASSWORD_SALT_LENGTH)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+	key := PBKDF2SHA256([]byte(password), salt, PASSWORD_HASH_ITERATIONS, PASSWORD_KEY_LENGTH)
+	return fmt.Sprintf("%s$%d$%s$%s",
+		PASSWORD_HASH_SCHEME,
+		PASSWORD_HASH_ITERATIONS,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+/*
+Checks a password against a hash made by HashPassword( ).
+
+Parameters:
+
+	password: The password to check
+	encoded: The stored hash
+
+Returns:
+
+	Whether the password matches. A malformed hash never matches.
+*/
+func VerifyPassword(password string, encoded string) bool {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 4 || parts[0] != PASSWORD_HASH_SCHEME {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations <= 0 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	expected, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	key := PBKDF2SHA256([]byte(password), salt, iterations, len(expected))
+
+	/*
+		A constant time comparison takes as long however many bytes
+		match, so response times don't leak how close a guess was.
+	*/
+	return subtle.ConstantTimeCompare(key, expected) == 1
+}
+
+/*
+Derives a key from a password with PBKDF2 (RFC 8018) using HMAC-SHA256.
+This is written out here as the standard library only gained a PBKDF2
+package after the Go version this module targets.
+
+Parameters:
+
+	password: The password to derive a key from
+	salt: Random bytes stored with the key
+	iterations: Number of HMAC rounds per block
+	key_length: Length of the derived key in bytes
+
+Returns:
+
+	The derived key.
+*/
+func PBKDF2SHA256(password []byte, salt []byte, iterations int, key_length int) []byte {
+	prf := hmac.New(sha256.New, password)
+	block_count := (key_length + prf.Size() - 1) / prf.Size()
+	key := make([]byte, 0, block_count*prf.Size())
+	for block := 1; block <= block_count; block++ {
+		// U1 = PRF(password, salt || block number)
+		prf.Reset()
+		prf.Write(salt)
+		binary.Write(prf, binary.BigEndian, uint32(block))
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+
+		// T = U1 xor U2 xor ... where Ui = PRF(password, Ui-1)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:key_length]
+}
+
+/*
+Limits failed attempts at something (here, link passwords) per key. A
+key that fails too many times within a window is locked out until the
+oldest failure in the window is old enough to be forgotten.
+
+An attempt is counted as a failure from the moment it is allowed, and
+only forgotten once it succeeds (see Reset( )) or turns out not to be an
+attempt (see Release( )). Otherwise many guesses made at once would all
+be allowed before the first of them failed.
+*/
+type AttemptLimiter struct {
+	// Number of failures allowed within the window
+	maxFailures int
+
+	// How long a failure is remembered for
+	window time.Duration
+
+	/*
+		Requests are handled by concurrent goroutines, so the fields below
+		have to be protected (Go maps are not safe for concurrent writes).
+	*/
+	lock sync.Mutex
+
+	// Times of recent failures (and attempts in progress) per key, oldest first
+	failures map[string][]time.Time
+
+	// When keys whose failures were all forgotten were last swept away
+	lastSweep time.Time
+}
+
+// Makes an AttemptLimiter, see the AttemptLimiter fields for the parameters
+func NewAttemptLimiter(max_failures int, window time.Duration) *AttemptLimiter {
+	return &AttemptLimiter{
+		maxFailures: max_failures,
+		window:      window,
+		failures:    make(map[string][]time.Time),
+		lastSweep:   time.Now(),
+	}
+}
+
+/*
+Drops failures that are older than the window for a key. This must be
+called with the lock held.
+
+Returns:
+
+	The failures that are still within the window.
+*/
+func (limiter *AttemptLimiter) prune(key string, now time.Time) []time.Time {
+	recent := limiter.failures[key]
+	for len(recent) > 0 && now.Sub(recent[0]) >= limiter.window {
+		recent = recent[1:]
+	}
+	if len(recent) == 0 {
+		delete(limiter.failures, key)
+		return nil
+	}
+	limiter.failures[key] = recent
+	return recent
+}
+
+/*
+Checks whether a key may make another attempt and, if so, counts the
+attempt as a failure until it is known to have succeeded. Each allowed
+attempt must be followed by Reset( ) if it succeeds or Release( ) if no
+attempt was made after all. A failed attempt needs nothing more.
+
+Parameters:
+
+	key: Identifies who is attempting what (e.g. client IP and alias)
+
+Returns:
+
+	Whether an attempt is allowed and, if not, how long until it will be.
+*/
+func (limiter *AttemptLimiter) Allow(key string) (bool, time.Duration) {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	/*
+		Keys are only pruned when they are looked up, so the keys of
+		clients that never came back are swept away once per window.
+	*/
+	now := time.Now()
+	if now.Sub(limiter.lastSweep) >= limiter.window {
+		for other := range limiter.failures {
+			limiter.prune(other, now)
+		}
+		limiter.lastSweep = now
+	}
+
+	recent := limiter.prune(key, now)
+	if len(recent) < limiter.maxFailures {
+		limiter.failures[key] = append(recent, now)
+		return true, 0
+	}
+	return false, limiter.window - now.Sub(recent[0])
+}
+
+/*
+Takes back an attempt allowed by Allow( ) that was not made after all
+(e.g. no password was given), so it doesn't count as a failure.
+*/
+func (limiter *AttemptLimiter) Release(key string) {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	recent := limiter.prune(key, time.Now())
+	if len(recent) == 1 {
+		delete(limiter.failures, key)
+	} else if len(recent) > 1 {
+		limiter.failures[key] = recent[:len(recent)-1]
+	}
+}
+
+// Forgets the failed attempts of a key (e.g. after it succeeds)
+func (limiter *AttemptLimiter) Reset(key string) {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	delete(limiter.failures, key)
+}
+
+/*
+Gets the IP address of the client that made a request. The port is
+dropped, otherwise every connection from a client would look like a
+different client.
+*/
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+/*
+Checks that a request may access a link, i.e. the link has no password
+or the right one was provided. Failed attempts are counted against the
+client and alias, and once there are too many, even the right password
+is refused until the lockout passes.
+
+Parameters:
+
+	s: Pointer to Server holding the attempt limiter
+	r: The request trying to access the link
+	link: The link being accessed
+	password: The password provided with the request (may be empty)
+
+Returns:
+
+	The HTTP status to respond with and a message for the user if access
+	is refused. If access is allowed, the status is 0 and the message is
+	empty.
+*/
+func CheckLinkPassword(s *Server, r *http.Request, link *Link, password string) (int, string) {
+	if !link.PasswordHash.Valid {
+		return 0, ""
+	}
+
+	key := ClientIP(r) + " " + link.Alias
+	allowed, wait := s.passwordLimiter.Allow(key)
+	if !allowed {
+		return http.StatusTooManyRequests, fmt.Sprintf("Too many incorrect passwords for %s, try again in %d seconds", link.Alias, int(wait.Seconds())+1)
+	}
+	if password == "" {
+		s.passwordLimiter.Release(key)
+		return http.StatusUnauthorized, fmt.Sprintf("%s is password protected", link.Alias)
+	}
+
+	// An incorrect password stays counted as a failure by Allow( )
+	if !VerifyPassword(password, link.PasswordHash.String) {
+		return http.StatusForbidden, fmt.Sprintf("Incorrect password for %s", link.Alias)
+	}
+	s.passwordLimiter.Reset(key)
+	return 0, ""
+}
+
+// Data passed to PASSWORD_FORM_TEMPLATE
+type PasswordForm struct {
+	Alias string
+	Field string
+
+	// Message shown above the form, e.g. after an incorrect password
+	Message string
+}
+
+/*
+HTML form shown by the redirect route for password protected links. It
+posts the password back to the same URL. html/template escapes the
+fields, so an alias can't inject markup into the page.
+*/
+var PASSWORD_FORM_TEMPLATE = template.Must(template.New("password").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Alias}} is password protected</title>
+</head>
+<body>
+<h1>{{.Alias}} is password protected</h1>
+{{if .Message}}<p>{{.Message}}</p>{{end}}
+<form method="POST">
+<label>Password <input type="password" name="{{.Field}}" autofocus></label>
+<button type="submit">Continue</button>
+</form>
+</body>
+</html>
+`))
+
+/*
+Shows the password form for a link.
+
+Parameters:
+
+	w: Where we write response for user
+	status: HTTP status to respond with
+	alias: The protected alias
+	message: Message shown above the form (may be empty)
+*/
+func RespondWithPasswordForm(w http.ResponseWriter, status int, alias string, message string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	PASSWORD_FORM_TEMPLATE.Execute(w, PasswordForm{
+		Alias:   alias,
+		Field:   PASSWORD_FORM_FIELD,
+		Message: message,
+	})
+}
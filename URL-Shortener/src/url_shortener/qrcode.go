@@ -0,0 +1,748 @@
+/*
+Package url_shortener serves as a library of utilities for the URL-Shortener
+application. This includes the definition of our API, database configuration,
+and HTTP server implementation. This is used by the main package to instantiate
+and run a server easily. This library could be used in other applications
+that do more than just initializing and booting a server.
+
+This file provides a QR code encoder and renderers for PNG and SVG images.
+It is written from scratch (rather than pulling in a library) so the
+server keeps depending only on the SQLite driver. Only byte mode encoding
+is supported, which is all we need for URLs.
+
+The encoder follows the steps of the QR code specification (ISO/IEC 18004):
+
+1. Pick the smallest version (size) that fits the data at the requested
+error correction level.
+2. Turn the data into codewords and add Reed-Solomon error correction.
+3. Draw the fixed patterns (finders, timing, alignment, format and version
+information) and then the codewords.
+4. Try the 8 masks and keep the one with the lowest penalty score.
+*/
+
+package url_shortener
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+)
+
+/*
+Error correction levels, from lowest to highest. Higher levels can recover
+more of a damaged code (roughly 7%, 15%, 25% and 30%) at the cost of a
+bigger code for the same data.
+*/
+type QRErrorCorrection int
+
+const (
+	QR_ERROR_CORRECTION_L QRErrorCorrection = iota
+	QR_ERROR_CORRECTION_M
+	QR_ERROR_CORRECTION_Q
+	QR_ERROR_CORRECTION_H
+)
+
+// Smallest and largest QR code versions
+const QR_MIN_VERSION = 1
+const QR_MAX_VERSION = 40
+
+/*
+Bits that identify each error correction level in the format information.
+Note these are not in the same order as the levels.
+*/
+var QR_FORMAT_BITS = [4]int{1, 0, 3, 2}
+
+/*
+Number of error correction codewords in each block, indexed by level and
+then version (index 0 is unused as there is no version 0).
+*/
+var QR_ECC_CODEWORDS_PER_BLOCK = [4][41]int{
+	{-1, 7, 10, 15, 20, 26, 18, 20, 24, 30, 18, 20, 24, 26, 30, 22, 24, 28, 30, 28, 28, 28, 28, 30, 30, 26, 28, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+	{-1, 10, 16, 26, 18, 24, 16, 18, 22, 22, 26, 30, 22, 22, 24, 24, 28, 28, 26, 26, 26, 26, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28},
+	{-1, 13, 22, 18, 26, 18, 24, 18, 22, 20, 24, 28, 26, 24, 20, 30, 24, 28, 28, 26, 30, 28, 30, 30, 30, 30, 28, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+	{-1, 17, 28, 22, 16, 22, 28, 26, 26, 24, 28, 24, 28, 22, 24, 24, 30, 28, 28, 26, 28, 30, 24, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+}
+
+// Number of error correction blocks, indexed like QR_ECC_CODEWORDS_PER_BLOCK
+var QR_NUM_ERROR_CORRECTION_BLOCKS = [4][41]int{
+	{-1, 1, 1, 1, 1, 1, 2, 2, 2, 2, 4, 4, 4, 4, 4, 6, 6, 6, 6, 7, 8, 8, 9, 9, 10, 12, 12, 12, 13, 14, 15, 16, 17, 18, 19, 19, 20, 21, 22, 24, 25},
+	{-1, 1, 1, 1, 2, 2, 4, 4, 4, 5, 5, 5, 8, 9, 9, 10, 10, 11, 13, 14, 16, 17, 17, 18, 20, 21, 23, 25, 26, 28, 29, 31, 33, 35, 37, 38, 40, 43, 45, 47, 49},
+	{-1, 1, 1, 2, 2, 4, 4, 6, 6, 8, 8, 8, 10, 12, 16, 12, 17, 16, 18, 21, 20, 23, 23, 25, 27, 29, 34, 34, 35, 38, 40, 43, 45, 48, 51, 53, 56, 59, 62, 65, 68},
+	{-1, 1, 1, 2, 4, 4, 4, 5, 6, 8, 8, 11, 11, 16, 16, 18, 16, 19, 21, 25, 25, 25, 34, 30, 32, 35, 37, 40, 42, 45, 48, 51, 54, 57, 60, 63, 66, 70, 74, 77, 81},
+}
+
+/*
+Defaults and limits for the qr/ endpoint's query parameters. QR_MIN_SIZE
+is only the smallest size accepted (a version 1 code without a margin),
+smaller sizes than a code needs are rounded up (see QRImageSize( )).
+*/
+const QR_DEFAULT_SIZE = 256
+const QR_MIN_SIZE = 21
+const QR_MAX_SIZE = 4096
+const QR_DEFAULT_MARGIN = 4
+const QR_MAX_MARGIN = 64
+
+// Weights used when scoring masks, as given by the specification
+const QR_PENALTY_N1 = 3
+const QR_PENALTY_N2 = 3
+const QR_PENALTY_N3 = 40
+const QR_PENALTY_N4 = 10
+
+/*
+Represents an encoded QR code as a square grid of modules (the small
+squares a code is made of). A module that is true is dark.
+*/
+type QRCode struct {
+	// Width (and height) of the code in modules, 21 for version 1
+	Size int
+
+	// Modules indexed by row (y) and then column (x)
+	Modules [][]bool
+
+	/*
+		Marks modules that are part of fixed patterns, these are
+		skipped when drawing codewords and applying masks
+	*/
+	isFunction [][]bool
+}
+
+/*
+Parses an error correction level from its letter (L, M, Q or H).
+
+Parameters:
+
+	letter: The level's letter, case is ignored
+
+Returns:
+
+	The level and, if the letter is not a level, an error.
+*/
+func ParseQRErrorCorrection(letter string) (QRErrorCorrection, error) {
+	switch strings.ToUpper(letter) {
+	case "L":
+		return QR_ERROR_CORRECTION_L, nil
+	case "M":
+		return QR_ERROR_CORRECTION_M, nil
+	case "Q":
+		return QR_ERROR_CORRECTION_Q, nil
+	case "H":
+		return QR_ERROR_CORRECTION_H, nil
+	}
+	return 0, fmt.Errorf("unknown error correction level %s", letter)
+}
+
+/*
+Encodes bytes (e.g. a URL) into a QR code using byte mode.
+
+Parameters:
+
+	data: The bytes to encode
+	level: The error correction level to use
+
+Returns:
+
+	The QR code and, if the data does not fit in the largest version at
+	the given level, an error.
+*/
+func EncodeQR(data []byte, level QRErrorCorrection) (*QRCode, error) {
+	// Find the smallest version the data fits in
+	version := QR_MIN_VERSION
+	for ; version <= QR_MAX_VERSION; version++ {
+		if QRDataBits(len(data), version) <= QRNumDataCodewords(version, level)*8 {
+			break
+		}
+	}
+	if version > QR_MAX_VERSION {
+		return nil, errors.New("data is too long to fit in a QR code")
+	}
+
+	/*
+		Build the bit stream: the byte mode indicator (0100), the number
+		of bytes, then the bytes themselves.
+	*/
+	var bits []bool
+	bits = QRAppendBits(bits, 0x4, 4)
+	bits = QRAppendBits(bits, len(data), QRCharCountBits(version))
+	for _, b := range data {
+		bits = QRAppendBits(bits, int(b), 8)
+	}
+
+	/*
+		Add a terminator of up to 4 zero bits, pad to a whole byte, and
+		then fill any leftover capacity with the alternating pad bytes
+		the specification requires.
+	*/
+	capacity := QRNumDataCodewords(version, level) * 8
+	terminator := min(4, capacity-len(bits))
+	bits = QRAppendBits(bits, 0, terminator)
+	bits = QRAppendBits(bits, 0, (8-len(bits)%8)%8)
+	for pad := 0xEC; len(bits) < capacity; pad ^= 0xEC ^ 0x11 {
+		bits = QRAppendBits(bits, pad, 8)
+	}
+
+	codewords := make([]byte, len(bits)/8)
+	for i, bit := range bits {
+		if bit {
+			codewords[i>>3] |= 1 << (7 - i&7)
+		}
+	}
+
+	code := NewQRCode(version)
+	code.DrawFunctionPatterns(version, level)
+	code.DrawCodewords(QRAddEccAndInterleave(codewords, version, level))
+
+	/*
+		Try each mask and keep the best one. Masks are their own inverse
+		(they flip modules), so applying one again undoes it.
+	*/
+	best_mask := 0
+	best_penalty := -1
+	for mask := 0; mask < 8; mask++ {
+		code.ApplyMask(mask)
+		code.DrawFormatBits(level, mask)
+		penalty := code.PenaltyScore()
+		if best_penalty < 0 || penalty < best_penalty {
+			best_mask = mask
+			best_penalty = penalty
+		}
+		code.ApplyMask(mask)
+	}
+	code.ApplyMask(best_mask)
+	code.DrawFormatBits(level, best_mask)
+	return code, nil
+}
+
+/*
+Appends the lowest count bits of value (most significant first) to a
+bit stream.
+*/
+func QRAppendBits(bits []bool, value int, count int) []bool {
+	for i := count - 1; i >= 0; i-- {
+		bits = append(bits, (value>>i)&1 == 1)
+	}
+	return bits
+}
+
+// Returns the number of bits used for the byte count in a version
+func QRCharCountBits(version int) int {
+	if version <= 9 {
+		return 8
+	}
+	return 16
+}
+
+// Returns the number of bits needed to encode length bytes in a version
+func QRDataBits(length int, version int) int {
+	return 4 + QRCharCountBits(version) + 8*length
+}
+
+/*
+Returns the number of modules in a version that can hold data (including
+error correction) once all of the fixed patterns have been drawn.
+*/
+func QRNumRawDataModules(version int) int {
+	result := (16*version+128)*version + 64
+	if version >= 2 {
+		num_align := version/7 + 2
+		result -= (25*num_align-10)*num_align - 55
+		if version >= 7 {
+			result -= 36
+		}
+	}
+	return result
+}
+
+// Returns the number of data (not error correction) codewords in a version
+func QRNumDataCodewords(version int, level QRErrorCorrection) int {
+	return QRNumRawDataModules(version)/8 - QR_ECC_CODEWORDS_PER_BLOCK[level][version]*QR_NUM_ERROR_CORRECTION_BLOCKS[level][version]
+}
+
+/*
+Splits data codewords into blocks, computes each block's error correction
+codewords, and interleaves the blocks into the final codeword sequence.
+*/
+func QRAddEccAndInterleave(data []byte, version int, level QRErrorCorrection) []byte {
+	num_blocks := QR_NUM_ERROR_CORRECTION_BLOCKS[level][version]
+	block_ecc_len := QR_ECC_CODEWORDS_PER_BLOCK[level][version]
+	raw_codewords := QRNumRawDataModules(version) / 8
+
+	/*
+		When codewords don't divide evenly, the first blocks are one
+		data codeword shorter than the rest.
+	*/
+	num_short_blocks := num_blocks - raw_codewords%num_blocks
+	short_block_len := raw_codewords / num_blocks
+
+	divisor := ReedSolomonDivisor(block_ecc_len)
+	blocks := make([][]byte, num_blocks)
+	k := 0
+	for i := range blocks {
+		data_len := short_block_len - block_ecc_len
+		if i >= num_short_blocks {
+			data_len++
+		}
+		block := append([]byte(nil), data[k:k+data_len]...)
+		k += data_len
+		ecc := ReedSolomonRemainder(block, divisor)
+
+		// Short blocks get a placeholder so all blocks line up
+		if i < num_short_blocks {
+			block = append(block, 0)
+		}
+		blocks[i] = append(block, ecc...)
+	}
+
+	// Take the ith codeword of every block in turn, skipping placeholders
+	result := make([]byte, 0, raw_codewords)
+	for i := range blocks[0] {
+		for j, block := range blocks {
+			if i != short_block_len-block_ecc_len || j >= num_short_blocks {
+				result = append(result, block[i])
+			}
+		}
+	}
+	return result
+}
+
+/*
+Multiplies two elements of the finite field GF(2^8) used by QR codes
+(whose reducing polynomial is x^8 + x^4 + x^3 + x^2 + 1, i.e. 0x11D).
+*/
+func GFMultiply(x byte, y byte) byte {
+	z := 0
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int((y>>i)&1) * int(x)
+	}
+	return byte(z)
+}
+
+/*
+Computes the Reed-Solomon generator polynomial of a given degree. The
+leading coefficient (always 1) is left out.
+*/
+func ReedSolomonDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	var root byte = 1
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = GFMultiply(result[j], root)
+			if j+1 < degree {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = GFMultiply(root, 0x02)
+	}
+	return result
+}
+
+// Computes the Reed-Solomon error correction codewords for a block of data
+func ReedSolomonRemainder(data []byte, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, coefficient := range divisor {
+			result[i] ^= GFMultiply(coefficient, factor)
+		}
+	}
+	return result
+}
+
+// Makes an empty (all light) QR code of the given version
+func NewQRCode(version int) *QRCode {
+	size := version*4 + 17
+	code := &QRCode{Size: size}
+	code.Modules = make([][]bool, size)
+	code.isFunction = make([][]bool, size)
+	for y := range code.Modules {
+		code.Modules[y] = make([]bool, size)
+		code.isFunction[y] = make([]bool, size)
+	}
+	return code
+}
+
+// Sets a module and marks it as part of a fixed pattern
+func (code *QRCode) SetFunctionModule(x int, y int, dark bool) {
+	code.Modules[y][x] = dark
+	code.isFunction[y][x] = true
+}
+
+/*
+Draws the fixed patterns: timing patterns, the three finder patterns in
+the corners, alignment patterns, and the format and version information.
+The format information is drawn with a dummy mask here to reserve its
+modules, it is redrawn once a mask has been picked.
+*/
+func (code *QRCode) DrawFunctionPatterns(version int, level QRErrorCorrection) {
+	for i := 0; i < code.Size; i++ {
+		code.SetFunctionModule(6, i, i%2 == 0)
+		code.SetFunctionModule(i, 6, i%2 == 0)
+	}
+
+	code.DrawFinderPattern(3, 3)
+	code.DrawFinderPattern(code.Size-4, 3)
+	code.DrawFinderPattern(3, code.Size-4)
+
+	// Alignment patterns go everywhere except on top of the finders
+	positions := QRAlignmentPatternPositions(version)
+	last := len(positions) - 1
+	for i, x := range positions {
+		for j, y := range positions {
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			code.DrawAlignmentPattern(x, y)
+		}
+	}
+
+	code.DrawFormatBits(level, 0)
+	code.DrawVersion(version)
+}
+
+/*
+Draws a finder pattern (the big squares in three corners) centered on
+(x, y) along with the light separator around it.
+*/
+func (code *QRCode) DrawFinderPattern(x int, y int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			distance := max(abs(dx), abs(dy))
+			xx, yy := x+dx, y+dy
+			if 0 <= xx && xx < code.Size && 0 <= yy && yy < code.Size {
+				code.SetFunctionModule(xx, yy, distance != 2 && distance != 4)
+			}
+		}
+	}
+}
+
+// Draws a 5x5 alignment pattern centered on (x, y)
+func (code *QRCode) DrawAlignmentPattern(x int, y int) {
+	for dy := -2; dy <= 2; dy++ {
+		for dx := -2; dx <= 2; dx++ {
+			code.SetFunctionModule(x+dx, y+dy, max(abs(dx), abs(dy)) != 1)
+		}
+	}
+}
+
+/*
+Returns the row/column coordinates of the alignment pattern centers for
+a version. Patterns are drawn at every pairing of these coordinates.
+*/
+func QRAlignmentPatternPositions(version int) []int {
+	if version == 1 {
+		return nil
+	}
+	num_align := version/7 + 2
+	step := (version*8 + num_align*3 + 5) / (num_align*4 - 4) * 2
+	size := version*4 + 17
+	result := make([]int, num_align)
+	result[0] = 6
+	for i, position := num_align-1, size-7; i >= 1; i, position = i-1, position-step {
+		result[i] = position
+	}
+	return result
+}
+
+/*
+Draws both copies of the format information (error correction level and
+mask, protected by a BCH code) next to the finder patterns.
+*/
+func (code *QRCode) DrawFormatBits(level QRErrorCorrection, mask int) {
+	data := QR_FORMAT_BITS[level]<<3 | mask
+	remainder := data
+	for i := 0; i < 10; i++ {
+		remainder = (remainder << 1) ^ ((remainder >> 9) * 0x537)
+	}
+	bits := (data<<10 | remainder) ^ 0x5412
+	bit := func(i int) bool { return (bits>>i)&1 == 1 }
+
+	// First copy, around the top left finder
+	for i := 0; i <= 5; i++ {
+		code.SetFunctionModule(8, i, bit(i))
+	}
+	code.SetFunctionModule(8, 7, bit(6))
+	code.SetFunctionModule(8, 8, bit(7))
+	code.SetFunctionModule(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		code.SetFunctionModule(14-i, 8, bit(i))
+	}
+
+	// Second copy, split between the top right and bottom left finders
+	for i := 0; i < 8; i++ {
+		code.SetFunctionModule(code.Size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		code.SetFunctionModule(8, code.Size-15+i, bit(i))
+	}
+
+	// This module is always dark
+	code.SetFunctionModule(8, code.Size-8, true)
+}
+
+/*
+Draws both copies of the version information (protected by a BCH code).
+Only versions 7 and up have it.
+*/
+func (code *QRCode) DrawVersion(version int) {
+	if version < 7 {
+		return
+	}
+	remainder := version
+	for i := 0; i < 12; i++ {
+		remainder = (remainder << 1) ^ ((remainder >> 11) * 0x1F25)
+	}
+	bits := version<<12 | remainder
+	for i := 0; i < 18; i++ {
+		dark := (bits>>i)&1 == 1
+		a := code.Size - 11 + i%3
+		b := i / 3
+		code.SetFunctionModule(a, b, dark)
+		code.SetFunctionModule(b, a, dark)
+	}
+}
+
+/*
+Draws codewords into the modules not used by fixed patterns. Codewords
+are laid out in a zigzag of two module wide columns, starting at the
+bottom right and alternating between going up and down.
+*/
+func (code *QRCode) DrawCodewords(data []byte) {
+	i := 0
+	for right := code.Size - 1; right >= 1; right -= 2 {
+		// The vertical timing pattern takes up a whole column
+		if right == 6 {
+			right = 5
+		}
+		for vertical := 0; vertical < code.Size; vertical++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				upward := (right+1)&2 == 0
+				y := vertical
+				if upward {
+					y = code.Size - 1 - vertical
+				}
+				if !code.isFunction[y][x] && i < len(data)*8 {
+					code.Modules[y][x] = (data[i>>3]>>(7-i&7))&1 == 1
+					i++
+				}
+			}
+		}
+	}
+}
+
+/*
+Flips every non-fixed module selected by one of the 8 mask patterns.
+Masks break up patterns in the data that could confuse a scanner.
+*/
+func (code *QRCode) ApplyMask(mask int) {
+	for y := 0; y < code.Size; y++ {
+		for x := 0; x < code.Size; x++ {
+			var flip bool
+			switch mask {
+			case 0:
+				flip = (x+y)%2 == 0
+			case 1:
+				flip = y%2 == 0
+			case 2:
+				flip = x%3 == 0
+			case 3:
+				flip = (x+y)%3 == 0
+			case 4:
+				flip = (x/3+y/2)%2 == 0
+			case 5:
+				flip = x*y%2+x*y%3 == 0
+			case 6:
+				flip = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				flip = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if flip && !code.isFunction[y][x] {
+				code.Modules[y][x] = !code.Modules[y][x]
+			}
+		}
+	}
+}
+
+/*
+Scores how hard the current modules would be to scan, lower is better.
+The four rules from the specification penalize long runs of one color,
+2x2 blocks of one color, patterns that look like finders, and an
+imbalance between dark and light modules.
+*/
+func (code *QRCode) PenaltyScore() int {
+	result := 0
+	finder_like := [][]bool{
+		{true, false, true, true, true, false, true, false, false, false, false},
+		{false, false, false, false, true, false, true, true, true, false, true},
+	}
+
+	// Rules 1 and 3 look at each row and each column as a line of modules
+	for i := 0; i < code.Size; i++ {
+		row := make([]bool, code.Size)
+		column := make([]bool, code.Size)
+		for j := 0; j < code.Size; j++ {
+			row[j] = code.Modules[i][j]
+			column[j] = code.Modules[j][i]
+		}
+		for _, line := range [][]bool{row, column} {
+			run := 1
+			for j := 1; j <= len(line); j++ {
+				if j < len(line) && line[j] == line[j-1] {
+					run++
+					continue
+				}
+				if run >= 5 {
+					result += QR_PENALTY_N1 + run - 5
+				}
+				run = 1
+			}
+			for j := 0; j+11 <= len(line); j++ {
+				for _, pattern := range finder_like {
+					matches := true
+					for k, dark := range pattern {
+						if line[j+k] != dark {
+							matches = false
+							break
+						}
+					}
+					if matches {
+						result += QR_PENALTY_N3
+					}
+				}
+			}
+		}
+	}
+
+	// Rule 2
+	for y := 0; y < code.Size-1; y++ {
+		for x := 0; x < code.Size-1; x++ {
+			color := code.Modules[y][x]
+			if color == code.Modules[y][x+1] && color == code.Modules[y+1][x] && color == code.Modules[y+1][x+1] {
+				result += QR_PENALTY_N2
+			}
+		}
+	}
+
+	// Rule 4, N4 for every 5% the dark share strays from 50%
+	dark := 0
+	for _, row := range code.Modules {
+		for _, module := range row {
+			if module {
+				dark++
+			}
+		}
+	}
+	total := code.Size * code.Size
+	k := (abs(dark*20-total*10)+total-1)/total - 1
+	result += k * QR_PENALTY_N4
+	return result
+}
+
+// Returns the absolute value of an integer
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+/*
+Gives the size of the image a QR code is rendered in: the requested size,
+rounded up to a pixel for each module of the code and of its margin if it
+is smaller. A smaller image would have to drop modules, and scanners
+can't read the code without them.
+
+Parameters:
+
+	code: The QR code to render
+	size: The requested width (and height) of the image in pixels
+	margin: Width of the margin around the code in modules
+
+Returns:
+
+	The width (and height) of the image in pixels.
+*/
+func QRImageSize(code *QRCode, size int, margin int) int {
+	return max(size, code.Size+2*margin)
+}
+
+/*
+Renders a QR code as a PNG image.
+
+Parameters:
+
+	code: The QR code to render
+	size: Width (and height) of the image in pixels
+	margin: Width of the light border (quiet zone) around the code in
+		modules. Scanners expect at least 4.
+
+Returns:
+
+	The PNG encoded image and, if encoding failed, an error.
+*/
+func RenderQRPNG(code *QRCode, size int, margin int) ([]byte, error) {
+	/*
+		A paletted image with two colors keeps the PNG small. Each pixel
+		is mapped back to the module it falls in, so the image is exactly
+		size pixels wide even if that is not a multiple of the modules.
+	*/
+	palette := color.Palette{color.White, color.Black}
+	img := image.NewPaletted(image.Rect(0, 0, size, size), palette)
+	total := code.Size + 2*margin
+	for py := 0; py < size; py++ {
+		y := py*total/size - margin
+		for px := 0; px < size; px++ {
+			x := px*total/size - margin
+			if 0 <= x && x < code.Size && 0 <= y && y < code.Size && code.Modules[y][x] {
+				img.SetColorIndex(px, py, 1)
+			}
+		}
+	}
+
+	var buffer bytes.Buffer
+	err := png.Encode(&buffer, img)
+	return buffer.Bytes(), err
+}
+
+/*
+Renders a QR code as an SVG image. The drawing is done in module units
+(via the viewBox) and scaled to the requested size, so it stays sharp
+at any print size.
+
+Parameters:
+
+	code: The QR code to render
+	size: Width (and height) of the image in pixels
+	margin: Width of the light border (quiet zone) around the code in
+		modules
+
+Returns:
+
+	The SVG document.
+*/
+func RenderQRSVG(code *QRCode, size int, margin int) []byte {
+	total := code.Size + 2*margin
+	var path strings.Builder
+	for y, row := range code.Modules {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&path, "M%d,%dh1v1h-1z", x+margin, y+margin)
+			}
+		}
+	}
+
+	var svg strings.Builder
+	fmt.Fprintf(&svg, `<?xml version="1.0" encoding="UTF-8"?>`+"\n")
+	fmt.Fprintf(&svg, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`+"\n", size, size, total, total)
+	fmt.Fprintf(&svg, `<rect width="100%%" height="100%%" fill="#FFFFFF"/>`+"\n")
+	fmt.Fprintf(&svg, `<path d="%s" fill="#000000"/>`+"\n", path.String())
+	fmt.Fprintf(&svg, "</svg>\n")
+	return []byte(svg.String())
+}
@@ -0,0 +1,116 @@
+/*
+Package url_shortener serves as a library of utilities for the URL-Shortener
+application. This includes the definition of our API, database configuration,
+and HTTP server implementation. This is used by the main package to instantiate
+and run a server easily. This library could be used in other applications
+that do more than just initializing and booting a server.
+
+This file provides how database work is run on behalf of a request. Work
+is tied to the request's context, so it stops when the client goes away,
+and given a deadline (query_timeout_seconds) so a stuck query can't hold
+a goroutine forever. When SQLite reports the database is busy (another
+connection holds the lock), the work is retried with exponential backoff
+rather than failing right away.
+*/
+
+package url_shortener
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// How long to wait before the first retry of busy database work
+const BUSY_BACKOFF_START = 10 * time.Millisecond
+
+// Longest wait between retries, the backoff doubles up to this
+const BUSY_BACKOFF_MAX = 500 * time.Millisecond
+
+// Messages sent to the user when database work could not be done in time
+const QUERY_TIMEOUT_MESSAGE = "Request timed out, try again later"
+const DATABASE_BUSY_MESSAGE = "Database is busy, try again later"
+const REQUEST_CANCELLED_MESSAGE = "Request was cancelled"
+
+/*
+Checks whether an error is SQLite reporting that the database is locked
+by another connection, which is worth retrying.
+
+Parameters:
+
+	err: The error returned by a database call
+
+Returns:
+
+	Whether the error is SQLITE_BUSY or SQLITE_LOCKED.
+*/
+func IsBusyError(err error) bool {
+	var sqlite_err sqlite3.Error
+	if !errors.As(err, &sqlite_err) {
+		return false
+	}
+	return sqlite_err.Code == sqlite3.ErrBusy || sqlite_err.Code == sqlite3.ErrLocked
+}
+
+/*
+Runs database work for a request with a deadline of query_timeout_seconds.
+Attempts that fail because the database is busy are retried up to
+busy_retries times, waiting longer before each retry. The deadline covers
+every attempt, so retrying can't hold a request past it.
+
+The work must be done entirely within the function (including reading
+every row and committing), as its context is cancelled once it returns.
+Since the work may run more than once, it must not have side effects
+outside of the database that a retry would repeat.
+
+Parameters:
+
+	s: Pointer to Server whose configuration gives the timeout and retries
+	ctx: Context of the request the work is done for
+	work: The database work, which must use the context it is given
+
+Returns:
+
+	The error returned by the last attempt. If the work ran out of time
+	or the request was cancelled, the error wraps context.DeadlineExceeded
+	or context.Canceled (see ReportUnexpectedInternalServerError( )).
+*/
+func RunQuery(s *Server, ctx context.Context, work func(ctx context.Context) error) error {
+	if s.config.QueryTimeoutSeconds > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(s.config.QueryTimeoutSeconds*float64(time.Second)))
+		defer cancel()
+	}
+
+	backoff := BUSY_BACKOFF_START
+	for attempt := 0; ; attempt++ {
+		work_ctx, cancel := context.WithCancel(ctx)
+		err := work(work_ctx)
+		cancel()
+
+		/*
+			The driver doesn't always return the context's error when it
+			is interrupted, so check the context itself. The error is
+			wrapped so it can still be logged.
+		*/
+		if err != nil && ctx.Err() != nil {
+			return fmt.Errorf("%w (%v)", ctx.Err(), err)
+		}
+		if err == nil || !IsBusyError(err) || attempt >= s.config.BusyRetries {
+			return err
+		}
+
+		// Wait before retrying, unless the request is cancelled meanwhile
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("%w (%v)", ctx.Err(), err)
+		case <-timer.C:
+		}
+		backoff = min(2*backoff, BUSY_BACKOFF_MAX)
+	}
+}
@@ -0,0 +1,266 @@
+/*
+Package url_shortener serves as a library of utilities for the URL-Shortener
+application. This includes the definition of our API, database configuration,
+and HTTP server implementation. This is used by the main package to instantiate
+and run a server easily. This library could be used in other applications
+that do more than just initializing and booting a server.
+
+This file provides how the query parameters a short link is visited with
+(e.g. ?utm_source=newsletter) are passed on to its URL, along with the
+link's default UTM parameters. The parameters are merged into the URL's
+own query in this order, each step only touching the keys it names:
+
+ 1. The link's URL keeps its own parameters.
+ 2. Default UTM parameters are added for keys the URL doesn't have.
+ 3. If the link passes parameters through, the incoming ones are added,
+    replacing a default UTM parameter with the same key. A key the URL
+    already has keeps the URL's value ("merge") or takes the incoming
+    value ("override").
+
+A key is replaced as a whole, so an incoming key with several values
+replaces every value of that key. The URL's parameters keep their order
+and encoding, the added ones follow them.
+*/
+
+package url_shortener
+
+import (
+	"database/sql"
+	"encoding/json"
+	neturl "net/url"
+	"slices"
+	"strings"
+)
+
+/*
+How a link treats the query parameters it is visited with, see the top
+of this file. Off (the default) ignores them.
+*/
+const PASSTHROUGH_OFF = "off"
+const PASSTHROUGH_MERGE = "merge"
+const PASSTHROUGH_OVERRIDE = "override"
+
+// Parameters a link may have defaults for
+var UTM_PARAMETERS = []string{"utm_source", "utm_medium", "utm_campaign", "utm_term", "utm_content", "utm_id"}
+
+/*
+Longest query string recorded with a click, longer ones are cut short so
+a visitor can't fill the click history with a huge query.
+*/
+const CLICK_PARAMS_MAX_LENGTH = 2048
+
+/*
+Checks the query parameter settings of a shorten request and puts them
+in the form they are stored in.
+
+Parameters:
+
+	request: Pointer to struct that represents contents of shorten request
+	settings: The settings being built for the new mapping
+
+Returns:
+
+	A message for the user if a setting is invalid, otherwise the empty
+	string.
+*/
+func SetQueryParameterSettings(request *ShortenRequest, settings *LinkSettings) string {
+	switch request.QueryPassthrough {
+	case "":
+		settings.QueryPassthrough = PASSTHROUGH_OFF
+	case PASSTHROUGH_OFF, PASSTHROUGH_MERGE, PASSTHROUGH_OVERRIDE:
+		settings.QueryPassthrough = request.QueryPassthrough
+	default:
+		return "query_passthrough must be off, merge or override"
+	}
+
+	if len(request.UTMDefaults) == 0 {
+		return ""
+	}
+	for key, value := range request.UTMDefaults {
+		if !slices.Contains(UTM_PARAMETERS, key) {
+			return "utm_defaults may only have " + strings.Join(UTM_PARAMETERS, ", ")
+		}
+		if value == "" {
+			return "utm_defaults values must not be empty"
+		}
+	}
+	// Maps of strings always encode, keys are sorted
+	contents, _ := json.Marshal(request.UTMDefaults)
+	settings.UTMDefaults.String = string(contents)
+	settings.UTMDefaults.Valid = true
+	return ""
+}
+
+/*
+Represents a parameter of a query string. Raw holds it as it appears in
+the query (still encoded), so a URL's own parameters are kept as they are.
+*/
+type queryParameter struct {
+	Key string
+	Raw string
+}
+
+/*
+Splits a query string into its parameters, in order. Unlike
+url.ParseQuery( ), this keeps the order and the encoding of the
+parameters. Parameters whose key can't be decoded are kept under their
+raw key.
+
+Parameters:
+
+	raw_query: The query string, without the leading ?
+
+Returns:
+
+	The parameters.
+*/
+func splitQuery(raw_query string) []queryParameter {
+	parameters := []queryParameter{}
+	for _, raw := range strings.Split(raw_query, "&") {
+		if raw == "" {
+			continue
+		}
+		raw_key, _, _ := strings.Cut(raw, "=")
+		key, err := neturl.QueryUnescape(raw_key)
+		if err != nil {
+			key = raw_key
+		}
+		parameters = append(parameters, queryParameter{Key: key, Raw: raw})
+	}
+	return parameters
+}
+
+/*
+Builds the URL a visitor of a link is sent to, merging the link's default
+UTM parameters and (if the link passes them through) the parameters the
+link was visited with into its URL. See the top of this file for how
+conflicting keys are merged.
+
+Parameters:
+
+	link: The link being expanded
+	incoming: The query string the link was visited with
+
+Returns:
+
+	The URL to send the visitor to. If the link's URL can't be parsed or
+	nothing is added, it is returned unchanged.
+*/
+func DestinationURL(link *Link, incoming string) string {
+	passthrough := link.QueryPassthrough != PASSTHROUGH_OFF && link.QueryPassthrough != "" && incoming != ""
+	if len(link.UTMDefaults) == 0 && !passthrough {
+		return link.Url
+	}
+	url, err := neturl.Parse(link.Url)
+	if err != nil {
+		return link.Url
+	}
+
+	own := splitQuery(url.RawQuery)
+	own_keys := map[string]bool{}
+	for _, parameter := range own {
+		own_keys[parameter.Key] = true
+	}
+
+	// Parameters to add, by key, in the order the keys are first added
+	added := map[string][]string{}
+	order := []string{}
+	add := func(key string, values []string) {
+		if _, ok := added[key]; !ok {
+			order = append(order, key)
+		}
+		added[key] = values
+	}
+
+	for _, key := range UTM_PARAMETERS {
+		value, ok := link.UTMDefaults[key]
+		if ok && !own_keys[key] {
+			add(key, []string{value})
+		}
+	}
+
+	if passthrough {
+		// Group the incoming values by key, keeping the order of the keys
+		incoming_values := map[string][]string{}
+		incoming_keys := []string{}
+		for _, parameter := range splitQuery(incoming) {
+			_, raw_value, _ := strings.Cut(parameter.Raw, "=")
+			value, err := neturl.QueryUnescape(raw_value)
+			if err != nil {
+				value = raw_value
+			}
+			if _, ok := incoming_values[parameter.Key]; !ok {
+				incoming_keys = append(incoming_keys, parameter.Key)
+			}
+			incoming_values[parameter.Key] = append(incoming_values[parameter.Key], value)
+		}
+
+		for _, key := range incoming_keys {
+			if own_keys[key] {
+				if link.QueryPassthrough == PASSTHROUGH_MERGE {
+					continue
+				}
+				own = slices.DeleteFunc(own, func(parameter queryParameter) bool {
+					return parameter.Key == key
+				})
+			}
+			add(key, incoming_values[key])
+		}
+	}
+
+	// Parameters of the URL are only ever dropped when replaced
+	if len(order) == 0 {
+		return link.Url
+	}
+	parts := []string{}
+	for _, parameter := range own {
+		parts = append(parts, parameter.Raw)
+	}
+	for _, key := range order {
+		for _, value := range added[key] {
+			parts = append(parts, neturl.QueryEscape(key)+"="+neturl.QueryEscape(value))
+		}
+	}
+	url.RawQuery = strings.Join(parts, "&")
+	return url.String()
+}
+
+/*
+Decodes the default UTM parameters of a link as stored.
+
+Parameters:
+
+	stored: The UTMDefaults column, NULL if the link has none
+
+Returns:
+
+	The parameters (nil if there are none) and, if they could not be
+	decoded, an error.
+*/
+func DecodeUTMDefaults(stored sql.NullString) (map[string]string, error) {
+	if !stored.Valid {
+		return nil, nil
+	}
+	var defaults map[string]string
+	err := json.Unmarshal([]byte(stored.String), &defaults)
+	return defaults, err
+}
+
+/*
+Gives the query string of a visit as it is recorded with the click, NULL
+if there was none.
+
+Parameters:
+
+	incoming: The query string the link was visited with
+
+Returns:
+
+	The value to store.
+*/
+func ClickParams(incoming string) sql.NullString {
+	if len(incoming) > CLICK_PARAMS_MAX_LENGTH {
+		incoming = incoming[:CLICK_PARAMS_MAX_LENGTH]
+	}
+	return sql.NullString{String: incoming, Valid: incoming != ""}
+}
@@ -0,0 +1,528 @@
+/*
+Package url_shortener serves as a library of utilities for the URL-Shortener
+application. This includes the definition of our API, database configuration,
+and HTTP server implementation. This is used by the main package to instantiate
+and run a server easily. This library could be used in other applications
+that do more than just initializing and booting a server.
+
+This file provides routing rules, which send the visitors of a link to
+other URLs by their device, language or the time of day (e.g. iOS users to
+the App Store, German speakers to a localized page). A link's rules are an
+ordered list checked on every expansion, the first matching rule giving
+the URL. If none match, the link's own URL (or split destination, see
+split.go) is used. Either way, the link's query parameter settings are
+applied to the URL (see query_params.go).
+
+A visit is matched on:
+
+ 1. The device class, browser family and operating system its User-Agent
+    is sorted into (see user_agents.go).
+ 2. The visitor's preferred language, the tag with the highest weight in
+    Accept-Language.
+ 3. The day and time in the rule's time zone.
+*/
+
+package url_shortener
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	// Time zones are built in, so rules work where the system has none
+	_ "time/tzdata"
+)
+
+// Most routing rules a link can have
+const ROUTING_MAX_RULES = 20
+
+// Days a rule may name, in the order of time.Weekday
+var ROUTING_DAYS = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// Language tags a rule may name, e.g. de or pt-BR
+var ROUTING_LANGUAGE_TAG = regexp.MustCompile(`^[A-Za-z]{1,8}(-[A-Za-z0-9]{1,8})*$`)
+
+// Query template to replace the routing rules of a link
+const QUERY_UPDATE_ROUTING_RULES_TEMPLATE = `
+UPDATE aliases
+SET RoutingRules = ?
+WHERE Alias = ?
+`
+
+// Time zones already loaded, as loading one reads and parses its data
+var routingLocations sync.Map
+
+/*
+Loads the time zone of a routing rule.
+
+Parameters:
+
+	name: An IANA time zone, empty for UTC
+
+Returns:
+
+	The time zone and, if there is no such time zone, an error.
+*/
+func loadRoutingLocation(name string) (*time.Location, error) {
+	if name == "" {
+		return time.UTC, nil
+	}
+	if location, ok := routingLocations.Load(name); ok {
+		return location.(*time.Location), nil
+	}
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	routingLocations.Store(name, location)
+	return location, nil
+}
+
+/*
+Parses a time of day of a rule's hours.
+
+Parameters:
+
+	value: The time as HH:MM
+
+Returns:
+
+	The minutes since midnight and whether the time is valid.
+*/
+func parseRoutingMinutes(value string) (int, bool) {
+	hours, minutes, found := strings.Cut(value, ":")
+	if !found || len(hours) != 2 || len(minutes) != 2 {
+		return 0, false
+	}
+	h, err := strconv.Atoi(hours)
+	if err != nil || h < 0 || h > 23 {
+		return 0, false
+	}
+	m, err := strconv.Atoi(minutes)
+	if err != nil || m < 0 || m > 59 {
+		return 0, false
+	}
+	return h*60 + m, true
+}
+
+/*
+Checks a list of routing rules.
+
+Parameters:
+
+	rules: The rules, in the order they are checked
+
+Returns:
+
+	A message for the user if a rule is invalid, otherwise the empty
+	string.
+*/
+func CheckRoutingRules(rules []RoutingRule) string {
+	if len(rules) > ROUTING_MAX_RULES {
+		return fmt.Sprintf("routing_rules must have at most %d rules", ROUTING_MAX_RULES)
+	}
+	for i, rule := range rules {
+		position := i + 1
+		if rule.Url == "" {
+			return fmt.Sprintf("routing rule %d must have a url", position)
+		}
+		for _, names := range [][]string{rule.Devices, rule.Browsers, rule.OS} {
+			if slices.Contains(names, "") {
+				return fmt.Sprintf("routing rule %d has an empty device, browser or os name", position)
+			}
+		}
+		for _, language := range rule.Languages {
+			if !ROUTING_LANGUAGE_TAG.MatchString(language) {
+				return fmt.Sprintf("routing rule %d has an invalid language %q", position, language)
+			}
+		}
+		for _, day := range rule.Days {
+			if !slices.Contains(ROUTING_DAYS, day) {
+				return fmt.Sprintf("routing rule %d days must be among %s", position, strings.Join(ROUTING_DAYS, ", "))
+			}
+		}
+		if rule.Hours != nil {
+			from, from_ok := parseRoutingMinutes(rule.Hours.From)
+			until, until_ok := parseRoutingMinutes(rule.Hours.Until)
+			if !from_ok || !until_ok {
+				return fmt.Sprintf("routing rule %d hours must be given as HH:MM", position)
+			}
+			if from == until {
+				return fmt.Sprintf("routing rule %d hours must not start and end at the same time", position)
+			}
+		}
+		_, err := loadRoutingLocation(rule.Timezone)
+		if err != nil {
+			return fmt.Sprintf("routing rule %d has an unknown timezone %q", position, rule.Timezone)
+		}
+	}
+	return ""
+}
+
+/*
+Puts routing rules in the form they are stored in.
+
+Parameters:
+
+	rules: The rules, which must have been checked
+
+Returns:
+
+	The value to store, NULL if there are no rules.
+*/
+func EncodeRoutingRules(rules []RoutingRule) sql.NullString {
+	if len(rules) == 0 {
+		return sql.NullString{}
+	}
+	// Rules only hold strings, so they always encode
+	contents, _ := json.Marshal(rules)
+	return sql.NullString{String: string(contents), Valid: true}
+}
+
+/*
+Decodes the routing rules of a link as stored.
+
+Parameters:
+
+	stored: The RoutingRules column, NULL if the link has none
+
+Returns:
+
+	The rules (nil if there are none) and, if they could not be decoded,
+	an error.
+*/
+func DecodeRoutingRules(stored sql.NullString) ([]RoutingRule, error) {
+	if !stored.Valid {
+		return nil, nil
+	}
+	var rules []RoutingRule
+	err := json.Unmarshal([]byte(stored.String), &rules)
+	return rules, err
+}
+
+/*
+Checks the routing rules of a shorten request and puts them in the
+settings of the new mapping.
+
+Parameters:
+
+	request: Pointer to struct that represents contents of shorten request
+	settings: The settings being built for the new mapping
+
+Returns:
+
+	A message for the user if a rule is invalid, otherwise the empty
+	string.
+*/
+func SetRoutingRuleSettings(request *ShortenRequest, settings *LinkSettings) string {
+	err_msg := CheckRoutingRules(request.RoutingRules)
+	if err_msg != "" {
+		return err_msg
+	}
+	settings.RoutingRules = EncodeRoutingRules(request.RoutingRules)
+	return ""
+}
+
+/*
+Gives the language a visitor prefers most from their Accept-Language
+header: the tag with the highest weight, the first one listed on a tie.
+Tags with a weight of 0 and the wildcard are passed over.
+
+Parameters:
+
+	header: The Accept-Language header of a request
+
+Returns:
+
+	The tag in lower case, or the empty string if there is none.
+*/
+func PreferredLanguage(header string) string {
+	type weighted struct {
+		tag    string
+		weight float64
+	}
+	tags := []weighted{}
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(part, ";")
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || tag == "*" {
+			continue
+		}
+		weight := 1.0
+		if value, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			weight = parsed
+		}
+		if weight > 0 {
+			tags = append(tags, weighted{tag, weight})
+		}
+	}
+	if len(tags) == 0 {
+		return ""
+	}
+	sort.SliceStable(tags, func(i, j int) bool {
+		return tags[i].weight > tags[j].weight
+	})
+	return tags[0].tag
+}
+
+// Represents what a visit is matched on (see the top of this file)
+type RoutingVisit struct {
+	Class    UserAgentClass
+	Language string
+	Time     time.Time
+}
+
+/*
+Describes a visit for the routing rules.
+
+Parameters:
+
+	r: The request visiting the link
+	class: What the request's User-Agent was sorted into
+	now: When the visit happens
+
+Returns:
+
+	The visit.
+*/
+func NewRoutingVisit(r *http.Request, class UserAgentClass, now time.Time) RoutingVisit {
+	return RoutingVisit{
+		Class:    class,
+		Language: PreferredLanguage(r.Header.Get("Accept-Language")),
+		Time:     now,
+	}
+}
+
+/*
+Checks whether a visit matches a routing rule. The rule must have been
+checked (see CheckRoutingRules( )).
+
+Parameters:
+
+	rule: The rule
+	visit: The visit
+
+Returns:
+
+	Whether every condition of the rule holds.
+*/
+func (rule *RoutingRule) Matches(visit RoutingVisit) bool {
+	any_name := func(names []string, name string) bool {
+		return len(names) == 0 || slices.ContainsFunc(names, func(candidate string) bool {
+			return strings.EqualFold(candidate, name)
+		})
+	}
+	if !any_name(rule.Devices, visit.Class.Device) || !any_name(rule.Browsers, visit.Class.Browser) || !any_name(rule.OS, visit.Class.OS) {
+		return false
+	}
+
+	if len(rule.Languages) > 0 {
+		matched := slices.ContainsFunc(rule.Languages, func(language string) bool {
+			language = strings.ToLower(language)
+			return visit.Language == language || strings.HasPrefix(visit.Language, language+"-")
+		})
+		if !matched {
+			return false
+		}
+	}
+
+	if len(rule.Days) == 0 && rule.Hours == nil {
+		return true
+	}
+	location, err := loadRoutingLocation(rule.Timezone)
+	if err != nil {
+		return false
+	}
+	local := visit.Time.In(location)
+	if len(rule.Days) > 0 && !slices.Contains(rule.Days, ROUTING_DAYS[local.Weekday()]) {
+		return false
+	}
+	if rule.Hours != nil {
+		from, _ := parseRoutingMinutes(rule.Hours.From)
+		until, _ := parseRoutingMinutes(rule.Hours.Until)
+		minutes := local.Hour()*60 + local.Minute()
+		if from < until {
+			return minutes >= from && minutes < until
+		}
+		// The hours run past midnight
+		return minutes >= from || minutes < until
+	}
+	return true
+}
+
+/*
+Finds the first routing rule a visit matches.
+
+Parameters:
+
+	rules: The link's rules, in order
+	visit: The visit
+
+Returns:
+
+	The position of the rule in the list (counting from 0), -1 if none
+	match.
+*/
+func MatchRoutingRules(rules []RoutingRule, visit RoutingVisit) int {
+	for i := range rules {
+		if rules[i].Matches(visit) {
+			return i
+		}
+	}
+	return -1
+}
+
+/*
+Replaces the routing rules of an existing link, recording the change in
+the audit log.
+
+Parameters:
+
+	s: Pointer to Server whose database we update
+	ctx: Context of the request making the change
+	alias: The alias of the link
+	rules: The new rules, none to remove them
+	actor: Who is making the change
+
+Returns:
+
+	An error message that is meant to be sent to the user (like in
+	UpdateLink( )) and the error that occurred. If the alias is not
+	mapped, the error is sql.ErrNoRows.
+*/
+func SetRoutingRules(s *Server, ctx context.Context, alias string, rules []RoutingRule, actor *Actor) (string, error) {
+	err_msg := CheckRoutingRules(rules)
+	if err_msg != "" {
+		return err_msg, errors.New("invalid routing rules")
+	}
+	stored := EncodeRoutingRules(rules)
+
+	err := RunQuery(s, ctx, func(ctx context.Context) error {
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		before, err := GetLinkState(ctx, tx, alias)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, QUERY_UPDATE_ROUTING_RULES_TEMPLATE, stored, alias)
+		if err != nil {
+			return err
+		}
+		after, err := GetLinkState(ctx, tx, alias)
+		if err != nil {
+			return err
+		}
+		err = RecordAudit(ctx, tx, AUDIT_ACTION_UPDATE, alias, actor, before, after)
+		if err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err == sql.ErrNoRows {
+		return fmt.Sprintf("Cannot edit %s, not mapped", alias), err
+	} else if err != nil {
+		return INTERNAL_ERROR_MESSAGE, err
+	}
+	return "", nil
+}
+
+/*
+Handles requests on the route/ endpoint, showing which routing rule the
+request would match and where it would be sent (with the link's query
+parameter settings applied), without counting an expansion. Password protected links need their password, like on expand/.
+
+Parameters:
+
+	s: Pointer to HTTP server whose links are routed
+	w: Where we write response for user
+	r: Pointer to struct that represents contents of HTTP request
+*/
+func Route(s *Server, w http.ResponseWriter, r *http.Request) {
+	// Only GET requests are allowed on the route/ endpoint
+	if r.Method != http.MethodGet {
+		ReportInvalidMethodError(w, r, r.Method)
+		return
+	}
+
+	now := time.Now()
+	if at := r.URL.Query().Get("at"); at != "" {
+		seconds, err := ParseTimeParameter(at)
+		if err != nil {
+			ReportBadRequestError(w, r, at, "at must be an RFC 3339 time or a date")
+			return
+		}
+		now = time.Unix(seconds, 0)
+	}
+
+	alias := strings.TrimPrefix(r.URL.Path, ROUTE_ENDPOINT)
+	link, err := GetLinkByAlias(s, r.Context(), alias)
+	if err == sql.ErrNoRows {
+		ReportBadRequestError(w, r, "No mapping exists for alias", fmt.Sprintf("Cannot route %s, not mapped", alias))
+		return
+	} else if err != nil {
+		ReportUnexpectedInternalServerError(w, r, err)
+		return
+	}
+
+	if link.Disabled {
+		ReportExpansionError(w, r, alias, LINK_DISABLED_ERROR)
+		return
+	}
+
+	status, err_msg := CheckLinkPassword(s, r, link, r.Header.Get(PASSWORD_HEADER))
+	if status != 0 {
+		RequestLogger(r).Info("Password check failed", "alias", alias)
+		ReportClientError(w, r, status, "Password check failed", err_msg)
+		return
+	}
+
+	class := s.userAgents.Classify(r.UserAgent())
+	visit := NewRoutingVisit(r, class, now)
+	response := RouteResponse{
+		Alias:    alias,
+		Device:   class.Device,
+		Browser:  class.Browser,
+		OS:       class.OS,
+		Language: visit.Language,
+		Time:     now.UTC().Format(time.RFC3339),
+	}
+	// The URL is picked like RecordExpansion( ) does
+	target := new(Link)
+	*target = *link
+	if i := MatchRoutingRules(link.RoutingRules, visit); i >= 0 {
+		target.Url = link.RoutingRules[i].Url
+		response.Rule = i + 1
+		response.RuleName = link.RoutingRules[i].Name
+	} else if destination := ChooseDestination(s, r, link); destination != nil {
+		target.Url = destination.Url
+		response.Variant = destination.Name
+	}
+
+	// Other than at, the query parameters are the ones the visit passes on
+	parts := []string{}
+	for _, parameter := range splitQuery(r.URL.RawQuery) {
+		if parameter.Key != "at" {
+			parts = append(parts, parameter.Raw)
+		}
+	}
+	response.Url = DestinationURL(target, strings.Join(parts, "&"))
+	RespondAsJSON(w, response)
+}
@@ -22,15 +22,22 @@ However, the package still needs to be imported in order to include the
 SQLite driver that's used by Go's sql package to instantiate a connection.
 */
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	neturl "net/url"
 	"os"
+	"os/signal"
+	"path"
 	"strconv"
 	"strings"
-	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -47,140 +54,173 @@ const HOSTNAME = "localhost"
 // Port to listen on
 const PORT = 8000
 
+// How long shutdown waits for requests in progress to finish
+const SHUTDOWN_TIMEOUT = 30 * time.Second
+
 // Error message for body of internal server errors sent to user
 const INTERNAL_ERROR_MESSAGE = "Unexpected Internal Server Error"
 
 // Represents our server type
 type Server struct {
+	// Settings loaded from the configuration file (see config.go)
+	config Config
+
 	// Connection to SQLite database that holds mapping/analytics table
 	db *sql.DB
 
+	// Checks custom aliases against the configured alias policy
+	aliasChecker *AliasChecker
+
+	// Rate limits incorrect passwords for protected links (see passwords.go)
+	passwordLimiter *AttemptLimiter
+
 	/*
-		The first alias we try when assigning an alias automatically.
-		Note, as shown in ShortenAutomatic( ) that multiple aliases
-		may have to be tried.
+		Random token the admin dashboard puts in its forms and expects
+		back, so other sites can't make a logged in admin's browser
+		submit them (see admin.go).
 	*/
-	nextAlias int
+	adminToken string
+
+	// Serves the HTTPS certificate, nil when serving plain HTTP (see tls.go)
+	certificates *CertificateReloader
 
 	/*
-		Mutex lock that ensures synchronized (consistent) updates to
-		nextAlias in the event that multiple requests come in at the
-		same time to automatically assign an alias. For more, see
-		ShortenAutomatic( ).
+		Hands out automatic aliases from a block reserved in the
+		database (see alias_allocator.go and ShortenAutomatic( )).
 	*/
-	nextAliasLock sync.Mutex
-}
+	aliases AliasAllocator
 
-////////////////////////// PRIVATE FUNCTIONS ///////////////////////
+	/*
+		Sends webhook deliveries, and wakes up the worker sending them
+		when new ones are written (see webhooks.go).
+	*/
+	webhookClient *http.Client
+	webhookWake   chan struct{}
 
-/*
-Initializes the SQLite database used by the server. In particular,
-the database is loaded from a file (if it exists). If not, the
-single table used by our server (aliases) is initialized.
+	// Sorts the User-Agent of each expansion (see user_agents.go)
+	userAgents *UserAgentClassifier
 
-Note that this function takes a *Server as an argument, not as
-the receiver. This is because the Server has not been set up
-yet and it would be strange to have an uninitialized object
-as the receiver. This is the case for the majority of functions
-in this file as they are operating on unintialized or partially
-initialized Server objects.
+	// Salt visitors are hashed with for the visitor sketches (see visitors.go)
+	visitorSalt []byte
 
-Parameters:
+	// Tells expansions by bots apart from those by people (see bots.go)
+	bots *BotDetector
 
-	s: Pointer to Server for which we initialize the database
+	/*
+		Progress of the server's lifecycle, reported by readiness (see
+		health.go). aliasesLoaded is set once LoadAliasAllocator( ) is
+		ready to lease ranges of aliases. These are read by requests while
+		being set, so they are atomic.
+	*/
+	migrated      atomic.Bool
+	aliasesLoaded atomic.Bool
+	draining      atomic.Bool
+}
+
+////////////////////////// PRIVATE FUNCTIONS ///////////////////////
+
+/*
+Opens a connection to the SQLite database file, creating the folder
+that holds it if needed. This does not touch the schema, so it is
+shared by server boot and the command line tools in commands.go.
 
 Returns:
 
-	If initialization failed, an error is returned, otherwise if
-	all goes well, nil is returned.
+	The database connection (which must be closed) and, if opening
+	failed, an error.
 */
-func InitializeDatabase(s *Server) error {
+func OpenDatabase() (*sql.DB, error) {
 	/*
 		Makes folder for database file if it doesn't exist,
 		basically a mkdir -p followed by a chmod 0x777
 	*/
 	err := os.MkdirAll(DATABASE_FOLDER, os.ModePerm)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Opens a connection to the database (must be closed)
-	s.db, err = sql.Open(SQL_DRIVER, DATABASE_FILE)
-	if err != nil {
-		return err
-	}
-
-	// Creates the table if it doesn't exist
-	_, err = s.db.Exec(QUERY_CREATE_TABLE)
-	return err
+	return sql.Open(SQL_DRIVER, DATABASE_DSN)
 }
 
 /*
-This sets the next alias value maintained by our server. To
-allow our server to work between boots, we cannot restart the
-automatic alias assignment from 0 each time. It starts with
-1 more than the maximum alias assigned already by the server.
+Initializes the SQLite database used by the server. In particular,
+the database is loaded from a file (if it exists) and any pending
+schema migrations are applied to it. For a brand new file, this
+creates all of the tables used by our server.
+
+Note that this function takes a *Server as an argument, not as
+the receiver. This is because the Server has not been set up
+yet and it would be strange to have an uninitialized object
+as the receiver. This is the case for the majority of functions
+in this file as they are operating on unintialized or partially
+initialized Server objects.
 
 Parameters:
 
-	s: Pointer to Server for which we set the next alias
+	s: Pointer to Server for which we initialize the database
 
 Returns:
 
 	If initialization failed, an error is returned, otherwise if
 	all goes well, nil is returned.
 */
-func SetNextAlias(s *Server) error {
-	/*
-		Parse maximum previously assigned alias. Note, MAX
-		will always return an element. A MAX on an empty row
-		selection will return NULL. Hence, we use the special
-		NullString type which is a type that can represent
-		null or a string.
-	*/
-	row := s.db.QueryRow(QUERY_GET_NEXT_ALIAS)
-	var maybe_max_alias sql.NullString
-	err := row.Scan(&maybe_max_alias)
+func InitializeDatabase(s *Server) error {
+	var err error
+	s.db, err = OpenDatabase()
 	if err != nil {
 		return err
 	}
 
-	/*
-		This indicates MAX returned NULL, so we start with an
-		alias of 0.
-	*/
-	if !maybe_max_alias.Valid {
-		s.nextAlias = 0
-		return nil
+	// Brings the schema up to date (creating tables if they don't exist)
+	applied, err := MigrateUp(s.db)
+	for _, migration := range applied {
+		log.Printf("Applied migration %d (%s)", migration.Version, migration.Name)
 	}
-
-	/*
-		Otherwise we convert alias to int and set the next alias
-		to 1 beyond it.
-	*/
-	s.nextAlias, err = strconv.Atoi(maybe_max_alias.String)
 	if err != nil {
 		return err
 	}
-	s.nextAlias += 1
+	s.migrated.Store(true)
 	return nil
 }
 
 /*
 Reports an unexpected internal error back to the user and logs it.
+Database work that ran out of time (see RunQuery( )) is not reported as
+an internal error: a timeout is reported as 504 (Gateway Timeout) and a
+busy database or a cancelled request as 503 (Service Unavailable), so
+clients know to try again.
 
 For this and the other two report error functions, we generally log
 more detailed information related to some internal failure (e.g.
 a SQL violation) while providing more vague or user friendly
-messages to the user.
+messages to the user. Errors are logged with the request's logger
+(see RequestLogger( )) so they carry the request ID.
 
 Parameters:
 
 	w: Where we write response for user
+	r: The request being answered
 	err: Unexpected error that occurred which is logged
 */
-func ReportUnexpectedInternalServerError(w http.ResponseWriter, err error) {
-	log.Println(err)
+func ReportUnexpectedInternalServerError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		RequestLogger(r).Warn("Database timed out", "error", err)
+		http.Error(w, QUERY_TIMEOUT_MESSAGE, http.StatusGatewayTimeout)
+		return
+	case errors.Is(err, context.Canceled):
+		// The client is most likely gone, so this is only worth a note
+		RequestLogger(r).Info("Request cancelled", "error", err)
+		http.Error(w, REQUEST_CANCELLED_MESSAGE, http.StatusServiceUnavailable)
+		return
+	case IsBusyError(err):
+		RequestLogger(r).Warn("Database busy", "error", err)
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, DATABASE_BUSY_MESSAGE, http.StatusServiceUnavailable)
+		return
+	}
+	RequestLogger(r).Error("Unexpected internal error", "error", err)
 
 	/*
 		http.Error will automatically set the provided error code
@@ -196,10 +236,11 @@ By request method we mean POST, GET, DELETE, etc.
 Parameters:
 
 	w: Where we write response for user
+	r: The request being answered
 	method: The method that was determined to be incorrect
 */
-func ReportInvalidMethodError(w http.ResponseWriter, method string) {
-	log.Printf("Received method: %s\n", method)
+func ReportInvalidMethodError(w http.ResponseWriter, r *http.Request, method string) {
+	RequestLogger(r).Warn("Invalid request method", "method", method)
 	http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 }
 
@@ -210,12 +251,30 @@ can contain any issue (e.g. duplicate aliases, URLs, etc.).
 Parameters:
 
 	w: Where we write response for user
+	r: The request being answered
 	log_err_msg: Message we only log related to bad request
 	user_err_msg: Message we both log and send to user for bad request
 */
-func ReportBadRequestError(w http.ResponseWriter, log_err_msg string, user_err_msg string) {
-	log.Printf("Internal Error: %s, Error sent to User: %s", log_err_msg, user_err_msg)
-	http.Error(w, user_err_msg, http.StatusBadRequest)
+func ReportBadRequestError(w http.ResponseWriter, r *http.Request, log_err_msg string, user_err_msg string) {
+	ReportClientError(w, r, http.StatusBadRequest, log_err_msg, user_err_msg)
+}
+
+/*
+Reports an error caused by the client back to the user and logs it. This
+is like ReportBadRequestError( ) but for errors that have a more specific
+status, e.g. a missing (401) or incorrect (403) password.
+
+Parameters:
+
+	w: Where we write response for user
+	r: The request being answered
+	status: HTTP status code of the error (4xx)
+	log_err_msg: Message we only log related to the error
+	user_err_msg: Message we both log and send to user for the error
+*/
+func ReportClientError(w http.ResponseWriter, r *http.Request, status int, log_err_msg string, user_err_msg string) {
+	RequestLogger(r).Warn("Client error", "status", status, "internal_error", log_err_msg, "user_error", user_err_msg)
+	http.Error(w, user_err_msg, status)
 }
 
 /*
@@ -235,26 +294,277 @@ func RespondAsJSON(w http.ResponseWriter, v any) {
 }
 
 /*
-Queries the server's database for the alias that is associated with
-a given URL.
+Queries the server's database for the aliases that are associated with
+a given URL. There is usually only one, but there can be several if
+duplicate URLs are allowed (see ShortenRequest).
+
+Parameters:
+
+	s: Pointer to Server whose database we query
+	ctx: Context of the request the lookup is for
+	url: Given URL for which we're finding the associated aliases
+
+Returns:
+
+	The aliases associated with the URL (oldest first) and, if an error
+	occurred during lookup, the lookup error. If no error occurred, nil
+	is returned. Note, unlike a single row lookup, no error is returned
+	if the URL has no aliases, the slice is just empty.
+*/
+func GetAliasesByURL(s *Server, ctx context.Context, url string) ([]string, error) {
+	var aliases []string
+	err := RunQuery(s, ctx, func(ctx context.Context) error {
+		aliases = nil
+		rows, err := s.db.QueryContext(ctx, QUERY_GET_ALIASES_BY_URL_TEMPLATE, url)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var alias string
+			err = rows.Scan(&alias)
+			if err != nil {
+				return err
+			}
+			aliases = append(aliases, alias)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return aliases, nil
+}
+
+/*
+Determines whether a shorten request may create another alias for a URL
+that already has one. This is the case if either the request or the
+server configuration asks for it.
+
+Parameters:
+
+	s: Pointer to Server whose configuration is checked
+	request: Pointer to struct that represents contents of shorten request
+
+Returns:
+
+	Whether duplicate URLs are allowed for this request.
+*/
+func AllowsDuplicateURL(s *Server, request *ShortenRequest) bool {
+	return s.config.AllowDuplicateURLs || request.AllowDuplicateUrl
+}
+
+/*
+Represents the settings of a new mapping that come from a shorten request
+and are stored alongside the URL and alias.
+*/
+type LinkSettings struct {
+	// Salted hash of the link's password, NULL if it has none
+	PasswordHash sql.NullString
+
+	// Cap on the number of expansions, NULL if it has none
+	MaxExpansions sql.NullInt64
+
+	// One of the PASSTHROUGH constants (see query_params.go)
+	QueryPassthrough string
+
+	// JSON of the default UTM parameters, NULL if there are none
+	UTMDefaults sql.NullString
+
+	// Destinations of a split link, none for a link with a single URL
+	Destinations []Destination
+
+	// JSON of the routing rules, NULL if there are none
+	RoutingRules sql.NullString
+
+	// Labels grouping the link (see campaigns.go), normalized
+	Tags     []string
+	Campaign sql.NullString
+}
+
+/*
+Builds the settings of a new mapping from a shorten request. This is done
+once per request (rather than per insert attempt) as hashing a password
+is deliberately slow.
+
+Parameters:
+
+	request: Pointer to struct that represents contents of shorten request
+
+Returns:
+
+	The settings, error message that is meant to be sent to the user
+	(INTERNAL_ERROR_MESSAGE for internal errors like in ShortenAutomatic( ))
+	and the error that occurred. If successful, the error message and
+	error are the empty string and nil respectively.
+*/
+func NewLinkSettings(request *ShortenRequest) (*LinkSettings, string, error) {
+	settings := new(LinkSettings)
+	if request.Password != "" {
+		hash, err := HashPassword(request.Password)
+		if err != nil {
+			return nil, INTERNAL_ERROR_MESSAGE, err
+		}
+		settings.PasswordHash = sql.NullString{String: hash, Valid: true}
+	}
+	if request.MaxExpansions < 0 {
+		return nil, "max_expansions must be positive", fmt.Errorf("invalid max_expansions %d", request.MaxExpansions)
+	} else if request.MaxExpansions > 0 {
+		settings.MaxExpansions = sql.NullInt64{Int64: int64(request.MaxExpansions), Valid: true}
+	}
+	err_msg := SetQueryParameterSettings(request, settings)
+	if err_msg != "" {
+		return nil, err_msg, fmt.Errorf("invalid query parameter settings %q %v", request.QueryPassthrough, request.UTMDefaults)
+	}
+	err_msg = SetDestinationSettings(request, settings)
+	if err_msg != "" {
+		return nil, err_msg, fmt.Errorf("invalid destinations %v", request.Destinations)
+	}
+	err_msg = SetRoutingRuleSettings(request, settings)
+	if err_msg != "" {
+		return nil, err_msg, fmt.Errorf("invalid routing rules %v", request.RoutingRules)
+	}
+	err_msg = SetLabelSettings(request, settings)
+	if err_msg != "" {
+		return nil, err_msg, fmt.Errorf("invalid tags %q or campaign %q", request.Tags, request.Campaign)
+	}
+	return settings, "", nil
+}
+
+/*
+Inserts a new URL <-> alias mapping into the database. If duplicate URLs
+are not allowed, the insert is skipped when the URL already has an alias.
+If the alias policy is case insensitive, the insert is also skipped when
+an alias matching the new one ignoring case exists.
+
+Parameters:
+
+	s: Pointer to Server whose database we insert into
+	ctx: Context of the request the mapping is made for
+	request: Pointer to struct that represents contents of shorten request.
+		Only request.Url and whether duplicates are allowed are used.
+	settings: Settings stored alongside the mapping
+	alias: Alias to map the URL to
+	automatic: Whether the alias was automatically assigned
+	actor: Who is creating the mapping, recorded in the audit log
+
+Returns:
+
+	nil if the mapping was inserted. If the URL already has an alias
+	(and duplicates are not allowed) an error whose message is
+	DUPLICATE_URL_VIOLATION is returned. If the alias is in use (exactly
+	or, when the policy says so, ignoring case) an error whose message is
+	DUPLICATE_ALIAS_VIOLATION is returned. Any other error is unexpected.
+*/
+func InsertMapping(s *Server, ctx context.Context, request *ShortenRequest, settings *LinkSettings, alias string, automatic bool, actor *Actor) error {
+	check_url := !AllowsDuplicateURL(s, request)
+	check_case := s.config.AliasPolicy.CaseInsensitive
+	var inserted int64
+	var queued bool
+	err := RunQuery(s, ctx, func(ctx context.Context) error {
+		// The mapping, its audit log entry and webhook deliveries are written together or not at all
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		var result sql.Result
+		if !check_url && !check_case {
+			result, err = tx.ExecContext(ctx, QUERY_MAKE_MAPPING_TEMPLATE, request.Url, alias, automatic, settings.PasswordHash, settings.MaxExpansions, time.Now().Unix(), settings.QueryPassthrough, settings.UTMDefaults, settings.RoutingRules, settings.Campaign)
+		} else {
+			result, err = tx.ExecContext(ctx, QUERY_MAKE_CHECKED_MAPPING_TEMPLATE, request.Url, alias, automatic, settings.PasswordHash, settings.MaxExpansions, time.Now().Unix(), settings.QueryPassthrough, settings.UTMDefaults, settings.RoutingRules, settings.Campaign, check_url, request.Url, check_case, alias)
+		}
+		if err != nil {
+			return err
+		}
+
+		// No row inserted means one of the NOT EXISTS checks failed
+		inserted, err = result.RowsAffected()
+		if err != nil || inserted == 0 {
+			return err
+		}
+		err = AddDestinations(ctx, tx, alias, settings.Destinations)
+		if err != nil {
+			return err
+		}
+		err = SetLinkTags(ctx, tx, alias, settings.Tags)
+		if err != nil {
+			return err
+		}
+		after, err := GetLinkState(ctx, tx, alias)
+		if err != nil {
+			return err
+		}
+		err = RecordAudit(ctx, tx, AUDIT_ACTION_CREATE, alias, actor, nil, after)
+		if err != nil {
+			return err
+		}
+		queued, err = EnqueueWebhookEvent(ctx, tx, NewWebhookEvent(WEBHOOK_EVENT_CREATED, alias, after.Url, 0, after.MaxExpansions))
+		if err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err == nil && queued {
+		WakeWebhookDeliveries(s)
+	}
+	if err != nil || inserted > 0 {
+		return err
+	}
+
+	/*
+		Figure out which check failed. If the URL has an alias, we report
+		that first to match what happens when duplicates are not allowed
+		and the policy is case sensitive. Otherwise, it must have been
+		the case insensitive alias check.
+	*/
+	if check_url {
+		aliases, err := GetAliasesByURL(s, ctx, request.Url)
+		if err != nil {
+			return err
+		}
+		if len(aliases) > 0 {
+			return errors.New(DUPLICATE_URL_VIOLATION)
+		}
+	}
+	return errors.New(DUPLICATE_ALIAS_VIOLATION)
+}
+
+/*
+Builds the message sent to a user whose shorten request failed because
+the URL already has an alias. The existing aliases are included so that
+a user would know how to visit their desired URL via the URL-Shortener
+application.
 
 Parameters:
 
-	s: Pointer to Server for which we set the next alias
-	url: Given URL for which we're finding the associated alias
+	s: Pointer to Server whose database we query
+	ctx: Context of the request that failed
+	url: URL that the user tried to shorten
 
 Returns:
 
-	The alias associated with the URL and, if an error occurred
-	during lookup, the lookup error. If no error occurred, nil
-	is returned and it is safe to assume alias holds the
-	associated URL.
+	The message to send to the user and, if looking up the existing
+	aliases failed, an error.
 */
-func GetAliasByURL(s *Server, url string) (string, error) {
-	row := s.db.QueryRow(QUERY_GET_ALIAS_BY_URL_TEMPLATE, url)
-	var alias string
-	err := row.Scan(&alias)
-	return alias, err
+func DuplicateURLMessage(s *Server, ctx context.Context, url string) (string, error) {
+	aliases, err := GetAliasesByURL(s, ctx, url)
+	if err != nil {
+		return "", err
+	}
+
+	/*
+		Don't expect the URL to have no aliases (because insertion failed
+		due to duplicated URLs)
+	*/
+	if len(aliases) == 0 {
+		return "", fmt.Errorf("no aliases found for duplicate URL %s", url)
+	} else if len(aliases) == 1 {
+		return fmt.Sprintf("URL already has an alias %s.", aliases[0]), nil
+	}
+	return fmt.Sprintf("URL already has aliases %s.", strings.Join(aliases, ", ")), nil
 }
 
 /*
@@ -264,8 +574,11 @@ Parameters:
 
 	s: Pointer to HTTP server that will be updated/used to make
 		new URL <-> alias mapping
+	ctx: Context of the request shortening the URL
 	request: Pointer to struct that represents contents of shorten
 		request. For this function, only request.Url is used.
+	settings: Settings stored alongside the mapping
+	actor: Who is shortening the URL, recorded in the audit log
 
 Returns:
 
@@ -276,101 +589,69 @@ Returns:
 	error are the empty string and nil respectively. If the
 	error is nil, it is assumed the returned alias is not empty.
 */
-func ShortenAutomatic(s *Server, request *ShortenRequest) (string, string, error) {
-
-	// Uncomment for testing concurrency robustness
-	// log.Printf("Beginning to service shorten request for %s", request.Url)
-	// defer log.Printf("Finished servicing shorten request for %s", request.Url)
+func ShortenAutomatic(s *Server, ctx context.Context, request *ShortenRequest, settings *LinkSettings, actor *Actor) (string, string, error) {
 
 	/*
 		It is possible that two shorten/ requests come in back to back that
 		require automatic alias assignment. As a result of Go's route handling
 		this will spawn two concurrently running goroutines.
 
-		For the purpose of illustrating the lock motivation, let us break
-		this down to two goroutines/threads that are doing an increment
-		operation. Let TMP be the result of the operation s.nextAlias + 1
-		that occurs on the right hand side of the expanded +=. Let A be
-		our counter (nextAlias). Let A start at 0.
-
-		Here is a possible order of execution subject to context switching.
-
-				goroutine #1					goroutine #2
-
-		1.		TMP = A + 1
-		2.										TMP = A + 1
-		3.										A = TMP
-		4.		A = TMP
-
-		As a result, both routines set A to 1, even though two increments
-		are done. Therefore, this is a race condition and the increments
-		need to be protected by a Mutex lock.
-
-		The code below is an expansion of the above scenario that involves
-		potentially multiple updates to nextAlias. Hence, the whole function
-		is locked off as a critical section.
+		Each of them gets a different alias from NextAutomaticAlias( ),
+		which only locks the allocator long enough to take the next alias
+		of the reserved block. The inserts then run concurrently, rather
+		than one after another behind a lock held across database round
+		trips.
 	*/
-	s.nextAliasLock.Lock()
-	defer s.nextAliasLock.Unlock()
-
-	var alias string
-
-	// Note for { } is proper Go syntax for a while (true) { }
 	for {
-		// Convert current next alias to string and try to insert
-		alias = strconv.Itoa(s.nextAlias)
-		_, err := s.db.Exec(QUERY_MAKE_MAPPING_TEMPLATE, request.Url, alias, true)
+		n, err := NextAutomaticAlias(s, ctx)
+		if err != nil {
+			return "", INTERNAL_ERROR_MESSAGE, err
+		}
+		alias := strconv.Itoa(n)
+		err = InsertMapping(s, ctx, request, settings, alias, true, actor)
 		if err == nil {
-			// Insertion successful -- return after we increase nextAlias
-			s.nextAlias += 1
-			break
-		} else if err.Error() == DUPLICATE_URL_VIOLATION {
+			// Insertion successful
+			return alias, "", nil
+		} else if err.Error() == DUPLICATE_ALIAS_VIOLATION {
+			/*
+				Insertion failed because the alias is in use for another URL.
+
+				Unlike in the custom alias case, if insertion fails due to duplicate
+				alias we can't just give up (as we are supposed to be assigning an
+				alias automatically).
+
+				Known custom numeric aliases are passed over by the allocator
+				(see SkipCustomAlias( )), so this only happens if one was made
+				at the same time (or by another server sharing the database).
+				The alias is taken, so we move on to the next one.
+			*/
+			continue
+		}
+
+		// The alias was not used, so it can be handed out again
+		ReturnAutomaticAlias(s, n)
+		if err.Error() == DUPLICATE_URL_VIOLATION {
 			// Insertion failed because the URL already has an alias
 
 			/*
-				Get the alias for the URL that we are trying to make
-				a mapping for. This is so that a user would know how
-				to visit their desired URL via the URL-Shortener
-				application.
+				Get the aliases for the URL that we are trying to make
+				a mapping for.
 
 				Note, this query can fail so we overwrite err after
 				saving the original duplicate error for logging
 				in Shorten( ).
 			*/
 			duplicate_url_err := err
-			alias, err = GetAliasByURL(s, request.Url)
-
-			/*
-				Don't expect this query to fail (because insertion failed
-				due to duplicated URLs)
-			*/
+			err_msg, err := DuplicateURLMessage(s, ctx, request.Url)
 			if err != nil {
 				return "", INTERNAL_ERROR_MESSAGE, err
 			}
-			return "", fmt.Sprintf("URL already has an alias %s.", alias), duplicate_url_err
-		} else if err.Error() == DUPLICATE_ALIAS_VIOLATION {
-			// Insertion failed because the alias is in use for another URL
-
-			/*
-				Unlike in the custom alias case, if insertion fails due to duplicate
-				alias we can't just give up (as we are supposed to be assigning an
-				alias automatically).
-
-				First off, the reason we even check for this is because the user could
-				make an alias be an automatic alias. For example, suppose now shorten/
-				requests have been made and the user shortens with a custom alias of "0".
-				This would conflict as this is the first nextAlias value.
-
-				Therefore, we keep incrementing nextAlias until we find one that does
-				not have a conflict and use that one as the automatic alias.
-			*/
-			s.nextAlias += 1
-		} else {
-			// Insertion failed for unexpected reason
-			return "", INTERNAL_ERROR_MESSAGE, err
+			return "", err_msg, duplicate_url_err
 		}
+
+		// Insertion failed for unexpected reason
+		return "", INTERNAL_ERROR_MESSAGE, err
 	}
-	return alias, "", nil
 }
 
 /*
@@ -380,8 +661,11 @@ Parameters:
 
 	s: Pointer to HTTP server that will be updated/used to make
 		new URL <-> alias mapping
+	ctx: Context of the request shortening the URL
 	request: Pointer to struct that represents contents of shorten
 		request.
+	settings: Settings stored alongside the mapping
+	actor: Who is shortening the URL, recorded in the audit log
 
 Returns:
 
@@ -392,38 +676,37 @@ Returns:
 	error are the empty string and nil respectively. If the
 	error is nil, it is assumed the returned alias is not empty.
 */
-func ShortenCustom(s *Server, request *ShortenRequest) (string, string, error) {
+func ShortenCustom(s *Server, ctx context.Context, request *ShortenRequest, settings *LinkSettings, actor *Actor) (string, string, error) {
+	// Reject aliases that break the alias policy before touching the database
+	violation := s.aliasChecker.Check(request.Alias)
+	if violation != "" {
+		return "", violation, fmt.Errorf("alias %q breaks alias policy", request.Alias)
+	}
+
 	// Insert custom mapping into database
-	_, err := s.db.Exec(QUERY_MAKE_MAPPING_TEMPLATE, request.Url, request.Alias, false)
+	err := InsertMapping(s, ctx, request, settings, request.Alias, false, actor)
 
 	if err == nil {
-		// Insertion successful -- return immediately
+		// Insertion successful -- keep automatic aliases clear of it and return
+		SkipCustomAlias(s, request.Alias)
 		return request.Alias, "", nil
 	} else if err.Error() == DUPLICATE_URL_VIOLATION {
 		// Insertion failed because the URL already has an alias
 
 		/*
-			Get the alias for the URL that we are trying to make
-			a mapping for. This is so that a user would know how
-			to visit their desired URL via the URL-Shortener
-			application.
+			Get the aliases for the URL that we are trying to make
+			a mapping for.
 
 			Note, this query can fail so we overwrite err after
 			saving the original duplicate error for logging
 			in Shorten( ).
 		*/
 		duplicate_url_err := err
-		alias, err := GetAliasByURL(s, request.Url)
-
-		/*
-			Don't expect this query to fail (because insertion failed
-			due to duplicated URLs)
-		*/
+		err_msg, err := DuplicateURLMessage(s, ctx, request.Url)
 		if err != nil {
 			return "", INTERNAL_ERROR_MESSAGE, err
 		}
-
-		return "", fmt.Sprintf("URL already has an alias %s.", alias), duplicate_url_err
+		return "", err_msg, duplicate_url_err
 	} else if err.Error() == DUPLICATE_ALIAS_VIOLATION {
 		// Insertion failed because alias is being used for another URL
 		return "", "Alias is already in use", err
@@ -433,6 +716,48 @@ func ShortenCustom(s *Server, request *ShortenRequest) (string, string, error) {
 	}
 }
 
+/*
+Creates the mapping a shorten request asks for. This is shared by shorten/
+and the admin dashboard (see admin.go) so links are created the same way
+no matter where the request came from.
+
+Parameters:
+
+	s: Pointer to HTTP server that will be updated/used to make
+		new URL <-> alias mapping
+	ctx: Context of the request shortening the URL
+	request: Pointer to struct that represents contents of shorten
+		request
+	actor: Who is shortening the URL, recorded in the audit log
+
+Returns:
+
+	The same as ShortenAutomatic( ) and ShortenCustom( ): the alias, error
+	message that is meant to be sent to the user and the error that
+	occurred.
+*/
+func CreateLink(s *Server, ctx context.Context, request *ShortenRequest, actor *Actor) (string, string, error) {
+	/*
+		First, build the settings stored alongside the mapping (this
+		validates them). Then, if decoding (as specified in api.go)
+		results in an empty alias we must automatically assign an alias.
+
+		A split link stored without a URL of its own gets its first
+		destination's, which is what listings show.
+	*/
+	settings, err_msg, err := NewLinkSettings(request)
+	if err == nil && request.Url == "" && len(settings.Destinations) > 0 {
+		request.Url = settings.Destinations[0].Url
+	}
+	if err != nil {
+		return "", err_msg, err
+	}
+	if request.Alias == "" {
+		return ShortenAutomatic(s, ctx, request, settings, actor)
+	}
+	return ShortenCustom(s, ctx, request, settings, actor)
+}
+
 /*
 Handles requests on the /shorten endpoint.
 
@@ -445,9 +770,11 @@ Parameters:
 	w: Where we write response for user
 */
 func Shorten(s *Server, w http.ResponseWriter, r *http.Request) {
+	logger := RequestLogger(r)
+
 	// Only POST requests are allowed on the shorten/ endpoint
 	if r.Method != http.MethodPost {
-		ReportInvalidMethodError(w, r.Method)
+		ReportInvalidMethodError(w, r, r.Method)
 		return
 	}
 
@@ -455,21 +782,11 @@ func Shorten(s *Server, w http.ResponseWriter, r *http.Request) {
 	var request ShortenRequest
 	err := json.NewDecoder(r.Body).Decode(&request)
 	if err != nil {
-		ReportBadRequestError(w, err.Error(), "Invalid JSON format")
+		ReportBadRequestError(w, r, err.Error(), "Invalid JSON format")
 		return
 	}
 
-	/*
-		If decoding (as specified in api.go) results in an empty
-		alias we must automatically assign an alias.
-	*/
-	var alias string
-	var err_msg string
-	if request.Alias == "" {
-		alias, err_msg, err = ShortenAutomatic(s, &request)
-	} else {
-		alias, err_msg, err = ShortenCustom(s, &request)
-	}
+	alias, err_msg, err := CreateLink(s, r.Context(), &request, NewActor(r, API_ACTOR))
 
 	/*
 		If an error occurred during shortening, we report it. Any
@@ -479,13 +796,14 @@ func Shorten(s *Server, w http.ResponseWriter, r *http.Request) {
 	*/
 	if err != nil {
 		if err_msg == INTERNAL_ERROR_MESSAGE {
-			ReportUnexpectedInternalServerError(w, err)
+			ReportUnexpectedInternalServerError(w, r, err)
 		} else {
-			ReportBadRequestError(w, err.Error(), err_msg)
+			ReportBadRequestError(w, r, err.Error(), err_msg)
 		}
 		return
 	}
 
+	logger.Info("Shortened URL", "alias", alias, "automatic", request.Alias == "")
 	RespondAsJSON(w, ShortenResponse{
 		Url:   request.Url,
 		Alias: alias,
@@ -493,34 +811,123 @@ func Shorten(s *Server, w http.ResponseWriter, r *http.Request) {
 }
 
 /*
-Handles requests on the /expand/ endpoint.
+Represents an existing mapping along with the settings needed to expand
+it. This is what is looked up whenever an alias is used.
+*/
+type Link struct {
+	Alias string
+	Url   string
 
-Parameters:
+	// Salted hash of the link's password, NULL if it has none
+	PasswordHash sql.NullString
 
-	s: Pointer to HTTP server that will be used to expand an
-		alias and record the expansion
-	request: Pointer to struct that represents contents of HTTP
-		request
-	w: Where we write response for user
-*/
-func Expand(s *Server, w http.ResponseWriter, r *http.Request) {
-	// Only GET requests are allowed on the expand/ endpoint
-	if r.Method != http.MethodGet {
-		ReportInvalidMethodError(w, r.Method)
-		return
-	}
+	// Whether the link has been switched off (e.g. from the admin dashboard)
+	Disabled bool
 
-	/*
-		Strip off the analytics/ endpoint from URL where request
-		was made at to get the alias that was provided in the
+	// How the link merges query parameters into its URL (see query_params.go)
+	QueryPassthrough string
+	UTMDefaults      map[string]string
+
+	// Destinations of a split link, none for a link with a single URL
+	Destinations []Destination
+
+	// Rules sending some visitors elsewhere, checked in order (see routing.go)
+	RoutingRules []RoutingRule
+}
+
+/*
+Queries the server's database for the link that an alias maps to. This is
+the lookup used by expand/ and by anything else that needs to check that
+an alias exists (e.g. qr/).
+
+Parameters:
+
+	s: Pointer to Server whose database we query
+	ctx: Context of the request the lookup is for
+	alias: Alias for which we're finding the link
+
+Returns:
+
+	The link and, if the lookup failed, the lookup error. If the alias is
+	not mapped, the error is sql.ErrNoRows.
+*/
+func GetLinkByAlias(s *Server, ctx context.Context, alias string) (*Link, error) {
+	link := &Link{Alias: alias}
+	var utm_defaults, routing_rules sql.NullString
+	var destinations []VariantAnalytics
+	err := RunQuery(s, ctx, func(ctx context.Context) error {
+		row := s.db.QueryRowContext(ctx, QUERY_GET_LINK_BY_ALIAS_TEMPLATE, alias)
+		err := row.Scan(&link.Url, &link.PasswordHash, &link.Disabled, &link.QueryPassthrough, &utm_defaults, &routing_rules)
+		if err != nil {
+			return err
+		}
+		destinations, err = GetDestinations(ctx, s.db.QueryContext, alias)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, destination := range destinations {
+		link.Destinations = append(link.Destinations, destination.Destination)
+	}
+	link.UTMDefaults, err = DecodeUTMDefaults(utm_defaults)
+	if err != nil {
+		return nil, err
+	}
+	link.RoutingRules, err = DecodeRoutingRules(routing_rules)
+	if err != nil {
+		return nil, err
+	}
+	return link, nil
+}
+
+/*
+Builds the short URL for an alias, i.e. the URL a user visits to be
+redirected to the alias's URL, starting from the configured public base
+URL.
+
+Parameters:
+
+	s: Pointer to Server whose configuration is used
+	alias: The alias to build the short URL for
+
+Returns:
+
+	The short URL.
+*/
+func ShortURL(s *Server, alias string) string {
+	return strings.TrimSuffix(s.config.PublicBaseURL, "/") + REDIRECT_ENDPOINT + neturl.PathEscape(alias)
+}
+
+/*
+Handles requests on the /expand/ endpoint.
+
+Parameters:
+
+	s: Pointer to HTTP server that will be used to expand an
+		alias and record the expansion
+	request: Pointer to struct that represents contents of HTTP
+		request
+	w: Where we write response for user
+*/
+func Expand(s *Server, w http.ResponseWriter, r *http.Request) {
+	logger := RequestLogger(r)
+
+	// Only GET requests are allowed on the expand/ endpoint
+	if r.Method != http.MethodGet {
+		ReportInvalidMethodError(w, r, r.Method)
+		return
+	}
+
+	/*
+		Strip off the analytics/ endpoint from URL where request
+		was made at to get the alias that was provided in the
 		request.
 	*/
 	alias := strings.TrimPrefix(r.URL.Path, EXPAND_ENDPOINT)
 
-	// Get the URL for the provided alias
-	row := s.db.QueryRow(QUERY_GET_URL_BY_ALIAS_TEMPLATE, alias)
-	var url string
-	err := row.Scan(&url)
+	// Get the link for the provided alias
+	link, err := GetLinkByAlias(s, r.Context(), alias)
 
 	/*
 		sql.ErrNoRows is the error provided by Scan in the event that QueryRow( )
@@ -529,13 +936,134 @@ func Expand(s *Server, w http.ResponseWriter, r *http.Request) {
 		We don't expect any other errors
 	*/
 	if err == sql.ErrNoRows {
-		ReportBadRequestError(w, "No mapping exists for alias", fmt.Sprintf("Cannot expand %s, not mapped", alias))
+		ReportBadRequestError(w, r, "No mapping exists for alias", fmt.Sprintf("Cannot expand %s, not mapped", alias))
+		return
+	} else if err != nil {
+		ReportUnexpectedInternalServerError(w, r, err)
+		return
+	}
+
+	if link.Disabled {
+		ReportExpansionError(w, r, alias, LINK_DISABLED_ERROR)
+		return
+	}
+
+	// JSON API clients provide the password of protected links in a header
+	status, err_msg := CheckLinkPassword(s, r, link, r.Header.Get(PASSWORD_HEADER))
+	if status != 0 {
+		logger.Info("Password check failed", "alias", alias)
+		ReportClientError(w, r, status, "Password check failed", err_msg)
+		return
+	}
+
+	url, variant, err := RecordExpansion(s, r, link)
+	if err != nil {
+		ReportExpansionError(w, r, alias, err)
+		return
+	}
+
+	logger.Info("Expanded alias", "alias", alias)
+	RespondAsJSON(w, ExpandResponse{
+		Url:     url,
+		Alias:   alias,
+		Variant: variant,
+	})
+}
+
+/*
+Handles requests on the /r/ endpoint. This is the browser facing version
+of expand/: instead of responding with JSON, the browser is redirected to
+the alias's URL. For password protected links, a GET shows a form for
+the password which is POSTed back here.
+
+Parameters:
+
+	s: Pointer to HTTP server that will be used to expand an
+		alias and record the expansion
+	request: Pointer to struct that represents contents of HTTP
+		request
+	w: Where we write response for user
+*/
+func Redirect(s *Server, w http.ResponseWriter, r *http.Request) {
+	// GET follows a short URL, POST submits the password form
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		ReportInvalidMethodError(w, r, r.Method)
+		return
+	}
+
+	alias := strings.TrimPrefix(r.URL.Path, REDIRECT_ENDPOINT)
+	link, err := GetLinkByAlias(s, r.Context(), alias)
+	if err == sql.ErrNoRows {
+		ReportClientError(w, r, http.StatusNotFound, "No mapping exists for alias", fmt.Sprintf("Cannot expand %s, not mapped", alias))
 		return
 	} else if err != nil {
-		ReportUnexpectedInternalServerError(w, err)
+		ReportUnexpectedInternalServerError(w, r, err)
+		return
+	}
+
+	if link.Disabled {
+		ReportExpansionError(w, r, alias, LINK_DISABLED_ERROR)
 		return
 	}
 
+	if link.PasswordHash.Valid {
+		// Following the short URL shows the form without counting a failure
+		if r.Method == http.MethodGet {
+			RespondWithPasswordForm(w, http.StatusOK, alias, "")
+			return
+		}
+		status, err_msg := CheckLinkPassword(s, r, link, r.PostFormValue(PASSWORD_FORM_FIELD))
+		if status != 0 {
+			RequestLogger(r).Info("Password check failed", "alias", alias, "error", err_msg)
+			RespondWithPasswordForm(w, status, alias, err_msg)
+			return
+		}
+	}
+
+	url, variant, err := RecordExpansion(s, r, link)
+	if err != nil {
+		ReportExpansionError(w, r, alias, err)
+		return
+	}
+	if variant != "" {
+		SetSplitCookie(w, alias, variant)
+	}
+
+	/*
+		303 (See Other) makes the browser follow up a POSTed form with a
+		GET, for a plain GET it behaves like the usual 302 (Found). We
+		don't use a permanent redirect (301) as browsers would cache it
+		and skip us (and the expansion count) on later visits.
+	*/
+	http.Redirect(w, r, url, http.StatusSeeOther)
+}
+
+// Error returned when expanding a link that has reached its maximum expansions
+var EXPANSION_LIMIT_ERROR = errors.New("alias has reached its maximum number of expansions")
+
+// Error reported when expanding a link that has been disabled
+var LINK_DISABLED_ERROR = errors.New("alias has been disabled")
+
+/*
+Records that a link has been expanded and determines where the user
+should be sent. This is shared by expand/ and r/, so it is the single
+place where an expansion is counted. Any access checks (e.g. passwords)
+must be done before calling this.
+
+Parameters:
+
+	s: Pointer to Server whose database we update
+	r: The request expanding the link
+	link: The link being expanded
+
+Returns:
+
+	The URL the user should be sent to (with the query parameters the
+	link adds, see DestinationURL( )), the name of the destination it
+	is (empty unless the link is split, see split.go) and, if recording
+	the expansion failed, an error.
+*/
+func RecordExpansion(s *Server, r *http.Request, link *Link) (string, string, error) {
 	/*
 		Increase the number of expansions done on alias. Note because UPDATE internally
 		does an increment, there's no need to provide the current number of expansions.
@@ -545,10 +1073,10 @@ func Expand(s *Server, w http.ResponseWriter, r *http.Request) {
 		request. As a result, two goroutines start running conccurently.
 
 		Suppose the following order of operations occur. In the left column,
-		SQL SELECT represents the QueryRow( ) call done above (which does
-		the expansion) and SQL UPDATE represents the Exec( ) call done below
-		(which does the expansion count update). In the right column, SQL
-		SELECT represents the QueryRow( ) call done in the function below
+		SQL SELECT represents the QueryRow( ) call done in GetLinkByAlias( )
+		(which does the expansion) and SQL UPDATE represents the Exec( ) call
+		done below (which does the expansion count update). In the right
+		column, SQL SELECT represents the QueryRow( ) call done in Analytics( )
 		which gets the # of expansions.
 
 				expand/ goroutine				analytics/ goroutine
@@ -571,17 +1099,157 @@ func Expand(s *Server, w http.ResponseWriter, r *http.Request) {
 		only happen after the UPDATE in the expand/ goroutine. We therefore
 		do not believe that maintaining this particular consistency is
 		worth the overhead of maintaining a locked state.
+
+		The click history is a different matter: the counter and the
+		history must agree, so the UPDATE and the click INSERT are done
+		in one transaction. Either both happen or neither does.
+	*/
+	/*
+		The first matching routing rule takes the place of the link's URL,
+		otherwise a split link's destination does.
 	*/
-	_, err = s.db.Exec(QUERY_UPDATE_ANALYTICS_BY_ALIAS_TEMPLATE, alias)
+	class := s.userAgents.Classify(r.UserAgent())
+	target := link
+	var variant sql.NullString
+	rule := MatchRoutingRules(link.RoutingRules, NewRoutingVisit(r, class, time.Now()))
+	if rule >= 0 {
+		target = new(Link)
+		*target = *link
+		target.Url = link.RoutingRules[rule].Url
+	} else if destination := ChooseDestination(s, r, link); destination != nil {
+		target = new(Link)
+		*target = *link
+		target.Url = destination.Url
+		variant = sql.NullString{String: destination.Name, Valid: true}
+	}
+
+	visitor := VisitorHash(s.visitorSalt, ClientIP(r), r.UserAgent())
+	bot, reason := s.bots.Detect(r, visitor)
+	if bot {
+		counted, err := RecordBotExpansion(s, r.Context(), link)
+		if err != nil {
+			return "", "", err
+		}
+		if counted {
+			RequestLogger(r).Info("Counted expansion by a bot", "alias", link.Alias, "reason", reason)
+			return DestinationURL(target, r.URL.RawQuery), variant.String, nil
+		}
+		// Expansions of capped links are all counted below
+	}
+
+	var queued bool
+	err := RunQuery(s, r.Context(), func(ctx context.Context) error {
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		/*
+			The UPDATE only matches the alias if it is under its maximum
+			number of expansions, so no row returned means the cap was
+			reached and the user must not be sent anywhere.
+		*/
+		var expansions int
+		var max_expansions sql.NullInt64
+		err = tx.QueryRowContext(ctx, QUERY_UPDATE_ANALYTICS_BY_ALIAS_TEMPLATE, link.Alias).Scan(&expansions, &max_expansions)
+		if errors.Is(err, sql.ErrNoRows) {
+			return EXPANSION_LIMIT_ERROR
+		}
+		if err != nil {
+			return err
+		}
+		now := time.Now().Unix()
+		_, err = tx.ExecContext(ctx, QUERY_RECORD_CLICK_TEMPLATE, link.Alias, now, ClickParams(r.URL.RawQuery), class.Device, class.Browser, class.OS, variant)
+		if err != nil {
+			return err
+		}
+		if variant.Valid {
+			_, err = tx.ExecContext(ctx, QUERY_UPDATE_DESTINATION_EXPANSIONS_TEMPLATE, link.Alias, variant.String)
+			if err != nil {
+				return err
+			}
+		}
+		err = RecordVisitor(ctx, tx, link.Alias, now, visitor)
+		if err != nil {
+			return err
+		}
+
+		// Events are only delivered if the expansion is recorded (see webhooks.go)
+		queued, err = EnqueueExpansionEvents(s, ctx, tx, link, expansions, max_expansions)
+		if err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
 	if err != nil {
-		ReportUnexpectedInternalServerError(w, err)
+		return "", "", err
+	}
+	if queued {
+		WakeWebhookDeliveries(s)
+	}
+	return DestinationURL(target, r.URL.RawQuery), variant.String, nil
+}
+
+/*
+Reports an error that occurred while recording an expansion (see
+RecordExpansion( )), or that stopped the expansion before it could be
+recorded (e.g. LINK_DISABLED_ERROR), back to the user and logs it.
+
+Parameters:
+
+	w: Where we write response for user
+	r: The request being answered
+	alias: The alias that was being expanded
+	err: The error returned by RecordExpansion( )
+*/
+func ReportExpansionError(w http.ResponseWriter, r *http.Request, alias string, err error) {
+	if errors.Is(err, EXPANSION_LIMIT_ERROR) {
+		// 410 (Gone) tells clients the link existed but is no longer usable
+		ReportClientError(w, r, http.StatusGone, err.Error(), fmt.Sprintf("%s has reached its maximum number of expansions", alias))
+		return
+	}
+	if errors.Is(err, LINK_DISABLED_ERROR) {
+		ReportClientError(w, r, http.StatusGone, err.Error(), fmt.Sprintf("%s has been disabled", alias))
 		return
 	}
+	ReportUnexpectedInternalServerError(w, r, err)
+}
 
-	RespondAsJSON(w, ExpandResponse{
-		Url:   url,
-		Alias: alias,
-	})
+/*
+Checks that a request may read the analytics of an alias. Analytics give
+out the URL of a link (and of its destinations), so a password protected
+link needs its password here just as on expand/. If access is refused,
+the error is reported back to the user.
+
+Parameters:
+
+	s: Pointer to HTTP server that will be used to look up the alias
+	w: Where we write response for user
+	r: The request for the analytics
+	alias: The alias whose analytics are requested
+
+Returns:
+
+	Whether the analytics may be given.
+*/
+func CheckAnalyticsAccess(s *Server, w http.ResponseWriter, r *http.Request, alias string) bool {
+	link, err := GetLinkByAlias(s, r.Context(), alias)
+	if err == sql.ErrNoRows {
+		ReportBadRequestError(w, r, "No mapping exists for alias", fmt.Sprintf("Cannot get analytics for %s, not mapped", alias))
+		return false
+	} else if err != nil {
+		ReportUnexpectedInternalServerError(w, r, err)
+		return false
+	}
+
+	status, err_msg := CheckLinkPassword(s, r, link, r.Header.Get(PASSWORD_HEADER))
+	if status != 0 {
+		RequestLogger(r).Info("Password check failed", "alias", alias)
+		ReportClientError(w, r, status, "Password check failed", err_msg)
+		return false
+	}
+	return true
 }
 
 /*
@@ -596,9 +1264,11 @@ Parameters:
 	w: Where we write response for user
 */
 func Analytics(s *Server, w http.ResponseWriter, r *http.Request) {
+	logger := RequestLogger(r)
+
 	// Only GET requests are allowed on the analytics/ endpoint
 	if r.Method != http.MethodGet {
-		ReportInvalidMethodError(w, r.Method)
+		ReportInvalidMethodError(w, r, r.Method)
 		return
 	}
 
@@ -609,11 +1279,43 @@ func Analytics(s *Server, w http.ResponseWriter, r *http.Request) {
 	*/
 	alias := strings.TrimPrefix(r.URL.Path, ANALYTICS_ENDPOINT)
 
+	// analytics/ with no alias is the same as analytics across all links
+	if alias == "" {
+		SummaryAnalytics(s, w, r)
+		return
+	}
+	if alias, found := strings.CutSuffix(alias, ANALYTICS_BREAKDOWN_SUFFIX); found {
+		if CheckAnalyticsAccess(s, w, r, alias) {
+			AnalyticsBreakdown(s, w, r, alias)
+		}
+		return
+	}
+	if alias, found := strings.CutSuffix(alias, ANALYTICS_VISITORS_SUFFIX); found {
+		if CheckAnalyticsAccess(s, w, r, alias) {
+			AnalyticsVisitors(s, w, r, alias)
+		}
+		return
+	}
+	if !CheckAnalyticsAccess(s, w, r, alias) {
+		return
+	}
+
 	// Get the URL, # expansions for the provided alias
-	row := s.db.QueryRow(QUERY_GET_ANALYTICS_BY_ALIAS_TEMPLATE, alias)
 	var url string
 	var expansions int
-	err := row.Scan(&url, &expansions)
+	var max_expansions sql.NullInt64
+	var bot_expansions int
+	var visitor_sketch []byte
+	var variants []VariantAnalytics
+	err := RunQuery(s, r.Context(), func(ctx context.Context) error {
+		row := s.db.QueryRowContext(ctx, QUERY_GET_ANALYTICS_BY_ALIAS_TEMPLATE, alias)
+		err := row.Scan(&url, &expansions, &max_expansions, &bot_expansions, &visitor_sketch)
+		if err != nil {
+			return err
+		}
+		variants, err = GetDestinations(ctx, s.db.QueryContext, alias)
+		return err
+	})
 
 	/*
 		sql.ErrNoRows is the error provided by Scan in the event that QueryRow( )
@@ -622,18 +1324,139 @@ func Analytics(s *Server, w http.ResponseWriter, r *http.Request) {
 		We don't expect any other errors
 	*/
 	if err == sql.ErrNoRows {
-		ReportBadRequestError(w, "No mapping exists for alias", fmt.Sprintf("Cannot get analytics for %s, not mapped", alias))
+		ReportBadRequestError(w, r, "No mapping exists for alias", fmt.Sprintf("Cannot get analytics for %s, not mapped", alias))
 		return
 	} else if err != nil {
-		ReportUnexpectedInternalServerError(w, err)
+		ReportUnexpectedInternalServerError(w, r, err)
+		return
+	}
+	sketch, err := DecodeVisitorSketch(visitor_sketch)
+	if err != nil {
+		ReportUnexpectedInternalServerError(w, r, err)
 		return
 	}
 
-	RespondAsJSON(w, AnalyticsResponse{
-		Url:        url,
-		Alias:      alias,
-		Expansions: expansions,
-	})
+	response := AnalyticsResponse{
+		Url:            url,
+		Alias:          alias,
+		Expansions:     expansions,
+		BotExpansions:  bot_expansions,
+		UniqueVisitors: sketch.Estimate(),
+		Variants:       variants,
+	}
+	if max_expansions.Valid {
+		limit := int(max_expansions.Int64)
+		response.MaxExpansions = &limit
+	}
+	logger.Info("Reported analytics", "alias", alias, "expansions", expansions, "bot_expansions", bot_expansions, "unique_visitors", response.UniqueVisitors)
+	RespondAsJSON(w, response)
+}
+
+/*
+Handles requests on the /qr/ endpoint. This renders a QR code for the
+short URL of an alias, as a PNG or SVG depending on the extension that
+follows the alias.
+
+Parameters:
+
+	s: Pointer to HTTP server that will be used to look up the alias
+	request: Pointer to struct that represents contents of HTTP
+		request
+	w: Where we write response for user
+*/
+func QR(s *Server, w http.ResponseWriter, r *http.Request) {
+	// Only GET requests are allowed on the qr/ endpoint
+	if r.Method != http.MethodGet {
+		ReportInvalidMethodError(w, r, r.Method)
+		return
+	}
+
+	// Split e.g. google.png into the alias and the image format
+	name := strings.TrimPrefix(r.URL.Path, QR_ENDPOINT)
+	extension := path.Ext(name)
+	alias := strings.TrimSuffix(name, extension)
+	if extension != ".png" && extension != ".svg" {
+		ReportBadRequestError(w, r, fmt.Sprintf("Unsupported QR format %q", extension), "QR codes are available as .png or .svg")
+		return
+	}
+
+	size, level, margin, err_msg := ParseQROptions(r)
+	if err_msg != "" {
+		ReportBadRequestError(w, r, r.URL.RawQuery, err_msg)
+		return
+	}
+
+	// Make sure the alias exists the same way expand/ does
+	_, err := GetLinkByAlias(s, r.Context(), alias)
+	if err == sql.ErrNoRows {
+		ReportBadRequestError(w, r, "No mapping exists for alias", fmt.Sprintf("Cannot make QR code for %s, not mapped", alias))
+		return
+	} else if err != nil {
+		ReportUnexpectedInternalServerError(w, r, err)
+		return
+	}
+
+	code, err := EncodeQR([]byte(ShortURL(s, alias)), level)
+	if err != nil {
+		ReportUnexpectedInternalServerError(w, r, err)
+		return
+	}
+	size = QRImageSize(code, size, margin)
+
+	if extension == ".svg" {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.Write(RenderQRSVG(code, size, margin))
+		return
+	}
+	image, err := RenderQRPNG(code, size, margin)
+	if err != nil {
+		ReportUnexpectedInternalServerError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(image)
+}
+
+/*
+Parses the size, ec and margin query parameters of a qr/ request, falling
+back to defaults for the ones that are missing.
+
+Parameters:
+
+	r: The qr/ request
+
+Returns:
+
+	The image size in pixels, the error correction level, the margin in
+	modules, and a message for the user if a parameter is invalid (empty
+	if they are all valid).
+*/
+func ParseQROptions(r *http.Request) (int, QRErrorCorrection, int, string) {
+	query := r.URL.Query()
+	size := QR_DEFAULT_SIZE
+	level := QR_ERROR_CORRECTION_M
+	margin := QR_DEFAULT_MARGIN
+
+	var err error
+	if query.Has("size") {
+		size, err = strconv.Atoi(query.Get("size"))
+		if err != nil || size < QR_MIN_SIZE || size > QR_MAX_SIZE {
+			return 0, 0, 0, fmt.Sprintf("size must be an integer between %d and %d", QR_MIN_SIZE, QR_MAX_SIZE)
+		}
+	}
+	if query.Has("ec") {
+		level, err = ParseQRErrorCorrection(query.Get("ec"))
+		if err != nil {
+			return 0, 0, 0, "ec must be one of L, M, Q, H"
+		}
+	}
+	if query.Has("margin") {
+		margin, err = strconv.Atoi(query.Get("margin"))
+		if err != nil || margin < 0 || margin > QR_MAX_MARGIN {
+			return 0, 0, 0, fmt.Sprintf("margin must be an integer between 0 and %d", QR_MAX_MARGIN)
+		}
+	}
+	return size, level, margin, ""
 }
 
 // Sets up the route handling for the server
@@ -653,9 +1476,58 @@ func SetUpRoutes(s *Server) {
 	http.HandleFunc(EXPAND_ENDPOINT, func(w http.ResponseWriter, r *http.Request) {
 		Expand(s, w, r)
 	})
+	http.HandleFunc(REDIRECT_ENDPOINT, func(w http.ResponseWriter, r *http.Request) {
+		Redirect(s, w, r)
+	})
+	http.HandleFunc(ROUTE_ENDPOINT, func(w http.ResponseWriter, r *http.Request) {
+		Route(s, w, r)
+	})
 	http.HandleFunc(ANALYTICS_ENDPOINT, func(w http.ResponseWriter, r *http.Request) {
 		Analytics(s, w, r)
 	})
+	http.HandleFunc(ANALYTICS_SUMMARY_ENDPOINT, func(w http.ResponseWriter, r *http.Request) {
+		SummaryAnalytics(s, w, r)
+	})
+	http.HandleFunc(CAMPAIGNS_ENDPOINT, func(w http.ResponseWriter, r *http.Request) {
+		CampaignAnalytics(s, w, r)
+	})
+	http.HandleFunc(QR_ENDPOINT, func(w http.ResponseWriter, r *http.Request) {
+		QR(s, w, r)
+	})
+	http.HandleFunc(LINKS_ENDPOINT, func(w http.ResponseWriter, r *http.Request) {
+		Links(s, w, r)
+	})
+	http.HandleFunc(HEALTHZ_ENDPOINT, Healthz)
+	http.HandleFunc(READYZ_ENDPOINT, func(w http.ResponseWriter, r *http.Request) {
+		Readyz(s, w, r)
+	})
+
+	/*
+		The admin dashboard, audit log, backups, webhooks and labels are
+		only served once admin credentials are configured
+	*/
+	if AdminEnabled(s.config) {
+		http.HandleFunc(ADMIN_ENDPOINT, func(w http.ResponseWriter, r *http.Request) {
+			AdminDashboard(s, w, r)
+		})
+		http.HandleFunc(AUDIT_ENDPOINT, func(w http.ResponseWriter, r *http.Request) {
+			Audit(s, w, r)
+		})
+		http.HandleFunc(BACKUPS_ENDPOINT, func(w http.ResponseWriter, r *http.Request) {
+			Backups(s, w, r)
+		})
+		http.HandleFunc(WEBHOOKS_ENDPOINT, func(w http.ResponseWriter, r *http.Request) {
+			Webhooks(s, w, r)
+		})
+		http.HandleFunc(WEBHOOKS_ENDPOINT+"/", func(w http.ResponseWriter, r *http.Request) {
+			Webhooks(s, w, r)
+		})
+		http.HandleFunc(LABELS_ENDPOINT, func(w http.ResponseWriter, r *http.Request) {
+			Labels(s, w, r)
+		})
+	} else {
+		log.Println("Admin dashboard is off, set admin_username and admin_password_hash to turn it on")
+	}
 }
 
 //////////////// PUBLIC FUNCTIONS AND METHODS ///////////////////////
@@ -665,8 +1537,12 @@ Sets up a new Server object and returns it to the invoking code. This
 initializes the server database, next alias, and the route handling.
 It returns a pointer to the Server object if setup was successful.
 nil is returned if setup failed.
+
+Parameters:
+
+	config: Server configuration, see LoadConfig( ) and DefaultConfig( )
 */
-func NewServer() *Server {
+func NewServer(config Config) *Server {
 	/*
 		Go apparently doesn't distinguish between stack and heap in
 		its spec, but new( ) does force a heap allocation under the
@@ -682,48 +1558,187 @@ func NewServer() *Server {
 		See here for more: https://stackoverflow.com/a/10866871
 	*/
 	server := new(Server)
+	server.config = config
 
-	// Default log granularity is seconds -- lowering to microseconds
-	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds)
-	err := InitializeDatabase(server)
+	// Logs are structured from here on (see logging.go)
+	err := SetUpLogging(config)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	server.aliasChecker, err = NewAliasChecker(config.AliasPolicy)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	server.passwordLimiter = NewAttemptLimiter(config.PasswordMaxFailures, time.Duration(config.PasswordLockoutSeconds)*time.Second)
+	server.userAgents, err = NewUserAgentClassifier(config.UserAgentRulesFile)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	server.bots, err = NewBotDetector(config)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	server.webhookClient = NewWebhookClient(config)
+	server.webhookWake = make(chan struct{}, 1)
+	server.adminToken, err = NewAdminToken()
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	tls_enabled, err := TLSEnabled(config)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	if tls_enabled {
+		server.certificates, err = NewCertificateReloader(config.TLSCertFile, config.TLSKeyFile)
+		if err != nil {
+			log.Println(err)
+			return nil
+		}
+	}
+	err = InitializeDatabase(server)
 	if err != nil {
+		if server.db != nil {
+			server.db.Close()
+		}
 		log.Println(err)
 		return nil
 	}
-	err = SetNextAlias(server)
+	err = LoadAliasAllocator(server)
+	if err != nil {
+		server.db.Close()
+		log.Println(err)
+		return nil
+	}
+	err = LoadVisitorSalt(server)
 	if err != nil {
 		server.db.Close()
 		log.Println(err)
 		return nil
 	}
 	SetUpRoutes(server)
+	go RunAliasLeaseRenewals(server)
+	go RunWebhookDeliveries(server)
+	if config.BackupIntervalSeconds > 0 {
+		go RunScheduledBackups(server)
+	}
 	return server
 }
 
 /*
 Runs the server by having it start listening on a particular
-interface and port. Once it has been closed, the database
-connection is closed.
+interface and port until it is interrupted (Ctrl+C) or terminated.
+This serves HTTPS if a certificate is configured (along with the
+optional redirect from plain HTTP), otherwise plain HTTP. It then
+shuts down gracefully (see Shutdown( )), and once it has been
+closed, the database connection is closed.
 
 Note, because this function operates on an initialized
 Server, it is made a method with a Server receiver.
 */
 func (s *Server) Run() {
 	/*
-		The nil parameter specifies we are using the default request
-		multiplexer. In particular, it will try to match the endpoint
-		to the routes that have been registered in SetupRoutes( ).
+		The handler is the default request multiplexer wrapped so
+		requests are logged (see LogRequests( )). In particular, it will
+		try to match the endpoint to the routes that have been
+		registered in SetupRoutes( ).
 
 		It is important to note that when a request comes in, it will
 		result in a goroutine spawning where request/route handling is
 		done.
+	*/
+	http_server := &http.Server{
+		Addr:    fmt.Sprintf("%s:%d", HOSTNAME, PORT),
+		Handler: LogRequests(http.DefaultServeMux),
+	}
+	servers := []*http.Server{http_server}
+	var redirect_server *http.Server
+	if s.certificates != nil {
+		http_server.TLSConfig = NewTLSConfig(s.certificates)
+		if s.config.HTTPRedirectPort > 0 {
+			redirect_server = NewRedirectServer(s.config.HTTPRedirectPort)
+			servers = append(servers, redirect_server)
+		}
+	}
+
+	/*
+		signal.Notify( ) delivers the signals to a channel instead of
+		killing the program, so a goroutine can wait for one and then
+		shut down the servers. done is closed once shutdown is complete.
+	*/
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		received := <-signals
+		log.Printf("Received %s, shutting down", received)
+		s.Shutdown(servers...)
+		close(done)
+	}()
 
-		Also, this function always returns an error even when Ctrl+C'd
-		by the user. Regardless, when this function terminates, we have
-		to make sure the database connection is closed for proper
-		resource cleanup.
+	/*
+		The redirect server runs alongside the main one. If it fails
+		(e.g. its port is taken), the main server keeps running.
 	*/
-	err := http.ListenAndServe(fmt.Sprintf("%s:%d", HOSTNAME, PORT), nil)
-	log.Println(err)
+	if redirect_server != nil {
+		go func() {
+			err := redirect_server.ListenAndServe()
+			if !errors.Is(err, http.ErrServerClosed) {
+				log.Println(err)
+			}
+		}()
+	}
+
+	/*
+		ListenAndServe( ) returns ErrServerClosed as soon as Shutdown( )
+		is called, which is expected. Otherwise (e.g. the port is taken)
+		there is nothing to wait for. The certificate comes from the TLS
+		configuration, hence the empty file names.
+	*/
+	var err error
+	if s.certificates != nil {
+		err = http_server.ListenAndServeTLS("", "")
+	} else {
+		err = http_server.ListenAndServe()
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		<-done
+	} else {
+		log.Println(err)
+	}
+	ReleaseAliasRange(s)
 	s.db.Close()
 }
+
+/*
+Shuts down the server gracefully. Readiness fails first and requests are
+still answered for shutdown_drain_seconds, so an orchestrator can stop
+sending traffic before the listeners close. Then the servers stop
+accepting connections and wait (up to SHUTDOWN_TIMEOUT) for requests in
+progress to finish.
+
+Parameters:
+
+	http_servers: The HTTP servers Run( ) is listening with
+*/
+func (s *Server) Shutdown(http_servers ...*http.Server) {
+	s.draining.Store(true)
+	if s.config.ShutdownDrainSeconds > 0 {
+		log.Printf("Draining for %d seconds", s.config.ShutdownDrainSeconds)
+		time.Sleep(time.Duration(s.config.ShutdownDrainSeconds) * time.Second)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+	defer cancel()
+	for _, http_server := range http_servers {
+		err := http_server.Shutdown(ctx)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
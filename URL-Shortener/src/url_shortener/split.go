@@ -0,0 +1,277 @@
+/*
+Package url_shortener serves as a library of utilities for the URL-Shortener
+application. This includes the definition of our API, database configuration,
+and HTTP server implementation. This is used by the main package to instantiate
+and run a server easily. This library could be used in other applications
+that do more than just initializing and booting a server.
+
+This file provides split links, whose visitors are shared between several
+weighted destinations (variants) for A/B experiments. A visitor keeps
+getting the same variant:
+
+ 1. A variant named by the visitor's cookie (set by the redirect route,
+    or sent by an API client) is used while the link still has it.
+ 2. Otherwise, the variant is picked from a hash of the alias and the
+    client, which is the X-Client-ID header if given or else the IP
+    address and User-Agent. The hash falls within the total weight, so
+    each variant gets its share of clients.
+
+The destinations of a link are kept in the destinations table, along with
+how many expansions each got. The link's own URL (aliases.URL) is shown in
+listings and is not visited.
+*/
+
+package url_shortener
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// Header an API client identifies itself with, so it keeps its variant
+const CLIENT_ID_HEADER = "X-Client-ID"
+
+/*
+Name of the cookie holding a visitor's variant. The cookie's path is the
+link's short URL, so each link has its own.
+*/
+const SPLIT_COOKIE_NAME = "variant"
+
+// How long the variant cookie is kept by the browser
+const SPLIT_COOKIE_MAX_AGE = 30 * 24 * time.Hour
+
+// Limits on the destinations of a split link
+const SPLIT_MIN_DESTINATIONS = 2
+const SPLIT_MAX_DESTINATIONS = 10
+const SPLIT_MAX_WEIGHT = 1000
+
+// Variant names, also what the variant cookie holds
+var SPLIT_VARIANT_NAME = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// Query template to add a destination to a link being created
+const QUERY_ADD_DESTINATION_TEMPLATE = `
+INSERT INTO destinations (Alias, Variant, URL, Weight)
+VALUES (?, ?, ?, ?)
+`
+
+// Query template to get the destinations of a link, in the order they were given
+const QUERY_GET_DESTINATIONS_TEMPLATE = `
+SELECT Variant, URL, Weight, Expansions
+FROM destinations
+WHERE Alias = ?
+ORDER BY rowid
+`
+
+// Query template to count an expansion of a variant
+const QUERY_UPDATE_DESTINATION_EXPANSIONS_TEMPLATE = `
+UPDATE destinations
+SET Expansions = Expansions + 1
+WHERE Alias = ? AND Variant = ?
+`
+
+// Query template for deleting the destinations of a mapping being deleted
+const QUERY_DELETE_DESTINATIONS_TEMPLATE = `
+DELETE FROM destinations
+WHERE Alias = ?
+`
+
+/*
+Checks the destinations of a shorten request and puts them in the
+settings of the new mapping. A destination left without a weight gets a
+weight of 1, so leaving out every weight splits visitors evenly.
+
+Parameters:
+
+	request: Pointer to struct that represents contents of shorten request
+	settings: The settings being built for the new mapping
+
+Returns:
+
+	A message for the user if a destination is invalid, otherwise the
+	empty string.
+*/
+func SetDestinationSettings(request *ShortenRequest, settings *LinkSettings) string {
+	if len(request.Destinations) == 0 {
+		return ""
+	}
+	if len(request.Destinations) < SPLIT_MIN_DESTINATIONS || len(request.Destinations) > SPLIT_MAX_DESTINATIONS {
+		return fmt.Sprintf("destinations must have between %d and %d entries", SPLIT_MIN_DESTINATIONS, SPLIT_MAX_DESTINATIONS)
+	}
+	names := map[string]bool{}
+	for _, destination := range request.Destinations {
+		if !SPLIT_VARIANT_NAME.MatchString(destination.Name) {
+			return "destination names must be 1 to 32 letters, digits, - or _"
+		}
+		if names[destination.Name] {
+			return fmt.Sprintf("destination name %s is used twice", destination.Name)
+		}
+		names[destination.Name] = true
+		if destination.Url == "" {
+			return fmt.Sprintf("destination %s must have a url", destination.Name)
+		}
+		if destination.Weight < 0 || destination.Weight > SPLIT_MAX_WEIGHT {
+			return fmt.Sprintf("destination weights must be between 1 and %d (a missing or 0 weight means 1)", SPLIT_MAX_WEIGHT)
+		}
+		// A weight that was left out decodes as 0
+		if destination.Weight == 0 {
+			destination.Weight = 1
+		}
+		settings.Destinations = append(settings.Destinations, destination)
+	}
+	return ""
+}
+
+/*
+Adds the destinations of a link being created. This must be called within
+the transaction inserting the mapping.
+
+Parameters:
+
+	ctx: Context of the transaction
+	tx: The transaction inserting the mapping
+	alias: The alias of the new link
+	destinations: The destinations, none for a link with a single URL
+
+Returns:
+
+	If a destination could not be added, an error, otherwise nil.
+*/
+func AddDestinations(ctx context.Context, tx *sql.Tx, alias string, destinations []Destination) error {
+	for _, destination := range destinations {
+		_, err := tx.ExecContext(ctx, QUERY_ADD_DESTINATION_TEMPLATE, alias, destination.Name, destination.Url, destination.Weight)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Reads the destinations of a link. This is used both outside a transaction
+(looking up a link) and inside one (the audit log's link state), so the
+query function is passed in.
+
+Parameters:
+
+	ctx: Context the query runs in
+	query: QueryContext of the database or transaction to read from
+	alias: The alias whose destinations are read
+
+Returns:
+
+	The destinations with their expansions (none for a link with a single
+	URL) and, if the query failed, an error.
+*/
+func GetDestinations(ctx context.Context, query func(context.Context, string, ...any) (*sql.Rows, error), alias string) ([]VariantAnalytics, error) {
+	rows, err := query(ctx, QUERY_GET_DESTINATIONS_TEMPLATE, alias)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var destinations []VariantAnalytics
+	for rows.Next() {
+		var destination VariantAnalytics
+		err = rows.Scan(&destination.Name, &destination.Url, &destination.Weight, &destination.Expansions)
+		if err != nil {
+			return nil, err
+		}
+		destinations = append(destinations, destination)
+	}
+	return destinations, rows.Err()
+}
+
+/*
+Hashes a client of a split link, keyed with the salt of the database (see
+LoadVisitorSalt( )) so clients can't work out their variant in advance.
+
+Parameters:
+
+	salt: The salt clients are hashed with
+	alias: The alias being expanded, so each link splits clients anew
+	client: What identifies the client
+
+Returns:
+
+	The hash of the client.
+*/
+func SplitHash(salt []byte, alias string, client string) uint64 {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write([]byte(alias))
+	mac.Write([]byte{0})
+	mac.Write([]byte(client))
+	return binary.BigEndian.Uint64(mac.Sum(nil))
+}
+
+/*
+Picks the destination of a split link a request is sent to (see the top
+of this file).
+
+Parameters:
+
+	s: Pointer to Server whose salt clients are hashed with
+	r: The request expanding the link
+	link: The link being expanded
+
+Returns:
+
+	The destination, nil if the link has a single URL.
+*/
+func ChooseDestination(s *Server, r *http.Request, link *Link) *Destination {
+	if len(link.Destinations) == 0 {
+		return nil
+	}
+	cookie, err := r.Cookie(SPLIT_COOKIE_NAME)
+	if err == nil {
+		for i := range link.Destinations {
+			if link.Destinations[i].Name == cookie.Value {
+				return &link.Destinations[i]
+			}
+		}
+	}
+
+	client := r.Header.Get(CLIENT_ID_HEADER)
+	if client == "" {
+		client = ClientIP(r) + "\x00" + r.UserAgent()
+	}
+	total := 0
+	for _, destination := range link.Destinations {
+		total += destination.Weight
+	}
+	point := int(SplitHash(s.visitorSalt, link.Alias, client) % uint64(total))
+	for i := range link.Destinations {
+		point -= link.Destinations[i].Weight
+		if point < 0 {
+			return &link.Destinations[i]
+		}
+	}
+	// Not reached, as the point is below the total weight
+	return &link.Destinations[len(link.Destinations)-1]
+}
+
+/*
+Sets the cookie that keeps a browser on its variant of a split link. It is
+set again on every visit, so it lasts SPLIT_COOKIE_MAX_AGE from the last.
+
+Parameters:
+
+	w: Where we write the response for the user
+	alias: The alias being expanded
+	variant: The name of the visitor's variant
+*/
+func SetSplitCookie(w http.ResponseWriter, alias string, variant string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     SPLIT_COOKIE_NAME,
+		Value:    variant,
+		Path:     REDIRECT_ENDPOINT + alias,
+		MaxAge:   int(SPLIT_COOKIE_MAX_AGE.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
@@ -0,0 +1,242 @@
+/*
+Package url_shortener serves as a library of utilities for the URL-Shortener
+application. This includes the definition of our API, database configuration,
+and HTTP server implementation. This is used by the main package to instantiate
+and run a server easily. This library could be used in other applications
+that do more than just initializing and booting a server.
+
+This file provides serving over HTTPS. The certificate is reloaded when
+its files change on disk, so certificates can be rotated without a
+restart (which would also lose in-memory state like rate limits). Plain
+HTTP clients can optionally be redirected to HTTPS by a second listener.
+*/
+
+package url_shortener
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+How often the certificate files are checked for changes. Handshakes in
+between reuse the certificate without touching the file system.
+*/
+const CERTIFICATE_CHECK_INTERVAL = time.Second
+
+/*
+Records the version of a certificate file that was loaded, to tell when
+it changes. Modification times can be coarse, so the size is kept too.
+*/
+type fileVersion struct {
+	modified time.Time
+	size     int64
+}
+
+/*
+Serves the certificate for TLS handshakes, loading it again when the
+certificate or key file changes. If the new files can't be loaded (e.g.
+the certificate was replaced but the key not yet), the old certificate
+keeps being served and loading is retried at the next check.
+*/
+type CertificateReloader struct {
+	certFile string
+	keyFile  string
+
+	// Guards every field below, as handshakes run concurrently
+	lock        sync.Mutex
+	certificate *tls.Certificate
+	certVersion fileVersion
+	keyVersion  fileVersion
+	lastCheck   time.Time
+}
+
+/*
+Checks whether TLS is turned on in a configuration.
+
+Parameters:
+
+	config: Server configuration
+
+Returns:
+
+	Whether the server should serve HTTPS and, if only one of the
+	certificate and key files is set, an error.
+*/
+func TLSEnabled(config Config) (bool, error) {
+	if (config.TLSCertFile == "") != (config.TLSKeyFile == "") {
+		return false, errors.New("tls_cert_file and tls_key_file must be set together")
+	}
+	return config.TLSCertFile != "", nil
+}
+
+/*
+Gets the version of a file on disk.
+
+Parameters:
+
+	path: Path to the file
+
+Returns:
+
+	The version and, if the file could not be read, an error.
+*/
+func getFileVersion(path string) (fileVersion, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return fileVersion{}, err
+	}
+	return fileVersion{modified: stat.ModTime(), size: stat.Size()}, nil
+}
+
+/*
+Makes a reloader for a certificate and loads the certificate right away,
+so a server with a bad certificate fails to boot rather than failing
+every handshake.
+
+Parameters:
+
+	cert_file: Path to the PEM encoded certificate (chain)
+	key_file: Path to the PEM encoded private key
+
+Returns:
+
+	The reloader and, if the certificate could not be loaded, an error.
+*/
+func NewCertificateReloader(cert_file string, key_file string) (*CertificateReloader, error) {
+	reloader := &CertificateReloader{certFile: cert_file, keyFile: key_file}
+	reloader.lock.Lock()
+	defer reloader.lock.Unlock()
+	err := reloader.reload()
+	if err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+/*
+Loads the certificate if its files changed since it was last loaded. The
+caller must hold the lock.
+
+Returns:
+
+	If the files changed but could not be loaded, an error, otherwise nil.
+*/
+func (c *CertificateReloader) reload() error {
+	c.lastCheck = time.Now()
+	cert_version, err := getFileVersion(c.certFile)
+	if err != nil {
+		return err
+	}
+	key_version, err := getFileVersion(c.keyFile)
+	if err != nil {
+		return err
+	}
+	if c.certificate != nil && cert_version == c.certVersion && key_version == c.keyVersion {
+		return nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading certificate %s: %w", c.certFile, err)
+	}
+	if c.certificate != nil {
+		log.Printf("Reloaded certificate %s", c.certFile)
+	}
+	c.certificate = &certificate
+	c.certVersion = cert_version
+	c.keyVersion = key_version
+	return nil
+}
+
+/*
+Gives the certificate for a TLS handshake, checking for changed files at
+most once per CERTIFICATE_CHECK_INTERVAL. Its signature matches
+tls.Config.GetCertificate.
+
+Parameters:
+
+	hello: The client's hello message (unused, there is one certificate)
+
+Returns:
+
+	The current certificate and nil. Failing to reload is only logged.
+*/
+func (c *CertificateReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if time.Since(c.lastCheck) >= CERTIFICATE_CHECK_INTERVAL {
+		err := c.reload()
+		if err != nil {
+			log.Printf("Keeping the current certificate: %s", err)
+		}
+	}
+	return c.certificate, nil
+}
+
+/*
+Makes the TLS configuration for the server, which gets its certificate
+from a reloader.
+
+Parameters:
+
+	certificates: Reloader serving the certificate
+
+Returns:
+
+	The TLS configuration.
+*/
+func NewTLSConfig(certificates *CertificateReloader) *tls.Config {
+	return &tls.Config{
+		GetCertificate: certificates.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+}
+
+/*
+Makes the plain HTTP server that redirects every request to the same
+path over HTTPS.
+
+Parameters:
+
+	port: Port the redirect server listens on
+
+Returns:
+
+	The redirect server, which is not listening yet.
+*/
+func NewRedirectServer(port int) *http.Server {
+	return &http.Server{
+		Addr:    fmt.Sprintf("%s:%d", HOSTNAME, port),
+		Handler: LogRequests(http.HandlerFunc(RedirectToHTTPS)),
+	}
+}
+
+/*
+Redirects a plain HTTP request to the same host, path and query over
+HTTPS on PORT. A permanent redirect (308) is used as, unlike 301, it
+tells clients to repeat the method and body, so a POST stays a POST.
+
+Parameters:
+
+	w: Where we write response for user
+	request: Pointer to struct that represents contents of HTTP
+		request
+*/
+func RedirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		// The Host header had no port, an IPv6 address keeps its brackets then
+		host = strings.TrimSuffix(strings.TrimPrefix(r.Host, "["), "]")
+	}
+	target := fmt.Sprintf("https://%s%s", net.JoinHostPort(host, fmt.Sprint(PORT)), r.URL.RequestURI())
+	http.Redirect(w, r, target, http.StatusPermanentRedirect)
+}
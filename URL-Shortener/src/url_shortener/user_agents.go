@@ -0,0 +1,307 @@
+/*
+Package url_shortener serves as a library of utilities for the URL-Shortener
+application. This includes the definition of our API, database configuration,
+and HTTP server implementation. This is used by the main package to instantiate
+and run a server easily. This library could be used in other applications
+that do more than just initializing and booting a server.
+
+This file provides how the User-Agent of each expansion is sorted into a
+device class, browser family and operating system for the analytics
+breakdown. The rules are regular expressions in a JSON file. A default
+file (rules/user_agents.json) is built into the executable, and
+user_agent_rules_file points to a replacement, which is reloaded when it
+changes on disk so the rules can be updated without a rebuild or restart.
+*/
+
+package url_shortener
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+)
+
+//go:embed rules/user_agents.json
+var defaultUserAgentRules []byte
+
+// Name given when no rule matches (including when there is no User-Agent)
+const USER_AGENT_OTHER = "Other"
+
+// Name reported for clicks recorded before User-Agents were sorted
+const USER_AGENT_UNKNOWN = "Unknown"
+
+// How often the rules file is checked for changes
+const USER_AGENT_RULES_CHECK_INTERVAL = time.Second
+
+/*
+Specifies the JSON structure of a rule. A User-Agent matches the rule if
+it matches Pattern and, when given, doesn't match Exclude (Go's regular
+expressions can't look ahead, so this is how e.g. "Android but not
+Mobile" is written).
+*/
+type UserAgentRule struct {
+	Name    string `json:"name"`
+	Pattern string `json:"pattern"`
+	Exclude string `json:"exclude,omitempty"`
+}
+
+/*
+Specifies the JSON structure of a rules file. Within each list, the
+first matching rule gives the name, so more specific rules come first
+(e.g. Edge before Chrome, as Edge's User-Agent mentions Chrome too).
+*/
+type UserAgentRules struct {
+	Devices          []UserAgentRule `json:"devices"`
+	Browsers         []UserAgentRule `json:"browsers"`
+	OperatingSystems []UserAgentRule `json:"operating_systems"`
+}
+
+// Represents a rule whose regular expressions have been compiled
+type compiledUserAgentRule struct {
+	name    string
+	pattern *regexp.Regexp
+	exclude *regexp.Regexp
+}
+
+// Represents a rules file whose rules have been compiled
+type compiledUserAgentRules struct {
+	devices          []compiledUserAgentRule
+	browsers         []compiledUserAgentRule
+	operatingSystems []compiledUserAgentRule
+}
+
+/*
+Represents what a User-Agent was sorted into. These are recorded with
+each click.
+*/
+type UserAgentClass struct {
+	Device  string
+	Browser string
+	OS      string
+}
+
+/*
+Sorts User-Agents with the current rules, loading the rules file again
+when it changes. If a changed file can't be loaded, the previous rules
+are kept and loading is retried at the next check.
+*/
+type UserAgentClassifier struct {
+	// Path to the rules file, empty to use the built in rules
+	file string
+
+	// Guards every field below, as expansions run concurrently
+	lock      sync.Mutex
+	rules     *compiledUserAgentRules
+	version   fileVersion
+	lastCheck time.Time
+}
+
+/*
+Compiles one list of rules.
+
+Parameters:
+
+	list: Name of the list, for error messages
+	rules: The rules of the list
+
+Returns:
+
+	The compiled rules and, if a rule has no name or an invalid regular
+	expression, an error.
+*/
+func compileUserAgentRuleList(list string, rules []UserAgentRule) ([]compiledUserAgentRule, error) {
+	compiled := make([]compiledUserAgentRule, len(rules))
+	for i, rule := range rules {
+		if rule.Name == "" || rule.Pattern == "" {
+			return nil, fmt.Errorf("%s rule %d must have a name and a pattern", list, i+1)
+		}
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s rule %d (%s): %w", list, i+1, rule.Name, err)
+		}
+		compiled[i] = compiledUserAgentRule{name: rule.Name, pattern: pattern}
+		if rule.Exclude != "" {
+			compiled[i].exclude, err = regexp.Compile(rule.Exclude)
+			if err != nil {
+				return nil, fmt.Errorf("%s rule %d (%s): %w", list, i+1, rule.Name, err)
+			}
+		}
+	}
+	return compiled, nil
+}
+
+/*
+Parses and compiles a rules file.
+
+Parameters:
+
+	contents: The contents of the rules file
+
+Returns:
+
+	The compiled rules and, if the file is not valid, an error.
+*/
+func ParseUserAgentRules(contents []byte) (*compiledUserAgentRules, error) {
+	var rules UserAgentRules
+	err := json.Unmarshal(contents, &rules)
+	if err != nil {
+		return nil, err
+	}
+	compiled := new(compiledUserAgentRules)
+	compiled.devices, err = compileUserAgentRuleList("devices", rules.Devices)
+	if err != nil {
+		return nil, err
+	}
+	compiled.browsers, err = compileUserAgentRuleList("browsers", rules.Browsers)
+	if err != nil {
+		return nil, err
+	}
+	compiled.operatingSystems, err = compileUserAgentRuleList("operating_systems", rules.OperatingSystems)
+	if err != nil {
+		return nil, err
+	}
+	return compiled, nil
+}
+
+/*
+Makes a classifier and loads its rules right away, so a server with a bad
+rules file fails to boot rather than sorting every User-Agent into Other.
+
+Parameters:
+
+	file: Path to the rules file, empty to use the built in rules
+
+Returns:
+
+	The classifier and, if the rules could not be loaded, an error.
+*/
+func NewUserAgentClassifier(file string) (*UserAgentClassifier, error) {
+	classifier := &UserAgentClassifier{file: file}
+	if file == "" {
+		rules, err := ParseUserAgentRules(defaultUserAgentRules)
+		if err != nil {
+			return nil, err
+		}
+		classifier.rules = rules
+		return classifier, nil
+	}
+
+	classifier.lock.Lock()
+	defer classifier.lock.Unlock()
+	err := classifier.reload()
+	if err != nil {
+		return nil, err
+	}
+	return classifier, nil
+}
+
+/*
+Loads the rules file if it changed since it was last loaded. The caller
+must hold the lock.
+
+Returns:
+
+	If the file changed but could not be loaded, an error, otherwise nil.
+*/
+func (c *UserAgentClassifier) reload() error {
+	c.lastCheck = time.Now()
+	version, err := getFileVersion(c.file)
+	if err != nil {
+		return err
+	}
+	if c.rules != nil && version == c.version {
+		return nil
+	}
+
+	contents, err := os.ReadFile(c.file)
+	if err != nil {
+		return err
+	}
+	rules, err := ParseUserAgentRules(contents)
+	if err != nil {
+		return fmt.Errorf("loading User-Agent rules %s: %w", c.file, err)
+	}
+	if c.rules != nil {
+		log.Printf("Reloaded User-Agent rules %s", c.file)
+	}
+	c.rules = rules
+	c.version = version
+	return nil
+}
+
+/*
+Finds the first rule in a list that a User-Agent matches.
+
+Parameters:
+
+	rules: The list of rules
+	user_agent: The User-Agent to match
+
+Returns:
+
+	The name of the rule and whether any rule matched.
+*/
+func findUserAgentRule(rules []compiledUserAgentRule, user_agent string) (string, bool) {
+	for _, rule := range rules {
+		if rule.pattern.MatchString(user_agent) && (rule.exclude == nil || !rule.exclude.MatchString(user_agent)) {
+			return rule.name, true
+		}
+	}
+	return "", false
+}
+
+/*
+Gives the name of the first rule in a list that a User-Agent matches.
+
+Parameters:
+
+	rules: The list of rules
+	user_agent: The User-Agent to sort
+
+Returns:
+
+	The name of the rule, or USER_AGENT_OTHER if none match.
+*/
+func matchUserAgentRules(rules []compiledUserAgentRule, user_agent string) string {
+	name, found := findUserAgentRule(rules, user_agent)
+	if !found {
+		return USER_AGENT_OTHER
+	}
+	return name
+}
+
+/*
+Sorts a User-Agent into a device class, browser family and operating
+system, checking the rules file for changes at most once per
+USER_AGENT_RULES_CHECK_INTERVAL.
+
+Parameters:
+
+	user_agent: The User-Agent header of a request
+
+Returns:
+
+	What the User-Agent was sorted into.
+*/
+func (c *UserAgentClassifier) Classify(user_agent string) UserAgentClass {
+	c.lock.Lock()
+	if c.file != "" && time.Since(c.lastCheck) >= USER_AGENT_RULES_CHECK_INTERVAL {
+		err := c.reload()
+		if err != nil {
+			log.Printf("Keeping the current User-Agent rules: %s", err)
+		}
+	}
+	rules := c.rules
+	c.lock.Unlock()
+
+	return UserAgentClass{
+		Device:  matchUserAgentRules(rules.devices, user_agent),
+		Browser: matchUserAgentRules(rules.browsers, user_agent),
+		OS:      matchUserAgentRules(rules.operatingSystems, user_agent),
+	}
+}
@@ -0,0 +1,413 @@
+/*
+Package url_shortener serves as a library of utilities for the URL-Shortener
+application. This includes the definition of our API, database configuration,
+and HTTP server implementation. This is used by the main package to instantiate
+and run a server easily. This library could be used in other applications
+that do more than just initializing and booting a server.
+
+This file provides the estimate of how many different visitors expanded an
+alias. Counting them exactly would mean keeping every visitor, so each
+alias keeps a HyperLogLog sketch instead: a fixed array of registers that
+each hold the longest run of leading zeros seen among the hashes landing
+in them. A visitor is the client's IP address and User-Agent, hashed with
+a secret salt so the sketches say nothing about who visited.
+
+Besides the all time sketch (aliases.VisitorSketch), a sketch is kept per
+alias and day (visitor_sketches). Merging sketches (the largest of each
+register) gives the sketch of the union, so the visitors of any range of
+days are estimated without counting a returning visitor twice.
+*/
+
+package url_shortener
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+	"net/http"
+	"time"
+)
+
+/*
+Number of bits of a hash that pick its register. 2^12 registers take 4 KiB
+per sketch and give estimates within about 1.6% (the standard error is
+1.04 / sqrt(registers)).
+*/
+const SKETCH_PRECISION = 12
+
+// Number of registers in a sketch
+const SKETCH_REGISTERS = 1 << SKETCH_PRECISION
+
+// Query to get the salt visitors are hashed with
+const QUERY_GET_VISITOR_SALT = `
+SELECT Salt
+FROM visitor_salt
+`
+
+// Query templates to read and write the all time sketch of an alias
+const QUERY_GET_VISITOR_SKETCH_TEMPLATE = `
+SELECT VisitorSketch
+FROM aliases
+WHERE Alias = ?
+`
+const QUERY_SET_VISITOR_SKETCH_TEMPLATE = `
+UPDATE aliases
+SET VisitorSketch = ?
+WHERE Alias = ?
+`
+
+// Query templates to read and write the sketch of an alias for a day
+const QUERY_GET_DAILY_VISITOR_SKETCH_TEMPLATE = `
+SELECT Sketch
+FROM visitor_sketches
+WHERE Alias = ? AND Day = ?
+`
+const QUERY_SET_DAILY_VISITOR_SKETCH_TEMPLATE = `
+INSERT INTO visitor_sketches (Alias, Day, Sketch)
+VALUES (?, ?, ?)
+ON CONFLICT (Alias, Day) DO UPDATE SET Sketch = excluded.Sketch
+`
+
+// Query template to get the daily sketches of an alias between two days (inclusive)
+const QUERY_GET_DAILY_VISITOR_SKETCHES_TEMPLATE = `
+SELECT Day, Sketch
+FROM visitor_sketches
+WHERE Alias = ? AND Day >= ? AND Day <= ?
+ORDER BY Day
+`
+
+// Query template for deleting the daily sketches of a mapping being deleted
+const QUERY_DELETE_VISITOR_SKETCHES_TEMPLATE = `
+DELETE FROM visitor_sketches
+WHERE Alias = ?
+`
+
+/*
+A HyperLogLog sketch, one byte per register. This is also how it is
+stored, so a sketch is read and written without conversion.
+*/
+type VisitorSketch []byte
+
+// Makes an empty sketch, which estimates no visitors
+func NewVisitorSketch() VisitorSketch {
+	return make(VisitorSketch, SKETCH_REGISTERS)
+}
+
+/*
+Reads a sketch as stored.
+
+Parameters:
+
+	stored: The stored sketch, nil if the alias (or day) has none yet
+
+Returns:
+
+	The sketch (empty if none was stored) and, if the stored bytes are not
+	a sketch, an error.
+*/
+func DecodeVisitorSketch(stored []byte) (VisitorSketch, error) {
+	if stored == nil {
+		return NewVisitorSketch(), nil
+	}
+	if len(stored) != SKETCH_REGISTERS {
+		return nil, fmt.Errorf("visitor sketch has %d registers, expected %d", len(stored), SKETCH_REGISTERS)
+	}
+	return VisitorSketch(stored), nil
+}
+
+/*
+Adds a visitor to the sketch.
+
+Parameters:
+
+	hash: The visitor's hash (see VisitorHash( ))
+
+Returns:
+
+	Whether the sketch changed. It doesn't for most returning visitors, in
+	which case it needn't be written back.
+*/
+func (sketch VisitorSketch) Add(hash uint64) bool {
+	register := hash >> (64 - SKETCH_PRECISION)
+
+	/*
+		The rank is the position of the first 1 in the rest of the hash.
+		The bit set below the rest bounds it for a rest of all zeros.
+	*/
+	rest := hash<<SKETCH_PRECISION | 1<<(SKETCH_PRECISION-1)
+	rank := byte(bits.LeadingZeros64(rest) + 1)
+	if rank <= sketch[register] {
+		return false
+	}
+	sketch[register] = rank
+	return true
+}
+
+/*
+Merges another sketch into this one, so it estimates the visitors of both.
+
+Parameters:
+
+	other: The sketch to merge in
+*/
+func (sketch VisitorSketch) Merge(other VisitorSketch) {
+	for i, rank := range other {
+		if rank > sketch[i] {
+			sketch[i] = rank
+		}
+	}
+}
+
+/*
+Estimates the number of visitors added to the sketch.
+
+Returns:
+
+	The estimate, rounded to a whole visitor.
+*/
+func (sketch VisitorSketch) Estimate() int {
+	registers := float64(SKETCH_REGISTERS)
+	sum := 0.0
+	empty := 0
+	for _, rank := range sketch {
+		sum += math.Ldexp(1, -int(rank))
+		if rank == 0 {
+			empty++
+		}
+	}
+	alpha := 0.7213 / (1 + 1.079/registers)
+	estimate := alpha * registers * registers / sum
+
+	/*
+		The raw estimate is biased for small numbers of visitors, where
+		counting the empty registers (linear counting) is more accurate.
+		With 64 bit hashes, no correction is needed for large numbers.
+	*/
+	if estimate <= 2.5*registers && empty > 0 {
+		estimate = registers * math.Log(registers/float64(empty))
+	}
+	return int(math.Round(estimate))
+}
+
+/*
+Hashes a visitor, keyed with the salt of the database.
+
+Parameters:
+
+	salt: The salt visitors are hashed with (see LoadVisitorSalt( ))
+	ip: The client's IP address
+	user_agent: The client's User-Agent header
+
+Returns:
+
+	The hash of the visitor.
+*/
+func VisitorHash(salt []byte, ip string, user_agent string) uint64 {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write([]byte(ip))
+	// Keeps e.g. "1.2.3.4" + "5x" apart from "1.2.3.45" + "x"
+	mac.Write([]byte{0})
+	mac.Write([]byte(user_agent))
+	return binary.BigEndian.Uint64(mac.Sum(nil))
+}
+
+/*
+Loads the salt visitors are hashed with into the server. It is made by the
+migration that created the sketches, so it stays the same across restarts.
+
+Parameters:
+
+	s: Pointer to Server whose database holds the salt
+
+Returns:
+
+	If the salt could not be read, an error, otherwise nil.
+*/
+func LoadVisitorSalt(s *Server) error {
+	err := s.db.QueryRow(QUERY_GET_VISITOR_SALT).Scan(&s.visitorSalt)
+	if err != nil {
+		return err
+	}
+	if len(s.visitorSalt) == 0 {
+		return errors.New("visitor salt is empty")
+	}
+	return nil
+}
+
+/*
+Gives the day (UTC) a Unix time falls on, as daily sketches are keyed.
+
+Parameters:
+
+	unix: The Unix time
+
+Returns:
+
+	The day as YYYY-MM-DD.
+*/
+func VisitorDay(unix int64) string {
+	return time.Unix(unix, 0).UTC().Format(time.DateOnly)
+}
+
+/*
+Adds a visitor to an alias's all time sketch and its sketch for the day,
+writing back the sketches that changed. This runs in the transaction
+recording the expansion, after the UPDATE that took the write lock, so
+concurrent expansions can't overwrite each other's registers.
+
+Parameters:
+
+	ctx: Context of the expansion
+	tx: The transaction recording the expansion
+	alias: The alias being expanded
+	now: Unix time of the expansion
+	hash: The visitor's hash
+
+Returns:
+
+	If a query failed, an error, otherwise nil.
+*/
+func RecordVisitor(ctx context.Context, tx *sql.Tx, alias string, now int64, hash uint64) error {
+	var stored []byte
+	err := tx.QueryRowContext(ctx, QUERY_GET_VISITOR_SKETCH_TEMPLATE, alias).Scan(&stored)
+	if err != nil {
+		return err
+	}
+	sketch, err := DecodeVisitorSketch(stored)
+	if err != nil {
+		return err
+	}
+	if sketch.Add(hash) {
+		_, err = tx.ExecContext(ctx, QUERY_SET_VISITOR_SKETCH_TEMPLATE, []byte(sketch), alias)
+		if err != nil {
+			return err
+		}
+	}
+
+	day := VisitorDay(now)
+	stored = nil
+	err = tx.QueryRowContext(ctx, QUERY_GET_DAILY_VISITOR_SKETCH_TEMPLATE, alias, day).Scan(&stored)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	sketch, err = DecodeVisitorSketch(stored)
+	if err != nil {
+		return err
+	}
+	if sketch.Add(hash) {
+		_, err = tx.ExecContext(ctx, QUERY_SET_DAILY_VISITOR_SKETCH_TEMPLATE, alias, day, []byte(sketch))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Gets the unique visitors of an alias over a range of days, per day and
+merged over the range.
+
+Parameters:
+
+	s: Pointer to Server whose database we query
+	ctx: Context of the request the visitors are for
+	alias: The alias whose visitors are estimated
+	since: Start of the window, nil if open
+	until: End of the window, nil if open
+
+Returns:
+
+	The visitors and, if a query failed, an error. If the alias is not
+	mapped, the error is sql.ErrNoRows.
+*/
+func GetAnalyticsVisitors(s *Server, ctx context.Context, alias string, since *int64, until *int64) (*AnalyticsVisitorsResponse, error) {
+	/*
+		Sketches are kept per day, so the window is widened to the days
+		it touches. An open window runs from the first day to the last.
+	*/
+	first_day := "0000-01-01"
+	last_day := "9999-12-31"
+	if since != nil {
+		first_day = VisitorDay(*since)
+	}
+	if until != nil {
+		last_day = VisitorDay(*until - 1)
+	}
+
+	var response *AnalyticsVisitorsResponse
+	err := RunQuery(s, ctx, func(ctx context.Context) error {
+		response = &AnalyticsVisitorsResponse{Alias: alias, Days: []DailyCount{}}
+		err := s.db.QueryRowContext(ctx, QUERY_GET_URL_BY_ALIAS_TEMPLATE, alias).Scan(&response.Url)
+		if err != nil {
+			return err
+		}
+
+		rows, err := s.db.QueryContext(ctx, QUERY_GET_DAILY_VISITOR_SKETCHES_TEMPLATE, alias, first_day, last_day)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		merged := NewVisitorSketch()
+		for rows.Next() {
+			var day string
+			var stored []byte
+			err = rows.Scan(&day, &stored)
+			if err != nil {
+				return err
+			}
+			sketch, err := DecodeVisitorSketch(stored)
+			if err != nil {
+				return err
+			}
+			response.Days = append(response.Days, DailyCount{Day: day, Count: sketch.Estimate()})
+			merged.Merge(sketch)
+		}
+		err = rows.Err()
+		if err != nil {
+			return err
+		}
+		response.UniqueVisitors = merged.Estimate()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+/*
+Handles requests for an alias's unique visitors over a window, i.e. on
+/urlshortener/analytics/<alias>/visitors (see Analytics( ) in server.go).
+
+Parameters:
+
+	s: Pointer to HTTP server whose sketches are read
+	request: Pointer to struct that represents contents of HTTP
+		request
+	w: Where we write response for user
+	alias: The alias whose visitors are estimated
+*/
+func AnalyticsVisitors(s *Server, w http.ResponseWriter, r *http.Request, alias string) {
+	since, until, err_msg := ParseTimeWindow(r)
+	if err_msg != "" {
+		ReportBadRequestError(w, r, r.URL.RawQuery, err_msg)
+		return
+	}
+
+	response, err := GetAnalyticsVisitors(s, r.Context(), alias, since, until)
+	if err == sql.ErrNoRows {
+		ReportBadRequestError(w, r, "No mapping exists for alias", fmt.Sprintf("Cannot get analytics for %s, not mapped", alias))
+		return
+	} else if err != nil {
+		ReportUnexpectedInternalServerError(w, r, err)
+		return
+	}
+	RequestLogger(r).Info("Reported unique visitors", "alias", alias, "unique_visitors", response.UniqueVisitors)
+	RespondAsJSON(w, response)
+}
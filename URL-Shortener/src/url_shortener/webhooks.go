@@ -0,0 +1,1007 @@
+/*
+Package url_shortener serves as a library of utilities for the URL-Shortener
+application. This includes the definition of our API, database configuration,
+and HTTP server implementation. This is used by the main package to instantiate
+and run a server easily. This library could be used in other applications
+that do more than just initializing and booting a server.
+
+This file provides webhooks: downstream systems subscribe to link events
+(a link is created, expanded, reaches a milestone number of expansions or
+expires) and are sent a signed JSON payload for each one.
+
+Deliveries go through an outbox. When a change happens, a delivery is
+written for each subscribed webhook in the same transaction as the change,
+so an event is never lost nor sent for a change that was rolled back. A
+background worker then sends the deliveries that are due, retrying failed
+ones with exponential backoff until webhook_max_attempts is reached. The
+deliveries are kept afterwards as each webhook's delivery history, and the
+worker deletes them once they are older than webhook_retention_seconds.
+*/
+
+package url_shortener
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Events a webhook may subscribe to
+const WEBHOOK_EVENT_CREATED = "link.created"
+const WEBHOOK_EVENT_EXPANDED = "link.expanded"
+const WEBHOOK_EVENT_MILESTONE = "link.milestone"
+const WEBHOOK_EVENT_EXPIRED = "link.expired"
+
+var WEBHOOK_EVENTS = []string{WEBHOOK_EVENT_CREATED, WEBHOOK_EVENT_EXPANDED, WEBHOOK_EVENT_MILESTONE, WEBHOOK_EVENT_EXPIRED}
+
+/*
+Statuses of a delivery. A pending delivery is sent once its next attempt
+is due, a failed one has used up its attempts and is not sent again.
+*/
+const WEBHOOK_STATUS_PENDING = "pending"
+const WEBHOOK_STATUS_DELIVERED = "delivered"
+const WEBHOOK_STATUS_FAILED = "failed"
+
+/*
+Headers sent with each delivery. The signature is the hex encoded
+HMAC-SHA256, keyed with the webhook's secret, of the timestamp, a period
+and the body (see SignWebhookPayload( )). Signing the timestamp lets
+receivers refuse old deliveries being replayed.
+*/
+const WEBHOOK_ID_HEADER = "X-Webhook-ID"
+const WEBHOOK_EVENT_HEADER = "X-Webhook-Event"
+const WEBHOOK_TIMESTAMP_HEADER = "X-Webhook-Timestamp"
+const WEBHOOK_SIGNATURE_HEADER = "X-Webhook-Signature"
+const WEBHOOK_SIGNATURE_PREFIX = "sha256="
+
+/*
+How often the worker looks for due deliveries. New deliveries wake it up
+right away (see WakeWebhookDeliveries( )), so this mostly paces retries.
+*/
+const WEBHOOK_POLL_INTERVAL = time.Second
+
+// Largest number of deliveries the worker sends at once
+const WEBHOOK_BATCH_SIZE = 20
+
+// Longest wait between attempts, the backoff doubles up to this
+const WEBHOOK_BACKOFF_MAX = time.Hour
+
+/*
+Most often delivered and given up deliveries are looked for to delete,
+or every webhook_retention_seconds if that is shorter.
+*/
+const WEBHOOK_PRUNE_INTERVAL = time.Minute
+
+// Number of deliveries deleted at a time, so pruning never holds up writes for long
+const WEBHOOK_PRUNE_BATCH_SIZE = 1000
+
+// Number of bytes of random secret generated for a webhook
+const WEBHOOK_SECRET_BYTES = 32
+
+// Number of deliveries in a page when the request does not give a limit
+const WEBHOOK_DELIVERIES_DEFAULT_LIMIT = 100
+
+// Largest number of deliveries a request may ask for in one page
+const WEBHOOK_DELIVERIES_MAX_LIMIT = 1000
+
+/*
+Query template to write a delivery of an event to every webhook subscribed
+to it. Events holds a comma separated list, so commas are put around both
+sides to match whole event names only.
+*/
+const QUERY_ENQUEUE_WEBHOOK_DELIVERIES_TEMPLATE = `
+INSERT INTO webhook_deliveries (WebhookID, Event, Payload, Status, NextAttempt, Created)
+SELECT ID, ?, ?, 'pending', ?, ?
+FROM webhooks
+WHERE ',' || Events || ',' LIKE '%,' || ? || ',%'
+`
+
+// Query template to subscribe a webhook
+const QUERY_INSERT_WEBHOOK_TEMPLATE = `
+INSERT INTO webhooks (URL, Secret, Events, Created)
+VALUES (?, ?, ?, ?)
+`
+
+// Query to list every webhook (without their secrets)
+const QUERY_GET_WEBHOOKS = `
+SELECT ID, URL, Events, Created
+FROM webhooks
+ORDER BY ID
+`
+
+// Query template to get where, and with which secret, a webhook is sent
+const QUERY_GET_WEBHOOK_TARGET_TEMPLATE = `
+SELECT URL, Secret
+FROM webhooks
+WHERE ID = ?
+`
+
+/*
+Query template to delete a batch of deliveries that were delivered or
+given up before a Unix time. The last attempt at such a delivery also set
+its NextAttempt, so this goes through the webhook_deliveries_due index.
+*/
+const QUERY_PRUNE_WEBHOOK_DELIVERIES_TEMPLATE = `
+DELETE FROM webhook_deliveries
+WHERE ID IN (
+	SELECT ID
+	FROM webhook_deliveries
+	WHERE Status IN ('delivered', 'failed') AND NextAttempt < ?
+	LIMIT ?
+)
+`
+
+// Query templates to delete a webhook along with its deliveries
+const QUERY_DELETE_WEBHOOK_TEMPLATE = `
+DELETE FROM webhooks
+WHERE ID = ?
+`
+
+const QUERY_DELETE_WEBHOOK_DELIVERIES_TEMPLATE = `
+DELETE FROM webhook_deliveries
+WHERE WebhookID = ?
+`
+
+/*
+Query template to claim the deliveries that are due. Their next attempt is
+pushed past the time sending them can take, so servers sharing the database
+don't send them too. If the server dies while sending, the claim runs out
+and the deliveries are sent again.
+*/
+const QUERY_CLAIM_WEBHOOK_DELIVERIES_TEMPLATE = `
+UPDATE webhook_deliveries
+SET NextAttempt = ?
+WHERE ID IN (
+	SELECT ID
+	FROM webhook_deliveries
+	WHERE Status = 'pending' AND NextAttempt <= ?
+	ORDER BY NextAttempt, ID
+	LIMIT ?
+)
+RETURNING ID, WebhookID, Event, Payload, Attempts
+`
+
+// Query template to record the outcome of an attempt to send a delivery
+const QUERY_RECORD_WEBHOOK_ATTEMPT_TEMPLATE = `
+UPDATE webhook_deliveries
+SET Status = ?, Attempts = Attempts + 1, NextAttempt = ?, LastAttempt = ?, ResponseStatus = ?, Error = ?
+WHERE ID = ?
+`
+
+/*
+Creates the payload of an event about a link.
+
+Parameters:
+
+	event: One of the WEBHOOK_EVENT constants
+	alias: The alias of the link
+	url: The URL the link maps to
+	expansions: The link's number of expansions after the event
+	max_expansions: The link's cap on expansions, nil if it has none
+
+Returns:
+
+	The event, timestamped now.
+*/
+func NewWebhookEvent(event string, alias string, url string, expansions int, max_expansions *int) *WebhookEvent {
+	return &WebhookEvent{
+		Event:         event,
+		Time:          time.Now().UTC().Format(time.RFC3339),
+		Alias:         alias,
+		Url:           url,
+		Expansions:    expansions,
+		MaxExpansions: max_expansions,
+	}
+}
+
+/*
+Writes a delivery of an event to every webhook subscribed to it. This must
+be called within the transaction making the change, before it is committed.
+
+Parameters:
+
+	ctx: Context of the transaction
+	tx: The transaction making the change
+	event: The event to deliver
+
+Returns:
+
+	Whether any delivery was written (so the worker should be woken up
+	once the transaction is committed) and, if writing failed, an error.
+*/
+func EnqueueWebhookEvent(ctx context.Context, tx *sql.Tx, event *WebhookEvent) (bool, error) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return false, err
+	}
+	now := time.Now().Unix()
+	result, err := tx.ExecContext(ctx, QUERY_ENQUEUE_WEBHOOK_DELIVERIES_TEMPLATE, event.Event, string(payload), now, now, event.Event)
+	if err != nil {
+		return false, err
+	}
+	written, err := result.RowsAffected()
+	return written > 0, err
+}
+
+/*
+Writes the deliveries of the events an expansion triggers: the expansion
+itself, a milestone every webhook_milestone_interval expansions, and the
+link expiring if the expansion was the last one its cap allows.
+
+Parameters:
+
+	s: Pointer to Server whose configuration gives the milestone interval
+	ctx: Context of the transaction
+	tx: The transaction recording the expansion
+	link: The link that was expanded
+	expansions: The link's number of expansions, including this one
+	max_expansions: The link's cap on expansions, NULL if it has none
+
+Returns:
+
+	Same as EnqueueWebhookEvent( ).
+*/
+func EnqueueExpansionEvents(s *Server, ctx context.Context, tx *sql.Tx, link *Link, expansions int, max_expansions sql.NullInt64) (bool, error) {
+	var limit *int
+	if max_expansions.Valid {
+		value := int(max_expansions.Int64)
+		limit = &value
+	}
+
+	events := []string{WEBHOOK_EVENT_EXPANDED}
+	interval := s.config.WebhookMilestoneInterval
+	if interval > 0 && expansions%interval == 0 {
+		events = append(events, WEBHOOK_EVENT_MILESTONE)
+	}
+	if limit != nil && expansions >= *limit {
+		events = append(events, WEBHOOK_EVENT_EXPIRED)
+	}
+
+	queued := false
+	for _, event := range events {
+		written, err := EnqueueWebhookEvent(ctx, tx, NewWebhookEvent(event, link.Alias, link.Url, expansions, limit))
+		if err != nil {
+			return false, err
+		}
+		queued = queued || written
+	}
+	return queued, nil
+}
+
+/*
+Wakes the delivery worker up so new deliveries are sent right away rather
+than at its next poll. This never blocks: if the worker has already been
+woken up, it will see the new deliveries too.
+
+Parameters:
+
+	s: Pointer to Server whose worker is woken up
+*/
+func WakeWebhookDeliveries(s *Server) {
+	select {
+	case s.webhookWake <- struct{}{}:
+	default:
+	}
+}
+
+/*
+Computes the hex encoded signature of a delivery, see
+WEBHOOK_SIGNATURE_HEADER. Receivers compute the same to check a delivery
+came from us.
+
+Parameters:
+
+	secret: The webhook's secret
+	timestamp: The Unix time sent in WEBHOOK_TIMESTAMP_HEADER
+	body: The body of the delivery
+
+Returns:
+
+	The signature, without WEBHOOK_SIGNATURE_PREFIX.
+*/
+func SignWebhookPayload(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+/*
+Computes how long to wait before the next attempt at a delivery. The wait
+starts at webhook_retry_seconds and doubles with each failed attempt, up
+to WEBHOOK_BACKOFF_MAX.
+
+Parameters:
+
+	s: Pointer to Server whose configuration gives the first wait
+	attempts: Number of attempts made so far (at least 1)
+
+Returns:
+
+	The wait before the next attempt.
+*/
+func WebhookRetryDelay(s *Server, attempts int) time.Duration {
+	delay := time.Duration(s.config.WebhookRetrySeconds) * time.Second
+	for i := 1; i < attempts && delay < WEBHOOK_BACKOFF_MAX; i++ {
+		delay *= 2
+	}
+	return min(delay, WEBHOOK_BACKOFF_MAX)
+}
+
+/*
+Represents a delivery claimed by the worker, along with where it is sent.
+*/
+type claimedDelivery struct {
+	ID        int64
+	WebhookID int64
+	Event     string
+	Payload   string
+	Attempts  int
+	Url       string
+	Secret    string
+}
+
+/*
+Sends a delivery to its webhook. Only a 2xx response counts as delivered,
+redirects are not followed.
+
+Parameters:
+
+	s: Pointer to Server whose HTTP client sends the delivery
+	delivery: The delivery to send
+
+Returns:
+
+	The status of the response (0 if there was none) and, if the delivery
+	was not accepted, an error.
+*/
+func SendWebhookDelivery(s *Server, delivery *claimedDelivery) (int, error) {
+	body := []byte(delivery.Payload)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	request, err := http.NewRequest(http.MethodPost, delivery.Url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(WEBHOOK_ID_HEADER, strconv.FormatInt(delivery.ID, 10))
+	request.Header.Set(WEBHOOK_EVENT_HEADER, delivery.Event)
+	request.Header.Set(WEBHOOK_TIMESTAMP_HEADER, timestamp)
+	request.Header.Set(WEBHOOK_SIGNATURE_HEADER, WEBHOOK_SIGNATURE_PREFIX+SignWebhookPayload(delivery.Secret, timestamp, body))
+
+	response, err := s.webhookClient.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	// Reading the body lets the connection be reused, but it is not kept
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64*1024))
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, fmt.Errorf("receiver answered %s", response.Status)
+	}
+	return response.StatusCode, nil
+}
+
+/*
+Claims the deliveries that are due and sends them, each in its own
+goroutine so one slow receiver doesn't hold up the others. The outcome of
+each attempt is recorded, scheduling a retry if it failed and attempts
+remain.
+
+Parameters:
+
+	s: Pointer to Server whose deliveries are sent
+
+Returns:
+
+	The number of deliveries claimed (if it is WEBHOOK_BATCH_SIZE, more
+	may be due) and, if claiming failed, an error.
+*/
+func DeliverDueWebhooks(s *Server) (int, error) {
+	timeout := time.Duration(s.config.WebhookTimeoutSeconds) * time.Second
+	var deliveries []*claimedDelivery
+	err := RunQuery(s, context.Background(), func(ctx context.Context) error {
+		deliveries = nil
+		now := time.Now()
+		rows, err := s.db.QueryContext(ctx, QUERY_CLAIM_WEBHOOK_DELIVERIES_TEMPLATE, now.Add(2*timeout).Unix(), now.Unix(), WEBHOOK_BATCH_SIZE)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			delivery := new(claimedDelivery)
+			err = rows.Scan(&delivery.ID, &delivery.WebhookID, &delivery.Event, &delivery.Payload, &delivery.Attempts)
+			if err != nil {
+				return err
+			}
+			deliveries = append(deliveries, delivery)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var wait_group sync.WaitGroup
+	for _, delivery := range deliveries {
+		wait_group.Add(1)
+		go func() {
+			defer wait_group.Done()
+			err := DeliverWebhook(s, delivery)
+			if err != nil {
+				log.Printf("Could not record webhook delivery %d: %v", delivery.ID, err)
+			}
+		}()
+	}
+	wait_group.Wait()
+	return len(deliveries), nil
+}
+
+/*
+Sends a claimed delivery and records the outcome of the attempt.
+
+Parameters:
+
+	s: Pointer to Server whose delivery is sent
+	delivery: The claimed delivery
+
+Returns:
+
+	If the outcome could not be recorded, an error, otherwise nil. A
+	failed attempt is not an error here, it is recorded.
+*/
+func DeliverWebhook(s *Server, delivery *claimedDelivery) error {
+	err := RunQuery(s, context.Background(), func(ctx context.Context) error {
+		return s.db.QueryRowContext(ctx, QUERY_GET_WEBHOOK_TARGET_TEMPLATE, delivery.WebhookID).Scan(&delivery.Url, &delivery.Secret)
+	})
+	// The webhook was deleted since, along with its deliveries
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	status_code, send_err := SendWebhookDelivery(s, delivery)
+	attempts := delivery.Attempts + 1
+	now := time.Now()
+	status := WEBHOOK_STATUS_DELIVERED
+	next_attempt := now
+	response_status := sql.NullInt64{Int64: int64(status_code), Valid: status_code != 0}
+	var error_text sql.NullString
+	if send_err != nil {
+		error_text = sql.NullString{String: send_err.Error(), Valid: true}
+		if attempts >= s.config.WebhookMaxAttempts {
+			status = WEBHOOK_STATUS_FAILED
+		} else {
+			status = WEBHOOK_STATUS_PENDING
+			next_attempt = now.Add(WebhookRetryDelay(s, attempts))
+		}
+		log.Printf("Webhook delivery %d to %s failed (attempt %d): %v", delivery.ID, delivery.Url, attempts, send_err)
+	}
+
+	return RunQuery(s, context.Background(), func(ctx context.Context) error {
+		_, err := s.db.ExecContext(ctx, QUERY_RECORD_WEBHOOK_ATTEMPT_TEMPLATE, status, next_attempt.Unix(), now.Unix(), response_status, error_text, delivery.ID)
+		return err
+	})
+}
+
+/*
+Deletes the deliveries that were delivered or given up before a time, a
+batch at a time. Pending deliveries are kept however old they are.
+
+Parameters:
+
+	s: Pointer to Server whose deliveries are deleted
+	before: Deliveries whose last attempt was before this are deleted
+
+Returns:
+
+	The number of deliveries deleted and, if a batch could not be
+	deleted, an error.
+*/
+func PruneWebhookDeliveries(s *Server, before time.Time) (int64, error) {
+	var pruned int64
+	for {
+		var deleted int64
+		err := RunQuery(s, context.Background(), func(ctx context.Context) error {
+			result, err := s.db.ExecContext(ctx, QUERY_PRUNE_WEBHOOK_DELIVERIES_TEMPLATE, before.Unix(), WEBHOOK_PRUNE_BATCH_SIZE)
+			if err != nil {
+				return err
+			}
+			deleted, err = result.RowsAffected()
+			return err
+		})
+		pruned += deleted
+		if err != nil || deleted < WEBHOOK_PRUNE_BATCH_SIZE {
+			return pruned, err
+		}
+	}
+}
+
+/*
+Sends webhook deliveries as they become due until the server stops. The
+worker wakes up every WEBHOOK_POLL_INTERVAL, or right away when new
+deliveries are written. It also deletes deliveries past their retention
+(see PruneWebhookDeliveries( )).
+
+Parameters:
+
+	s: Pointer to Server whose deliveries are sent
+*/
+func RunWebhookDeliveries(s *Server) {
+	ticker := time.NewTicker(WEBHOOK_POLL_INTERVAL)
+	defer ticker.Stop()
+
+	retention := time.Duration(s.config.WebhookRetentionSeconds) * time.Second
+	prune_interval := min(WEBHOOK_PRUNE_INTERVAL, retention)
+	var last_prune time.Time
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.webhookWake:
+		}
+
+		if retention > 0 && time.Since(last_prune) >= prune_interval {
+			pruned, err := PruneWebhookDeliveries(s, time.Now().Add(-retention))
+			if err != nil {
+				log.Println("Could not delete old webhook deliveries:", err)
+			} else if pruned > 0 {
+				log.Printf("Deleted %d webhook deliveries older than %s", pruned, retention)
+			}
+			last_prune = time.Now()
+		}
+
+		// Keep going while full batches are claimed, there may be more
+		for {
+			claimed, err := DeliverDueWebhooks(s)
+			if err != nil {
+				log.Println("Could not claim webhook deliveries:", err)
+				break
+			}
+			if claimed < WEBHOOK_BATCH_SIZE {
+				break
+			}
+		}
+	}
+}
+
+/*
+Creates the HTTP client deliveries are sent with. It gives up on a
+receiver after webhook_timeout_seconds and doesn't follow redirects, so
+a receiver must answer the URL it subscribed with.
+
+Parameters:
+
+	config: The server configuration
+
+Returns:
+
+	The HTTP client.
+*/
+func NewWebhookClient(config Config) *http.Client {
+	return &http.Client{
+		Timeout: time.Duration(config.WebhookTimeoutSeconds) * time.Second,
+		CheckRedirect: func(request *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+/*
+Checks the settings of a new webhook. The URL must be absolute and use
+http or https, and at least one known event must be given.
+
+Parameters:
+
+	request: The requested webhook
+
+Returns:
+
+	A message for the user if the webhook is invalid, otherwise the
+	empty string.
+*/
+func ValidateWebhookRequest(request *WebhookRequest) string {
+	parsed, err := url.Parse(request.Url)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return "url must be an absolute http or https URL"
+	}
+	if len(request.Events) == 0 {
+		return "events must list at least one event"
+	}
+	for _, event := range request.Events {
+		if !slices.Contains(WEBHOOK_EVENTS, event) {
+			return fmt.Sprintf("events must be among %s", strings.Join(WEBHOOK_EVENTS, ", "))
+		}
+	}
+	return ""
+}
+
+/*
+Subscribes a webhook. If the request has no secret, a random one is made.
+
+Parameters:
+
+	s: Pointer to Server whose database we update
+	ctx: Context of the request
+	request: The validated webhook request
+
+Returns:
+
+	The webhook, including its secret, and if writing it failed, an
+	error.
+*/
+func CreateWebhook(s *Server, ctx context.Context, request *WebhookRequest) (*WebhookInfo, error) {
+	secret := request.Secret
+	if secret == "" {
+		random := make([]byte, WEBHOOK_SECRET_BYTES)
+		_, err := rand.Read(random)
+		if err != nil {
+			return nil, err
+		}
+		secret = hex.EncodeToString(random)
+	}
+
+	// Each event is listed once, in the order of WEBHOOK_EVENTS
+	events := []string{}
+	for _, event := range WEBHOOK_EVENTS {
+		if slices.Contains(request.Events, event) {
+			events = append(events, event)
+		}
+	}
+
+	created := time.Now()
+	var id int64
+	err := RunQuery(s, ctx, func(ctx context.Context) error {
+		result, err := s.db.ExecContext(ctx, QUERY_INSERT_WEBHOOK_TEMPLATE, request.Url, secret, strings.Join(events, ","), created.Unix())
+		if err != nil {
+			return err
+		}
+		id, err = result.LastInsertId()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &WebhookInfo{
+		ID:      id,
+		Url:     request.Url,
+		Events:  events,
+		Secret:  secret,
+		Created: created.UTC().Format(time.RFC3339),
+	}, nil
+}
+
+/*
+Lists every webhook. Secrets are only shown when a webhook is created.
+
+Parameters:
+
+	s: Pointer to Server whose webhooks are listed
+	ctx: Context of the request
+
+Returns:
+
+	The webhooks, oldest first, and if the query failed, an error.
+*/
+func GetWebhooks(s *Server, ctx context.Context) ([]WebhookInfo, error) {
+	var webhooks []WebhookInfo
+	err := RunQuery(s, ctx, func(ctx context.Context) error {
+		webhooks = []WebhookInfo{}
+		rows, err := s.db.QueryContext(ctx, QUERY_GET_WEBHOOKS)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var webhook WebhookInfo
+			var events string
+			var created int64
+			err = rows.Scan(&webhook.ID, &webhook.Url, &events, &created)
+			if err != nil {
+				return err
+			}
+			webhook.Events = strings.Split(events, ",")
+			webhook.Created = time.Unix(created, 0).UTC().Format(time.RFC3339)
+			webhooks = append(webhooks, webhook)
+		}
+		return rows.Err()
+	})
+	return webhooks, err
+}
+
+/*
+Deletes a webhook along with its deliveries, including the ones not yet
+sent.
+
+Parameters:
+
+	s: Pointer to Server whose database we update
+	ctx: Context of the request
+	id: ID of the webhook
+
+Returns:
+
+	If the webhook does not exist, sql.ErrNoRows. Otherwise, if deleting
+	failed, an error, else nil.
+*/
+func DeleteWebhook(s *Server, ctx context.Context, id int64) error {
+	return RunQuery(s, ctx, func(ctx context.Context) error {
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		result, err := tx.ExecContext(ctx, QUERY_DELETE_WEBHOOK_TEMPLATE, id)
+		if err != nil {
+			return err
+		}
+		deleted, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if deleted == 0 {
+			return sql.ErrNoRows
+		}
+		_, err = tx.ExecContext(ctx, QUERY_DELETE_WEBHOOK_DELIVERIES_TEMPLATE, id)
+		if err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+}
+
+/*
+Represents the filters and page of a delivery history request, parsed
+from its query parameters.
+*/
+type WebhookDeliveriesQuery struct {
+	WebhookID int64
+	Status    string
+	Limit     int
+
+	// ID of the last delivery of the previous page, 0 to start from the first
+	After int64
+}
+
+/*
+Parses the query parameters of a delivery history request, see
+WEBHOOKS_ENDPOINT for the parameters.
+
+Parameters:
+
+	r: The delivery history request
+	id: ID of the webhook whose deliveries are requested
+
+Returns:
+
+	The parsed query and a message for the user if a parameter is invalid
+	(empty if they are all valid).
+*/
+func ParseWebhookDeliveriesQuery(r *http.Request, id int64) (*WebhookDeliveriesQuery, string) {
+	params := r.URL.Query()
+	query := &WebhookDeliveriesQuery{
+		WebhookID: id,
+		Status:    params.Get("status"),
+		Limit:     WEBHOOK_DELIVERIES_DEFAULT_LIMIT,
+	}
+	if query.Status != "" && query.Status != WEBHOOK_STATUS_PENDING && query.Status != WEBHOOK_STATUS_DELIVERED && query.Status != WEBHOOK_STATUS_FAILED {
+		return nil, "status must be pending, delivered or failed"
+	}
+	if params.Has("limit") {
+		limit, err := strconv.Atoi(params.Get("limit"))
+		if err != nil || limit < 1 || limit > WEBHOOK_DELIVERIES_MAX_LIMIT {
+			return nil, fmt.Sprintf("limit must be an integer between 1 and %d", WEBHOOK_DELIVERIES_MAX_LIMIT)
+		}
+		query.Limit = limit
+	}
+	if params.Has("cursor") {
+		after, err := strconv.ParseInt(params.Get("cursor"), 10, 64)
+		if err != nil || after < 0 {
+			return nil, "cursor is not valid"
+		}
+		query.After = after
+	}
+	return query, ""
+}
+
+/*
+Gets a page of a webhook's delivery history, oldest first like the audit
+log.
+
+Parameters:
+
+	s: Pointer to Server whose deliveries are read
+	ctx: Context of the request
+	query: The parsed delivery history request
+
+Returns:
+
+	The page and, if the query failed, an error. If the webhook does not
+	exist, the error is sql.ErrNoRows.
+*/
+func GetWebhookDeliveries(s *Server, ctx context.Context, query *WebhookDeliveriesQuery) (*WebhookDeliveriesPage, error) {
+	conditions := []string{"WebhookID = ?", "ID > ?"}
+	args := []any{query.WebhookID, query.After}
+	if query.Status != "" {
+		conditions = append(conditions, "Status = ?")
+		args = append(args, query.Status)
+	}
+	sql_query := "SELECT ID, Event, Payload, Status, Attempts, NextAttempt, LastAttempt, ResponseStatus, Error, Created FROM webhook_deliveries WHERE " + strings.Join(conditions, " AND ") + " ORDER BY ID LIMIT ?"
+	args = append(args, query.Limit+1)
+
+	var page *WebhookDeliveriesPage
+	err := RunQuery(s, ctx, func(ctx context.Context) error {
+		page = &WebhookDeliveriesPage{Deliveries: []WebhookDelivery{}}
+		// Checks the webhook exists, an empty history is not an error
+		var target_url, secret string
+		err := s.db.QueryRowContext(ctx, QUERY_GET_WEBHOOK_TARGET_TEMPLATE, query.WebhookID).Scan(&target_url, &secret)
+		if err != nil {
+			return err
+		}
+
+		rows, err := s.db.QueryContext(ctx, sql_query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var delivery WebhookDelivery
+			var payload string
+			var next_attempt, created int64
+			var last_attempt, response_status sql.NullInt64
+			var error_text sql.NullString
+			err = rows.Scan(&delivery.ID, &delivery.Event, &payload, &delivery.Status, &delivery.Attempts, &next_attempt, &last_attempt, &response_status, &error_text, &created)
+			if err != nil {
+				return err
+			}
+			delivery.WebhookID = query.WebhookID
+			delivery.Payload = json.RawMessage(payload)
+			delivery.Created = time.Unix(created, 0).UTC().Format(time.RFC3339)
+			if delivery.Status == WEBHOOK_STATUS_PENDING {
+				delivery.NextAttempt = time.Unix(next_attempt, 0).UTC().Format(time.RFC3339)
+			}
+			if last_attempt.Valid {
+				delivery.LastAttempt = time.Unix(last_attempt.Int64, 0).UTC().Format(time.RFC3339)
+			}
+			if response_status.Valid {
+				status := int(response_status.Int64)
+				delivery.ResponseStatus = &status
+			}
+			delivery.Error = error_text.String
+			page.Deliveries = append(page.Deliveries, delivery)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(page.Deliveries) > query.Limit {
+		page.Deliveries = page.Deliveries[:query.Limit]
+		page.NextCursor = strconv.FormatInt(page.Deliveries[query.Limit-1].ID, 10)
+	}
+	return page, nil
+}
+
+/*
+Handles requests on the webhooks endpoint and the paths below it, see
+WEBHOOKS_ENDPOINT. Webhook secrets and payloads are sensitive, so it
+requires the admin credentials like the admin dashboard does, and a JSON
+content type to subscribe (see CheckAdminJSONRequest( )).
+
+Parameters:
+
+	s: Pointer to HTTP server whose webhooks are managed
+	request: Pointer to struct that represents contents of HTTP
+		request
+	w: Where we write response for user
+*/
+func Webhooks(s *Server, w http.ResponseWriter, r *http.Request) {
+	if !CheckAdminCredentials(s, w, r) {
+		return
+	}
+
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, WEBHOOKS_ENDPOINT), "/")
+	if rest == "" {
+		switch r.Method {
+		case http.MethodGet:
+			webhooks, err := GetWebhooks(s, r.Context())
+			if err != nil {
+				ReportUnexpectedInternalServerError(w, r, err)
+				return
+			}
+			RespondAsJSON(w, webhooks)
+		case http.MethodPost:
+			if !CheckAdminJSONRequest(w, r) {
+				return
+			}
+			var request WebhookRequest
+			err := json.NewDecoder(r.Body).Decode(&request)
+			if err != nil {
+				ReportBadRequestError(w, r, err.Error(), "Invalid JSON format")
+				return
+			}
+			err_msg := ValidateWebhookRequest(&request)
+			if err_msg != "" {
+				ReportBadRequestError(w, r, request.Url, err_msg)
+				return
+			}
+			webhook, err := CreateWebhook(s, r.Context(), &request)
+			if err != nil {
+				ReportUnexpectedInternalServerError(w, r, err)
+				return
+			}
+			RequestLogger(r).Info("Subscribed webhook", "webhook", webhook.ID, "url", webhook.Url)
+			RespondAsJSON(w, webhook)
+		default:
+			ReportInvalidMethodError(w, r, r.Method)
+		}
+		return
+	}
+
+	// The rest of the path is {id} or {id}/deliveries
+	id_text, page, _ := strings.Cut(rest, "/")
+	id, err := strconv.ParseInt(id_text, 10, 64)
+	if err != nil || (page != "" && page != "deliveries") {
+		ReportClientError(w, r, http.StatusNotFound, "Unknown webhooks path "+rest, "Page not found")
+		return
+	}
+
+	if page == "" {
+		// Only DELETE requests are allowed on a single webhook
+		if r.Method != http.MethodDelete {
+			ReportInvalidMethodError(w, r, r.Method)
+			return
+		}
+		err = DeleteWebhook(s, r.Context(), id)
+		if errors.Is(err, sql.ErrNoRows) {
+			ReportClientError(w, r, http.StatusNotFound, "No webhook exists for ID", fmt.Sprintf("Webhook %d does not exist", id))
+			return
+		}
+		if err != nil {
+			ReportUnexpectedInternalServerError(w, r, err)
+			return
+		}
+		RequestLogger(r).Info("Deleted webhook", "webhook", id)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// Only GET requests are allowed on the delivery history
+	if r.Method != http.MethodGet {
+		ReportInvalidMethodError(w, r, r.Method)
+		return
+	}
+	query, err_msg := ParseWebhookDeliveriesQuery(r, id)
+	if err_msg != "" {
+		ReportBadRequestError(w, r, r.URL.RawQuery, err_msg)
+		return
+	}
+	deliveries, err := GetWebhookDeliveries(s, r.Context(), query)
+	if errors.Is(err, sql.ErrNoRows) {
+		ReportClientError(w, r, http.StatusNotFound, "No webhook exists for ID", fmt.Sprintf("Webhook %d does not exist", id))
+		return
+	}
+	if err != nil {
+		ReportUnexpectedInternalServerError(w, r, err)
+		return
+	}
+	RespondAsJSON(w, deliveries)
+}
@@ -1,2 +1,2 @@
 cd ../src
-go run .
\ No newline at end of file
+go run . "$@"
\ No newline at end of file
@@ -1,2 +1,2 @@
 rm -f ../data/database.db 
-bash boot.sh
\ No newline at end of file
+bash boot.sh "$@"
\ No newline at end of file
@@ -0,0 +1,6 @@
+cd ../src
+go run . migrate up > ../tests/test22.out 2>&1
+go run . migrate up >> ../tests/test22.out 2>&1
+go run . migrate status | awk '{print $1, $2}' >> ../tests/test22.out 2>&1
+cd ../tests
+diff test22.out test22.ref
\ No newline at end of file
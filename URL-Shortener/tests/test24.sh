@@ -0,0 +1,6 @@
+curl -s -w "\\nResponse code: %{http_code}\\n" -X POST http://localhost:8000/urlshortener/shorten -H "Content-Type: application/json" -d '{"url":"https://www.google.com", "alias":"a/b"}' > test24.out 2>&1
+curl -s -w "\\nResponse code: %{http_code}\\n" -X POST http://localhost:8000/urlshortener/shorten -H "Content-Type: application/json" -d '{"url":"https://www.google.com", "alias":"my alias"}' >> test24.out 2>&1
+curl -s -w "\\nResponse code: %{http_code}\\n" -X POST http://localhost:8000/urlshortener/shorten -H "Content-Type: application/json" -d '{"url":"https://www.google.com", "alias":"Analytics"}' >> test24.out 2>&1
+curl -s -w "\\nResponse code: %{http_code}\\n" -X POST http://localhost:8000/urlshortener/shorten -H "Content-Type: application/json" -d '{"url":"https://www.google.com", "alias":"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"}' >> test24.out 2>&1
+curl -s -w "\\nResponse code: %{http_code}\\n" -X POST http://localhost:8000/urlshortener/shorten -H "Content-Type: application/json" -d '{"url":"https://www.google.com", "alias":"Google_Search-1"}' >> test24.out 2>&1
+diff test24.out test24.ref
\ No newline at end of file
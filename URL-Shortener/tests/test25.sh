@@ -0,0 +1,5 @@
+curl -s -w "\\nResponse code: %{http_code}\\n" -X POST http://localhost:8000/urlshortener/shorten -H "Content-Type: application/json" -d '{"url":"https://www.google.com", "alias":"go"}' > test25.out 2>&1
+curl -s -w "\\nResponse code: %{http_code}\\n" -X POST http://localhost:8000/urlshortener/shorten -H "Content-Type: application/json" -d '{"url":"https://www.google.com", "alias":"Google"}' >> test25.out 2>&1
+curl -s -w "\\nResponse code: %{http_code}\\n" -X POST http://localhost:8000/urlshortener/shorten -H "Content-Type: application/json" -d '{"url":"https://www.nytimes.com", "alias":"google"}' >> test25.out 2>&1
+curl -s -w "\\nResponse code: %{http_code}\\n" -X POST http://localhost:8000/urlshortener/shorten -H "Content-Type: application/json" -d '{"url":"https://www.nytimes.com", "alias":"nyt"}' >> test25.out 2>&1
+diff test25.out test25.ref
\ No newline at end of file
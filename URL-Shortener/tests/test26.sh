@@ -0,0 +1,12 @@
+curl -s -w "\nResponse code: %{http_code}\n" -X POST http://localhost:8000/urlshortener/shorten -H "Content-Type: application/json" -d '{"url":"https://www.google.com", "alias":"google"}' > test26.out 2>&1
+curl -s -o /dev/null -w "Content type: %{content_type}\nResponse code: %{http_code}\n" -X GET http://localhost:8000/urlshortener/qr/google.png >> test26.out 2>&1
+curl -s -o /dev/null -w "Content type: %{content_type}\nResponse code: %{http_code}\n" -X GET "http://localhost:8000/urlshortener/qr/google.svg?size=512&ec=H&margin=2" >> test26.out 2>&1
+curl -s -w "\nResponse code: %{http_code}\n" -X GET http://localhost:8000/urlshortener/qr/google.gif >> test26.out 2>&1
+curl -s -w "\nResponse code: %{http_code}\n" -X GET "http://localhost:8000/urlshortener/qr/google.png?ec=X" >> test26.out 2>&1
+curl -s -w "\nResponse code: %{http_code}\n" -X GET http://localhost:8000/urlshortener/qr/yahoo.png >> test26.out 2>&1
+# The PNG's width and height are read from its header
+curl -s -o test26.png -w "Content type: %{content_type}\nResponse code: %{http_code}\n" -X GET "http://localhost:8000/urlshortener/qr/google.png?size=21" >> test26.out 2>&1
+echo "Size:" $(od -An -t u4 --endian=big -j 16 -N 8 test26.png) >> test26.out 2>&1
+curl -s -w "\nResponse code: %{http_code}\n" -X GET "http://localhost:8000/urlshortener/qr/google.svg?size=21&margin=0" | grep -o 'width="[0-9]*" height="[0-9]*" viewBox="[0-9 ]*"\|Response code: [0-9]*' >> test26.out 2>&1
+rm -f test26.png
+diff test26.out test26.ref
\ No newline at end of file
@@ -0,0 +1,24 @@
+curl -s -w "\nResponse code: %{http_code}\n" -X POST http://localhost:8000/urlshortener/shorten -H "Content-Type: application/json" -d '{"url":"https://www.google.com", "alias":"docs", "password":"hunter2"}' > test27.out 2>&1
+curl -s -w "\nResponse code: %{http_code}\n" -X GET http://localhost:8000/urlshortener/expand/docs >> test27.out 2>&1
+curl -s -w "\nResponse code: %{http_code}\n" -X GET http://localhost:8000/urlshortener/expand/docs -H "X-Link-Password: wrong" >> test27.out 2>&1
+curl -s -w "\nResponse code: %{http_code}\n" -X GET http://localhost:8000/urlshortener/expand/docs -H "X-Link-Password: hunter2" >> test27.out 2>&1
+curl -s -o /dev/null -w "Content type: %{content_type}\nResponse code: %{http_code}\n" -X GET http://localhost:8000/urlshortener/r/docs >> test27.out 2>&1
+curl -s -o /dev/null -w "Redirect: %{redirect_url}\nResponse code: %{http_code}\n" -X POST http://localhost:8000/urlshortener/r/docs -d "password=hunter2" >> test27.out 2>&1
+curl -s -w "\nResponse code: %{http_code}\n" -X GET http://localhost:8000/urlshortener/analytics/docs >> test27.out 2>&1
+curl -s -w "\nResponse code: %{http_code}\n" -X GET http://localhost:8000/urlshortener/analytics/docs -H "X-Link-Password: hunter2" >> test27.out 2>&1
+for i in 1 2 3 4 5; do
+    curl -s -w "\nResponse code: %{http_code}\n" -X GET http://localhost:8000/urlshortener/expand/docs -H "X-Link-Password: wrong$i" >> test27.out 2>&1
+done
+curl -s -w "\nResponse code: %{http_code}\n" -X GET http://localhost:8000/urlshortener/expand/docs -H "X-Link-Password: hunter2" | sed 's/in [0-9]* seconds/in N seconds/' >> test27.out 2>&1
+curl -s -w "\nResponse code: %{http_code}\n" -X GET http://localhost:8000/urlshortener/analytics/docs -H "X-Link-Password: hunter2" | sed 's/in [0-9]* seconds/in N seconds/' >> test27.out 2>&1
+curl -s -o /dev/null -X POST http://localhost:8000/urlshortener/shorten -H "Content-Type: application/json" -d '{"url":"https://www.example.com/vault", "alias":"vault", "password":"hunter2"}'
+for i in 1 2 3 4 5 6; do
+    curl -s -o /dev/null -w "Response code: %{http_code}\n" -X GET http://localhost:8000/urlshortener/expand/vault >> test27.out 2>&1
+done
+for i in $(seq 20); do
+    curl -s -o /dev/null -w "Response code: %{http_code}\n" -X GET http://localhost:8000/urlshortener/expand/vault -H "X-Link-Password: guess$i" > test27_$i.out 2>&1 &
+done
+wait
+cat test27_*.out | sort | uniq -c >> test27.out
+rm -f test27_*.out
+diff test27.out test27.ref
\ No newline at end of file
@@ -0,0 +1,5 @@
+curl -s -w "\nResponse code: %{http_code}\n" -X POST http://localhost:8000/urlshortener/shorten -H "Content-Type: application/json" -d '{"url":"https://www.google.com"}' > test28.out 2>&1
+curl -s -o /dev/null -w "Redirect: %{redirect_url}\nResponse code: %{http_code}\n" -X GET http://localhost:8000/urlshortener/r/0 >> test28.out 2>&1
+curl -s -w "\nResponse code: %{http_code}\n" -X GET http://localhost:8000/urlshortener/r/1 >> test28.out 2>&1
+curl -s -w "\nResponse code: %{http_code}\n" -X GET http://localhost:8000/urlshortener/analytics/0 >> test28.out 2>&1
+diff test28.out test28.ref
\ No newline at end of file
@@ -0,0 +1,15 @@
+curl -s -w "\nResponse code: %{http_code}\n" -X POST http://localhost:8000/urlshortener/shorten -H "Content-Type: application/json" -d '{"url":"https://www.google.com", "alias":"invite", "max_expansions":1}' > test29.out 2>&1
+curl -s -w "\nResponse code: %{http_code}\n" -X GET http://localhost:8000/urlshortener/expand/invite >> test29.out 2>&1
+curl -s -w "\nResponse code: %{http_code}\n" -X GET http://localhost:8000/urlshortener/expand/invite >> test29.out 2>&1
+curl -s -w "\nResponse code: %{http_code}\n" -X GET http://localhost:8000/urlshortener/r/invite >> test29.out 2>&1
+curl -s -w "\nResponse code: %{http_code}\n" -X GET http://localhost:8000/urlshortener/analytics/invite >> test29.out 2>&1
+curl -s -w "\nResponse code: %{http_code}\n" -X POST http://localhost:8000/urlshortener/shorten -H "Content-Type: application/json" -d '{"url":"https://www.nytimes.com", "max_expansions":-1}' >> test29.out 2>&1
+curl -s -w "\nResponse code: %{http_code}\n" -X POST http://localhost:8000/urlshortener/shorten -H "Content-Type: application/json" -d '{"url":"https://www.nytimes.com", "alias":"news", "max_expansions":3}' >> test29.out 2>&1
+for i in 1 2 3 4 5 6 7 8 9 10; do
+    curl -s -o /dev/null -w "Response code: %{http_code}\n" -X GET http://localhost:8000/urlshortener/expand/news > test29_$i.out 2>&1 &
+done
+wait
+cat test29_*.out | sort | uniq -c >> test29.out
+rm test29_*.out
+curl -s -w "\nResponse code: %{http_code}\n" -X GET http://localhost:8000/urlshortener/analytics/news >> test29.out 2>&1
+diff test29.out test29.ref
\ No newline at end of file
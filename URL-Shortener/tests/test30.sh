@@ -0,0 +1,26 @@
+# Creation times and cursors holding them vary between runs, so they are masked
+MASK='s/"created":"[^"]*"/"created":"T"/g; s/"next_cursor":"[^"]*"/"next_cursor":"C"/g'
+curl -s -o /dev/null -X POST http://localhost:8000/urlshortener/shorten -H "Content-Type: application/json" -d '{"url":"https://www.google.com"}'
+curl -s -o /dev/null -X POST http://localhost:8000/urlshortener/shorten -H "Content-Type: application/json" -d '{"url":"https://www.nytimes.com", "alias":"news"}'
+curl -s -o /dev/null -X POST http://localhost:8000/urlshortener/shorten -H "Content-Type: application/json" -d '{"url":"https://www.nytimes.com/section/world", "alias":"news-world", "allow_duplicate_url":true}'
+curl -s -o /dev/null -X POST http://localhost:8000/urlshortener/shorten -H "Content-Type: application/json" -d '{"url":"https://www.github.com", "alias":"code", "max_expansions":5}'
+curl -s -o /dev/null -X GET http://localhost:8000/urlshortener/expand/news
+curl -s -o /dev/null -X GET http://localhost:8000/urlshortener/expand/news
+curl -s -o /dev/null -X GET http://localhost:8000/urlshortener/expand/code
+curl -s -w "\nResponse code: %{http_code}\n" -X GET "http://localhost:8000/urlshortener/links" | sed -E "$MASK" > test30.out 2>&1
+curl -s -w "\nResponse code: %{http_code}\n" -X GET "http://localhost:8000/urlshortener/links?alias_prefix=news" | sed -E "$MASK" >> test30.out 2>&1
+curl -s -w "\nResponse code: %{http_code}\n" -X GET "http://localhost:8000/urlshortener/links?url_contains=nytimes&automatic=false&sort=alias&order=desc" | sed -E "$MASK" >> test30.out 2>&1
+curl -s -w "\nResponse code: %{http_code}\n" -X GET "http://localhost:8000/urlshortener/links?automatic=true" | sed -E "$MASK" >> test30.out 2>&1
+curl -s -w "\nResponse code: %{http_code}\n" -X GET "http://localhost:8000/urlshortener/links?created_after=2000-01-01&created_before=2000-01-02" | sed -E "$MASK" >> test30.out 2>&1
+PAGE=$(curl -s -X GET "http://localhost:8000/urlshortener/links?sort=expansions&order=desc&limit=2")
+echo "$PAGE" | sed -E "$MASK" >> test30.out 2>&1
+CURSOR=$(echo "$PAGE" | sed -E 's/.*"next_cursor":"([^"]*)".*/\1/')
+curl -s -w "\nResponse code: %{http_code}\n" -X GET "http://localhost:8000/urlshortener/links?sort=expansions&order=desc&limit=2&cursor=$CURSOR" | sed -E "$MASK" >> test30.out 2>&1
+curl -s -w "\nResponse code: %{http_code}\n" -X GET "http://localhost:8000/urlshortener/links?sort=alias&limit=2&cursor=$CURSOR" >> test30.out 2>&1
+curl -s -w "\nResponse code: %{http_code}\n" -X GET "http://localhost:8000/urlshortener/links?sort=url" >> test30.out 2>&1
+curl -s -w "\nResponse code: %{http_code}\n" -X GET "http://localhost:8000/urlshortener/links?limit=0" >> test30.out 2>&1
+curl -s -w "\nResponse code: %{http_code}\n" -X GET "http://localhost:8000/urlshortener/links?created_after=yesterday" >> test30.out 2>&1
+curl -s -o /dev/null -X POST http://localhost:8000/urlshortener/shorten -H "Content-Type: application/json" -d '{"url":"https://www.example.com/secret", "alias":"secret", "password":"hunter2"}'
+curl -s -w "\nResponse code: %{http_code}\n" -X GET "http://localhost:8000/urlshortener/links?alias_prefix=secret" | sed -E "$MASK" >> test30.out 2>&1
+curl -s -w "\nResponse code: %{http_code}\n" -X GET "http://localhost:8000/urlshortener/links?url_contains=secret" | sed -E "$MASK" >> test30.out 2>&1
+diff test30.out test30.ref
\ No newline at end of file
@@ -0,0 +1,22 @@
+# Days vary between runs, so they are masked
+MASK='s/"day":"[^"]*"/"day":"D"/g'
+curl -s -o /dev/null -X POST http://localhost:8000/urlshortener/shorten -H "Content-Type: application/json" -d '{"url":"https://www.google.com"}'
+curl -s -o /dev/null -X POST http://localhost:8000/urlshortener/shorten -H "Content-Type: application/json" -d '{"url":"https://www.nytimes.com", "alias":"news"}'
+curl -s -o /dev/null -X POST http://localhost:8000/urlshortener/shorten -H "Content-Type: application/json" -d '{"url":"https://www.github.com", "alias":"code"}'
+curl -s -o /dev/null -X GET http://localhost:8000/urlshortener/expand/news
+curl -s -o /dev/null -X GET http://localhost:8000/urlshortener/expand/news
+curl -s -o /dev/null -X GET http://localhost:8000/urlshortener/r/news
+curl -s -o /dev/null -X GET http://localhost:8000/urlshortener/expand/code
+curl -s -w "\nResponse code: %{http_code}\n" -X GET "http://localhost:8000/urlshortener/analytics" | sed -E "$MASK" > test31.out 2>&1
+curl -s -w "\nResponse code: %{http_code}\n" -X GET "http://localhost:8000/urlshortener/analytics/?top=1" | sed -E "$MASK" >> test31.out 2>&1
+curl -s -w "\nResponse code: %{http_code}\n" -X GET "http://localhost:8000/urlshortener/analytics?since=2000-01-01" | sed -E "$MASK" >> test31.out 2>&1
+curl -s -w "\nResponse code: %{http_code}\n" -X GET "http://localhost:8000/urlshortener/analytics?since=2000-01-01&until=2000-01-02" | sed -E "$MASK" >> test31.out 2>&1
+curl -s -w "\nResponse code: %{http_code}\n" -X GET "http://localhost:8000/urlshortener/analytics?top=0" >> test31.out 2>&1
+curl -s -w "\nResponse code: %{http_code}\n" -X GET "http://localhost:8000/urlshortener/analytics?until=tomorrow" >> test31.out 2>&1
+curl -s -o /dev/null -X POST http://localhost:8000/urlshortener/shorten -H "Content-Type: application/json" -d '{"url":"https://www.example.com/secret", "alias":"secret", "password":"hunter2"}'
+for i in 1 2 3 4; do
+    curl -s -o /dev/null -X GET http://localhost:8000/urlshortener/expand/secret -H "X-Link-Password: hunter2"
+done
+curl -s -w "\nResponse code: %{http_code}\n" -X GET "http://localhost:8000/urlshortener/analytics?top=1" | sed -E "$MASK" >> test31.out 2>&1
+curl -s -w "\nResponse code: %{http_code}\n" -X GET "http://localhost:8000/urlshortener/analytics?since=2000-01-01&top=1" | sed -E "$MASK" >> test31.out 2>&1
+diff test31.out test31.ref
\ No newline at end of file
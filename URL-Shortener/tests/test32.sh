@@ -0,0 +1,33 @@
+ADMIN=http://localhost:8000/urlshortener/admin
+CODE="\nResponse code: %{http_code}\n"
+REDIRECT="Response code: %{http_code}\nLocation: %header{location}\n"
+curl -s -o /dev/null -w "$CODE" -X GET $ADMIN/ > test32.out 2>&1
+curl -s -o /dev/null -w "$CODE" -u admin:wrong -X GET $ADMIN/ >> test32.out 2>&1
+curl -s -o /dev/null -w "$CODE" -u admin:secret -X GET $ADMIN/ >> test32.out 2>&1
+curl -s -o /dev/null -w "Content type: %{content_type}$CODE" -u admin:secret -X GET $ADMIN/static/admin.css >> test32.out 2>&1
+
+# Forms must carry the token shown on the dashboard
+TOKEN=$(curl -s -u admin:secret $ADMIN/ | sed -n -E 's/.*name="token" value="([^"]*)".*/\1/p' | head -1)
+curl -s -w "$CODE" -u admin:secret -X POST $ADMIN/create -d "url=https://www.google.com" >> test32.out 2>&1
+curl -s -o /dev/null -w "$REDIRECT" -u admin:secret -X POST $ADMIN/create -d "token=$TOKEN&url=https://www.google.com&alias=google&max_expansions=" >> test32.out 2>&1
+curl -s -o /dev/null -w "$REDIRECT" -u admin:secret -X POST $ADMIN/create -d "token=$TOKEN&url=https://www.google.com" >> test32.out 2>&1
+curl -s -w "$CODE" -X GET http://localhost:8000/urlshortener/expand/google >> test32.out 2>&1
+
+# Search and link pages
+curl -s -u admin:secret "$ADMIN/?alias_prefix=goo&automatic=&sort=alias&order=asc" | grep -o -E '<td><a href="[^"]*">[^<]*</a></td>' >> test32.out 2>&1
+curl -s -u admin:secret $ADMIN/links/google | grep -o "<rect" | wc -l >> test32.out 2>&1
+curl -s -o /dev/null -w "$CODE" -u admin:secret -X GET $ADMIN/links/missing >> test32.out 2>&1
+
+# Edit, disable, enable and delete
+curl -s -o /dev/null -w "$REDIRECT" -u admin:secret -X POST $ADMIN/links/google/edit -d "token=$TOKEN&url=https://www.google.com/maps&password_action=set&password=hunter2" >> test32.out 2>&1
+curl -s -w "$CODE" -X GET http://localhost:8000/urlshortener/expand/google -H "X-Link-Password: hunter2" >> test32.out 2>&1
+curl -s -o /dev/null -w "$REDIRECT" -u admin:secret -X POST $ADMIN/links/google/edit -d "token=$TOKEN&url=https://www.google.com/maps&password_action=remove&max_expansions=abc" >> test32.out 2>&1
+curl -s -o /dev/null -w "$REDIRECT" -u admin:secret -X POST $ADMIN/links/google/disable -d "token=$TOKEN" >> test32.out 2>&1
+curl -s -w "$CODE" -X GET http://localhost:8000/urlshortener/expand/google -H "X-Link-Password: hunter2" >> test32.out 2>&1
+curl -s -w "$CODE" -X GET http://localhost:8000/urlshortener/r/google >> test32.out 2>&1
+curl -s -o /dev/null -w "$REDIRECT" -u admin:secret -X POST $ADMIN/links/google/enable -d "token=$TOKEN" >> test32.out 2>&1
+curl -s -w "$CODE" -X GET http://localhost:8000/urlshortener/expand/google -H "X-Link-Password: hunter2" >> test32.out 2>&1
+curl -s -o /dev/null -w "$REDIRECT" -u admin:secret -X POST $ADMIN/links/google/delete -d "token=$TOKEN" >> test32.out 2>&1
+curl -s -w "$CODE" -X GET http://localhost:8000/urlshortener/expand/google >> test32.out 2>&1
+curl -s -o /dev/null -w "$CODE" -u admin:secret -X POST $ADMIN/links/google/delete -d "token=$TOKEN" >> test32.out 2>&1
+diff test32.out test32.ref
\ No newline at end of file
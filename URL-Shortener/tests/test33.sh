@@ -0,0 +1,35 @@
+ADMIN=http://localhost:8000/urlshortener/admin
+AUDIT=http://localhost:8000/urlshortener/audit
+CODE="\nResponse code: %{http_code}\n"
+# Entry times change from run to run
+MASK='s/"time":"[^"]*"/"time":"<time>"/g'
+curl -s -w "$CODE" -X POST http://localhost:8000/urlshortener/shorten -d '{"url":"https://www.google.com"}' > test33.out 2>&1
+curl -s -w "$CODE" -X POST http://localhost:8000/urlshortener/shorten -d '{"url":"https://www.youtube.com","alias":"yt","max_expansions":5}' >> test33.out 2>&1
+
+# Changes made on the admin dashboard are recorded with the admin's username
+TOKEN=$(curl -s -u admin:secret $ADMIN/ | sed -n -E 's/.*name="token" value="([^"]*)".*/\1/p' | head -1)
+curl -s -o /dev/null -u admin:secret -X POST $ADMIN/create -d "token=$TOKEN&url=https://www.bing.com&alias=bing" >> test33.out 2>&1
+curl -s -o /dev/null -u admin:secret -X POST $ADMIN/links/yt/edit -d "token=$TOKEN&url=https://www.youtube.com/feed&password_action=set&password=hunter2&max_expansions=" >> test33.out 2>&1
+curl -s -o /dev/null -u admin:secret -X POST $ADMIN/links/yt/disable -d "token=$TOKEN" >> test33.out 2>&1
+curl -s -o /dev/null -u admin:secret -X POST $ADMIN/links/yt/enable -d "token=$TOKEN" >> test33.out 2>&1
+curl -s -o /dev/null -u admin:secret -X POST $ADMIN/links/bing/delete -d "token=$TOKEN" >> test33.out 2>&1
+
+# Failed changes are not recorded
+curl -s -o /dev/null -u admin:secret -X POST $ADMIN/links/yt/edit -d "token=$TOKEN&url=https://www.google.com&password_action=keep" >> test33.out 2>&1
+curl -s -o /dev/null -w "$CODE" -X POST http://localhost:8000/urlshortener/shorten -d '{"url":"https://www.google.com"}' >> test33.out 2>&1
+
+# Query the log
+curl -s -w "$CODE" -X GET $AUDIT >> test33.out 2>&1
+curl -s -w "$CODE" -u admin:wrong -X GET $AUDIT >> test33.out 2>&1
+curl -s -w "$CODE" -u admin:secret -X GET $AUDIT | sed -E "$MASK" >> test33.out 2>&1
+curl -s -w "$CODE" -u admin:secret -X GET "$AUDIT?alias=yt&action=update" | sed -E "$MASK" >> test33.out 2>&1
+curl -s -w "$CODE" -u admin:secret -X GET "$AUDIT?actor=api&limit=1" | sed -E "$MASK" >> test33.out 2>&1
+curl -s -w "$CODE" -u admin:secret -X GET "$AUDIT?actor=api&limit=1&cursor=1" | sed -E "$MASK" >> test33.out 2>&1
+curl -s -w "$CODE" -u admin:secret -X GET "$AUDIT?since=2000-01-01&until=2000-01-02" >> test33.out 2>&1
+curl -s -w "$CODE" -u admin:secret -X GET "$AUDIT?limit=0" >> test33.out 2>&1
+curl -s -w "$CODE" -u admin:secret -X GET "$AUDIT?format=csv" >> test33.out 2>&1
+curl -s -w "$CODE" -u admin:secret -X POST $AUDIT >> test33.out 2>&1
+
+# Export as JSON lines
+curl -s -w "Content type: %{content_type}$CODE" -u admin:secret -X GET "$AUDIT?format=jsonl&alias=bing" | sed -E "$MASK" >> test33.out 2>&1
+diff test33.out test33.ref
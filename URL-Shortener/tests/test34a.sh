@@ -0,0 +1,27 @@
+BACKUPS=http://localhost:8000/urlshortener/backups
+CODE="\nResponse code: %{http_code}\n"
+# Backup names, times and sizes change from run to run
+MASK='s/database-[0-9T.]*Z\.db/database-<time>.db/g; s/"created":"[^"]*"/"created":"<time>"/g; s/"size":[0-9]*/"size":<size>/g'
+rm -rf ../data/backups
+curl -s -w "$CODE" -u admin:secret -X GET $BACKUPS > test34.out 2>&1
+curl -s -w "$CODE" -X POST http://localhost:8000/urlshortener/shorten -d '{"url":"https://www.google.com","alias":"google"}' >> test34.out 2>&1
+
+# Backups from the endpoint and the command line while the server is running
+curl -s -w "$CODE" -u admin:secret -X POST $BACKUPS -H "Content-Type: application/json" | sed -E "$MASK" >> test34.out 2>&1
+cd ../src
+go run . -config ../tests/test34.json backup | sed -E "$MASK" >> ../tests/test34.out 2>&1
+cd ../tests
+curl -s -w "$CODE" -X POST http://localhost:8000/urlshortener/shorten -d '{"url":"https://www.youtube.com","alias":"yt"}' >> test34.out 2>&1
+curl -s -o /dev/null -u admin:secret -X POST $BACKUPS -H "Content-Type: application/json" >> test34.out 2>&1
+curl -s -o /dev/null -u admin:secret -X POST $BACKUPS -H "Content-Type: application/json" >> test34.out 2>&1
+
+# Only the newest 3 backups are kept
+curl -s -w "$CODE" -u admin:secret -X GET $BACKUPS | sed -E "$MASK" >> test34.out 2>&1
+cd ../src
+go run . -config ../tests/test34.json backup list | sed -E "$MASK" | awk '{print $1}' >> ../tests/test34.out 2>&1
+cd ../tests
+curl -s -w "$CODE" -X POST $BACKUPS >> test34.out 2>&1
+# Without a JSON content type, so other sites can't take backups through an admin's browser
+curl -s -w "$CODE" -u admin:secret -X POST $BACKUPS >> test34.out 2>&1
+curl -s -w "$CODE" -u admin:secret -X POST $BACKUPS -H "Content-Type: text/plain" >> test34.out 2>&1
+curl -s -w "$CODE" -u admin:secret -X DELETE $BACKUPS >> test34.out 2>&1
@@ -0,0 +1,18 @@
+# Error messages are logged with the date and time
+MASK='s/^[0-9\/]+ [0-9:]+ //; s/database-[0-9T.]*Z\.db/database-<time>.db/g'
+cd ../src
+echo "not a database" > ../data/not_a_backup.db
+go run . restore ../data/not_a_backup.db 2>&1 | sed -E "$MASK" | grep -v "exit status" >> ../tests/test34.out
+go run . restore ../data/missing.db 2>&1 | sed -E "$MASK" | grep -v "exit status" >> ../tests/test34.out
+rm ../data/not_a_backup.db
+
+# An empty file is a valid SQLite database, but not one of ours
+: > ../data/empty.db
+go run . restore ../data/empty.db 2>&1 | sed -E "$MASK" | grep -v "exit status" >> ../tests/test34.out
+rm ../data/empty.db
+
+# The oldest backup kept was taken before yt was created
+OLDEST=../data/backups/$(ls ../data/backups | head -1)
+go run . restore $OLDEST 2>&1 | sed -E "$MASK" >> ../tests/test34.out
+ls ../data | grep -c "database.db.pre-restore" >> ../tests/test34.out
+cd ../tests
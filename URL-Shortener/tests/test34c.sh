@@ -0,0 +1,4 @@
+CODE="\nResponse code: %{http_code}\n"
+curl -s -w "$CODE" -X GET http://localhost:8000/urlshortener/expand/google >> test34.out 2>&1
+curl -s -w "$CODE" -X GET http://localhost:8000/urlshortener/expand/yt >> test34.out 2>&1
+diff test34.out test34.ref
@@ -0,0 +1,7 @@
+CODE="\nResponse code: %{http_code}\n"
+# Free disk space changes from run to run
+MASK='s/"free_bytes":[0-9]+/"free_bytes":<bytes>/g'
+curl -s -w "$CODE" -X GET http://localhost:8000/healthz > test35.out 2>&1
+curl -s -w "$CODE" -X GET http://localhost:8000/readyz | sed -E "$MASK" >> test35.out 2>&1
+curl -s -o /dev/null -w "$CODE" -I http://localhost:8000/readyz >> test35.out 2>&1
+curl -s -w "$CODE" -X POST http://localhost:8000/readyz >> test35.out 2>&1
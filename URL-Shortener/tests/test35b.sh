@@ -0,0 +1,13 @@
+CODE="\nResponse code: %{http_code}\n"
+MASK='s/"free_bytes":[0-9]+/"free_bytes":<bytes>/g'
+# No disk has an exabyte free, so the disk check fails
+curl -s -w "$CODE" -X GET http://localhost:8000/readyz | sed -E "$MASK" >> test35.out 2>&1
+
+# Stop the server as Ctrl + C would, it keeps answering while it drains
+pkill -INT -x url_shortener
+sleep 1
+curl -s -w "$CODE" -X GET http://localhost:8000/readyz | sed -E "$MASK" >> test35.out 2>&1
+curl -s -w "$CODE" -X GET http://localhost:8000/healthz >> test35.out 2>&1
+sleep 3
+curl -s -w "$CODE" -X GET http://localhost:8000/healthz >> test35.out 2>&1
+diff test35.out test35.ref
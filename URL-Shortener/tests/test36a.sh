@@ -0,0 +1,3 @@
+# Makes a self-signed certificate for localhost with the given common name
+mkdir -p ../data/tls
+openssl req -x509 -newkey rsa:2048 -nodes -days 1 -subj "/CN=$1" -addext "subjectAltName=DNS:localhost" -keyout ../data/tls/key.pem -out ../data/tls/cert.pem > /dev/null 2>&1
@@ -0,0 +1,26 @@
+CODE="\nResponse code: %{http_code}\n"
+REDIRECT="Response code: %{http_code}\nLocation: %header{location}\n"
+SUBJECT() { curl -s -k -v -o /dev/null https://localhost:8000/healthz 2>&1 | grep -o -E "subject: CN=[a-z]+"; }
+curl -s -k -w "$CODE" -X POST https://localhost:8000/urlshortener/shorten -d '{"url":"https://www.google.com"}' > test36.out 2>&1
+curl -s -k -w "$CODE" -X GET https://localhost:8000/urlshortener/expand/0 >> test36.out 2>&1
+SUBJECT >> test36.out
+
+# Plain HTTP on the HTTPS port is refused, the redirect port sends clients to HTTPS
+curl -s -w "$CODE" -X GET http://localhost:8000/urlshortener/expand/0 >> test36.out 2>&1
+curl -s -o /dev/null -w "$REDIRECT" -X GET "http://localhost:8080/urlshortener/links?sort=alias" >> test36.out 2>&1
+curl -s -o /dev/null -w "$REDIRECT" -X POST http://localhost:8080/urlshortener/shorten -d '{"url":"https://www.youtube.com"}' >> test36.out 2>&1
+curl -s -o /dev/null -w "$REDIRECT" -H "Host: [::1]" http://localhost:8080/healthz >> test36.out 2>&1
+curl -s -o /dev/null -w "$REDIRECT" -H "Host: [::1]:8080" http://localhost:8080/healthz >> test36.out 2>&1
+curl -s -k -L -w "$CODE" -X POST http://localhost:8080/urlshortener/shorten -d '{"url":"https://www.youtube.com"}' >> test36.out 2>&1
+
+# Rotating the certificate takes effect without a restart
+bash test36a.sh second
+sleep 2
+SUBJECT >> test36.out
+curl -s -k -w "$CODE" -X GET https://localhost:8000/urlshortener/expand/1 >> test36.out 2>&1
+
+# A broken certificate is not loaded, the previous one is kept
+echo "not a certificate" > ../data/tls/cert.pem
+sleep 2
+SUBJECT >> test36.out
+diff test36.out test36.ref
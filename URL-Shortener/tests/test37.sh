@@ -0,0 +1,22 @@
+# This test boots (and stops) its own server so it can read the logs
+CODE="\nResponse code: %{http_code}\n"
+rm -f ../data/database.db
+cd ../src
+go run . -config ../tests/test37.json 2> ../tests/test37.log &
+cd ../tests
+for i in $(seq 100); do curl -s -o /dev/null localhost:8000/healthz && break; sleep 0.2; done
+
+# A valid request ID is sent back, an invalid one is replaced by a generated one
+curl -s -D - -o /dev/null -H "X-Request-ID: shorten-1" -X POST http://localhost:8000/urlshortener/shorten -d '{"url":"https://www.google.com","alias":"google"}' | grep -i "x-request-id" | tr -d '\r' > test37.out
+curl -s -D - -o /dev/null -H "X-Request-ID: not valid!" -X GET http://localhost:8000/urlshortener/expand/google | grep -i "x-request-id" | tr -d '\r' | sed -E 's/[0-9a-f]{32}/<generated>/' >> test37.out
+curl -s -o /dev/null -H "X-Request-ID: expand-1" -X GET http://localhost:8000/urlshortener/expand/missing >> test37.out
+curl -s -o /dev/null -H "X-Request-ID: analytics-1" -X GET http://localhost:8000/urlshortener/analytics/google >> test37.out
+curl -s -o /dev/null -H "X-Request-ID: shorten-2" -X GET http://localhost:8000/urlshortener/shorten >> test37.out
+pkill -INT -x url_shortener
+sleep 1
+
+# Every record is JSON, the records of the requests above are kept without their times and latencies
+grep -c -v "^{" test37.log >> test37.out
+grep -E '"request_id":"(shorten|expand|analytics)-[0-9]"' test37.log | sed -E 's/"time":"[^"]*",//; s/"latency":[0-9]+/"latency":<latency>/' >> test37.out
+rm test37.log
+diff test37.out test37.ref
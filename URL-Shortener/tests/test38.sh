@@ -0,0 +1,33 @@
+# This test boots (and stops) its own servers so it can hold the database lock from outside
+CODE="\nResponse code: %{http_code}\n"
+rm -f ../data/database.db
+rm -f test38.out
+
+# Holds an exclusive lock on the database (blocking readers and writers) for a few seconds
+lock_database() {
+    (echo "BEGIN EXCLUSIVE;"; sleep 3; echo "COMMIT;") | sqlite3 ../data/database.db &
+    sleep 0.5
+}
+
+for config in test38a test38b; do
+    cd ../src
+    go run . -config ../tests/$config.json 2> /dev/null &
+    cd ../tests
+    for i in $(seq 100); do curl -s -o /dev/null localhost:8000/healthz && break; sleep 0.2; done
+    curl -s -w "$CODE" -X POST http://localhost:8000/urlshortener/shorten -d '{"url":"https://www.google.com","alias":"google"}' >> test38.out
+
+    # Without retries a locked database is busy (503), with retries the request runs out of time (504)
+    lock_database
+    curl -s -D - -o /dev/null -X GET http://localhost:8000/urlshortener/expand/google | grep -i -e "^HTTP" -e "retry-after" | tr -d '\r' >> test38.out
+    curl -s -w "$CODE" -X GET http://localhost:8000/urlshortener/analytics/google >> test38.out
+    curl -s -w "$CODE" -X POST http://localhost:8000/urlshortener/shorten -d '{"url":"https://www.bing.com"}' >> test38.out
+    wait $!
+
+    # Once the lock is let go, requests succeed again and nothing was half written
+    curl -s -w "$CODE" -X GET http://localhost:8000/urlshortener/analytics/google >> test38.out
+    curl -s -w "$CODE" -X POST http://localhost:8000/urlshortener/shorten -d '{"url":"https://www.bing.com"}' >> test38.out
+    pkill -INT -x url_shortener
+    sleep 1
+    rm -f ../data/database.db
+done
+diff test38.out test38.ref
@@ -0,0 +1,24 @@
+SHORTEN=http://localhost:8000/urlshortener/shorten
+curl -s -w "\nResponse code: %{http_code}\n" -X POST $SHORTEN -d '{"url":"https://www.one.com","alias":"1"}' > test39.out
+curl -s -w "\nResponse code: %{http_code}\n" -X POST $SHORTEN -d '{"url":"https://www.two.com","alias":"2"}' >> test39.out
+curl -s -w "\nResponse code: %{http_code}\n" -X POST $SHORTEN -d '{"url":"https://www.bond.com","alias":"007"}' >> test39.out
+
+# Automatic aliases pass over the custom numeric aliases, 007 is not one
+curl -s -w "\nResponse code: %{http_code}\n" -X POST $SHORTEN -d '{"url":"https://www.web0.com"}' >> test39.out
+curl -s -w "\nResponse code: %{http_code}\n" -X POST $SHORTEN -d '{"url":"https://www.web3.com"}' >> test39.out
+curl -s -w "\nResponse code: %{http_code}\n" -X POST $SHORTEN -d '{"url":"https://www.five.com","alias":"5"}' >> test39.out
+curl -s -w "\nResponse code: %{http_code}\n" -X POST $SHORTEN -d '{"url":"https://www.web4.com"}' >> test39.out
+curl -s -w "\nResponse code: %{http_code}\n" -X POST $SHORTEN -d '{"url":"https://www.web6.com"}' >> test39.out
+
+# A failed automatic shorten doesn't use up an alias
+curl -s -w "\nResponse code: %{http_code}\n" -X POST $SHORTEN -d '{"url":"https://www.web6.com"}' >> test39.out
+curl -s -w "\nResponse code: %{http_code}\n" -X POST $SHORTEN -d '{"url":"https://www.web7.com"}' >> test39.out
+
+# Concurrent automatic shortens (crossing into a new block) each get a different alias with no gaps
+seq 100 | xargs -P 20 -I {} curl -s -X POST $SHORTEN -d '{"url":"https://www.concurrent{}.com"}' | grep -o '"alias":"[0-9]*"' | grep -o '[0-9]\+' | sort -n > test39.aliases
+wc -l < test39.aliases >> test39.out
+sort -n -u test39.aliases | wc -l >> test39.out
+head -1 test39.aliases >> test39.out
+tail -1 test39.aliases >> test39.out
+rm test39.aliases
+diff test39.out test39.ref
@@ -0,0 +1,43 @@
+# This test boots (and stops or kills) its own servers, one after another, sharing one database
+SHORTEN=http://localhost:8000/urlshortener/shorten
+rm -f ../data/database.db
+rm -f test40.out
+cd ../src
+go build -o ../tests/test40_server .
+cd ../tests
+
+boot() {
+    (cd ../src && exec ../tests/test40_server -config ../tests/test40.json 2> /dev/null) &
+    SERVER=$!
+    for i in $(seq 100); do curl -s -o /dev/null localhost:8000/healthz && break; sleep 0.1; done
+}
+ranges() {
+    sqlite3 ../data/database.db "SELECT Start, End, Next, Owner IS NOT NULL, LeaseExpires > unixepoch() FROM alias_ranges ORDER BY Start" >> test40.out
+}
+
+# The first server leases 0 to 99 and records its progress when renewing, then dies
+boot
+curl -s -X POST $SHORTEN -d '{"url":"https://www.web0.com"}' >> test40.out; echo >> test40.out
+curl -s -X POST $SHORTEN -d '{"url":"https://www.web1.com"}' >> test40.out; echo >> test40.out
+sleep 1.5
+{ pkill -KILL -x test40_server; wait $SERVER; } 2> /dev/null
+ranges
+
+# While the dead server's lease lasts, a second server leases a new range, and gives it up when stopped
+boot
+curl -s -X POST $SHORTEN -d '{"url":"https://www.web100.com"}' >> test40.out; echo >> test40.out
+pkill -INT -x test40_server
+sleep 1
+ranges
+
+# Once the dead server's lease expires, its range is taken over where it left off
+sleep 2
+boot
+curl -s -X POST $SHORTEN -d '{"url":"https://www.web2.com"}' >> test40.out; echo >> test40.out
+curl -s -X POST $SHORTEN -d '{"url":"https://www.web3.com"}' >> test40.out; echo >> test40.out
+ranges
+pkill -INT -x test40_server
+sleep 1
+ranges
+rm test40_server
+diff test40.out test40.ref
@@ -0,0 +1,54 @@
+# This test starts its own webhook receiver (webhook_receiver.go) next to the server
+WEBHOOKS=http://localhost:8000/urlshortener/webhooks
+RECEIVER=http://localhost:9041
+CODE="\nResponse code: %{http_code}\n"
+# Times and generated secrets change from run to run
+MASK='s/"(time|created|next_attempt|last_attempt)":"[^"]*"/"\1":"<time>"/g; s/"secret":"[0-9a-f]{64}"/"secret":"<secret>"/g'
+rm -f test41.out test41.received
+go build -o test41_receiver webhook_receiver.go
+./test41_receiver -secret topsecret > test41.received 2> /dev/null &
+RECEIVER_PID=$!
+for i in $(seq 100); do curl -s -o /dev/null $RECEIVER/ && break; sleep 0.1; done
+
+# Subscribing requires the admin credentials, a JSON content type (so other sites can't subscribe
+# through an admin's browser), a http(s) URL and known events
+curl -s -w "$CODE" -X POST $WEBHOOKS -d '{"url":"'$RECEIVER'/ok","events":["link.created"]}' >> test41.out 2>&1
+curl -s -w "$CODE" -u admin:secret -X POST $WEBHOOKS -H "Content-Type: text/plain" -d '{"url":"'$RECEIVER'/ok","events":["link.created"]}' >> test41.out 2>&1
+curl -s -w "$CODE" -u admin:secret -X POST $WEBHOOKS -d '{"url":"'$RECEIVER'/ok","events":["link.created"]}' >> test41.out 2>&1
+curl -s -w "$CODE" -u admin:secret -X POST $WEBHOOKS -H "Content-Type: application/json" -d '{"url":"ftp://localhost/ok","events":["link.created"]}' >> test41.out 2>&1
+curl -s -w "$CODE" -u admin:secret -X POST $WEBHOOKS -H "Content-Type: application/json" -d '{"url":"'$RECEIVER'/ok","events":["link.deleted"]}' >> test41.out 2>&1
+curl -s -w "$CODE" -u admin:secret -X POST $WEBHOOKS -H "Content-Type: application/json" -d '{"url":"'$RECEIVER'/ok","events":[]}' >> test41.out 2>&1
+
+# One webhook gets every event, one only creations (failing twice), one only expiries (always
+# failing, and with a generated secret the receiver doesn't know)
+curl -s -w "$CODE" -u admin:secret -X POST $WEBHOOKS -H "Content-Type: application/json" -d '{"url":"'$RECEIVER'/ok","events":["link.expired","link.created","link.expanded","link.milestone"],"secret":"topsecret"}' | sed -E "$MASK" >> test41.out 2>&1
+curl -s -w "$CODE" -u admin:secret -X POST $WEBHOOKS -H "Content-Type: application/json" -d '{"url":"'$RECEIVER'/flaky","events":["link.created"],"secret":"topsecret"}' | sed -E "$MASK" >> test41.out 2>&1
+curl -s -w "$CODE" -u admin:secret -X POST $WEBHOOKS -H "Content-Type: application/json" -d '{"url":"'$RECEIVER'/down","events":["link.expired"]}' | sed -E "$MASK" >> test41.out 2>&1
+curl -s -w "$CODE" -u admin:secret $WEBHOOKS | sed -E "$MASK" >> test41.out 2>&1
+
+# A link expanded up to its cap: 3 expansions, a milestone at 2 and the expiry, nothing for the refused 4th
+curl -s -w "$CODE" -X POST http://localhost:8000/urlshortener/shorten -d '{"url":"https://www.google.com","alias":"google","max_expansions":3}' >> test41.out 2>&1
+for i in 1 2 3 4; do
+    curl -s -o /dev/null -w "%{http_code}\n" http://localhost:8000/urlshortener/expand/google >> test41.out 2>&1
+done
+
+# Retries wait 1 then 2 seconds, by then the flaky webhook got through and the down one gave up
+sleep 6
+for id in 1 2 3; do
+    curl -s -w "$CODE" -u admin:secret $WEBHOOKS/$id/deliveries | sed -E "$MASK" >> test41.out 2>&1
+done
+curl -s -w "$CODE" -u admin:secret "$WEBHOOKS/1/deliveries?status=delivered&limit=2" | sed -E "$MASK" >> test41.out 2>&1
+curl -s -w "$CODE" -u admin:secret "$WEBHOOKS/1/deliveries?status=delivered&limit=2&cursor=2" | sed -E "$MASK" >> test41.out 2>&1
+curl -s -w "$CODE" -u admin:secret "$WEBHOOKS/1/deliveries?status=lost" >> test41.out 2>&1
+
+# Deleting a webhook removes its history, after which it is not found
+curl -s -w "$CODE" -u admin:secret -X DELETE $WEBHOOKS/3 >> test41.out 2>&1
+curl -s -w "$CODE" -u admin:secret -X DELETE $WEBHOOKS/3 >> test41.out 2>&1
+curl -s -w "$CODE" -u admin:secret $WEBHOOKS/3/deliveries >> test41.out 2>&1
+curl -s -w "$CODE" -u admin:secret $WEBHOOKS/abc >> test41.out 2>&1
+
+# Deliveries are sent concurrently, so the order they arrive in varies (the first line was the receiver being probed)
+{ kill $RECEIVER_PID; wait $RECEIVER_PID; } 2> /dev/null
+tail -n +2 test41.received | sort >> test41.out
+rm test41_receiver test41.received
+diff test41.out test41.ref
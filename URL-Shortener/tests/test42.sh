@@ -0,0 +1,31 @@
+SHORTEN=http://localhost:8000/urlshortener/shorten
+EXPAND=http://localhost:8000/urlshortener/expand
+CODE="\nResponse code: %{http_code}\n"
+rm -f test42.out
+
+# Invalid settings
+curl -s -w "$CODE" -X POST $SHORTEN -d '{"url":"https://example.com","query_passthrough":"all"}' >> test42.out 2>&1
+curl -s -w "$CODE" -X POST $SHORTEN -d '{"url":"https://example.com","utm_defaults":{"source":"site"}}' >> test42.out 2>&1
+curl -s -w "$CODE" -X POST $SHORTEN -d '{"url":"https://example.com","utm_defaults":{"utm_source":""}}' >> test42.out 2>&1
+
+# Without passthrough the parameters a link is visited with are dropped
+curl -s -w "$CODE" -X POST $SHORTEN -d '{"url":"https://example.com/?a=1","alias":"plain"}' >> test42.out 2>&1
+curl -s -w "$CODE" "$EXPAND/plain?utm_source=newsletter" >> test42.out 2>&1
+
+# Defaults are added unless the URL has the key, incoming parameters replace defaults but (merging) not the URL's own
+curl -s -w "$CODE" -X POST $SHORTEN -d '{"url":"https://example.com/page?ref=home&utm_source=site#top","alias":"news","query_passthrough":"merge","utm_defaults":{"utm_source":"default","utm_medium":"email"}}' >> test42.out 2>&1
+curl -s -w "$CODE" "$EXPAND/news" >> test42.out 2>&1
+curl -s -w "$CODE" "$EXPAND/news?utm_source=newsletter&utm_medium=social&x=1&x=2&ref=ad" >> test42.out 2>&1
+
+# Overriding, incoming parameters replace the URL's own (every value of the key), which keep their order and encoding
+curl -s -w "$CODE" -X POST $SHORTEN -d '{"url":"https://example.com/?ref=home&lang=en&ref=top&name=a%20b","alias":"over","query_passthrough":"override"}' >> test42.out 2>&1
+curl -s -w "$CODE" "$EXPAND/over?ref=ad&q=a%20b%26c" >> test42.out 2>&1
+curl -s -o /dev/null -w "%{http_code} %{redirect_url}\n" "http://localhost:8000/urlshortener/r/over?ref=mail" >> test42.out 2>&1
+
+# Protected links keep the parameters through the password form, which posts back to the same URL
+curl -s -w "$CODE" -X POST $SHORTEN -d '{"url":"https://example.com/secret","alias":"locked","password":"hunter2","query_passthrough":"merge","utm_defaults":{"utm_campaign":"launch"}}' >> test42.out 2>&1
+curl -s -o /dev/null -w "%{http_code} %{redirect_url}\n" -X POST "http://localhost:8000/urlshortener/r/locked?utm_source=qr" -d "password=hunter2" >> test42.out 2>&1
+
+# The parameters each expansion came with are recorded with the click
+sqlite3 ../data/database.db "SELECT Alias, COALESCE(Params, 'NULL') FROM clicks ORDER BY rowid" >> test42.out 2>&1
+diff test42.out test42.ref
@@ -0,0 +1,34 @@
+SHORTEN=http://localhost:8000/urlshortener/shorten
+EXPAND=http://localhost:8000/urlshortener/expand
+ANALYTICS=http://localhost:8000/urlshortener/analytics
+CODE="\nResponse code: %{http_code}\n"
+rm -f test43.out
+
+curl -s -w "$CODE" -X POST $SHORTEN -d '{"url":"https://example.com","alias":"agents"}' >> test43.out 2>&1
+curl -s -w "$CODE" -X POST $SHORTEN -d '{"url":"https://example.com/other","alias":"quiet"}' >> test43.out 2>&1
+
+# One expansion per User-Agent, a phone's twice
+IPHONE="Mozilla/5.0 (iPhone; CPU iPhone OS 17_4 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4 Mobile/15E148 Safari/604.1"
+curl -s -o /dev/null -A "$IPHONE" "$EXPAND/agents"
+curl -s -o /dev/null -A "$IPHONE" "$EXPAND/agents"
+curl -s -o /dev/null -A "Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Mobile Safari/537.36" "$EXPAND/agents"
+curl -s -o /dev/null -A "Mozilla/5.0 (Linux; Android 13; SM-X710) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36" "$EXPAND/agents"
+curl -s -o /dev/null -A "Mozilla/5.0 (iPad; CPU OS 17_4 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4 Mobile/15E148 Safari/604.1" "$EXPAND/agents"
+curl -s -o /dev/null -A "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36 Edg/124.0.0.0" "$EXPAND/agents"
+curl -s -o /dev/null -A "Mozilla/5.0 (Macintosh; Intel Mac OS X 14_4) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4 Safari/605.1.15" "$EXPAND/agents"
+curl -s -o /dev/null -A "Mozilla/5.0 (X11; Linux x86_64; rv:125.0) Gecko/20100101 Firefox/125.0" "$EXPAND/agents"
+curl -s -o /dev/null -A "curl/8.5.0" "$EXPAND/agents"
+curl -s -o /dev/null -A "python-requests/2.31.0" "$EXPAND/agents"
+
+curl -s -w "$CODE" "$ANALYTICS/agents/breakdown" >> test43.out 2>&1
+
+# Windows, an empty window and a link with no expansions
+curl -s -w "$CODE" "$ANALYTICS/agents/breakdown?since=2000-01-01&until=2100-01-01" >> test43.out 2>&1
+curl -s -w "$CODE" "$ANALYTICS/agents/breakdown?until=2000-01-01" >> test43.out 2>&1
+curl -s -w "$CODE" "$ANALYTICS/quiet/breakdown" >> test43.out 2>&1
+
+# Invalid requests
+curl -s -w "$CODE" "$ANALYTICS/agents/breakdown?since=yesterday" >> test43.out 2>&1
+curl -s -w "$CODE" "$ANALYTICS/missing/breakdown" >> test43.out 2>&1
+curl -s -w "$CODE" -X POST "$ANALYTICS/agents/breakdown" >> test43.out 2>&1
+diff test43.out test43.ref
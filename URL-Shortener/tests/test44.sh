@@ -0,0 +1,35 @@
+SHORTEN=http://localhost:8000/urlshortener/shorten
+EXPAND=http://localhost:8000/urlshortener/expand
+ANALYTICS=http://localhost:8000/urlshortener/analytics
+CODE="\nResponse code: %{http_code}\n"
+rm -f test44.out
+
+curl -s -w "$CODE" -X POST $SHORTEN -d '{"url":"https://example.com","alias":"visits"}' >> test44.out 2>&1
+curl -s -w "$CODE" -X POST $SHORTEN -d '{"url":"https://example.com/other","alias":"quiet"}' >> test44.out 2>&1
+
+# 3 visitors (same address, different User-Agents) expanding 6 times
+for agent in a b a c b a; do
+    curl -s -o /dev/null -A "visitor-$agent" "$EXPAND/visits"
+done
+curl -s -w "$CODE" "$ANALYTICS/visits" >> test44.out 2>&1
+curl -s -w "$CODE" "$ANALYTICS/quiet" >> test44.out 2>&1
+
+# Make today's visitors those of an earlier day, then 2 of them return along with 2 new ones
+sqlite3 ../data/database.db "UPDATE visitor_sketches SET Day = '2024-05-01' WHERE Alias = 'visits'"
+for agent in a c d e d; do
+    curl -s -o /dev/null -A "visitor-$agent" "$EXPAND/visits"
+done
+TODAY=$(date -u +%F)
+
+# All time (5 visitors), per day (3 and 4) and windows of one day or both
+curl -s -w "$CODE" "$ANALYTICS/visits" >> test44.out 2>&1
+curl -s -w "$CODE" "$ANALYTICS/visits/visitors" | sed "s/$TODAY/TODAY/g" >> test44.out 2>&1
+curl -s -w "$CODE" "$ANALYTICS/visits/visitors?since=2024-05-01T12:00:00Z&until=2024-05-02" >> test44.out 2>&1
+curl -s -w "$CODE" "$ANALYTICS/visits/visitors?since=2024-05-02" | sed "s/$TODAY/TODAY/g" >> test44.out 2>&1
+curl -s -w "$CODE" "$ANALYTICS/visits/visitors?until=2000-01-01" >> test44.out 2>&1
+curl -s -w "$CODE" "$ANALYTICS/quiet/visitors" >> test44.out 2>&1
+
+# Invalid requests
+curl -s -w "$CODE" "$ANALYTICS/visits/visitors?until=tomorrow" >> test44.out 2>&1
+curl -s -w "$CODE" "$ANALYTICS/missing/visitors" >> test44.out 2>&1
+diff test44.out test44.ref
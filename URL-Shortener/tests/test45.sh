@@ -0,0 +1,36 @@
+SHORTEN=http://localhost:8000/urlshortener/shorten
+EXPAND=http://localhost:8000/urlshortener/expand
+ANALYTICS=http://localhost:8000/urlshortener/analytics
+CODE="\nResponse code: %{http_code}\n"
+BROWSER="Mozilla/5.0 (X11; Linux x86_64; rv:125.0) Gecko/20100101 Firefox/125.0"
+rm -f test45.out
+
+curl -s -w "$CODE" -X POST $SHORTEN -d '{"url":"https://example.com","alias":"promo"}' >> test45.out 2>&1
+curl -s -w "$CODE" -X POST $SHORTEN -d '{"url":"https://example.com/invite","alias":"invite","max_expansions":1}' >> test45.out 2>&1
+
+# Bots by signature (one excluded from it) and by missing header still get the URL
+curl -s -w "$CODE" -A "PreviewBot/1.0" -H "Accept-Language: en" "$EXPAND/promo" >> test45.out 2>&1
+curl -s -w "$CODE" -A "SiteCrawler/2.0" -H "Accept-Language: en" "$EXPAND/promo" >> test45.out 2>&1
+curl -s -w "$CODE" -A "NotACrawler/2.0" -H "Accept-Language: en" "$EXPAND/promo" >> test45.out 2>&1
+curl -s -w "$CODE" -A "$BROWSER" "$EXPAND/promo" >> test45.out 2>&1
+curl -s -o /dev/null -w "%{http_code} %{redirect_url}\n" -A "PreviewBot/1.0" -H "Accept-Language: en" "http://localhost:8000/urlshortener/r/promo" >> test45.out 2>&1
+curl -s -w "$CODE" "$ANALYTICS/promo" >> test45.out 2>&1
+
+# A visitor expanding more than 3 times within a minute is counted as a bot from the 4th time, others aren't
+for i in 1 2 3 4 5; do
+    curl -s -o /dev/null -A "$BROWSER" -H "Accept-Language: en" "$EXPAND/promo"
+done
+curl -s -o /dev/null -A "$BROWSER (other)" -H "Accept-Language: en" "$EXPAND/promo"
+curl -s -w "$CODE" "$ANALYTICS/promo" >> test45.out 2>&1
+
+# Expansions of a capped link are all counted like a person's, so posing as a bot doesn't get past the cap
+curl -s -w "$CODE" -A "PreviewBot/1.0" -H "Accept-Language: en" "$EXPAND/invite" >> test45.out 2>&1
+curl -s -w "$CODE" -A "PreviewBot/1.0" -H "Accept-Language: en" "$EXPAND/invite" >> test45.out 2>&1
+curl -s -w "$CODE" -A "$BROWSER (invited)" -H "Accept-Language: en" "$EXPAND/invite" >> test45.out 2>&1
+curl -s -w "$CODE" -A "PreviewBot/1.0" -H "Accept-Language: en" "$EXPAND/invite" >> test45.out 2>&1
+curl -s -w "$CODE" "$ANALYTICS/invite" >> test45.out 2>&1
+curl -s -w "$CODE" "$ANALYTICS?top=1" | sed -E 's/"day":"[0-9-]+"/"day":"D"/g' >> test45.out 2>&1
+
+# Only expansions counted like a person's go into the click history
+sqlite3 ../data/database.db "SELECT Alias, COUNT(*) FROM clicks GROUP BY Alias ORDER BY Alias" >> test45.out 2>&1
+diff test45.out test45.ref
@@ -0,0 +1,49 @@
+SHORTEN=http://localhost:8000/urlshortener/shorten
+EXPAND=http://localhost:8000/urlshortener/expand
+ANALYTICS=http://localhost:8000/urlshortener/analytics
+REDIRECT=http://localhost:8000/urlshortener/r
+LOCATION="Response code: %{http_code}\nLocation: %header{location}\n"
+CODE="\nResponse code: %{http_code}\n"
+rm -f test46.out
+
+# Invalid destinations
+curl -s -w "$CODE" -X POST $SHORTEN -d '{"alias":"bad","destinations":[{"name":"a","url":"https://example.com/a"}]}' >> test46.out 2>&1
+curl -s -w "$CODE" -X POST $SHORTEN -d '{"alias":"bad","destinations":[{"name":"a b","url":"https://example.com/a"},{"name":"b","url":"https://example.com/b"}]}' >> test46.out 2>&1
+curl -s -w "$CODE" -X POST $SHORTEN -d '{"alias":"bad","destinations":[{"name":"a","url":"https://example.com/a"},{"name":"a","url":"https://example.com/b"}]}' >> test46.out 2>&1
+curl -s -w "$CODE" -X POST $SHORTEN -d '{"alias":"bad","destinations":[{"name":"a","url":"https://example.com/a"},{"name":"b"}]}' >> test46.out 2>&1
+curl -s -w "$CODE" -X POST $SHORTEN -d '{"alias":"bad","destinations":[{"name":"a","url":"https://example.com/a","weight":2000},{"name":"b","url":"https://example.com/b"}]}' >> test46.out 2>&1
+curl -s -w "$CODE" -X POST $SHORTEN -d '{"alias":"bad","destinations":[{"name":"a","url":"https://example.com/a","weight":-1},{"name":"b","url":"https://example.com/b"}]}' >> test46.out 2>&1
+
+# An even split without a URL of its own (a weight left out or 0 is 1), and one that favours a variant
+curl -s -w "$CODE" -X POST $SHORTEN -d '{"alias":"exp","destinations":[{"name":"a","url":"https://example.com/a"},{"name":"b","url":"https://example.com/b","weight":0}]}' >> test46.out 2>&1
+curl -s -w "$CODE" -X POST $SHORTEN -d '{"url":"https://example.com","alias":"heavy","destinations":[{"name":"main","url":"https://example.com/main","weight":1000},{"name":"rare","url":"https://example.com/rare","weight":1}]}' >> test46.out 2>&1
+
+# Each client keeps its variant, and a client's cookie picks it
+for client in 1 2 3 4 5 6 7 8; do
+    first=$(curl -s -A "client $client" -H "X-Client-ID: client-$client" "$EXPAND/exp")
+    second=$(curl -s -A "client $client" -H "X-Client-ID: client-$client" "$EXPAND/exp")
+    if [ "$first" = "$second" ]; then echo "client $client kept its variant" >> test46.out; fi
+done
+curl -s -w "$CODE" -A "cookie" -b "variant=b" "$EXPAND/exp" >> test46.out 2>&1
+curl -s -w "$CODE" -A "cookie" -b "variant=a" "$EXPAND/exp" >> test46.out 2>&1
+# A cookie naming no variant is ignored (which variant the client gets depends on the salt)
+curl -s -A "cookie" -b "variant=missing" -H "X-Client-ID: client-1" "$EXPAND/exp" | grep -q '"variant":"[ab]"' && echo "unknown cookie ignored" >> test46.out
+curl -s -w "$CODE" -A "heavy" -H "X-Client-ID: client-1" "$EXPAND/heavy" >> test46.out 2>&1
+
+# The redirect sets the cookie for the link
+curl -s -o /dev/null -A "redirect" -b "variant=b" -w "$LOCATION" "$REDIRECT/exp" >> test46.out 2>&1
+curl -s -o /dev/null -A "redirect" -b "variant=b" -D - "$REDIRECT/exp" | grep -i "^Set-Cookie" | tr -d '\r' >> test46.out 2>&1
+
+# Expansions per variant add up to the link's
+curl -s "$ANALYTICS/exp" | python3 -c "
+import json, sys
+analytics = json.load(sys.stdin)
+print('url', analytics['url'], 'expansions', analytics['expansions'])
+print('variants add up', sum(variant['expansions'] for variant in analytics['variants']) == analytics['expansions'])
+for variant in analytics['variants']:
+    print(variant['name'], variant['url'], variant['weight'])
+" >> test46.out 2>&1
+curl -s -w "$CODE" "$ANALYTICS/heavy" >> test46.out 2>&1
+# Every click of a split link records its variant
+sqlite3 ../data/database.db "SELECT Alias, COUNT(*), COUNT(Variant) FROM clicks GROUP BY Alias ORDER BY Alias" >> test46.out 2>&1
+diff test46.out test46.ref
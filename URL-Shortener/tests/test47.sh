@@ -0,0 +1,55 @@
+SHORTEN=http://localhost:8000/urlshortener/shorten
+EXPAND=http://localhost:8000/urlshortener/expand
+ROUTE=http://localhost:8000/urlshortener/route
+CODE="\nResponse code: %{http_code}\n"
+IPHONE="Mozilla/5.0 (iPhone; CPU iPhone OS 17_4 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4 Mobile/15E148 Safari/604.1"
+WINDOWS="Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36"
+rm -f test47.out
+
+# Invalid rules
+curl -s -w "$CODE" -X POST $SHORTEN -d '{"url":"https://example.com","alias":"bad","routing_rules":[{"os":["iOS"]}]}' >> test47.out 2>&1
+curl -s -w "$CODE" -X POST $SHORTEN -d '{"url":"https://example.com","alias":"bad","routing_rules":[{"url":"https://example.com/a","days":["monday"]}]}' >> test47.out 2>&1
+curl -s -w "$CODE" -X POST $SHORTEN -d '{"url":"https://example.com","alias":"bad","routing_rules":[{"url":"https://example.com/a","hours":{"from":"9:00","until":"17:00"}}]}' >> test47.out 2>&1
+curl -s -w "$CODE" -X POST $SHORTEN -d '{"url":"https://example.com","alias":"bad","routing_rules":[{"url":"https://example.com/a","hours":{"from":"09:00","until":"09:00"}}]}' >> test47.out 2>&1
+curl -s -w "$CODE" -X POST $SHORTEN -d '{"url":"https://example.com","alias":"bad","routing_rules":[{"url":"https://example.com/a","hours":{"from":"09:00","until":"17:00"},"timezone":"Mars/Olympus"}]}' >> test47.out 2>&1
+curl -s -w "$CODE" -X POST $SHORTEN -d '{"url":"https://example.com","alias":"bad","routing_rules":[{"url":"https://example.com/a"},{"url":"https://example.com/b","languages":["de_DE"]}]}' >> test47.out 2>&1
+
+# Phones to the app store, German speakers to a localized page, weekends and nights (in Berlin) to a fallback
+curl -s -w "$CODE" -X POST $SHORTEN -d '{"url":"https://example.com/shop","alias":"shop","utm_defaults":{"utm_source":"short"},"routing_rules":[
+    {"name":"app","os":["iOS"],"devices":["mobile"],"url":"https://apps.apple.com/app/shop"},
+    {"name":"german","languages":["de"],"url":"https://example.com/de/shop"},
+    {"name":"weekend","days":["sat","sun"],"timezone":"Europe/Berlin","url":"https://example.com/closed"},
+    {"name":"night","hours":{"from":"18:00","until":"09:00"},"timezone":"Europe/Berlin","url":"https://example.com/closed"}]}' >> test47.out 2>&1
+
+# Dry runs at a Wednesday noon in Berlin, then on a Saturday and at night
+curl -s -w "$CODE" -A "$IPHONE" "$ROUTE/shop?at=2024-05-15T10:00:00Z" >> test47.out 2>&1
+curl -s -w "$CODE" -A "$WINDOWS" -H "Accept-Language: en-US,en;q=0.9,de;q=0.5" "$ROUTE/shop?at=2024-05-15T10:00:00Z" >> test47.out 2>&1
+curl -s -w "$CODE" -A "$WINDOWS" -H "Accept-Language: fr;q=0.4, de-AT;q=0.8, *" "$ROUTE/shop?at=2024-05-15T10:00:00Z" >> test47.out 2>&1
+curl -s -w "$CODE" -A "$WINDOWS" -H "Accept-Language: en" "$ROUTE/shop?at=2024-05-18T10:00:00Z" >> test47.out 2>&1
+curl -s -w "$CODE" -A "$WINDOWS" -H "Accept-Language: en" "$ROUTE/shop?at=2024-05-15T06:59:00Z" >> test47.out 2>&1
+curl -s -w "$CODE" -A "$WINDOWS" -H "Accept-Language: en" "$ROUTE/shop?at=2024-05-15T07:00:00Z" >> test47.out 2>&1
+curl -s -w "$CODE" -A "$WINDOWS" -H "Accept-Language: en" "$ROUTE/shop?at=2024-05-15T16:00:00Z" >> test47.out 2>&1
+
+# Expansions follow the rules, with the link's query parameters
+curl -s -w "$CODE" -A "$IPHONE" "$EXPAND/shop" >> test47.out 2>&1
+curl -s -w "$CODE" -A "$WINDOWS" -H "Accept-Language: de-DE" "$EXPAND/shop" >> test47.out 2>&1
+curl -s -w "$CODE" "http://localhost:8000/urlshortener/analytics/shop" >> test47.out 2>&1
+
+# Rules come before a split's destinations, and protected links need their password
+curl -s -w "$CODE" -X POST $SHORTEN -d '{"alias":"split","destinations":[{"name":"a","url":"https://example.com/a"},{"name":"b","url":"https://example.com/b"}],"routing_rules":[{"os":["iOS"],"url":"https://apps.apple.com/app/split"}]}' >> test47.out 2>&1
+curl -s -w "$CODE" -A "$IPHONE" -b "variant=b" "$ROUTE/split?at=2024-05-15" >> test47.out 2>&1
+curl -s -w "$CODE" -A "$WINDOWS" -b "variant=b" "$ROUTE/split?at=2024-05-15" >> test47.out 2>&1
+curl -s -w "$CODE" -X POST $SHORTEN -d '{"url":"https://example.com/secret","alias":"secret","password":"hunter2","routing_rules":[{"os":["iOS"],"url":"https://example.com/secret/ios"}]}' >> test47.out 2>&1
+curl -s -w "$CODE" -A "$IPHONE" "$ROUTE/secret" >> test47.out 2>&1
+curl -s -w "$CODE" -A "$IPHONE" -H "X-Link-Password: hunter2" "$ROUTE/secret?at=2024-05-15" >> test47.out 2>&1
+
+# Dry runs apply the link's query parameter settings like expansions do, leaving out at
+curl -s -w "$CODE" -X POST $SHORTEN -d '{"url":"https://example.com/news?ref=home","alias":"news","query_passthrough":"merge","utm_defaults":{"utm_source":"short","utm_medium":"email"},"routing_rules":[{"os":["iOS"],"url":"https://apps.apple.com/app/news"}]}' >> test47.out 2>&1
+curl -s -w "$CODE" -A "$WINDOWS" "$ROUTE/news?utm_medium=social&at=2024-05-15T10:00:00Z&x=1" >> test47.out 2>&1
+curl -s -w "$CODE" -A "$IPHONE" "$ROUTE/news?at=2024-05-15T10:00:00Z&ref=ad" >> test47.out 2>&1
+
+# Invalid dry runs
+curl -s -w "$CODE" "$ROUTE/shop?at=noon" >> test47.out 2>&1
+curl -s -w "$CODE" "$ROUTE/missing" >> test47.out 2>&1
+curl -s -w "$CODE" -X POST "$ROUTE/shop" >> test47.out 2>&1
+diff test47.out test47.ref
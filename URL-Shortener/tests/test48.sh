@@ -0,0 +1,49 @@
+SHORTEN=http://localhost:8000/urlshortener/shorten
+EXPAND=http://localhost:8000/urlshortener/expand
+LINKS=http://localhost:8000/urlshortener/links
+CAMPAIGNS=http://localhost:8000/urlshortener/campaigns
+CODE="\nResponse code: %{http_code}\n"
+TODAY=$(date -u +%F)
+MASK='s/"created":"[^"]*"/"created":"T"/g'
+rm -f test48.out
+
+# Invalid tags and campaigns
+curl -s -w "$CODE" -X POST $SHORTEN -d '{"url":"https://example.com/bad","alias":"bad","tags":["two words"]}' >> test48.out 2>&1
+curl -s -w "$CODE" -X POST $SHORTEN -d '{"url":"https://example.com/bad","alias":"bad","tags":["a","b","c","d","e","f","g","h","i","j","k"]}' >> test48.out 2>&1
+curl -s -w "$CODE" -X POST $SHORTEN -d '{"url":"https://example.com/bad","alias":"bad","campaign":"spring/sale"}' >> test48.out 2>&1
+
+# Tags and campaigns are kept in lower case, tags sorted without repeats
+curl -s -w "$CODE" -X POST $SHORTEN -d '{"url":"https://example.com/shoes","alias":"shoes","tags":["Email","social","email"],"campaign":"Spring-Sale"}' >> test48.out 2>&1
+curl -s -w "$CODE" -X POST $SHORTEN -d '{"url":"https://example.com/hats","alias":"hats","tags":["social"],"campaign":"spring-sale"}' >> test48.out 2>&1
+curl -s -w "$CODE" -X POST $SHORTEN -d '{"url":"https://example.com/coats","alias":"coats","tags":["email"],"campaign":"winter-sale"}' >> test48.out 2>&1
+curl -s -w "$CODE" -X POST $SHORTEN -d '{"url":"https://example.com/plain","alias":"plain"}' >> test48.out 2>&1
+
+# Filter links by tag (every tag given must be on the link) and by campaign
+curl -s -w "$CODE" "$LINKS?tag=email&sort=alias" | sed -E "$MASK" >> test48.out 2>&1
+curl -s -w "$CODE" "$LINKS?tag=EMAIL&tag=social&sort=alias" | sed -E "$MASK" >> test48.out 2>&1
+curl -s -w "$CODE" "$LINKS?campaign=spring-sale&sort=alias" | sed -E "$MASK" >> test48.out 2>&1
+curl -s -w "$CODE" "$LINKS?tag=none" >> test48.out 2>&1
+curl -s -w "$CODE" "$LINKS?tag=no%20tag" >> test48.out 2>&1
+curl -s -w "$CODE" "$LINKS?campaign=" >> test48.out 2>&1
+
+# Campaign analytics add up the campaign's links only
+for i in 1 2 3; do curl -s -o /dev/null -A "visitor $i" "$EXPAND/shoes"; done
+curl -s -o /dev/null -A "visitor 1" "$EXPAND/hats"
+curl -s -o /dev/null -A "visitor 1" "$EXPAND/coats"
+curl -s -w "$CODE" "$CAMPAIGNS/spring-sale" | sed "s/$TODAY/TODAY/g" >> test48.out 2>&1
+curl -s -w "$CODE" "$CAMPAIGNS/Spring-Sale?top=1&since=2000-01-01" | sed "s/$TODAY/TODAY/g" >> test48.out 2>&1
+curl -s -w "$CODE" "$CAMPAIGNS/spring-sale?until=2000-01-01" >> test48.out 2>&1
+curl -s -w "$CODE" "$CAMPAIGNS/winter-sale" | sed "s/$TODAY/TODAY/g" >> test48.out 2>&1
+
+# Invalid requests
+curl -s -w "$CODE" "$CAMPAIGNS/summer-sale" >> test48.out 2>&1
+curl -s -w "$CODE" "$CAMPAIGNS/" >> test48.out 2>&1
+curl -s -w "$CODE" "$CAMPAIGNS/spring-sale?top=0" >> test48.out 2>&1
+curl -s -w "$CODE" -X POST "$CAMPAIGNS/spring-sale" >> test48.out 2>&1
+
+# The URLs of password protected links are left out of the top links
+curl -s -o /dev/null -X POST $SHORTEN -d '{"url":"https://example.com/secret","alias":"secret","campaign":"spring-sale","password":"hunter2"}'
+for i in 1 2 3 4; do curl -s -o /dev/null -H "X-Link-Password: hunter2" "$EXPAND/secret"; done
+curl -s -w "$CODE" "$CAMPAIGNS/spring-sale?top=1" | sed "s/$TODAY/TODAY/g" >> test48.out 2>&1
+curl -s -w "$CODE" "$CAMPAIGNS/spring-sale?top=1&since=2000-01-01" | sed "s/$TODAY/TODAY/g" >> test48.out 2>&1
+diff test48.out test48.ref
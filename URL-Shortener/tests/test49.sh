@@ -0,0 +1,33 @@
+SHORTEN=http://localhost:8000/urlshortener/shorten
+LABELS=http://localhost:8000/urlshortener/labels
+LINKS=http://localhost:8000/urlshortener/links
+CODE="\nResponse code: %{http_code}\n"
+MASK='s/"created":"[^"]*"/"created":"T"/g'
+rm -f test49.out
+
+curl -s -o /dev/null -X POST $SHORTEN -d '{"url":"https://example.com/shoes","alias":"shoes","tags":["email"],"campaign":"spring-sale"}'
+
+# Changing labels needs the admin credentials
+curl -s -w "$CODE" -X PUT $LABELS/shoes -d '{"tags":["print"]}' >> test49.out 2>&1
+curl -s -w "$CODE" -u admin:wrong -X PUT $LABELS/shoes -d '{"tags":["print"]}' >> test49.out 2>&1
+
+# Tags and campaign are replaced, and normalized as when shortening
+curl -s -w "$CODE" -u admin:secret -X PUT $LABELS/shoes -d '{"tags":["Print","social","print"],"campaign":"Winter-Sale"}' | sed -E "$MASK" >> test49.out 2>&1
+curl -s -w "$CODE" "$LINKS?tag=print" | sed -E "$MASK" >> test49.out 2>&1
+curl -s -w "$CODE" "$LINKS?tag=email" >> test49.out 2>&1
+curl -s -w "$CODE" "$LINKS?campaign=winter-sale" | sed -E "$MASK" >> test49.out 2>&1
+
+# Leaving them out removes them
+curl -s -w "$CODE" -u admin:secret -X PUT $LABELS/shoes -d '{}' | sed -E "$MASK" >> test49.out 2>&1
+curl -s -w "$CODE" "$LINKS?campaign=winter-sale" >> test49.out 2>&1
+
+# Invalid requests
+curl -s -w "$CODE" -u admin:secret -X PUT $LABELS/shoes -d '{"tags":["two words"]}' >> test49.out 2>&1
+curl -s -w "$CODE" -u admin:secret -X PUT $LABELS/shoes -d '{"campaign":"spring/sale"}' >> test49.out 2>&1
+curl -s -w "$CODE" -u admin:secret -X PUT $LABELS/shoes -d 'tags' >> test49.out 2>&1
+curl -s -w "$CODE" -u admin:secret -X PUT $LABELS/boots -d '{"tags":["print"]}' >> test49.out 2>&1
+curl -s -w "$CODE" -u admin:secret -X GET $LABELS/shoes >> test49.out 2>&1
+
+# Each change is in the audit log
+curl -s -u admin:secret "http://localhost:8000/urlshortener/audit?alias=shoes&action=update" | grep -o '"actor":"[^"]*"' >> test49.out 2>&1
+diff test49.out test49.ref
@@ -0,0 +1,37 @@
+# This test starts its own webhook receiver (webhook_receiver.go) next to the server
+WEBHOOKS=http://localhost:8000/urlshortener/webhooks
+RECEIVER=http://localhost:9041
+CODE="\nResponse code: %{http_code}\n"
+# Only the statuses of the deliveries are compared, counted as their order varies
+COUNT='"status":"[a-z]*"\|"deliveries":\[\]\|Response code: [0-9]*'
+rm -f test50.out
+go build -o test50_receiver webhook_receiver.go
+./test50_receiver -secret topsecret > /dev/null 2>&1 &
+RECEIVER_PID=$!
+for i in $(seq 100); do curl -s -o /dev/null $RECEIVER/ && break; sleep 0.1; done
+
+# One webhook gets every expansion, another fails and waits a minute before its retry
+curl -s -o /dev/null -u admin:secret -X POST $WEBHOOKS -H "Content-Type: application/json" -d '{"url":"'$RECEIVER'/ok","events":["link.expanded"],"secret":"topsecret"}'
+curl -s -o /dev/null -u admin:secret -X POST $WEBHOOKS -H "Content-Type: application/json" -d '{"url":"'$RECEIVER'/down","events":["link.expanded"]}'
+curl -s -o /dev/null -X POST http://localhost:8000/urlshortener/shorten -d '{"url":"https://www.google.com","alias":"google"}'
+for i in 1 2 3; do
+    curl -s -o /dev/null http://localhost:8000/urlshortener/expand/google
+done
+
+# The deliveries are in the history at first
+sleep 1
+for id in 1 2; do
+    curl -s -w "$CODE" -u admin:secret $WEBHOOKS/$id/deliveries | grep -o "$COUNT" | sort | uniq -c >> test50.out
+    echo "---" >> test50.out
+done
+
+# After webhook_retention_seconds, delivered ones are deleted but the pending retries are kept
+sleep 4
+for id in 1 2; do
+    curl -s -w "$CODE" -u admin:secret $WEBHOOKS/$id/deliveries | grep -o "$COUNT" | sort | uniq -c >> test50.out
+    echo "---" >> test50.out
+done
+
+{ kill $RECEIVER_PID; wait $RECEIVER_PID; } 2> /dev/null
+rm test50_receiver
+diff test50.out test50.ref
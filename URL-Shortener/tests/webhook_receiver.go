@@ -0,0 +1,77 @@
+/*
+A local HTTP receiver for testing webhooks (see test41.sh). It prints a line
+for each delivery it gets, saying whether its signature checks out with the
+secret it is given, and answers depending on the path the webhook was
+subscribed with:
+
+	/ok: always 200 (OK)
+	/flaky: 500 (Internal Server Error) to the first two deliveries, then 200
+	/down: always 500
+
+Usage: go run webhook_receiver.go -port 9041 -secret <secret>
+*/
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+)
+
+func main() {
+	port := flag.Int("port", 9041, "Port to listen on")
+	secret := flag.String("secret", "", "Secret the deliveries are signed with")
+	flag.Parse()
+
+	var lock sync.Mutex
+	flaky_failures := 0
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Same as SignWebhookPayload( ) in the server
+		mac := hmac.New(sha256.New, []byte(*secret))
+		mac.Write([]byte(r.Header.Get("X-Webhook-Timestamp")))
+		mac.Write([]byte("."))
+		mac.Write(body)
+		signature := "bad"
+		if hmac.Equal([]byte(r.Header.Get("X-Webhook-Signature")), []byte("sha256="+hex.EncodeToString(mac.Sum(nil)))) {
+			signature = "ok"
+		}
+
+		var event struct {
+			Event      string `json:"event"`
+			Alias      string `json:"alias"`
+			Expansions int    `json:"expansions"`
+		}
+		json.Unmarshal(body, &event)
+
+		lock.Lock()
+		defer lock.Unlock()
+		fmt.Printf("%s %s %s %s %d signature=%s\n", r.URL.Path, r.Header.Get("X-Webhook-Event"), event.Event, event.Alias, event.Expansions, signature)
+		os.Stdout.Sync()
+
+		switch r.URL.Path {
+		case "/flaky":
+			if flaky_failures < 2 {
+				flaky_failures++
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		case "/down":
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+	log.Fatal(http.ListenAndServe(fmt.Sprintf("localhost:%d", *port), nil))
+}